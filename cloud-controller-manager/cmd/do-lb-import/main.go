@@ -0,0 +1,76 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command do-lb-import prints the YAML of a Service adopting an existing
+// DigitalOcean load balancer, with the annotations, ports and ID keeping its
+// settings. The settings which cannot be kept are listed as comments.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/cmd/internal/lbfile"
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/do"
+)
+
+func main() {
+	lbID := flag.String("lb-id", "", "ID of the load balancer to import, read with the token in DO_ACCESS_TOKEN")
+	lbPath := flag.String("lb-file", "", "path of the load balancer in JSON to import, e.g. the output of doctl compute load-balancer get -o json")
+	namespace := flag.String("namespace", "default", "namespace of the Service")
+	name := flag.String("name", "", "name of the Service, made from the name of the load balancer if not set")
+	flag.Parse()
+
+	if (*lbID == "") == (*lbPath == "") {
+		fmt.Fprintln(os.Stderr, "exactly one of -lb-id and -lb-file is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*lbID, *lbPath, *namespace, *name); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(lbID, lbPath, namespace, name string) error {
+	lb, err := lbfile.ReadLoadBalancer(lbID, lbPath)
+	if err != nil {
+		return err
+	}
+
+	service, unrepresentable := do.ServiceFromLoadBalancer(lb)
+	service.Namespace = namespace
+	if name != "" {
+		service.Name = name
+	}
+
+	data, err := yaml.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("# Service adopting load balancer %s (%s).\n", lb.ID, lb.Name)
+	fmt.Println("# Set spec.selector to the pods to balance across, and the targetPort of each port if they listen on another one.")
+	for _, setting := range unrepresentable {
+		fmt.Printf("# UNREPRESENTABLE: %s\n", setting)
+	}
+	fmt.Print(string(data))
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command do-lb-render prints the DigitalOcean load balancer request the
+// cloud controller manager would send for a Service, without deploying it,
+// and optionally how it differs from an existing load balancer.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/cmd/internal/lbfile"
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/do"
+)
+
+// output is what do-lb-render prints.
+type output struct {
+	*do.RenderedLoadBalancer
+	Diff []string `json:"diff,omitempty"`
+}
+
+func main() {
+	servicePath := flag.String("service", "", "path of the Service YAML or JSON to render, - for stdin")
+	nodesPath := flag.String("nodes", "", "path of a Node or a list of Nodes to balance across, e.g. the output of kubectl get nodes -o yaml")
+	dropletsPath := flag.String("droplets", "", "path of a JSON list of the droplets of the nodes, e.g. the output of doctl compute droplet list -o json; made up from the provider IDs of the nodes if not set")
+	clusterName := flag.String("cluster-name", "kubernetes", "name of the cluster, used to name the load balancers of groups")
+	region := flag.String("region", "nyc1", "region of the cluster")
+	lbID := flag.String("lb-id", "", "ID of a load balancer to diff against, read with the token in DO_ACCESS_TOKEN")
+	lbPath := flag.String("lb-file", "", "path of a load balancer in JSON to diff against, e.g. the output of doctl compute load-balancer get -o json")
+	flag.Parse()
+
+	if *servicePath == "" {
+		fmt.Fprintln(os.Stderr, "-service is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*servicePath, *nodesPath, *dropletsPath, *clusterName, *region, *lbID, *lbPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(servicePath, nodesPath, dropletsPath, clusterName, region, lbID, lbPath string) error {
+	service := &v1.Service{}
+	if err := lbfile.ReadYAML(servicePath, service); err != nil {
+		return err
+	}
+
+	nodes, err := readNodes(nodesPath)
+	if err != nil {
+		return err
+	}
+
+	var droplets []godo.Droplet
+	if dropletsPath != "" {
+		if err := lbfile.ReadYAML(dropletsPath, &droplets); err != nil {
+			return err
+		}
+	}
+
+	out := output{RenderedLoadBalancer: do.RenderLoadBalancer(clusterName, region, service, nodes, droplets)}
+
+	lb, err := lbfile.ReadLoadBalancer(lbID, lbPath)
+	if err != nil {
+		return err
+	}
+	if lb != nil && out.Request != nil {
+		out.Diff = do.DiffLoadBalancer(out.Request, lb)
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	if len(out.Errors) > 0 {
+		return fmt.Errorf("service %s/%s is invalid", service.Namespace, service.Name)
+	}
+	return nil
+}
+
+// readNodes returns the Node or the list of Nodes in the file path, or no
+// nodes if path is empty.
+func readNodes(path string) ([]*v1.Node, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	var list struct {
+		Kind  string    `json:"kind"`
+		Items []v1.Node `json:"items"`
+	}
+	if err := lbfile.ReadYAML(path, &list); err != nil {
+		return nil, err
+	}
+
+	if list.Kind == "Node" {
+		node := &v1.Node{}
+		if err := lbfile.ReadYAML(path, node); err != nil {
+			return nil, err
+		}
+		return []*v1.Node{node}, nil
+	}
+
+	nodes := make([]*v1.Node, len(list.Items))
+	for i := range list.Items {
+		nodes[i] = &list.Items[i]
+	}
+	return nodes, nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command fake-digitalocean-api serves a stateful fake of the DigitalOcean
+// API, for running the cloud controller manager against it with
+// DO_OVERRIDE_URL.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to serve the fake API on")
+	region := flag.String("region", "nyc1", "region of the seeded droplets")
+	droplets := flag.String("droplets", "", "comma separated names of droplets to seed")
+	flag.Parse()
+
+	fake := fakedo.NewServer()
+	for i, name := range strings.Split(*droplets, ",") {
+		if name == "" {
+			continue
+		}
+		d := fake.AddDroplet(godo.Droplet{
+			Name:   name,
+			Region: &godo.Region{Slug: *region},
+			Size:   &godo.Size{Slug: "s-1vcpu-1gb"},
+			Networks: &godo.Networks{
+				V4: []godo.NetworkV4{
+					{IPAddress: fmt.Sprintf("10.0.0.%d", i+1), Type: "private"},
+					{IPAddress: fmt.Sprintf("192.0.2.%d", i+1), Type: "public"},
+				},
+			},
+		})
+		glog.Infof("seeded droplet %s with ID %d", d.Name, d.ID)
+	}
+
+	glog.Infof("serving fake DigitalOcean API on %s", *listen)
+	glog.Fatal(http.ListenAndServe(*listen, fake))
+}
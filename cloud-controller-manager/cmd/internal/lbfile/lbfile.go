@@ -0,0 +1,87 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lbfile reads the files and load balancers given to the load
+// balancer commands.
+package lbfile
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/digitalocean/godo"
+	"github.com/ghodss/yaml"
+	"golang.org/x/oauth2"
+)
+
+// ReadYAML decodes the YAML or JSON file path, or stdin if path is -, into
+// obj.
+func ReadYAML(path string, obj interface{}) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.Unmarshal(data, obj); err != nil {
+		return fmt.Errorf("failed to decode %s: %s", path, err)
+	}
+	return nil
+}
+
+// ReadLoadBalancer returns the load balancer id from the DigitalOcean API,
+// authenticating with the token in DO_ACCESS_TOKEN, or the one in the file
+// path, or nil if both are empty.
+func ReadLoadBalancer(id, path string) (*godo.LoadBalancer, error) {
+	switch {
+	case id != "":
+		token := os.Getenv("DO_ACCESS_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("DO_ACCESS_TOKEN is required to read load balancer %s", id)
+		}
+		client := godo.NewClient(oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})))
+		lb, _, err := client.LoadBalancers.Get(context.Background(), id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get load balancer %s: %s", id, err)
+		}
+		return lb, nil
+
+	case path != "":
+		// doctl prints a list holding the load balancer.
+		var lbs []godo.LoadBalancer
+		if err := ReadYAML(path, &lbs); err == nil {
+			if len(lbs) != 1 {
+				return nil, fmt.Errorf("expected one load balancer in %s, got %d", path, len(lbs))
+			}
+			return &lbs[0], nil
+		}
+
+		lb := &godo.LoadBalancer{}
+		if err := ReadYAML(path, lb); err != nil {
+			return nil, err
+		}
+		return lb, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// defaultAccountName is the name of the account whose token is passed
+	// through the environment.
+	defaultAccountName = "default"
+
+	// annDOAccount is the annotation used to pick the account the load
+	// balancer or floating IP of a Service is created in. The default
+	// account is used if not set.
+	annDOAccount = "service.beta.kubernetes.io/do-account"
+)
+
+// accountNamePattern matches valid account names. Account names only appear
+// in annotation values, logs and metric labels.
+var accountNamePattern = regexp.MustCompile(`^[a-z0-9]([-_.a-z0-9]{0,61}[a-z0-9])?$`)
+
+// cloudConfig is the configuration read from the file passed with
+// --cloud-config. It is optional, as is every field.
+type cloudConfig struct {
+	// Accounts are the DigitalOcean accounts the cluster runs droplets in,
+	// in addition to the default account.
+	Accounts []accountConfig `json:"accounts"`
+}
+
+// accountConfig configures an additional DigitalOcean account.
+type accountConfig struct {
+	// Name identifies the account in annotations, logs and metrics.
+	Name string `json:"name"`
+	// TokenPath is the path of a file holding the access token of the
+	// account. It is reread when it changes, like DO_ACCESS_TOKEN_PATH.
+	TokenPath string `json:"tokenPath"`
+	// Tag, if set, restricts the droplets of the account nodes are matched
+	// against, by name or by the controllers and load balancers, to those
+	// carrying the tag. Droplets are still looked up by provider ID.
+	Tag string `json:"tag"`
+}
+
+// parseCloudConfig returns the cloudConfig read from config, which holds
+// YAML or JSON. An empty cloudConfig is returned if config is nil.
+func parseCloudConfig(config io.Reader) (*cloudConfig, error) {
+	cfg := &cloudConfig{}
+	if config == nil {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadAll(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cloud config: %s", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return cfg, nil
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse cloud config: %s", err)
+	}
+
+	names := map[string]bool{defaultAccountName: true}
+	for _, acc := range cfg.Accounts {
+		if !accountNamePattern.MatchString(acc.Name) {
+			return nil, fmt.Errorf("invalid account name %q: must consist of at most 63 lower case alphanumeric characters, '-', '_' or '.', and start and end with an alphanumeric character", acc.Name)
+		}
+		if names[acc.Name] {
+			return nil, fmt.Errorf("account %q is configured more than once", acc.Name)
+		}
+		names[acc.Name] = true
+
+		if acc.TokenPath == "" {
+			return nil, fmt.Errorf("account %q has no tokenPath", acc.Name)
+		}
+	}
+
+	return cfg, nil
+}
+
+// account is a DigitalOcean account the cluster runs droplets in, along with
+// the state the cloud provider keeps per account.
+type account struct {
+	name        string
+	tag         string
+	client      *godo.Client
+	tokenSource *rotatingTokenSource
+
+	loadbalancers *loadbalancers
+	sizes         *sizeCache
+}
+
+// droplets returns the droplets of a, restricted to those carrying its tag
+// if it has one.
+func (a *account) droplets(ctx context.Context) ([]godo.Droplet, error) {
+	return dropletList(ctx, a.client, a.tag)
+}
+
+// accounts are the accounts of the cloud provider, the default account
+// first. The account each droplet was last found in is remembered, so that
+// it is asked first next time.
+type accounts struct {
+	list []*account
+
+	mu        sync.Mutex
+	byDroplet map[string]*account
+}
+
+// newAccounts returns the accounts list, the default account first.
+func newAccounts(list ...*account) *accounts {
+	return &accounts{
+		list:      list,
+		byDroplet: map[string]*account{},
+	}
+}
+
+// singleAccount returns accounts holding client as the default account only.
+func singleAccount(client *godo.Client) *accounts {
+	return newAccounts(&account{name: defaultAccountName, client: client})
+}
+
+// defaultAccount returns the account configured through the environment.
+func (a *accounts) defaultAccount() *account {
+	return a.list[0]
+}
+
+// get returns the account name, or the default account if name is empty.
+func (a *accounts) get(name string) (*account, error) {
+	if name == "" {
+		return a.defaultAccount(), nil
+	}
+
+	for _, acc := range a.list {
+		if acc.name == name {
+			return acc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown DigitalOcean account %q", name)
+}
+
+// forService returns the account picked by the annotation of service.
+func (a *accounts) forService(service *v1.Service) (*account, error) {
+	acc, err := a.get(service.Annotations[annDOAccount])
+	if err != nil {
+		return nil, fmt.Errorf("invalid annotation %q: %s", annDOAccount, err)
+	}
+	return acc, nil
+}
+
+// names returns the names of a, the default account first.
+func (a *accounts) names() []string {
+	names := make([]string, len(a.list))
+	for i, acc := range a.list {
+		names[i] = acc.name
+	}
+	return names
+}
+
+// lookupOrder returns a in the order to look up the droplet id in.
+func (a *accounts) lookupOrder(id string) []*account {
+	a.mu.Lock()
+	last, ok := a.byDroplet[id]
+	a.mu.Unlock()
+
+	if !ok {
+		return a.list
+	}
+
+	order := []*account{last}
+	for _, acc := range a.list {
+		if acc != last {
+			order = append(order, acc)
+		}
+	}
+	return order
+}
+
+// remember records that the droplet id was found in acc.
+func (a *accounts) remember(id string, acc *account) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.byDroplet[id] = acc
+}
+
+// dropletByID returns the droplet id along with the account holding it. If
+// no account holds it, the not found error of the first account asked is
+// returned. Other errors are returned right away, so that a failing account
+// does not make droplets look missing.
+func (a *accounts) dropletByID(ctx context.Context, id string) (*godo.Droplet, *account, error) {
+	var notFound error
+	for _, acc := range a.lookupOrder(id) {
+		droplet, err := dropletByID(ctx, acc.client, id)
+		if err == nil {
+			a.remember(id, acc)
+			return droplet, acc, nil
+		}
+		if !isNotFound(err) {
+			return nil, nil, err
+		}
+		if notFound == nil {
+			notFound = err
+		}
+	}
+
+	return nil, nil, notFound
+}
+
+// dropletByName returns the droplet identified by nodeName along with the
+// account holding it. Accounts are searched in order and the first droplet
+// found is returned.
+func (a *accounts) dropletByName(ctx context.Context, nodeName types.NodeName) (*godo.Droplet, *account, error) {
+	for _, acc := range a.list {
+		droplets, err := acc.droplets(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if droplet := findDropletByName(droplets, nodeName); droplet != nil {
+			a.remember(fmt.Sprint(droplet.ID), acc)
+			return droplet, acc, nil
+		}
+	}
+
+	return nil, nil, cloudprovider.InstanceNotFound
+}
+
+// allDroplets returns the droplets of all accounts, restricted to those
+// carrying the tag of their account.
+func (a *accounts) allDroplets(ctx context.Context) ([]godo.Droplet, error) {
+	var droplets []godo.Droplet
+	for _, acc := range a.list {
+		list, err := acc.droplets(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list droplets of account %q: %s", acc.name, err)
+		}
+		droplets = append(droplets, list...)
+	}
+	return droplets, nil
+}
+
+// accountLoadBalancers implements cloudprovider.LoadBalancer by handing each
+// Service to the loadbalancers of the account picked by its annotation.
+type accountLoadBalancers struct {
+	accounts *accounts
+}
+
+// forService returns the loadbalancers of the account of service.
+func (a accountLoadBalancers) forService(service *v1.Service) (*loadbalancers, error) {
+	acc, err := a.accounts.forService(service)
+	if err != nil {
+		return nil, err
+	}
+	return acc.loadbalancers, nil
+}
+
+// GetLoadBalancer returns the *v1.LoadBalancerStatus of service in its
+// account.
+func (a accountLoadBalancers) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (*v1.LoadBalancerStatus, bool, error) {
+	l, err := a.forService(service)
+	if err != nil {
+		return nil, false, err
+	}
+	return l.GetLoadBalancer(ctx, clusterName, service)
+}
+
+// EnsureLoadBalancer ensures that the cluster is running a load balancer for
+// service in its account.
+func (a accountLoadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	l, err := a.forService(service)
+	if err != nil {
+		return nil, err
+	}
+	return l.EnsureLoadBalancer(ctx, clusterName, service, nodes)
+}
+
+// UpdateLoadBalancer updates the load balancer for service in its account.
+func (a accountLoadBalancers) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	l, err := a.forService(service)
+	if err != nil {
+		return err
+	}
+	return l.UpdateLoadBalancer(ctx, clusterName, service, nodes)
+}
+
+// EnsureLoadBalancerDeleted deletes the load balancer of service in its
+// account.
+func (a accountLoadBalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	l, err := a.forService(service)
+	if err != nil {
+		return err
+	}
+	return l.EnsureLoadBalancerDeleted(ctx, clusterName, service)
+}
+
+// accountNames returns the names of a joined for messages.
+func accountNames(a *accounts) string {
+	return strings.Join(a.names(), ", ")
+}
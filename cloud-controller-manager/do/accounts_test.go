@@ -0,0 +1,239 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+	dto "github.com/prometheus/client_model/go"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_parseCloudConfig(t *testing.T) {
+	testcases := []struct {
+		name     string
+		config   string
+		accounts []accountConfig
+		err      string
+	}{
+		{
+			name:   "empty",
+			config: "  \n",
+		},
+		{
+			name: "yaml",
+			config: `
+accounts:
+- name: team-b
+  tokenPath: /etc/do/team-b
+  tag: k8s-prod
+`,
+			accounts: []accountConfig{{Name: "team-b", TokenPath: "/etc/do/team-b", Tag: "k8s-prod"}},
+		},
+		{
+			name:     "json",
+			config:   `{"accounts": [{"name": "team-b", "tokenPath": "/etc/do/team-b"}]}`,
+			accounts: []accountConfig{{Name: "team-b", TokenPath: "/etc/do/team-b"}},
+		},
+		{
+			name:     "name with underscore and dot",
+			config:   `{"accounts": [{"name": "team_b.eu", "tokenPath": "/etc/do/team-b"}]}`,
+			accounts: []accountConfig{{Name: "team_b.eu", TokenPath: "/etc/do/team-b"}},
+		},
+		{
+			name:   "invalid name",
+			config: `{"accounts": [{"name": "Team B", "tokenPath": "/etc/do/team-b"}]}`,
+			err:    "invalid account name",
+		},
+		{
+			name:   "default name",
+			config: `{"accounts": [{"name": "default", "tokenPath": "/etc/do/team-b"}]}`,
+			err:    "configured more than once",
+		},
+		{
+			name:   "no token",
+			config: `{"accounts": [{"name": "team-b"}]}`,
+			err:    "has no tokenPath",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseCloudConfig(strings.NewReader(test.config))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(cfg.Accounts, test.accounts) {
+				t.Errorf("expected accounts %v, got %v", test.accounts, cfg.Accounts)
+			}
+		})
+	}
+
+	if cfg, err := parseCloudConfig(nil); err != nil || len(cfg.Accounts) != 0 {
+		t.Errorf("expected no config to be empty, got %v and %v", cfg, err)
+	}
+}
+
+// newTestAccounts returns accounts for the default fake API and the fake API
+// of account team-b, whose node lookups by name are restricted to tag.
+func newTestAccounts(t *testing.T, tag string) (*accounts, func()) {
+	fakeA, clientA, closeA := newFakeAPI(t)
+	fakeB, clientB, closeB := newFakeAPI(t)
+
+	fakeA.AddDroplet(godo.Droplet{ID: 10, Name: "node-a", Region: &godo.Region{Slug: "nyc1"}})
+	fakeB.AddDroplet(godo.Droplet{ID: 20, Name: "node-b", Region: &godo.Region{Slug: "sfo2"}, Tags: []string{"k8s"}})
+	fakeB.AddDroplet(godo.Droplet{ID: 21, Name: "untagged", Region: &godo.Region{Slug: "sfo2"}})
+
+	a := newAccounts(
+		&account{name: defaultAccountName, client: clientA, loadbalancers: newTestLoadbalancers(clientA, "nyc1", 5, 1)},
+		&account{name: "team-b", tag: tag, client: clientB, loadbalancers: newTestLoadbalancers(clientB, "nyc1", 5, 1)},
+	)
+	return a, func() {
+		closeA()
+		closeB()
+	}
+}
+
+func Test_accounts_droplets(t *testing.T) {
+	accounts, closeFn := newTestAccounts(t, "k8s")
+	defer closeFn()
+	ctx := context.TODO()
+
+	zones := newZones(accounts, "nyc1")
+	zone, err := zones.GetZoneByProviderID(ctx, "digitalocean://20")
+	if err != nil || zone.Region != "sfo2" {
+		t.Errorf("expected droplet of the second account to be in sfo2, got %v and %v", zone, err)
+	}
+	zone, err = zones.GetZoneByNodeName(ctx, "node-a")
+	if err != nil || zone.Region != "nyc1" {
+		t.Errorf("expected droplet of the default account to be in nyc1, got %v and %v", zone, err)
+	}
+
+	// droplets are looked up in the account they were last found in first.
+	_, acc, err := accounts.dropletByID(ctx, "20")
+	if err != nil || acc.name != "team-b" {
+		t.Fatalf("expected droplet 20 in team-b, got %v and %v", acc, err)
+	}
+	if order := accounts.lookupOrder("20"); order[0].name != "team-b" {
+		t.Errorf("expected team-b to be asked first, got %s", order[0].name)
+	}
+
+	// the tag of an account restricts lookups by name and its droplets.
+	if _, _, err := accounts.dropletByName(ctx, "untagged"); err == nil {
+		t.Error("expected untagged droplet not to be found by name")
+	}
+	droplets, err := accounts.allDroplets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var ids []int
+	for _, droplet := range droplets {
+		ids = append(ids, droplet.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{10, 20}) {
+		t.Errorf("expected droplets 10 and 20, got %v", ids)
+	}
+
+	instances := newInstances(accounts, "nyc1")
+	exists, err := instances.InstanceExistsByProviderID(ctx, "digitalocean://21")
+	if err != nil || !exists {
+		t.Errorf("expected droplet of the second account to exist, got %t and %v", exists, err)
+	}
+	if _, _, err := accounts.dropletByID(ctx, "30"); !isNotFound(err) {
+		t.Errorf("expected droplet missing in every account to be not found, got %v", err)
+	}
+}
+
+func Test_accountLoadBalancers(t *testing.T) {
+	accounts, closeFn := newTestAccounts(t, "")
+	defer closeFn()
+	ctx := context.TODO()
+
+	teamB, _ := accounts.get("team-b")
+	teamB.loadbalancers.account = teamB.name
+	recorder := record.NewFakeRecorder(10)
+	teamB.loadbalancers.recorder = recorder
+
+	lbs := accountLoadBalancers{accounts}
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}},
+	}
+
+	service := newScenarioService()
+	service.Annotations = map[string]string{annDOAccount: "team-b"}
+	if _, err := lbs.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lb, err := teamB.loadbalancers.lbByName(ctx, "ascenario")
+	if err != nil {
+		t.Fatalf("expected load balancer in team-b, got %s", err)
+	}
+	if !reflect.DeepEqual(lb.DropletIDs, []int{20}) || lb.Region.Slug != "sfo2" {
+		t.Errorf("expected load balancer for node-b in sfo2, got %v in %v", lb.DropletIDs, lb.Region)
+	}
+	if _, err := accounts.defaultAccount().loadbalancers.lbByName(ctx, "ascenario"); err != errLBNotFound {
+		t.Errorf("expected no load balancer in the default account, got %v", err)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); !strings.Contains(events, "Nodes node-a have no droplet in account team-b") {
+		t.Errorf("expected node-a to be reported as excluded, got %s", events)
+	}
+
+	service.Annotations[annDOAccount] = "team-c"
+	if _, _, err := lbs.GetLoadBalancer(ctx, "cluster", service); err == nil || !strings.Contains(err.Error(), `unknown DigitalOcean account "team-c"`) {
+		t.Errorf("expected unknown account to fail, got %v", err)
+	}
+}
+
+func Test_metricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newMetricsTransport(http.DefaultTransport, "metrics-test")}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	var m dto.Metric
+	if err := apiRequests.WithLabelValues("metrics-test", "GET", "418").Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if count := m.GetCounter().GetValue(); count != 2 {
+		t.Errorf("expected 2 requests to be counted, got %v", count)
+	}
+}
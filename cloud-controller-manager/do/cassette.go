@@ -0,0 +1,381 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// scrubbedFields maps the JSON fields identifying an account to the values
+// they are replaced with in cassettes.
+var scrubbedFields = map[string]string{
+	"uuid":  "00000000-0000-0000-0000-000000000000",
+	"email": "scrubbed@example.com",
+}
+
+const (
+	// scrubbedSecret replaces secrets, such as tokens, found in cassettes.
+	scrubbedSecret = "REDACTED"
+	// recordedBaseURL replaces the base URL of the API recorded, e.g. in
+	// links to pages, so that cassettes do not depend on where they were
+	// recorded.
+	recordedBaseURL = "https://api.digitalocean.com"
+)
+
+// recordedHeaders are the response headers kept in cassettes.
+var recordedHeaders = []string{"Content-Type", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"}
+
+// cassette holds recorded exchanges with the DigitalOcean API.
+type cassette struct {
+	Interactions []*interaction `json:"interactions"`
+}
+
+// interaction is a request and the response it got.
+type interaction struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+
+	// replayed is set once the interaction was replayed.
+	replayed bool
+}
+
+type recordedRequest struct {
+	Method string          `json:"method"`
+	URI    string          `json:"uri"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// loadCassette reads the cassette at path.
+func loadCassette(path string) (*cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// save writes c to path, one interaction per line so that changes to
+// cassettes are easy to review.
+func (c *cassette) save(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString(`{"interactions": [`)
+	for n, i := range c.Interactions {
+		data, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  ")
+		buf.Write(data)
+	}
+	buf.WriteString("\n]}\n")
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// scrub returns body with secrets and the fields identifying an account
+// replaced. Bodies which are not JSON are returned as JSON strings.
+func scrub(body []byte, secrets []string) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	for _, secret := range secrets {
+		if secret != "" {
+			body = bytes.Replace(body, []byte(secret), []byte(scrubbedSecret), -1)
+		}
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		s, _ := json.Marshal(string(body))
+		return s
+	}
+
+	scrubbed, _ := json.Marshal(scrubValue(v))
+	return scrubbed
+}
+
+func scrubValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if replacement, ok := scrubbedFields[key]; ok {
+				if _, isString := value.(string); isString {
+					v[key] = replacement
+					continue
+				}
+			}
+			v[key] = scrubValue(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = scrubValue(value)
+		}
+	}
+	return v
+}
+
+// readBody reads and restores the body of req.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// recordingTransport is an http.RoundTripper recording the exchanges
+// through base into a cassette, which is written to path after every
+// exchange. Tokens and account identifiers are scrubbed.
+type recordingTransport struct {
+	base http.RoundTripper
+	path string
+
+	mu       sync.Mutex
+	cassette *cassette
+	secrets  []string
+}
+
+// newRecordingTransport returns a recordingTransport sending requests
+// through base.
+func newRecordingTransport(base http.RoundTripper, path string) *recordingTransport {
+	return &recordingTransport{
+		base:     base,
+		path:     path,
+		cassette: &cassette{Interactions: []*interaction{}},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	// the caller gets the body as is, only the recorded copy is scrubbed.
+	respBody = append([]byte(nil), respBody...)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); token != "" && !contains(t.secrets, token) {
+		t.secrets = append(t.secrets, token)
+	}
+	baseURL := []byte(req.URL.Scheme + "://" + req.URL.Host)
+	respBody = bytes.Replace(respBody, baseURL, []byte(recordedBaseURL), -1)
+
+	headers := map[string]string{}
+	for _, h := range recordedHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			headers[h] = v
+		}
+	}
+
+	t.cassette.Interactions = append(t.cassette.Interactions, &interaction{
+		Request: recordedRequest{
+			Method: req.Method,
+			URI:    req.URL.RequestURI(),
+			Body:   scrub(reqBody, t.secrets),
+		},
+		Response: recordedResponse{
+			Status:  resp.StatusCode,
+			Headers: headers,
+			Body:    scrub(respBody, t.secrets),
+		},
+	})
+
+	if err := t.cassette.save(t.path); err != nil {
+		glog.Errorf("failed to save cassette %s: %s", t.path, err)
+	}
+
+	return resp, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// replayTransport is an http.RoundTripper answering requests from a
+// cassette. Each request is answered by the first interaction not replayed
+// yet with the same method, URI and body, so that repeated requests replay
+// changes such as status transitions in order. Requests without such an
+// interaction fail.
+type replayTransport struct {
+	mu       sync.Mutex
+	cassette *cassette
+}
+
+// newReplayTransport returns a replayTransport answering from c.
+func newReplayTransport(c *cassette) *replayTransport {
+	return &replayTransport{cassette: c}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	// request bodies are recorded scrubbed, so the token, which is in the
+	// header only, need not be known.
+	scrubbed := scrub(body, nil)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, i := range t.cassette.Interactions {
+		if i.replayed || i.Request.Method != req.Method || i.Request.URI != req.URL.RequestURI() || !sameJSON(i.Request.Body, scrubbed) {
+			continue
+		}
+		i.replayed = true
+
+		resp := &http.Response{
+			Status:     fmt.Sprintf("%d %s", i.Response.Status, http.StatusText(i.Response.Status)),
+			StatusCode: i.Response.Status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Request:    req,
+		}
+		for k, v := range i.Response.Headers {
+			resp.Header.Set(k, v)
+		}
+
+		// bodies which are not JSON are recorded as JSON strings.
+		body := []byte(i.Response.Body)
+		var s string
+		if json.Unmarshal(body, &s) == nil {
+			body = []byte(s)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("cassette: no recorded interaction left for %s %s with body %s", req.Method, req.URL.RequestURI(), scrubbed)
+}
+
+// unreplayed returns the interactions which were not replayed.
+func (t *replayTransport) unreplayed() []*interaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var left []*interaction
+	for _, i := range t.cassette.Interactions {
+		if !i.replayed {
+			left = append(left, i)
+		}
+	}
+	return left
+}
+
+// sameJSON returns true if a and b hold the same JSON value.
+func sameJSON(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// apiTransportFromEnv returns the transport to send DigitalOcean API requests
+// through. It replays a cassette instead of reaching the API if
+// doReplayCassetteEnv is set, injects the faults configured through the
+// environment and records the exchanges, faults included, into a cassette if
+// doRecordCassetteEnv is set.
+func apiTransportFromEnv() (http.RoundTripper, error) {
+	record, replay := os.Getenv(doRecordCassetteEnv), os.Getenv(doReplayCassetteEnv)
+	if record != "" && replay != "" {
+		return nil, fmt.Errorf("%q and %q cannot be set at the same time", doRecordCassetteEnv, doReplayCassetteEnv)
+	}
+
+	transport := http.DefaultTransport
+	if replay != "" {
+		c, err := loadCassette(replay)
+		if err != nil {
+			return nil, err
+		}
+		glog.Warningf("cassette: replaying DigitalOcean API calls from %s", replay)
+		transport = newReplayTransport(c)
+	}
+
+	transport, err := faultTransportFromEnv(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if record != "" {
+		glog.Warningf("cassette: recording DigitalOcean API calls to %s", record)
+		transport = newRecordingTransport(transport, record)
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+	"golang.org/x/oauth2"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+var recordCassettes = flag.Bool("record-cassettes", false, "record the cassettes in testdata/cassettes instead of replaying them")
+
+// cassetteClient returns a client replaying the cassette name from
+// testdata/cassettes, and injecting faults while recording.
+//
+// With -record-cassettes, the cassette is recorded instead. It is recorded
+// against the API at DO_OVERRIDE_URL, or the DigitalOcean API, if
+// DO_ACCESS_TOKEN is set, and against a fake API seeded with seed otherwise.
+// The returned function must be called once done; it fails t if recorded
+// interactions were not replayed.
+func cassetteClient(t *testing.T, name string, seed func(*fakedo.Server), faults string) (*godo.Client, func()) {
+	path := filepath.Join("testdata", "cassettes", name+".json")
+
+	if !*recordCassettes {
+		c, err := loadCassette(path)
+		if err != nil {
+			t.Fatalf("failed to load cassette: %s", err)
+		}
+		replay := newReplayTransport(c)
+
+		client, err := godo.New(&http.Client{Transport: replay})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return client, func() {
+			for _, i := range replay.unreplayed() {
+				t.Errorf("recorded interaction was not replayed: %s %s", i.Request.Method, i.Request.URI)
+			}
+		}
+	}
+
+	closeFn := func() {}
+	token, baseURL := os.Getenv(doAccessTokenEnv), os.Getenv(doOverrideAPIURLEnv)
+	if token == "" {
+		fake := fakedo.NewServer()
+		seed(fake)
+		server := httptest.NewServer(fake)
+		token, baseURL, closeFn = "fake-token", server.URL, server.Close
+	}
+
+	rules, err := parseFaultRules(faults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := newRecordingTransport(newFaultTransport(http.DefaultTransport, rules, defaultFaultSeed), path)
+	httpClient := &http.Client{Transport: &oauth2.Transport{
+		Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+		Base:   recorder,
+	}}
+
+	opts := []godo.ClientOpt{}
+	if baseURL != "" {
+		opts = append(opts, godo.SetBaseURL(baseURL))
+	}
+	client, err := godo.New(httpClient, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, closeFn
+}
+
+func Test_scrub(t *testing.T) {
+	body := []byte(`{"account":{"uuid":"8f2b","email":"me@example.org","team":{"uuid":"77c1"},"droplet_limit":25},"note":"token secret-token"}`)
+
+	got := scrub(body, []string{"secret-token"})
+
+	var v map[string]interface{}
+	if err := json.Unmarshal(got, &v); err != nil {
+		t.Fatalf("expected scrubbed body to be JSON, got %s", got)
+	}
+	for _, leaked := range []string{"8f2b", "77c1", "me@example.org", "secret-token"} {
+		if strings.Contains(string(got), leaked) {
+			t.Errorf("expected %q to be scrubbed, got %s", leaked, got)
+		}
+	}
+	if !strings.Contains(string(got), `"droplet_limit":25`) {
+		t.Errorf("expected other fields to be kept, got %s", got)
+	}
+
+	if got := scrub([]byte("not json"), nil); string(got) != `"not json"` {
+		t.Errorf("expected non JSON body to be recorded as a string, got %s", got)
+	}
+	if got := scrub(nil, nil); got != nil {
+		t.Errorf("expected empty body to be recorded as nothing, got %s", got)
+	}
+}
+
+func Test_cassette_recordAndReplay(t *testing.T) {
+	fake := fakedo.NewServer()
+	fake.SetLoadBalancerTransition(2, fakedo.StatusActive)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cassette.json")
+	recorder := newRecordingTransport(http.DefaultTransport, path)
+	recording, err := godo.New(&http.Client{Transport: &oauth2.Transport{
+		Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret-token"}),
+		Base:   recorder,
+	}}, godo.SetBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	req := &godo.LoadBalancerRequest{
+		Name:            "lb",
+		Region:          "nyc1",
+		ForwardingRules: []godo.ForwardingRule{{EntryProtocol: "tcp", EntryPort: 80, TargetProtocol: "tcp", TargetPort: 30080}},
+	}
+
+	// a scenario: the account, a load balancer transitioning from new to
+	// active and a missing droplet.
+	scenario := func(client *godo.Client) []string {
+		var got []string
+		account, _, err := client.Account.Get(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, account.UUID)
+
+		lb, _, err := client.LoadBalancers.Create(ctx, req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			lb, _, err = client.LoadBalancers.Get(ctx, lb.ID)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got = append(got, lb.Status)
+		}
+
+		_, resp, err := client.Droplets.Get(ctx, 42)
+		if err == nil {
+			t.Fatal("expected missing droplet")
+		}
+		got = append(got, resp.Status)
+
+		return got
+	}
+
+	recorded := scenario(recording)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected cassette to be saved: %s", err)
+	}
+	for _, leaked := range []string{"secret-token", "fake-account", "fake@example.com", server.URL} {
+		if strings.Contains(string(data), leaked) {
+			t.Errorf("expected %q to be scrubbed from the cassette", leaked)
+		}
+	}
+
+	c, err := loadCassette(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	replay := newReplayTransport(c)
+	replaying, err := godo.New(&http.Client{Transport: replay})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := scenario(replaying)
+	want := []string{scrubbedFields["uuid"], fakedo.StatusNew, fakedo.StatusActive, "404 Not Found"}
+	if strings.Join(replayed, ",") != strings.Join(want, ",") {
+		t.Errorf("got replayed %v, want %v", replayed, want)
+	}
+	if len(recorded) != len(replayed) || recorded[1] != replayed[1] || recorded[2] != replayed[2] {
+		t.Errorf("expected replay %v to match recording %v", replayed, recorded)
+	}
+	if left := replay.unreplayed(); len(left) != 0 {
+		t.Errorf("expected all interactions to be replayed, got %d left", len(left))
+	}
+
+	// every interaction is replayed once, so another request fails.
+	if _, _, err := replaying.Account.Get(ctx); err == nil || !strings.Contains(err.Error(), "no recorded interaction left for GET /v2/account") {
+		t.Errorf("expected unmatched request to fail, got %v", err)
+	}
+	// as do requests with another body.
+	other := *req
+	other.Name = "other"
+	if _, _, err := replaying.LoadBalancers.Create(ctx, &other); err == nil {
+		t.Error("expected request with another body to fail")
+	}
+}
+
+func Test_apiTransportFromEnv(t *testing.T) {
+	os.Setenv(doRecordCassetteEnv, "record.json")
+	os.Setenv(doReplayCassetteEnv, "replay.json")
+	defer os.Unsetenv(doRecordCassetteEnv)
+	defer os.Unsetenv(doReplayCassetteEnv)
+
+	if _, err := apiTransportFromEnv(); err == nil {
+		t.Error("expected recording and replaying at once to fail")
+	}
+
+	os.Unsetenv(doRecordCassetteEnv)
+	if _, err := apiTransportFromEnv(); err == nil {
+		t.Error("expected missing cassette to fail")
+	}
+
+	os.Unsetenv(doReplayCassetteEnv)
+	transport, err := apiTransportFromEnv()
+	if err != nil || transport != http.DefaultTransport {
+		t.Errorf("expected the default transport, got %v and %v", transport, err)
+	}
+}
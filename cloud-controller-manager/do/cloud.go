@@ -17,14 +17,24 @@ limitations under the License.
 package do
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
 
 	"golang.org/x/oauth2"
 
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/cloudprovider"
 	"k8s.io/kubernetes/pkg/controller"
 )
@@ -33,59 +43,362 @@ const (
 	doAccessTokenEnv    string = "DO_ACCESS_TOKEN"
 	doOverrideAPIURLEnv string = "DO_OVERRIDE_URL"
 	providerName        string = "digitalocean"
-)
 
-type tokenSource struct {
-	AccessToken string
-}
+	// doRegionEnv is the region the cluster runs in, e.g. nyc1. It is read
+	// from the droplet metadata if not set, which is only possible on a
+	// droplet.
+	doRegionEnv string = "DO_REGION"
 
-func (t *tokenSource) Token() (*oauth2.Token, error) {
-	token := &oauth2.Token{
-		AccessToken: t.AccessToken,
-	}
-	return token, nil
-}
+	// doAccessTokenPathEnv is the path of a file holding the access token,
+	// which is reread every doAccessTokenPollPeriodEnv, e.g. 30s. It takes
+	// precedence over doAccessTokenEnv.
+	doAccessTokenPathEnv       string = "DO_ACCESS_TOKEN_PATH"
+	doAccessTokenPollPeriodEnv string = "DO_ACCESS_TOKEN_POLL_PERIOD"
+
+	// doAccessTokenSecretEnv references the key of a Secret, as
+	// namespace/name[:key], whose changes rotate the access token. The key
+	// defaults to access-token.
+	doAccessTokenSecretEnv string = "DO_ACCESS_TOKEN_SECRET"
+
+	// doNodeTagLabelRulesEnv and doNodeTagTaintRulesEnv hold comma separated
+	// tag-prefix=key-prefix rules mapping droplet tags onto node labels and
+	// taints.
+	doNodeTagLabelRulesEnv string = "DO_NODE_TAG_LABEL_RULES"
+	doNodeTagTaintRulesEnv string = "DO_NODE_TAG_TAINT_RULES"
+
+	// doNodeLabelTagWritebackEnv holds comma separated label-key=tag-key
+	// rules selecting node labels to push back onto droplets as tags.
+	doNodeLabelTagWritebackEnv string = "DO_NODE_LABEL_TAG_WRITEBACK"
+
+	// doNodeTagSyncPeriodEnv is the interval between two synchronizations of
+	// droplet tags onto nodes, e.g. 30s.
+	doNodeTagSyncPeriodEnv string = "DO_NODE_TAG_SYNC_PERIOD"
+
+	// doNodeSizeLabelsEnv disables labeling nodes with the resources and
+	// price of their droplet size when set to false.
+	doNodeSizeLabelsEnv string = "DO_NODE_SIZE_LABELS"
+
+	// doNodeDeletionConfirmationsEnv and doNodeDeletionWindowEnv configure
+	// how many consecutive not-found observations spanning at least how long
+	// are required before a droplet is reported as gone, which deletes its
+	// node.
+	doNodeDeletionConfirmationsEnv string = "DO_NODE_DELETION_CONFIRMATIONS"
+	doNodeDeletionWindowEnv        string = "DO_NODE_DELETION_WINDOW"
+
+	// doNodeDropletActionsEnv enables surfacing in-progress droplet actions
+	// as node conditions and taints when set to true.
+	// doNodeDropletActionsSyncPeriodEnv is the interval between two polls of
+	// droplet action state, e.g. 30s.
+	doNodeDropletActionsEnv           string = "DO_NODE_DROPLET_ACTIONS"
+	doNodeDropletActionsSyncPeriodEnv string = "DO_NODE_DROPLET_ACTIONS_SYNC_PERIOD"
+
+	// doNodeRemediationEnv enables powering on and power cycling stuck
+	// droplets when set to true. The remaining variables tune when and how
+	// often remediations happen, see remediationConfig.
+	doNodeRemediationEnv                string = "DO_NODE_REMEDIATION"
+	doNodeRemediationPowerOnAfterEnv    string = "DO_NODE_REMEDIATION_POWER_ON_AFTER"
+	doNodeRemediationPowerCycleAfterEnv string = "DO_NODE_REMEDIATION_POWER_CYCLE_AFTER"
+	doNodeRemediationNodeCooldownEnv    string = "DO_NODE_REMEDIATION_NODE_COOLDOWN"
+	doNodeRemediationMinIntervalEnv     string = "DO_NODE_REMEDIATION_MIN_INTERVAL"
+	doNodeRemediationMaxConcurrentEnv   string = "DO_NODE_REMEDIATION_MAX_CONCURRENT"
+	doNodeRemediationSyncPeriodEnv      string = "DO_NODE_REMEDIATION_SYNC_PERIOD"
+
+	// doNodeFloatingIPsEnv enables pinning floating IPs to the nodes naming
+	// them and reporting them as node addresses when set to true.
+	// doFloatingIPPoolsEnv holds comma separated name=ip1|ip2 pools nodes
+	// can get a floating IP from.
+	doNodeFloatingIPsEnv           string = "DO_NODE_FLOATING_IPS"
+	doFloatingIPPoolsEnv           string = "DO_FLOATING_IP_POOLS"
+	doNodeFloatingIPsSyncPeriodEnv string = "DO_NODE_FLOATING_IPS_SYNC_PERIOD"
+
+	// doPreflightChecksEnv disables verifying the account, region and token
+	// permissions on startup when set to false. Checks failing transiently,
+	// e.g. with server errors, are retried and do not stop startup.
+	doPreflightChecksEnv string = "DO_PREFLIGHT_CHECKS"
+
+	// doHealthBindAddressEnv is the address, e.g. :10260, to serve the
+	// periodically rerun preflight checks on at /healthz. The health
+	// endpoint is disabled if not set.
+	doHealthBindAddressEnv string = "DO_HEALTH_BIND_ADDRESS"
+
+	// doDryRunEnv logs, instead of performing, every mutating API call when
+	// set to true. When doDryRunAutoDegradeEnv is set to true, dry-run is
+	// also turned on once a mutating call is forbidden, e.g. because the
+	// token is read-only, until the token changes.
+	doDryRunEnv            string = "DO_DRY_RUN"
+	doDryRunAutoDegradeEnv string = "DO_DRY_RUN_AUTO_DEGRADE"
+
+	// doDebugFaultsEnv holds semicolon separated rules of faults to inject
+	// into DigitalOcean API calls, see parseFaultRules.
+	// doDebugFaultsSeedEnv seeds the chance of faults to apply. Both are
+	// meant for debugging only.
+	doDebugFaultsEnv     string = "DO_DEBUG_FAULTS"
+	doDebugFaultsSeedEnv string = "DO_DEBUG_FAULTS_SEED"
+
+	// doRecordCassetteEnv is the path of a file to record the exchanges with
+	// the DigitalOcean API into, with tokens and account identifiers
+	// scrubbed. doReplayCassetteEnv is the path of such a file to answer
+	// requests from instead of the API.
+	doRecordCassetteEnv string = "DO_RECORD_CASSETTE"
+	doReplayCassetteEnv string = "DO_REPLAY_CASSETTE"
+
+	// doLBRecoveryThresholdEnv is the number of times a load balancer must
+	// error or time out becoming active before it is deleted and recreated,
+	// or replaced by an active load balancer with the same name. Recovery is
+	// disabled when set to 0. Replacements for a Service back off from
+	// doLBRecoveryBackoffEnv up to doLBRecoveryMaxBackoffEnv.
+	doLBRecoveryThresholdEnv  string = "DO_LB_RECOVERY_THRESHOLD"
+	doLBRecoveryBackoffEnv    string = "DO_LB_RECOVERY_BACKOFF"
+	doLBRecoveryMaxBackoffEnv string = "DO_LB_RECOVERY_MAX_BACKOFF"
+
+	// doLBDrainWindowEnv is how long the connections of nodes annotated as
+	// draining are given to complete once they were removed from load
+	// balancers, before they are reported drained, e.g. 2m.
+	doLBDrainWindowEnv string = "DO_LB_DRAIN_WINDOW"
+
+	// doLBAdoptionEnv allows Services to adopt existing load balancers
+	// through annDOLoadBalancerID when set to true. Any Service author can
+	// then take over, rename and delete the load balancers of the account
+	// not created for Services.
+	doLBAdoptionEnv string = "DO_LB_ADOPTION"
+)
 
 type cloud struct {
-	client        *godo.Client
-	instances     cloudprovider.Instances
-	zones         cloudprovider.Zones
-	loadbalancers cloudprovider.LoadBalancer
+	// accounts holds the clients and per-account state, the account
+	// configured through the environment first.
+	accounts    *accounts
+	tokenSource *rotatingTokenSource
+	instances   *instances
+	zones       cloudprovider.Zones
+
+	nodeTags       *nodeTagsConfig
+	nodeSizeLabels bool
+
+	dropletActions           bool
+	dropletActionsSyncPeriod time.Duration
+
+	remediation *remediationConfig
+
+	nodeFloatingIPs *nodeFloatingIPsConfig
+
+	health            *preflightHealth
+	healthBindAddress string
 }
 
 func newCloud(config io.Reader) (cloudprovider.Interface, error) {
-	token := os.Getenv(doAccessTokenEnv)
+	cfg, err := parseCloudConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := initialToken()
+	if err != nil {
+		return nil, err
+	}
 
 	opts := []godo.ClientOpt{}
 
-	if overrideURL := os.Getenv(doOverrideAPIURLEnv); overrideURL != "" {
+	overrideURL := os.Getenv(doOverrideAPIURLEnv)
+	if overrideURL != "" {
 		opts = append(opts, godo.SetBaseURL(overrideURL))
 	}
 
-	if token == "" {
-		return nil, fmt.Errorf("environment variable %q is required", doAccessTokenEnv)
+	tokenFilePollPeriod, err := durationFromEnv(doAccessTokenPollPeriodEnv, defaultTokenFilePollPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	dryRun, err := boolFromEnv(doDryRunEnv, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dryRunAutoDegrade, err := boolFromEnv(doDryRunAutoDegradeEnv, false)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := apiTransportFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
-	tokenSource := &tokenSource{
-		AccessToken: token,
+	regionSource := doRegionEnv
+	region := os.Getenv(doRegionEnv)
+	if region == "" {
+		regionSource = "droplet metadata"
+		region, err = dropletRegion()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region from droplet metadata: %s", err)
+		}
 	}
 
-	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	doClient, err := godo.New(oauthClient, opts...)
+	preflight, err := boolFromEnv(doPreflightChecksEnv, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create godo client: %s", err)
+		return nil, err
+	}
+
+	lbAdoption, err := boolFromEnv(doLBAdoptionEnv, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// newAccount returns the account name authenticating with token read from
+	// tokenFrom, along with the results of its preflight checks. Only checks
+	// which fail permanently are an error.
+	newAccount := func(name, tag, token, tokenFrom string) (*account, []preflightResult, error) {
+		tokenSource := newRotatingTokenSource(token, accountTokenValidator(overrideURL))
+
+		// oauth2.NewClient would cache the first token forever since it never
+		// expires, so the transport is built directly to pick up rotations.
+		oauthClient := &http.Client{
+			Transport: &oauth2.Transport{
+				Source: tokenSource,
+				Base:   newDryRunTransport(newMetricsTransport(transport, name), name, dryRun, dryRunAutoDegrade),
+			},
+		}
+		client, err := godo.New(oauthClient, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create godo client for account %q: %s", name, err)
+		}
+
+		var results []preflightResult
+		if preflight {
+			results = retryPreflightChecks(context.Background(), client, region, preflightSources{token: tokenFrom, region: regionSource})
+			if err := preflightError(permanentFailures(results)); err != nil {
+				return nil, nil, fmt.Errorf("account %q: %s", name, err)
+			}
+			if err := preflightError(results); err != nil {
+				glog.Warningf("account %q: continuing despite transient %s", name, err)
+			}
+		}
+
+		lbRecovery, err := lbRecoveryFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		lbDrains, err := lbDrainsFromEnv(name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		loadbalancers := newLoadbalancers(client, region)
+		loadbalancers.adoption = lbAdoption
+		loadbalancers.recovery = lbRecovery
+		loadbalancers.drains = lbDrains
+		loadbalancers.dropletTag = tag
+		if len(cfg.Accounts) > 0 {
+			loadbalancers.account = name
+		}
+
+		return &account{
+			name:          name,
+			tag:           tag,
+			client:        client,
+			tokenSource:   tokenSource,
+			loadbalancers: loadbalancers,
+			sizes:         newSizeCache(client, defaultSizeCacheTTL),
+		}, results, nil
 	}
 
-	region, err := dropletRegion()
+	defaultTokenSource := initialTokenSource()
+	defaultAccount, results, err := newAccount(defaultAccountName, "", token, defaultTokenSource)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get region from droplet metadata: %s", err)
+		return nil, err
+	}
+
+	// the health checks of the default account rerun with the token rotated
+	// through the Secret, if any.
+	healthTokenSource := defaultTokenSource
+	if ref := os.Getenv(doAccessTokenSecretEnv); ref != "" {
+		healthTokenSource = fmt.Sprintf("%s or the Secret %s", defaultTokenSource, ref)
+	}
+	health := newPreflightHealth(region)
+	health.add(defaultAccountName, defaultAccount.client, preflightSources{token: healthTokenSource, region: regionSource}, results)
+
+	list := []*account{defaultAccount}
+	for _, ac := range cfg.Accounts {
+		token, err := tokenFromFile(ac.TokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("account %q: %s", ac.Name, err)
+		}
+
+		tokenFrom := fmt.Sprintf("tokenPath %q", ac.TokenPath)
+		acc, results, err := newAccount(ac.Name, ac.Tag, token, tokenFrom)
+		if err != nil {
+			return nil, err
+		}
+		health.add(ac.Name, acc.client, preflightSources{token: tokenFrom, region: regionSource}, results)
+		go watchTokenFile(acc.tokenSource, ac.TokenPath, tokenFilePollPeriod, wait.NeverStop)
+
+		list = append(list, acc)
+	}
+	accounts := newAccounts(list...)
+	if len(list) > 1 {
+		glog.Infof("managing droplets in DigitalOcean accounts %s", accountNames(accounts))
+	}
+
+	notFound, err := notFoundTrackerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	instances := newInstances(accounts, region)
+	instances.notFound = notFound
+
+	nodeTags, err := nodeTagsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	nodeSizeLabels, err := boolFromEnv(doNodeSizeLabelsEnv, true)
+	if err != nil {
+		return nil, err
+	}
+
+	dropletActions, err := boolFromEnv(doNodeDropletActionsEnv, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dropletActionsSyncPeriod, err := durationFromEnv(doNodeDropletActionsSyncPeriodEnv, defaultDropletActionsSyncPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	remediation, err := remediationConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	nodeFloatingIPs, err := nodeFloatingIPsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	instances.floatingIPs = nodeFloatingIPs != nil
+
+	if path := os.Getenv(doAccessTokenPathEnv); path != "" {
+		go watchTokenFile(defaultAccount.tokenSource, path, tokenFilePollPeriod, wait.NeverStop)
 	}
 
 	return &cloud{
-		client:        doClient,
-		instances:     newInstances(doClient, region),
-		zones:         newZones(doClient, region),
-		loadbalancers: newLoadbalancers(doClient, region),
+		accounts:       accounts,
+		tokenSource:    defaultAccount.tokenSource,
+		instances:      instances,
+		zones:          newZones(accounts, region),
+		nodeTags:       nodeTags,
+		nodeSizeLabels: nodeSizeLabels,
+
+		dropletActions:           dropletActions,
+		dropletActionsSyncPeriod: dropletActionsSyncPeriod,
+
+		remediation: remediation,
+
+		nodeFloatingIPs: nodeFloatingIPs,
+
+		health:            health,
+		healthBindAddress: os.Getenv(doHealthBindAddressEnv),
 	}, nil
 }
 
@@ -95,11 +408,97 @@ func init() {
 	})
 }
 
+// Initialize starts the DigitalOcean specific controllers enabled through the
+// environment.
 func (c *cloud) Initialize(clientBuilder controller.ControllerClientBuilder) {
+	clientset := clientBuilder.ClientOrDie("digitalocean-shared-informers")
+	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
+	nodeInformer := sharedInformer.Core().V1().Nodes()
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "digitalocean-cloud-controller-manager"})
+
+	if ref := os.Getenv(doAccessTokenSecretEnv); ref != "" {
+		if err := watchTokenSecret(c.tokenSource, clientset, ref, wait.NeverStop); err != nil {
+			glog.Errorf("failed to watch token secret: %s", err)
+		}
+	}
+
+	c.instances.recorder = recorder
+	c.instances.nodeLister = nodeInformer.Lister()
+	serviceInformer := sharedInformer.Core().V1().Services()
+	serviceLister := serviceInformer.Lister()
+
+	// the status annotations are written by a single writer shared by the
+	// accounts.
+	status := newStatusWriter(clientset, serviceLister, serviceInformer.Informer().HasSynced)
+	go status.Run(wait.NeverStop)
+
+	// remediations are limited across accounts.
+	var limiter *remediationLimiter
+	if c.remediation != nil {
+		limiter = newRemediationLimiter(c.remediation)
+	}
+
+	// the controllers run once per account; each leaves alone the nodes
+	// whose droplets it cannot find.
+	for _, acc := range c.accounts.list {
+		acc.loadbalancers.recorder = recorder
+		acc.loadbalancers.serviceLister = serviceLister
+		acc.loadbalancers.nodeLister = nodeInformer.Lister()
+		acc.loadbalancers.kclient = clientset
+		acc.loadbalancers.status = status
+		go acc.loadbalancers.runDrains(nodeInformer.Informer().HasSynced, wait.NeverStop)
+
+		if c.nodeTags != nil {
+			nodeTags := newNodeTagsController(acc.client, clientset, nodeInformer.Lister(), nodeInformer.Informer().HasSynced, c.nodeTags)
+			nodeTags.dropletTag = acc.tag
+			go nodeTags.Run(wait.NeverStop)
+		}
+
+		if c.nodeSizeLabels {
+			nodeSizes := newNodeSizesController(acc.client, clientset, nodeInformer.Lister(), nodeInformer.Informer().HasSynced, acc.sizes)
+			nodeSizes.dropletTag = acc.tag
+			go nodeSizes.Run(wait.NeverStop)
+		}
+
+		if c.dropletActions {
+			dropletActions := newDropletActionsController(acc.client, clientset, nodeInformer.Lister(), nodeInformer.Informer().HasSynced, c.dropletActionsSyncPeriod)
+			dropletActions.dropletTag = acc.tag
+			go dropletActions.Run(wait.NeverStop)
+		}
+
+		if c.remediation != nil {
+			remediation := newRemediationController(acc.client, nodeInformer.Lister(), nodeInformer.Informer().HasSynced, recorder, c.remediation)
+			remediation.dropletTag = acc.tag
+			remediation.limiter = limiter
+			go remediation.Run(wait.NeverStop)
+		}
+
+		if c.nodeFloatingIPs != nil {
+			nodeFloatingIPs := newNodeFloatingIPsController(acc.client, clientset, nodeInformer.Lister(), nodeInformer.Informer().HasSynced, recorder, c.nodeFloatingIPs)
+			if len(c.accounts.list) > 1 {
+				nodeFloatingIPs.account = acc.name
+			}
+			nodeFloatingIPs.dropletTag = acc.tag
+			go nodeFloatingIPs.Run(wait.NeverStop)
+		}
+	}
+
+	if c.healthBindAddress != "" {
+		go wait.Until(func() {
+			c.health.refresh(context.Background())
+		}, defaultPreflightRecheckPeriod, wait.NeverStop)
+		go c.health.serve(c.healthBindAddress)
+	}
+
+	sharedInformer.Start(wait.NeverStop)
 }
 
 func (c *cloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
-	return c.loadbalancers, true
+	return accountLoadBalancers{c.accounts}, true
 }
 
 func (c *cloud) Instances() (cloudprovider.Instances, bool) {
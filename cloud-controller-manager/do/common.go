@@ -19,6 +19,10 @@ package do
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"k8s.io/api/core/v1"
 
@@ -27,6 +31,44 @@ import (
 
 const apiPerPage = 100
 
+// isNotFound returns true if err is a godo error response with status 404.
+func isNotFound(err error) bool {
+	godoErr, ok := err.(*godo.ErrorResponse)
+	return ok && godoErr.Response != nil && godoErr.Response.StatusCode == http.StatusNotFound
+}
+
+// boolFromEnv returns the boolean value of the environment variable name, or
+// def if it is not set.
+func boolFromEnv(name string, def bool) (bool, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %q: %s", name, err)
+	}
+
+	return b, nil
+}
+
+// durationFromEnv returns the duration value of the environment variable
+// name, or def if it is not set.
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %q: %s", name, err)
+	}
+
+	return d, nil
+}
+
 func allDropletList(ctx context.Context, client *godo.Client) ([]godo.Droplet, error) {
 	list := []godo.Droplet{}
 
@@ -59,6 +101,103 @@ func allDropletList(ctx context.Context, client *godo.Client) ([]godo.Droplet, e
 	return list, nil
 }
 
+// dropletList returns the droplets of the account of client, restricted to
+// those carrying tag unless it is empty.
+func dropletList(ctx context.Context, client *godo.Client, tag string) ([]godo.Droplet, error) {
+	if tag == "" {
+		return allDropletList(ctx, client)
+	}
+	return allDropletListByTag(ctx, client, tag)
+}
+
+// allDropletListByTag returns the droplets carrying tag.
+func allDropletListByTag(ctx context.Context, client *godo.Client, tag string) ([]godo.Droplet, error) {
+	list := []godo.Droplet{}
+
+	opt := &godo.ListOptions{PerPage: apiPerPage}
+	for {
+		droplets, resp, err := client.Droplets.ListByTag(ctx, tag, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, droplets...)
+
+		if resp == nil || resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+
+		opt.Page = page + 1
+	}
+
+	return list, nil
+}
+
+func allFloatingIPList(ctx context.Context, client *godo.Client) ([]godo.FloatingIP, error) {
+	list := []godo.FloatingIP{}
+
+	opt := &godo.ListOptions{PerPage: apiPerPage}
+	for {
+		fips, resp, err := client.FloatingIPs.List(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp == nil {
+			return nil, fmt.Errorf("floating IPs list request returned no response")
+		}
+
+		list = append(list, fips...)
+
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+
+		opt.Page = page + 1
+	}
+
+	return list, nil
+}
+
+// allLoadBalancerList returns the load balancers of all pages. A missing
+// response is taken as the last page.
+func allLoadBalancerList(ctx context.Context, client *godo.Client) ([]godo.LoadBalancer, error) {
+	list := []godo.LoadBalancer{}
+
+	opt := &godo.ListOptions{PerPage: apiPerPage}
+	for {
+		lbs, resp, err := client.LoadBalancers.List(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, lbs...)
+
+		if resp == nil || resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+
+		opt.Page = page + 1
+	}
+
+	return list, nil
+}
+
 // nodeAddresses returns a []v1.NodeAddress from droplet.
 func nodeAddresses(droplet *godo.Droplet) ([]v1.NodeAddress, error) {
 	var addresses []v1.NodeAddress
@@ -78,3 +217,35 @@ func nodeAddresses(droplet *godo.Droplet) ([]v1.NodeAddress, error) {
 
 	return addresses, nil
 }
+
+// dropletForNode returns the droplet in droplets backing node, or nil if none
+// matches. A node with a providerID only matches the droplet it names, so
+// that a droplet with the same name, e.g. in another account, is not
+// mistaken for it. Otherwise the node name is compared against the droplet
+// names and addresses.
+func dropletForNode(node *v1.Node, droplets []godo.Droplet) *godo.Droplet {
+	if node.Spec.ProviderID != "" {
+		if id, err := dropletIDFromProviderID(node.Spec.ProviderID); err == nil {
+			for i := range droplets {
+				if strconv.Itoa(droplets[i].ID) == id {
+					return &droplets[i]
+				}
+			}
+			return nil
+		}
+	}
+
+	for i := range droplets {
+		if droplets[i].Name == node.Name {
+			return &droplets[i]
+		}
+		addresses, _ := nodeAddresses(&droplets[i])
+		for _, address := range addresses {
+			if address.Address == node.Name {
+				return &droplets[i]
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// defaultTokenSecretKey is the key of the token in the Secret named by
+	// doAccessTokenSecretEnv if none is given.
+	defaultTokenSecretKey = "access-token"
+
+	// defaultTokenFilePollPeriod is the default interval between two reads of
+	// the token file.
+	defaultTokenFilePollPeriod = 30 * time.Second
+)
+
+// tokenValidator returns an error if token may not be used.
+type tokenValidator func(ctx context.Context, token string) error
+
+// rotatingTokenSource is an oauth2.TokenSource whose token can be replaced
+// at runtime. A new token is only used once it validates; otherwise the last
+// good token is kept.
+type rotatingTokenSource struct {
+	validate tokenValidator
+
+	mu    sync.RWMutex
+	token string
+}
+
+var _ oauth2.TokenSource = &rotatingTokenSource{}
+
+// newRotatingTokenSource returns a rotatingTokenSource starting with token.
+func newRotatingTokenSource(token string, validate tokenValidator) *rotatingTokenSource {
+	return &rotatingTokenSource{
+		token:    token,
+		validate: validate,
+	}
+}
+
+// Token implements oauth2.TokenSource.
+func (t *rotatingTokenSource) Token() (*oauth2.Token, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return &oauth2.Token{AccessToken: t.token}, nil
+}
+
+// update switches to token if it differs from the current token and
+// validates. source names where token came from for logging.
+func (t *rotatingTokenSource) update(ctx context.Context, token, source string) error {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return fmt.Errorf("empty token from %s", source)
+	}
+
+	t.mu.RLock()
+	current := t.token
+	t.mu.RUnlock()
+	if token == current {
+		return nil
+	}
+
+	if err := t.validate(ctx, token); err != nil {
+		return fmt.Errorf("keeping last good token, new token from %s failed validation: %s", source, err)
+	}
+
+	t.mu.Lock()
+	t.token = token
+	t.mu.Unlock()
+
+	glog.Infof("rotated DigitalOcean access token from %s", source)
+	return nil
+}
+
+// accountTokenValidator returns a tokenValidator getting the account with
+// the token against the API at baseURL, or the default API if empty.
+func accountTokenValidator(baseURL string) tokenValidator {
+	return func(ctx context.Context, token string) error {
+		var opts []godo.ClientOpt
+		if baseURL != "" {
+			opts = append(opts, godo.SetBaseURL(baseURL))
+		}
+
+		client, err := godo.New(oauth2.NewClient(oauth2.NoContext, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})), opts...)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = client.Account.Get(ctx)
+		return err
+	}
+}
+
+// initialToken returns the token to start with, read from the file at
+// doAccessTokenPathEnv if set and from doAccessTokenEnv otherwise.
+func initialToken() (string, error) {
+	if path := os.Getenv(doAccessTokenPathEnv); path != "" {
+		return tokenFromFile(path)
+	}
+
+	if token := os.Getenv(doAccessTokenEnv); token != "" {
+		return token, nil
+	}
+
+	return "", fmt.Errorf("environment variable %q or %q is required", doAccessTokenEnv, doAccessTokenPathEnv)
+}
+
+// initialTokenSource describes where initialToken reads the token from, as
+// shown to operators.
+func initialTokenSource() string {
+	if path := os.Getenv(doAccessTokenPathEnv); path != "" {
+		return fmt.Sprintf("%s file %q", doAccessTokenPathEnv, path)
+	}
+	return doAccessTokenEnv
+}
+
+// tokenFromFile returns the token held by the file at path.
+func tokenFromFile(path string) (string, error) {
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token from %q: %s", path, err)
+	}
+	if t := strings.TrimSpace(string(token)); t != "" {
+		return t, nil
+	}
+	return "", fmt.Errorf("token file %q is empty", path)
+}
+
+// watchTokenFile updates ts with the content of the file at path every
+// period until stopCh is closed.
+func watchTokenFile(ts *rotatingTokenSource, path string, period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		token, err := ioutil.ReadFile(path)
+		if err != nil {
+			glog.Errorf("failed to read token from %q: %s", path, err)
+			return
+		}
+
+		if err := ts.update(context.Background(), string(token), "file "+path); err != nil {
+			glog.Errorf("failed to rotate token: %s", err)
+		}
+	}, period, stopCh)
+}
+
+// parseTokenSecret parses a namespace/name[:key] reference to the key of a
+// Secret holding the token.
+func parseTokenSecret(s string) (namespace, name, key string, err error) {
+	key = defaultTokenSecretKey
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		s, key = s[:i], s[i+1:]
+	}
+
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || key == "" {
+		return "", "", "", errors.New("format should be: namespace/name[:key]")
+	}
+
+	return parts[0], parts[1], key, nil
+}
+
+// tokenSecretHandler returns a function updating ts with the token held at
+// key of the Secret it is given.
+func tokenSecretHandler(ts *rotatingTokenSource, key string) func(obj interface{}) {
+	return func(obj interface{}) {
+		secret, ok := obj.(*v1.Secret)
+		if !ok {
+			return
+		}
+
+		source := fmt.Sprintf("secret %s/%s", secret.Namespace, secret.Name)
+		token, ok := secret.Data[key]
+		if !ok {
+			glog.Errorf("%s has no key %q", source, key)
+			return
+		}
+
+		if err := ts.update(context.Background(), string(token), source); err != nil {
+			glog.Errorf("failed to rotate token: %s", err)
+		}
+	}
+}
+
+// watchTokenSecret updates ts whenever the Secret referenced by ref changes,
+// until stopCh is closed.
+func watchTokenSecret(ts *rotatingTokenSource, kclient kubernetes.Interface, ref string, stopCh <-chan struct{}) error {
+	namespace, name, key, err := parseTokenSecret(ref)
+	if err != nil {
+		return fmt.Errorf("invalid %q: %s", doAccessTokenSecretEnv, err)
+	}
+
+	factory := informers.NewFilteredSharedInformerFactory(kclient, 0, namespace, func(opts *metav1.ListOptions) {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+	})
+
+	handler := tokenSecretHandler(ts, key)
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: handler,
+		UpdateFunc: func(_, obj interface{}) {
+			handler(obj)
+		},
+	})
+
+	factory.Start(stopCh)
+	return nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func validTokens(tokens ...string) tokenValidator {
+	return func(_ context.Context, token string) error {
+		for _, t := range tokens {
+			if t == token {
+				return nil
+			}
+		}
+		return errors.New("unauthorized")
+	}
+}
+
+func currentToken(t *testing.T, ts oauth2.TokenSource) string {
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return token.AccessToken
+}
+
+func Test_rotatingTokenSource(t *testing.T) {
+	ts := newRotatingTokenSource("old", validTokens("old", "new"))
+
+	if err := ts.update(context.TODO(), "bad", "test"); err == nil {
+		t.Error("expected invalid token to be rejected")
+	}
+	if got := currentToken(t, ts); got != "old" {
+		t.Errorf("expected last good token to be kept, got %q", got)
+	}
+
+	if err := ts.update(context.TODO(), "", "test"); err == nil {
+		t.Error("expected empty token to be rejected")
+	}
+
+	if err := ts.update(context.TODO(), "new\n", "test"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := currentToken(t, ts); got != "new" {
+		t.Errorf("expected rotated token, got %q", got)
+	}
+}
+
+func Test_rotatingTokenSource_transport(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	ts := newRotatingTokenSource("old", validTokens("new"))
+	client := &http.Client{Transport: &oauth2.Transport{Source: ts}}
+
+	for _, want := range []string{"old", "new"} {
+		if err := ts.update(context.TODO(), want, "test"); want != "old" && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+
+		if auth != "Bearer "+want {
+			t.Errorf("expected requests to use token %q, got %q", want, auth)
+		}
+	}
+}
+
+func Test_initialToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Unsetenv(doAccessTokenEnv)
+	defer os.Unsetenv(doAccessTokenPathEnv)
+
+	os.Unsetenv(doAccessTokenEnv)
+	os.Unsetenv(doAccessTokenPathEnv)
+	if _, err := initialToken(); err == nil {
+		t.Error("expected error without any token")
+	}
+
+	os.Setenv(doAccessTokenEnv, "from-env")
+	if token, err := initialToken(); err != nil || token != "from-env" {
+		t.Errorf("expected token from environment, got %q and error %v", token, err)
+	}
+	if source := initialTokenSource(); source != doAccessTokenEnv {
+		t.Errorf("expected token source %s, got %s", doAccessTokenEnv, source)
+	}
+
+	os.Setenv(doAccessTokenPathEnv, path)
+	if token, err := initialToken(); err != nil || token != "from-file" {
+		t.Errorf("expected token file to take precedence, got %q and error %v", token, err)
+	}
+	if source := initialTokenSource(); !strings.Contains(source, path) {
+		t.Errorf("expected token source to name %s, got %s", path, source)
+	}
+}
+
+func Test_watchTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newRotatingTokenSource("old", validTokens("new"))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watchTokenFile(ts, path, 10*time.Millisecond, stopCh)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for currentToken(t, ts) != "new" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected token to be rotated from file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_parseTokenSecret(t *testing.T) {
+	testcases := []struct {
+		ref                  string
+		namespace, name, key string
+		err                  bool
+	}{
+		{"kube-system/digitalocean", "kube-system", "digitalocean", "access-token", false},
+		{"kube-system/digitalocean:token", "kube-system", "digitalocean", "token", false},
+		{"digitalocean", "", "", "", true},
+		{"kube-system/digitalocean:", "", "", "", true},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.ref, func(t *testing.T) {
+			namespace, name, key, err := parseTokenSecret(test.ref)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if namespace != test.namespace || name != test.name || key != test.key {
+				t.Errorf("expected %s/%s:%s, got %s/%s:%s", test.namespace, test.name, test.key, namespace, name, key)
+			}
+		})
+	}
+}
+
+func Test_tokenSecretHandler(t *testing.T) {
+	ts := newRotatingTokenSource("old", validTokens("new"))
+	handler := tokenSecretHandler(ts, "access-token")
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "digitalocean"},
+		Data:       map[string][]byte{"access-token": []byte("bad")},
+	}
+	handler(secret)
+	if got := currentToken(t, ts); got != "old" {
+		t.Errorf("expected last good token to be kept, got %q", got)
+	}
+
+	secret.Data["access-token"] = []byte("new")
+	handler(secret)
+	if got := currentToken(t, ts); got != "new" {
+		t.Errorf("expected token to be rotated from secret, got %q", got)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// nodeConditionDropletActionInProgress is the node condition reporting
+	// whether an action is in progress on the droplet of a node.
+	nodeConditionDropletActionInProgress v1.NodeConditionType = "DropletActionInProgress"
+
+	// taintDropletActionInProgress is the NoSchedule taint placed on nodes
+	// while an action is in progress on their droplet.
+	taintDropletActionInProgress = "node.digitalocean.com/droplet-action-in-progress"
+
+	// droplet statuses in which the droplet is not ready to run workloads.
+	dropletNewStatus     = "new"
+	dropletArchiveStatus = "archive"
+
+	// defaultDropletActionsSyncPeriod is the default interval between two
+	// polls of droplet action state.
+	defaultDropletActionsSyncPeriod = 30 * time.Second
+)
+
+// dropletActionState describes whether an action is in progress on a droplet.
+type dropletActionState struct {
+	inProgress bool
+	reason     string
+	message    string
+}
+
+// camelCase turns the snake cased action type s into a CamelCase reason,
+// e.g. power_cycle into PowerCycle.
+func camelCase(s string) string {
+	parts := strings.Split(s, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+// actionStateOfDroplet returns the action state of droplet given the actions
+// listed for it.
+func actionStateOfDroplet(droplet *godo.Droplet, actions []godo.Action) dropletActionState {
+	for _, action := range actions {
+		if action.Status == godo.ActionInProgress {
+			return dropletActionState{
+				inProgress: true,
+				reason:     camelCase(action.Type),
+				message:    fmt.Sprintf("Droplet %d action %s (%d) is in progress", droplet.ID, action.Type, action.ID),
+			}
+		}
+	}
+
+	switch {
+	case droplet.Status == dropletNewStatus:
+		return dropletActionState{
+			inProgress: true,
+			reason:     "DropletNew",
+			message:    fmt.Sprintf("Droplet %d is being created", droplet.ID),
+		}
+	case droplet.Status == dropletArchiveStatus:
+		return dropletActionState{
+			inProgress: true,
+			reason:     "DropletArchived",
+			message:    fmt.Sprintf("Droplet %d is archived", droplet.ID),
+		}
+	case droplet.Locked:
+		return dropletActionState{
+			inProgress: true,
+			reason:     "DropletLocked",
+			message:    fmt.Sprintf("Droplet %d is locked", droplet.ID),
+		}
+	}
+
+	return dropletActionState{
+		reason:  "NoDropletAction",
+		message: fmt.Sprintf("No action is in progress on droplet %d", droplet.ID),
+	}
+}
+
+// setDropletActionCondition returns a copy of node with the
+// DropletActionInProgress condition reflecting state, and whether the
+// condition changed.
+func setDropletActionCondition(node *v1.Node, state dropletActionState, now metav1.Time) (*v1.Node, bool) {
+	status := v1.ConditionFalse
+	if state.inProgress {
+		status = v1.ConditionTrue
+	}
+
+	updated := node.DeepCopy()
+	for i := range updated.Status.Conditions {
+		cond := &updated.Status.Conditions[i]
+		if cond.Type != nodeConditionDropletActionInProgress {
+			continue
+		}
+
+		if cond.Status == status && cond.Reason == state.reason && cond.Message == state.message {
+			return updated, false
+		}
+
+		if cond.Status != status {
+			cond.LastTransitionTime = now
+		}
+		cond.Status = status
+		cond.Reason = state.reason
+		cond.Message = state.message
+		cond.LastHeartbeatTime = now
+
+		return updated, true
+	}
+
+	if !state.inProgress {
+		// no need to report the absence of actions on nodes which never had
+		// one.
+		return updated, false
+	}
+
+	updated.Status.Conditions = append(updated.Status.Conditions, v1.NodeCondition{
+		Type:               nodeConditionDropletActionInProgress,
+		Status:             status,
+		Reason:             state.reason,
+		Message:            state.message,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+	})
+
+	return updated, true
+}
+
+// setDropletActionTaint returns a copy of node carrying the
+// taintDropletActionInProgress taint if inProgress is true and lacking it
+// otherwise, and whether the taints changed.
+func setDropletActionTaint(node *v1.Node, inProgress bool) (*v1.Node, bool) {
+	updated := node.DeepCopy()
+
+	var taints []v1.Taint
+	found := false
+	for _, taint := range updated.Spec.Taints {
+		if taint.Key == taintDropletActionInProgress && taint.Effect == v1.TaintEffectNoSchedule {
+			found = true
+			if !inProgress {
+				continue
+			}
+		}
+		taints = append(taints, taint)
+	}
+
+	if found == inProgress {
+		return updated, false
+	}
+
+	if inProgress {
+		taints = append(taints, v1.Taint{
+			Key:    taintDropletActionInProgress,
+			Effect: v1.TaintEffectNoSchedule,
+		})
+	}
+	updated.Spec.Taints = taints
+
+	return updated, true
+}
+
+// dropletActionsController surfaces in-progress droplet actions as node
+// conditions and taints.
+type dropletActionsController struct {
+	client           *godo.Client
+	kclient          kubernetes.Interface
+	nodeLister       corelisters.NodeLister
+	nodeListerSynced cache.InformerSynced
+	syncPeriod       time.Duration
+
+	// dropletTag restricts the droplets whose actions are reported to those
+	// carrying it, if set.
+	dropletTag string
+}
+
+// newDropletActionsController returns a new dropletActionsController.
+func newDropletActionsController(client *godo.Client, kclient kubernetes.Interface, nodeLister corelisters.NodeLister, nodeListerSynced cache.InformerSynced, syncPeriod time.Duration) *dropletActionsController {
+	return &dropletActionsController{
+		client:           client,
+		kclient:          kclient,
+		nodeLister:       nodeLister,
+		nodeListerSynced: nodeListerSynced,
+		syncPeriod:       syncPeriod,
+	}
+}
+
+// Run polls droplet action state every sync period until stopCh is closed.
+func (c *dropletActionsController) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.nodeListerSynced) {
+		glog.Error("failed to sync node cache for droplet actions controller")
+		return
+	}
+
+	wait.Until(func() {
+		if err := c.sync(context.Background()); err != nil {
+			glog.Errorf("failed to sync droplet actions onto nodes: %s", err)
+		}
+	}, c.syncPeriod, stopCh)
+}
+
+// sync reconciles the droplet action condition and taint of all nodes.
+func (c *dropletActionsController) sync(ctx context.Context) error {
+	droplets, err := dropletList(ctx, c.client, c.dropletTag)
+	if err != nil {
+		return fmt.Errorf("failed to list droplets: %s", err)
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %s", err)
+	}
+
+	for _, node := range nodes {
+		droplet := dropletForNode(node, droplets)
+		if droplet == nil {
+			continue
+		}
+
+		var actions []godo.Action
+		if droplet.Locked {
+			// actions are only looked up for locked droplets, which is
+			// the case while an action is in progress.
+			actions, _, err = c.client.Droplets.Actions(ctx, droplet.ID, &godo.ListOptions{PerPage: apiPerPage})
+			if err != nil {
+				glog.Errorf("failed to list actions of droplet %d: %s", droplet.ID, err)
+			}
+		}
+
+		if err := c.syncNode(node, actionStateOfDroplet(droplet, actions)); err != nil {
+			glog.Errorf("failed to sync droplet action state of node %s: %s", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// syncNode updates the condition and taint of node according to state.
+func (c *dropletActionsController) syncNode(node *v1.Node, state dropletActionState) error {
+	updated, changed := setDropletActionCondition(node, state, metav1.Now())
+	if changed {
+		var err error
+		updated, err = c.kclient.CoreV1().Nodes().UpdateStatus(updated)
+		if err != nil {
+			return fmt.Errorf("failed to update node condition: %s", err)
+		}
+		glog.V(2).Infof("droplet action state of node %s changed: %s", node.Name, state.message)
+	}
+
+	updated, changed = setDropletActionTaint(updated, state.inProgress)
+	if changed {
+		if _, err := c.kclient.CoreV1().Nodes().Update(updated); err != nil {
+			return fmt.Errorf("failed to update node taints: %s", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_actionStateOfDroplet(t *testing.T) {
+	testcases := []struct {
+		name       string
+		droplet    *godo.Droplet
+		actions    []godo.Action
+		inProgress bool
+		reason     string
+	}{
+		{
+			"active droplet",
+			&godo.Droplet{ID: 1, Status: "active"},
+			nil,
+			false,
+			"NoDropletAction",
+		},
+		{
+			"resize in progress",
+			&godo.Droplet{ID: 1, Status: "off", Locked: true},
+			[]godo.Action{
+				{ID: 1, Type: "power_off", Status: godo.ActionCompleted},
+				{ID: 2, Type: "resize", Status: godo.ActionInProgress},
+			},
+			true,
+			"Resize",
+		},
+		{
+			"power cycle in progress",
+			&godo.Droplet{ID: 1, Status: "active", Locked: true},
+			[]godo.Action{{ID: 3, Type: "power_cycle", Status: godo.ActionInProgress}},
+			true,
+			"PowerCycle",
+		},
+		{
+			"locked without listed action",
+			&godo.Droplet{ID: 1, Status: "active", Locked: true},
+			nil,
+			true,
+			"DropletLocked",
+		},
+		{
+			"new droplet",
+			&godo.Droplet{ID: 1, Status: "new"},
+			nil,
+			true,
+			"DropletNew",
+		},
+		{
+			"archived droplet",
+			&godo.Droplet{ID: 1, Status: "archive"},
+			nil,
+			true,
+			"DropletArchived",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			state := actionStateOfDroplet(test.droplet, test.actions)
+			if state.inProgress != test.inProgress {
+				t.Errorf("expected in progress to be %t, got %t", test.inProgress, state.inProgress)
+			}
+			if state.reason != test.reason {
+				t.Errorf("expected reason %q, got %q", test.reason, state.reason)
+			}
+		})
+	}
+}
+
+func Test_setDropletActionCondition(t *testing.T) {
+	now := metav1.NewTime(time.Unix(100, 0))
+	later := metav1.NewTime(time.Unix(200, 0))
+	inProgress := dropletActionState{inProgress: true, reason: "Resize", message: "resizing"}
+	done := dropletActionState{reason: "NoDropletAction", message: "done"}
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+
+	if _, changed := setDropletActionCondition(node, done, now); changed {
+		t.Error("expected no condition to be added for idle droplet")
+	}
+
+	node, changed := setDropletActionCondition(node, inProgress, now)
+	if !changed {
+		t.Fatal("expected condition to be added")
+	}
+	want := []v1.NodeCondition{{
+		Type:               nodeConditionDropletActionInProgress,
+		Status:             v1.ConditionTrue,
+		Reason:             "Resize",
+		Message:            "resizing",
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+	}}
+	if !reflect.DeepEqual(node.Status.Conditions, want) {
+		t.Error("unexpected conditions")
+		t.Logf("expected: %v", want)
+		t.Logf("actual: %v", node.Status.Conditions)
+	}
+
+	if _, changed := setDropletActionCondition(node, inProgress, later); changed {
+		t.Error("expected unchanged state not to update condition")
+	}
+
+	node, changed = setDropletActionCondition(node, done, later)
+	if !changed {
+		t.Fatal("expected condition to be cleared")
+	}
+	cond := node.Status.Conditions[0]
+	if cond.Status != v1.ConditionFalse || cond.LastTransitionTime != later {
+		t.Errorf("unexpected cleared condition: %v", cond)
+	}
+}
+
+func Test_setDropletActionTaint(t *testing.T) {
+	userTaint := v1.Taint{Key: "user", Effect: v1.TaintEffectNoExecute}
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Spec:       v1.NodeSpec{Taints: []v1.Taint{userTaint}},
+	}
+
+	node, changed := setDropletActionTaint(node, true)
+	if !changed {
+		t.Fatal("expected taint to be added")
+	}
+	want := []v1.Taint{userTaint, {Key: taintDropletActionInProgress, Effect: v1.TaintEffectNoSchedule}}
+	if !reflect.DeepEqual(node.Spec.Taints, want) {
+		t.Error("unexpected taints")
+		t.Logf("expected: %v", want)
+		t.Logf("actual: %v", node.Spec.Taints)
+	}
+
+	if _, changed := setDropletActionTaint(node, true); changed {
+		t.Error("expected taint not to be added twice")
+	}
+
+	node, changed = setDropletActionTaint(node, false)
+	if !changed {
+		t.Fatal("expected taint to be removed")
+	}
+	if !reflect.DeepEqual(node.Spec.Taints, []v1.Taint{userTaint}) {
+		t.Errorf("unexpected taints after removal: %v", node.Spec.Taints)
+	}
+}
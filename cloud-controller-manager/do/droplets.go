@@ -25,10 +25,13 @@ import (
 	"strings"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/kubernetes/pkg/cloudprovider"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
 )
 
 const (
@@ -36,12 +39,28 @@ const (
 )
 
 type instances struct {
-	client *godo.Client
-	region string
+	accounts *accounts
+	region   string
+
+	// notFound confirms droplets are gone before reporting them as such.
+	notFound *notFoundTracker
+
+	// recorder and nodeLister are used to record events on nodes pending
+	// deletion. They are set once the cloud is initialized.
+	recorder   record.EventRecorder
+	nodeLister corelisters.NodeLister
+
+	// floatingIPs reports the floating IPs assigned to droplets as
+	// additional external addresses when true.
+	floatingIPs bool
 }
 
-func newInstances(client *godo.Client, region string) cloudprovider.Instances {
-	return &instances{client, region}
+func newInstances(accounts *accounts, region string) *instances {
+	return &instances{
+		accounts: accounts,
+		region:   region,
+		notFound: newNotFoundTracker(defaultDeletionConfirmations, defaultDeletionWindow),
+	}
 }
 
 // NodeAddresses returns all the valid addresses of the droplet identified by
@@ -50,12 +69,12 @@ func newInstances(client *godo.Client, region string) cloudprovider.Instances {
 // When nodeName identifies more than one droplet, only the first will be
 // considered.
 func (i *instances) NodeAddresses(ctx context.Context, nodeName types.NodeName) ([]v1.NodeAddress, error) {
-	droplet, err := dropletByName(ctx, i.client, nodeName)
+	droplet, acc, err := i.accounts.dropletByName(ctx, nodeName)
 	if err != nil {
 		return nil, err
 	}
 
-	return nodeAddresses(droplet)
+	return i.nodeAddresses(ctx, acc, droplet)
 }
 
 // NodeAddressesByProviderID returns all the valid addresses of the droplet
@@ -67,12 +86,34 @@ func (i *instances) NodeAddressesByProviderID(ctx context.Context, providerID st
 		return nil, err
 	}
 
-	droplet, err := dropletByID(ctx, i.client, id)
+	droplet, acc, err := i.accounts.dropletByID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	return nodeAddresses(droplet)
+	return i.nodeAddresses(ctx, acc, droplet)
+}
+
+// nodeAddresses returns the addresses of droplet in acc, including its
+// floating IPs if enabled.
+func (i *instances) nodeAddresses(ctx context.Context, acc *account, droplet *godo.Droplet) ([]v1.NodeAddress, error) {
+	addresses, err := nodeAddresses(droplet)
+	if err != nil || !i.floatingIPs {
+		return addresses, err
+	}
+
+	fips, err := allFloatingIPList(ctx, acc.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list floating IPs: %s", err)
+	}
+
+	for _, fip := range fips {
+		if fip.Droplet != nil && fip.Droplet.ID == droplet.ID {
+			addresses = append(addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: fip.IP})
+		}
+	}
+
+	return addresses, nil
 }
 
 // ExternalID returns the cloud provider ID of the droplet identified by
@@ -87,7 +128,7 @@ func (i *instances) ExternalID(ctx context.Context, nodeName types.NodeName) (st
 
 // InstanceID returns the cloud provider ID of the droplet identified by nodeName.
 func (i *instances) InstanceID(ctx context.Context, nodeName types.NodeName) (string, error) {
-	droplet, err := dropletByName(ctx, i.client, nodeName)
+	droplet, _, err := i.accounts.dropletByName(ctx, nodeName)
 	if err != nil {
 		return "", err
 	}
@@ -96,7 +137,7 @@ func (i *instances) InstanceID(ctx context.Context, nodeName types.NodeName) (st
 
 // InstanceType returns the type of the droplet identified by name.
 func (i *instances) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
-	droplet, err := dropletByName(ctx, i.client, name)
+	droplet, _, err := i.accounts.dropletByName(ctx, name)
 	if err != nil {
 		return "", err
 	}
@@ -111,7 +152,7 @@ func (i *instances) InstanceTypeByProviderID(ctx context.Context, providerID str
 		return "", err
 	}
 
-	droplet, err := dropletByID(ctx, i.client, id)
+	droplet, _, err := i.accounts.dropletByID(ctx, id)
 	if err != nil {
 		return "", err
 	}
@@ -131,6 +172,11 @@ func (i *instances) CurrentNodeName(ctx context.Context, hostname string) (types
 
 // InstanceExistsByProviderID returns true if the droplet identified by
 // providerID is running.
+//
+// A droplet that cannot be found in any account is cross-checked against the
+// list of all droplets of the accounts and only reported missing after it was
+// confirmed gone by consecutive observations, see notFoundTracker. Until then,
+// an event is recorded on the node and the droplet is reported as existing.
 func (i *instances) InstanceExistsByProviderID(ctx context.Context, providerID string) (bool, error) {
 	// NOTE: when false is returned with no error, the instance will be
 	// immediately deleted by the cloud controller manager.
@@ -140,8 +186,9 @@ func (i *instances) InstanceExistsByProviderID(ctx context.Context, providerID s
 		return false, err
 	}
 
-	_, err = dropletByID(ctx, i.client, id)
+	_, _, err = i.accounts.dropletByID(ctx, id)
 	if err == nil {
+		i.notFound.reset(id)
 		return true, nil
 	}
 
@@ -154,7 +201,51 @@ func (i *instances) InstanceExistsByProviderID(ctx context.Context, providerID s
 		return false, fmt.Errorf("error checking if instance exists: %v", err)
 	}
 
-	return false, nil
+	droplets, err := i.accounts.allDroplets(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error cross-checking droplet list for missing droplet %s: %v", id, err)
+	}
+
+	for _, droplet := range droplets {
+		if strconv.Itoa(droplet.ID) == id {
+			glog.Warningf("droplet %s reported as not found but is present in droplet list", id)
+			i.notFound.reset(id)
+			return true, nil
+		}
+	}
+
+	confirmed, count := i.notFound.observe(id)
+	if confirmed {
+		glog.Infof("droplet %s confirmed not found after %d observations", id, count)
+		return false, nil
+	}
+
+	i.recordPendingDeletion(providerID, fmt.Sprintf("Droplet %s not found (%d/%d observations within %s), node deletion pending", id, count, i.notFound.threshold, i.notFound.window))
+
+	return true, nil
+}
+
+// recordPendingDeletion records a warning event with message on the node
+// identified by providerID.
+func (i *instances) recordPendingDeletion(providerID, message string) {
+	glog.Warning(message)
+
+	if i.recorder == nil || i.nodeLister == nil {
+		return
+	}
+
+	nodes, err := i.nodeLister.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("failed to list nodes to record pending deletion: %s", err)
+		return
+	}
+
+	for _, node := range nodes {
+		if node.Spec.ProviderID == providerID {
+			i.recorder.Event(node, v1.EventTypeWarning, "DropletNotFound", message)
+			return
+		}
+	}
 }
 
 // InstanceShutdownByProviderID returns true if the droplet is turned off
@@ -164,7 +255,7 @@ func (i *instances) InstanceShutdownByProviderID(ctx context.Context, providerID
 		return false, fmt.Errorf("error getting droplet ID from provider ID %s, err: %v", providerID, err)
 	}
 
-	droplet, err := dropletByID(ctx, i.client, dropletID)
+	droplet, _, err := i.accounts.dropletByID(ctx, dropletID)
 	if err != nil {
 		return false, fmt.Errorf("error getting droplet %s by ID: %s", dropletID, err)
 	}
@@ -187,30 +278,22 @@ func dropletByID(ctx context.Context, client *godo.Client, id string) (*godo.Dro
 	return droplet, nil
 }
 
-// dropletByName returns a *godo.Droplet for the droplet identified by nodeName.
-//
-// When nodeName identifies more than one droplet, only the first will be
-// considered.
-func dropletByName(ctx context.Context, client *godo.Client, nodeName types.NodeName) (*godo.Droplet, error) {
-	// TODO (andrewsykim): list by tag once a tagging format is determined
-	droplets, err := allDropletList(ctx, client)
-	if err != nil {
-		return nil, err
-	}
-
+// findDropletByName returns the first of droplets identified by nodeName,
+// either by name or by address, or nil if there is none.
+func findDropletByName(droplets []godo.Droplet, nodeName types.NodeName) *godo.Droplet {
 	for _, droplet := range droplets {
 		if droplet.Name == string(nodeName) {
-			return &droplet, nil
+			return &droplet
 		}
 		addresses, _ := nodeAddresses(&droplet)
 		for _, address := range addresses {
 			if address.Address == string(nodeName) {
-				return &droplet, nil
+				return &droplet
 			}
 		}
 	}
 
-	return nil, cloudprovider.InstanceNotFound
+	return nil
 }
 
 // dropletIDFromProviderID returns a droplet's ID from providerID.
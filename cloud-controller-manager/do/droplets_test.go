@@ -20,15 +20,19 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strconv"
 	"testing"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/kubernetes/pkg/cloudprovider"
 
 	"github.com/digitalocean/godo"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
 )
 
 type fakeDropletService struct {
@@ -181,7 +185,7 @@ func TestNodeAddresses(t *testing.T) {
 	}
 
 	client := newFakeClient(fake)
-	instances := newInstances(client, "nyc1")
+	instances := newInstances(singleAccount(client), "nyc1")
 
 	expectedAddresses := []v1.NodeAddress{
 		{
@@ -217,7 +221,7 @@ func TestNodeAddressesByProviderID(t *testing.T) {
 		return droplet, resp, nil
 	}
 	client := newFakeClient(fake)
-	instances := newInstances(client, "nyc1")
+	instances := newInstances(singleAccount(client), "nyc1")
 
 	expectedAddresses := []v1.NodeAddress{
 		{
@@ -256,7 +260,7 @@ func TestInstanceID(t *testing.T) {
 	}
 
 	client := newFakeClient(fake)
-	instances := newInstances(client, "nyc1")
+	instances := newInstances(singleAccount(client), "nyc1")
 
 	id, err := instances.InstanceID(context.TODO(), "test-droplet")
 	if err != nil {
@@ -279,7 +283,7 @@ func TestInstanceType(t *testing.T) {
 	}
 
 	client := newFakeClient(fake)
-	instances := newInstances(client, "nyc1")
+	instances := newInstances(singleAccount(client), "nyc1")
 
 	instanceType, err := instances.InstanceType(context.TODO(), "test-droplet")
 	if err != nil {
@@ -300,7 +304,7 @@ func Test_InstanceShutdownByProviderID(t *testing.T) {
 	}
 
 	client := newFakeClient(fake)
-	instances := newInstances(client, "nyc1")
+	instances := newInstances(singleAccount(client), "nyc1")
 
 	shutdown, err := instances.InstanceShutdownByProviderID(context.TODO(), "digitalocean://123")
 	if err != nil {
@@ -363,3 +367,109 @@ func Test_dropletIDFromProviderID(t *testing.T) {
 	}
 
 }
+
+func Test_dropletForNode(t *testing.T) {
+	droplets := []godo.Droplet{
+		{ID: 1, Name: "node-a"},
+		{ID: 2, Name: "node-b"},
+	}
+
+	testcases := []struct {
+		name       string
+		nodeName   string
+		providerID string
+		dropletID  int
+	}{
+		{"by providerID", "node-a", "digitalocean://2", 2},
+		{"by name without providerID", "node-a", "", 1},
+		{"by name with invalid providerID", "node-b", "aws://2", 2},
+		// a droplet with the node's name, e.g. in another account, is not
+		// the droplet the node runs on.
+		{"providerID of another droplet", "node-a", "digitalocean://3", 0},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			node := &v1.Node{}
+			node.Name = test.nodeName
+			node.Spec.ProviderID = test.providerID
+
+			droplet := dropletForNode(node, droplets)
+			if test.dropletID == 0 {
+				if droplet != nil {
+					t.Errorf("expected no droplet, got %d", droplet.ID)
+				}
+				return
+			}
+			if droplet == nil || droplet.ID != test.dropletID {
+				t.Errorf("expected droplet %d, got %v", test.dropletID, droplet)
+			}
+		})
+	}
+}
+
+// Test_instances_cassette replays a recording of an account with more
+// droplets than fit in a page, one of them powered off. It is recorded with
+// droplets node-0 to node-104 and node-1 powered off.
+func Test_instances_cassette(t *testing.T) {
+	client, done := cassetteClient(t, "droplets", func(fake *fakedo.Server) {
+		for n := 0; n < apiPerPage+5; n++ {
+			status := "active"
+			if n == 1 {
+				status = "off"
+			}
+			fake.AddDroplet(godo.Droplet{
+				Name:     fmt.Sprintf("node-%d", n),
+				Status:   status,
+				Region:   &godo.Region{Slug: "nyc1"},
+				SizeSlug: "s-1vcpu-1gb",
+				Networks: &godo.Networks{
+					V4: []godo.NetworkV4{
+						{IPAddress: fmt.Sprintf("10.0.0.%d", n+1), Type: "private"},
+						{IPAddress: fmt.Sprintf("192.0.2.%d", n+1), Type: "public"},
+					},
+				},
+			})
+		}
+	}, "")
+	defer done()
+
+	ctx := context.TODO()
+	instances := newInstances(singleAccount(client), "nyc1")
+	instances.notFound = newNotFoundTracker(1, 0)
+
+	// node-104 is on the second page.
+	droplets, err := allDropletList(ctx, client)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ids := map[string]string{}
+	for _, d := range droplets {
+		ids[d.Name] = "digitalocean://" + strconv.Itoa(d.ID)
+	}
+	if len(ids) != apiPerPage+5 {
+		t.Fatalf("expected droplets of all pages, got %d", len(ids))
+	}
+
+	addresses, err := instances.NodeAddressesByProviderID(ctx, ids["node-104"])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(addresses, []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "node-104"},
+		{Type: v1.NodeInternalIP, Address: "10.0.0.105"},
+		{Type: v1.NodeExternalIP, Address: "192.0.2.105"},
+	}) {
+		t.Errorf("unexpected addresses %v", addresses)
+	}
+
+	shutdown, err := instances.InstanceShutdownByProviderID(ctx, ids["node-1"])
+	if err != nil || !shutdown {
+		t.Errorf("expected node-1 to be shut down, got %t and %v", shutdown, err)
+	}
+
+	exists, err := instances.InstanceExistsByProviderID(ctx, "digitalocean://999999999")
+	if err != nil || exists {
+		t.Errorf("expected missing droplet not to exist, got %t and %v", exists, err)
+	}
+}
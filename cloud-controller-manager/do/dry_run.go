@@ -0,0 +1,245 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// dryRunID is the ID of resources which would have been created.
+	dryRunID = "dry-run"
+	// dryRunFloatingIP is the IP of floating IPs which would have been
+	// allocated.
+	dryRunFloatingIP = "0.0.0.0"
+)
+
+// dryRunTransport is an http.RoundTripper passing reads through to the
+// DigitalOcean API and logging, instead of performing, every mutating call.
+// Mutating calls are answered with a minimal successful response so that
+// callers carry on as if the call had succeeded.
+//
+// When autoDegrade is set, mutating calls are performed until the API
+// rejects one as forbidden, e.g. with a read-only token, after which the
+// transport switches to dry-run until the token changes.
+type dryRunTransport struct {
+	base        http.RoundTripper
+	account     string
+	autoDegrade bool
+
+	mu      sync.Mutex
+	enabled bool
+	// degraded is set once dry-run was entered automatically because a call
+	// with the authorization degradedAuth was forbidden.
+	degraded     bool
+	degradedAuth string
+	// fabricated holds the bodies of resources which would have been
+	// created, by path, so that reading them back succeeds.
+	fabricated map[string][]byte
+}
+
+// newDryRunTransport returns a dryRunTransport sending requests for account
+// through base. enabled turns dry-run on from the start.
+func newDryRunTransport(base http.RoundTripper, account string, enabled, autoDegrade bool) *dryRunTransport {
+	t := &dryRunTransport{
+		base:        base,
+		account:     account,
+		enabled:     enabled,
+		autoDegrade: autoDegrade,
+		fabricated:  map[string][]byte{},
+	}
+	t.reportMode()
+
+	return t
+}
+
+// reportMode sets dryRunMode of the account to whether dry-run is on. The
+// caller must hold t.mu or own t exclusively.
+func (t *dryRunTransport) reportMode() {
+	on := 0.0
+	if t.enabled || t.degraded {
+		on = 1
+	}
+	dryRunMode.WithLabelValues(t.account).Set(on)
+}
+
+// isMutating returns true if method changes resources.
+func isMutating(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if t.degraded && req.Header.Get("Authorization") != t.degradedAuth {
+		glog.Infof("dry-run: token of account %q changed, leaving dry-run mode", t.account)
+		t.degraded = false
+		t.degradedAuth = ""
+		t.reportMode()
+	}
+	enabled := t.enabled || t.degraded
+	body, fabricated := t.fabricated[req.URL.Path]
+	t.mu.Unlock()
+
+	if !isMutating(req.Method) {
+		if enabled && fabricated {
+			return dryRunResponse(req, http.StatusOK, body), nil
+		}
+		return t.base.RoundTrip(req)
+	}
+
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	if !enabled {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !t.autoDegrade || resp.StatusCode != http.StatusForbidden {
+			return resp, err
+		}
+
+		resp.Body.Close()
+		glog.Warningf("dry-run: %s %s was forbidden, switching account %q to dry-run mode until its token changes as the token appears to be read-only", req.Method, req.URL.Path, t.account)
+
+		t.mu.Lock()
+		t.degraded = true
+		t.degradedAuth = req.Header.Get("Authorization")
+		t.reportMode()
+		t.mu.Unlock()
+	}
+
+	return t.intercept(req, reqBody), nil
+}
+
+// intercept logs what req would have done and returns a fabricated
+// response.
+func (t *dryRunTransport) intercept(req *http.Request, reqBody []byte) *http.Response {
+	glog.Infof("dry-run: would %s method=%s path=%s body=%s", dryRunVerb(req), req.Method, req.URL.Path, strings.TrimSpace(string(reqBody)))
+
+	if req.Method == http.MethodDelete {
+		t.mu.Lock()
+		delete(t.fabricated, req.URL.Path)
+		t.mu.Unlock()
+		return dryRunResponse(req, http.StatusNoContent, nil)
+	}
+
+	path, body := dryRunResource(req.URL.Path, reqBody)
+	if path != "" && dryRunVerb(req) == "create" {
+		t.mu.Lock()
+		t.fabricated[path] = body
+		t.mu.Unlock()
+	}
+
+	return dryRunResponse(req, http.StatusOK, body)
+}
+
+// dryRunVerb returns whether req creates, updates or deletes a resource.
+func dryRunVerb(req *http.Request) string {
+	switch req.Method {
+	case http.MethodDelete:
+		return "delete"
+	case http.MethodPost:
+		// posting to a top level collection, e.g. /v2/load_balancers,
+		// creates a resource; other posts act on existing resources.
+		if strings.Count(strings.Trim(req.URL.Path, "/"), "/") == 1 {
+			return "create"
+		}
+	}
+
+	return "update"
+}
+
+// dryRunResource returns the path and body of the resource a mutating call
+// to path with reqBody would have returned. The body holds just enough for
+// the callers in this package to carry on. An empty path is returned if the
+// resource has no path of its own.
+func dryRunResource(path string, reqBody []byte) (string, []byte) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal(reqBody, &req)
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 {
+		return "", []byte("{}")
+	}
+
+	var root string
+	var resource map[string]interface{}
+	switch {
+	case parts[len(parts)-1] == "actions":
+		root, resource = "action", map[string]interface{}{"status": "completed"}
+	case len(parts) <= 3 && parts[1] == "load_balancers":
+		id := dryRunID
+		if len(parts) == 3 {
+			id = parts[2]
+		}
+		root, resource = "load_balancer", map[string]interface{}{"id": id, "name": req.Name, "status": "active"}
+		path = "/v2/load_balancers/" + id
+	case len(parts) <= 3 && parts[1] == "firewalls":
+		id := dryRunID
+		if len(parts) == 3 {
+			id = parts[2]
+		}
+		root, resource = "firewall", map[string]interface{}{"id": id, "name": req.Name}
+		path = "/v2/firewalls/" + id
+	case len(parts) == 2 && parts[1] == "tags":
+		root, resource = "tag", map[string]interface{}{"name": req.Name}
+		path = "/v2/tags/" + req.Name
+	case len(parts) == 2 && parts[1] == "floating_ips":
+		root, resource = "floating_ip", map[string]interface{}{"ip": dryRunFloatingIP}
+		path = "/v2/floating_ips/" + dryRunFloatingIP
+	default:
+		return "", []byte("{}")
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{root: resource})
+	if root == "action" {
+		return "", body
+	}
+
+	return path, body
+}
+
+// dryRunResponse returns a response to req with status and body.
+func dryRunResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/godo"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/oauth2"
+)
+
+// newDryRunTestClient returns a godo client sending requests through a
+// dryRunTransport to a server answering reads and replying with status to
+// writes. The methods of the requests reaching the server are recorded in
+// received.
+func newDryRunTestClient(t *testing.T, enabled, autoDegrade bool, status int) (*godo.Client, *dryRunTransport, *[]string, func()) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Method)
+		if isMutating(r.Method) {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"id":"forbidden","message":"You do not have access for the attempted action."}`))
+			return
+		}
+		w.Write([]byte(`{"load_balancers":[{"id":"lb-1","name":"existing"}],"links":{}}`))
+	}))
+
+	transport := newDryRunTransport(http.DefaultTransport, "default", enabled, autoDegrade)
+	client, err := godo.New(&http.Client{Transport: transport}, godo.SetBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, transport, &received, server.Close
+}
+
+func Test_dryRunTransport(t *testing.T) {
+	client, _, received, closeFn := newDryRunTestClient(t, true, false, http.StatusOK)
+	defer closeFn()
+	ctx := context.TODO()
+
+	lbs, _, err := client.LoadBalancers.List(ctx, nil)
+	if err != nil || len(lbs) != 1 {
+		t.Fatalf("expected reads to pass through, got %v and error %v", lbs, err)
+	}
+
+	lb, _, err := client.LoadBalancers.Create(ctx, &godo.LoadBalancerRequest{Name: "new-lb", Region: "nyc1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lb.ID != dryRunID || lb.Name != "new-lb" || lb.Status != lbStatusActive {
+		t.Errorf("unexpected fabricated load balancer: %+v", lb)
+	}
+
+	// the load balancer which would have been created can be read back.
+	got, _, err := client.LoadBalancers.Get(ctx, lb.ID)
+	if err != nil || got.Name != "new-lb" {
+		t.Errorf("expected fabricated load balancer to be readable, got %+v and error %v", got, err)
+	}
+
+	if _, _, err := client.LoadBalancers.Update(ctx, "lb-1", &godo.LoadBalancerRequest{Name: "existing"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err := client.LoadBalancers.Delete(ctx, "lb-1"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err := client.Tags.TagResources(ctx, "tag", &godo.TagResourcesRequest{}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, _, err := client.DropletActions.PowerCycle(ctx, 1); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	fip, _, err := client.FloatingIPs.Create(ctx, &godo.FloatingIPCreateRequest{Region: "nyc1"})
+	if err != nil || fip.IP != dryRunFloatingIP {
+		t.Errorf("expected fabricated floating IP, got %+v and error %v", fip, err)
+	}
+
+	for _, method := range *received {
+		if method != http.MethodGet {
+			t.Errorf("expected only reads to reach the API, got %s", method)
+		}
+	}
+}
+
+func Test_dryRunTransport_autoDegrade(t *testing.T) {
+	client, transport, received, closeFn := newDryRunTestClient(t, false, true, http.StatusForbidden)
+	defer closeFn()
+	ctx := context.TODO()
+
+	if _, err := client.LoadBalancers.Delete(ctx, "lb-1"); err != nil {
+		t.Fatalf("expected forbidden call to degrade into dry-run, got %s", err)
+	}
+	if !transport.degraded {
+		t.Fatal("expected dry-run to be enabled")
+	}
+
+	if _, err := client.LoadBalancers.Delete(ctx, "lb-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(*received) != 1 {
+		t.Errorf("expected only the first call to reach the API, got %v", *received)
+	}
+}
+
+func Test_dryRunTransport_autoDegradeTokenChange(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"id":"forbidden","message":"You do not have access for the attempted action."}`))
+	}))
+	defer server.Close()
+
+	transport := newDryRunTransport(http.DefaultTransport, "dry-run-test", false, true)
+	token := "read-only"
+	client, err := godo.New(&http.Client{Transport: &oauth2.Transport{
+		Source: tokenSourceFunc(func() (*oauth2.Token, error) {
+			return &oauth2.Token{AccessToken: token}, nil
+		}),
+		Base: transport,
+	}}, godo.SetBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	dryRun := func() float64 {
+		var m dto.Metric
+		if err := dryRunMode.WithLabelValues("dry-run-test").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+	if dryRun() != 0 {
+		t.Error("expected dry-run to be reported off")
+	}
+
+	client.LoadBalancers.Delete(ctx, "lb-1")
+	client.LoadBalancers.Delete(ctx, "lb-1")
+	if len(received) != 1 || dryRun() != 1 {
+		t.Fatalf("expected dry-run to be entered and reported after the forbidden call, got calls %v", received)
+	}
+
+	// a rotated token may be allowed to mutate, so dry-run is left.
+	token = "read-write"
+	if _, err := client.LoadBalancers.Delete(ctx, "lb-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"Bearer read-only", "Bearer read-write"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected the call with the new token to reach the API, got %v", received)
+	}
+}
+
+// tokenSourceFunc is an oauth2.TokenSource returning the tokens of a
+// function.
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
+
+func Test_dryRunTransport_disabled(t *testing.T) {
+	client, _, _, closeFn := newDryRunTestClient(t, false, false, http.StatusForbidden)
+	defer closeFn()
+
+	if _, err := client.LoadBalancers.Delete(context.TODO(), "lb-1"); err == nil {
+		t.Error("expected forbidden error without dry-run")
+	}
+}
+
+func Test_dryRunVerb(t *testing.T) {
+	testcases := []struct {
+		method, path, verb string
+	}{
+		{http.MethodPost, "/v2/load_balancers", "create"},
+		{http.MethodPut, "/v2/load_balancers/lb-1", "update"},
+		{http.MethodPost, "/v2/load_balancers/lb-1/droplets", "update"},
+		{http.MethodPost, "/v2/droplets/1/actions", "update"},
+		{http.MethodDelete, "/v2/load_balancers/lb-1", "delete"},
+	}
+
+	for _, test := range testcases {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if verb := dryRunVerb(req); verb != test.verb {
+			t.Errorf("expected %s %s to %s, got %s", test.method, test.path, test.verb, verb)
+		}
+	}
+}
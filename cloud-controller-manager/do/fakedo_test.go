@@ -0,0 +1,126 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+// newFakeAPI returns a fake DigitalOcean API seeded with a droplet for each
+// of names, along with a client for it.
+func newFakeAPI(t *testing.T, names ...string) (*fakedo.Server, *godo.Client, func()) {
+	fake := fakedo.NewServer()
+	server := httptest.NewServer(fake)
+
+	for i, name := range names {
+		fake.AddDroplet(godo.Droplet{
+			ID:     i + 1,
+			Name:   name,
+			Region: &godo.Region{Slug: "nyc1"},
+			Networks: &godo.Networks{
+				V4: []godo.NetworkV4{
+					{IPAddress: "10.0.0.1", Type: "private"},
+					{IPAddress: "192.0.2.1", Type: "public"},
+				},
+			},
+		})
+	}
+
+	client, err := godo.New(http.DefaultClient, godo.SetBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, client, server.Close
+}
+
+func newScenarioService() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "scenario"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080}},
+		},
+	}
+}
+
+func Test_loadBalancerLifecycle_fakeAPI(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1", "node-2")
+	defer closeFn()
+	ctx := context.TODO()
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	service := newScenarioService()
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	}
+
+	status, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || len(lbs[0].DropletIDs) != 2 {
+		t.Fatalf("expected one load balancer with two droplets, got %v", lbs)
+	}
+	if status.Ingress[0].IP != lbs[0].IP {
+		t.Errorf("expected status to report IP %q, got %v", lbs[0].IP, status)
+	}
+
+	// a failing update surfaces as an error and is retried successfully.
+	fake.AddFault(fakedo.Fault{Method: http.MethodPut, PathPrefix: "/v2/load_balancers/", Status: http.StatusInternalServerError, Times: 1})
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes[:1]); err == nil {
+		t.Error("expected injected fault to fail the update")
+	}
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes[:1]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs[0].DropletIDs) != 1 {
+		t.Errorf("expected one droplet left behind the load balancer, got %v", lbs[0].DropletIDs)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs) != 0 {
+		t.Errorf("expected load balancer to be deleted, got %v", lbs)
+	}
+}
+
+func Test_loadBalancerErrored_fakeAPI(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	fake.SetLoadBalancerTransition(1, fakedo.StatusErrored)
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "cluster", newScenarioService(), nodes); err == nil {
+		t.Error("expected errored load balancer to fail")
+	}
+}
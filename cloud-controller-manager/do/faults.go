@@ -0,0 +1,346 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// defaultFaultSeed seeds the RNG of injected faults unless
+// doDebugFaultsSeedEnv is set, so that runs are reproducible.
+const defaultFaultSeed = 1
+
+// errFaultDropped is returned for requests whose connection was dropped.
+var errFaultDropped = errors.New("fault injection: connection dropped")
+
+// faultRule injects a fault into the requests it matches.
+type faultRule struct {
+	// method matches the request method, or any method if empty.
+	method string
+	// path matches the request path as a path.Match pattern, e.g.
+	// /v2/load_balancers/*.
+	path string
+	// page matches the page query parameter, or any page if zero.
+	page int
+	// probability is the chance of a matching request to be faulted.
+	probability float64
+	// times is the number of requests to fault, or unlimited if zero.
+	times int
+
+	// latency delays the request.
+	latency time.Duration
+	// status is returned instead of sending the request if non zero.
+	status int
+	// drop sends the request but loses its response, as if the connection
+	// dropped before it arrived.
+	drop bool
+	// truncate cuts the items of a list response in half and removes its
+	// links to further pages, so that listing ends early.
+	truncate bool
+}
+
+func (r *faultRule) String() string {
+	return fmt.Sprintf("%s %s", r.method, r.path)
+}
+
+func (r *faultRule) matches(req *http.Request) bool {
+	if r.method != "" && r.method != req.Method {
+		return false
+	}
+
+	if ok, _ := path.Match(r.path, req.URL.Path); !ok {
+		return false
+	}
+
+	if r.page != 0 {
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		if page != r.page {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseFaultRules parses rules separated by semicolons. A rule is a method,
+// or * for any method, a path pattern and space separated options, e.g.
+//
+//	POST /v2/load_balancers status=500 times=1; GET /v2/droplets page=3 drop
+//
+// The options are status=<code>, latency=<duration>, drop, truncate,
+// page=<n>, p=<probability> and times=<n>.
+func parseFaultRules(s string) ([]*faultRule, error) {
+	var rules []*faultRule
+	for _, spec := range strings.Split(s, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("fault %q must have a method, a path and at least one option", strings.TrimSpace(spec))
+		}
+
+		rule := &faultRule{method: strings.ToUpper(fields[0]), path: fields[1], probability: 1}
+		if rule.method == "*" {
+			rule.method = ""
+		}
+		if _, err := path.Match(rule.path, ""); err != nil {
+			return nil, fmt.Errorf("fault %q has an invalid path pattern: %s", strings.TrimSpace(spec), err)
+		}
+
+		injects := false
+		for _, option := range fields[2:] {
+			key, value := option, ""
+			if i := strings.Index(option, "="); i >= 0 {
+				key, value = option[:i], option[i+1:]
+			}
+
+			var err error
+			switch key {
+			case "status":
+				rule.status, err = strconv.Atoi(value)
+				if err == nil && (rule.status < 100 || rule.status > 599) {
+					err = errors.New("not an HTTP status code")
+				}
+				injects = true
+			case "latency":
+				rule.latency, err = time.ParseDuration(value)
+				injects = true
+			case "drop":
+				rule.drop = true
+				injects = true
+			case "truncate":
+				rule.truncate = true
+				injects = true
+			case "page":
+				rule.page, err = strconv.Atoi(value)
+			case "p":
+				rule.probability, err = strconv.ParseFloat(value, 64)
+				if err == nil && (rule.probability < 0 || rule.probability > 1) {
+					err = errors.New("not between 0 and 1")
+				}
+			case "times":
+				rule.times, err = strconv.Atoi(value)
+			default:
+				err = errors.New("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("fault %q has an invalid option %q: %s", strings.TrimSpace(spec), option, err)
+			}
+		}
+
+		if !injects {
+			return nil, fmt.Errorf("fault %q injects nothing, set one of status, latency, drop or truncate", strings.TrimSpace(spec))
+		}
+		if rule.status != 0 && (rule.drop || rule.truncate) {
+			return nil, fmt.Errorf("fault %q cannot both return a status and drop or truncate the response", strings.TrimSpace(spec))
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// faultTransport is an http.RoundTripper injecting faults into the requests
+// matching its rules before passing them on to base. The first matching rule
+// applies. Probabilities are drawn from an RNG with a fixed seed so that a
+// sequence of requests is faulted the same way across runs.
+type faultTransport struct {
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	rules []*faultRule
+}
+
+// newFaultTransport returns a faultTransport sending requests through base.
+func newFaultTransport(base http.RoundTripper, rules []*faultRule, seed int64) *faultTransport {
+	return &faultTransport{
+		base:  base,
+		rng:   rand.New(rand.NewSource(seed)),
+		rules: rules,
+	}
+}
+
+// rule returns the rule applying to req, if any, and consumes it.
+func (t *faultTransport) rule(req *http.Request) *faultRule {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, r := range t.rules {
+		if !r.matches(req) {
+			continue
+		}
+		if r.probability < 1 && t.rng.Float64() >= r.probability {
+			return nil
+		}
+
+		if r.times > 0 {
+			r.times--
+			if r.times == 0 {
+				t.rules = append(t.rules[:i], t.rules[i+1:]...)
+			}
+		}
+
+		return r
+	}
+
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rule := t.rule(req)
+	if rule == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	glog.V(2).Infof("fault injection: faulting %s %s with %s", req.Method, req.URL.RequestURI(), rule)
+
+	if rule.latency > 0 {
+		select {
+		case <-time.After(rule.latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if rule.status != 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return faultResponse(req, rule.status), nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rule.drop {
+		resp.Body.Close()
+		return nil, errFaultDropped
+	}
+
+	if rule.truncate {
+		return truncatePage(resp)
+	}
+
+	return resp, nil
+}
+
+// faultResponse returns a response with status, and with exhausted rate
+// limit headers for status 429.
+func faultResponse(req *http.Request, status int) *http.Response {
+	body, _ := json.Marshal(map[string]string{
+		"id":      "fault_injection",
+		"message": fmt.Sprintf("injected %d response", status),
+	})
+
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if status == http.StatusTooManyRequests {
+		header.Set("RateLimit-Limit", "5000")
+		header.Set("RateLimit-Remaining", "0")
+		header.Set("RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// truncatePage cuts the items of the list in resp in half and removes its
+// links. Responses which are not lists are returned unchanged.
+func truncatePage(resp *http.Response) (*http.Response, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var page map[string]json.RawMessage
+	if err := json.Unmarshal(body, &page); err == nil {
+		for key, value := range page {
+			var items []json.RawMessage
+			if key == "links" || json.Unmarshal(value, &items) != nil {
+				continue
+			}
+			page[key], _ = json.Marshal(items[:len(items)/2])
+			delete(page, "links")
+			body, _ = json.Marshal(page)
+			break
+		}
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+
+	return resp, nil
+}
+
+// faultTransportFromEnv returns base wrapped in a faultTransport configured
+// through the environment, or base itself if no faults are configured.
+func faultTransportFromEnv(base http.RoundTripper) (http.RoundTripper, error) {
+	spec := os.Getenv(doDebugFaultsEnv)
+	if spec == "" {
+		return base, nil
+	}
+
+	rules, err := parseFaultRules(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %s", doDebugFaultsEnv, err)
+	}
+
+	seed := int64(defaultFaultSeed)
+	if s := os.Getenv(doDebugFaultsSeedEnv); s != "" {
+		seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %s", doDebugFaultsSeedEnv, err)
+		}
+	}
+
+	glog.Warningf("fault injection: injecting %d faults into DigitalOcean API calls with seed %d, this is meant for debugging only", len(rules), seed)
+
+	return newFaultTransport(base, rules, seed), nil
+}
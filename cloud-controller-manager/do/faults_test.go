@@ -0,0 +1,305 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+// newFaultyFakeAPI returns a fake DigitalOcean API along with a client for
+// it injecting the faults in spec.
+func newFaultyFakeAPI(t *testing.T, spec string) (*fakedo.Server, *godo.Client, func()) {
+	rules, err := parseFaultRules(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := fakedo.NewServer()
+	server := httptest.NewServer(fake)
+
+	httpClient := &http.Client{Transport: newFaultTransport(http.DefaultTransport, rules, defaultFaultSeed)}
+	client, err := godo.New(httpClient, godo.SetBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, client, server.Close
+}
+
+func Test_parseFaultRules(t *testing.T) {
+	testcases := []struct {
+		name  string
+		spec  string
+		rules []*faultRule
+		err   string
+	}{
+		{
+			name:  "empty",
+			spec:  " ",
+			rules: nil,
+		},
+		{
+			name: "several rules",
+			spec: "post /v2/load_balancers status=429 times=1; * /v2/* latency=200ms p=0.5; GET /v2/droplets page=3 drop truncate",
+			rules: []*faultRule{
+				{method: "POST", path: "/v2/load_balancers", status: 429, times: 1, probability: 1},
+				{method: "", path: "/v2/*", latency: 200 * time.Millisecond, probability: 0.5},
+				{method: "GET", path: "/v2/droplets", page: 3, drop: true, truncate: true, probability: 1},
+			},
+		},
+		{
+			name: "missing options",
+			spec: "GET /v2/droplets",
+			err:  "must have a method, a path and at least one option",
+		},
+		{
+			name: "no fault",
+			spec: "GET /v2/droplets times=2",
+			err:  "injects nothing",
+		},
+		{
+			name: "invalid status",
+			spec: "GET /v2/droplets status=1000",
+			err:  "not an HTTP status code",
+		},
+		{
+			name: "invalid probability",
+			spec: "GET /v2/droplets drop p=2",
+			err:  "not between 0 and 1",
+		},
+		{
+			name: "unknown option",
+			spec: "GET /v2/droplets explode",
+			err:  "unknown option",
+		},
+		{
+			name: "status and drop",
+			spec: "GET /v2/droplets status=500 drop",
+			err:  "cannot both return a status",
+		},
+		{
+			name: "invalid pattern",
+			spec: "GET /v2/[ drop",
+			err:  "invalid path pattern",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseFaultRules(test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(rules, test.rules) {
+				t.Errorf("got rules %+v, want %+v", rules, test.rules)
+			}
+		})
+	}
+}
+
+func Test_faultTransport_status(t *testing.T) {
+	fake, client, closeFn := newFaultyFakeAPI(t, "POST /v2/load_balancers status=429 times=1")
+	defer closeFn()
+	ctx := context.TODO()
+
+	req := &godo.LoadBalancerRequest{
+		Name:            "lb",
+		Region:          "nyc1",
+		ForwardingRules: []godo.ForwardingRule{{EntryProtocol: "tcp", EntryPort: 80, TargetProtocol: "tcp", TargetPort: 30080}},
+	}
+
+	_, resp, err := client.LoadBalancers.Create(ctx, req)
+	if err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected rate limited create, got %v", err)
+	}
+	if resp.Rate.Remaining != 0 {
+		t.Errorf("expected exhausted rate limit, got %+v", resp.Rate)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs) != 0 {
+		t.Errorf("expected rate limited create not to reach the API, got %v", lbs)
+	}
+
+	if _, _, err := client.LoadBalancers.Create(ctx, req); err != nil {
+		t.Errorf("expected fault to apply once, got %s", err)
+	}
+}
+
+func Test_faultTransport_pages(t *testing.T) {
+	testcases := []struct {
+		name     string
+		spec     string
+		droplets int
+		err      bool
+	}{
+		{
+			name:     "failing page",
+			spec:     "GET /v2/droplets page=3 status=503",
+			droplets: 0,
+			err:      true,
+		},
+		{
+			name:     "dropped page",
+			spec:     "GET /v2/droplets page=3 drop",
+			droplets: 0,
+			err:      true,
+		},
+		{
+			name:     "truncated page ends listing early",
+			spec:     "GET /v2/droplets page=2 truncate",
+			droplets: apiPerPage + apiPerPage/2,
+		},
+		{
+			name:     "faults on other pages",
+			spec:     "GET /v2/droplets page=4 status=503",
+			droplets: 2*apiPerPage + 10,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			fake, client, closeFn := newFaultyFakeAPI(t, test.spec)
+			defer closeFn()
+
+			for i := 0; i < 2*apiPerPage+10; i++ {
+				fake.AddDroplet(godo.Droplet{Name: fmt.Sprintf("droplet-%d", i)})
+			}
+
+			droplets, err := allDropletList(context.TODO(), client)
+			if test.err != (err != nil) {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+			if len(droplets) != test.droplets {
+				t.Errorf("expected %d droplets, got %d", test.droplets, len(droplets))
+			}
+		})
+	}
+}
+
+func Test_faultTransport_loadBalancerCreate(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "faults"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080}},
+		},
+	}
+
+	testcases := []struct {
+		name string
+		spec string
+	}{
+		{
+			name: "response to create lost",
+			spec: "POST /v2/load_balancers drop times=1",
+		},
+		{
+			name: "waiting for activation times out",
+			spec: "GET /v2/load_balancers/* latency=10s times=1",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			fake, client, closeFn := newFaultyFakeAPI(t, test.spec)
+			defer closeFn()
+
+			lb := newTestLoadbalancers(client, "nyc1", 1, 1)
+			if _, err := lb.EnsureLoadBalancer(context.TODO(), "cluster", service, nil); err == nil {
+				t.Fatal("expected fault to fail ensuring the load balancer")
+			}
+			if lbs := fake.LoadBalancers(); len(lbs) != 1 {
+				t.Fatalf("expected load balancer to be created despite the fault, got %v", lbs)
+			}
+
+			// the next attempt adopts the load balancer instead of creating
+			// another one.
+			status, err := lb.EnsureLoadBalancer(context.TODO(), "cluster", service, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			lbs := fake.LoadBalancers()
+			if len(lbs) != 1 || status.Ingress[0].IP != lbs[0].IP {
+				t.Errorf("expected the single load balancer to be reported, got %v and %v", status, lbs)
+			}
+		})
+	}
+}
+
+type okTransport struct{}
+
+func (okTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return faultResponse(req, http.StatusOK), nil
+}
+
+func Test_faultTransport_seed(t *testing.T) {
+	sequence := func(seed int64) []int {
+		rules, err := parseFaultRules("GET /v2/account status=500 p=0.5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := newFaultTransport(okTransport{}, rules, seed)
+
+		var statuses []int
+		for i := 0; i < 32; i++ {
+			req, _ := http.NewRequest(http.MethodGet, "https://api.digitalocean.com/v2/account", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			statuses = append(statuses, resp.StatusCode)
+		}
+		return statuses
+	}
+
+	first := sequence(42)
+	if !reflect.DeepEqual(first, sequence(42)) {
+		t.Error("expected the same seed to fault the same requests")
+	}
+	if reflect.DeepEqual(first, sequence(43)) {
+		t.Error("expected another seed to fault other requests")
+	}
+
+	faulted := 0
+	for _, status := range first {
+		if status == http.StatusInternalServerError {
+			faulted++
+		}
+	}
+	if faulted == 0 || faulted == len(first) {
+		t.Errorf("expected about half of the requests to be faulted, got %d of %d", faulted, len(first))
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// annDOLoadBalancerMode is the annotation used to specify how a Service
+	// of type LoadBalancer is exposed. Options are loadbalancer, which
+	// creates a DO load balancer, and floating-ip, which assigns a DO
+	// floating IP to one of the nodes. Defaults to loadbalancer.
+	annDOLoadBalancerMode = "service.beta.kubernetes.io/do-loadbalancer-mode"
+
+	// annDOFloatingIP is the annotation used to specify an existing floating
+	// IP to use in floating-ip mode. If not set, a floating IP is allocated
+	// and released together with the Service.
+	annDOFloatingIP = "service.beta.kubernetes.io/do-floating-ip"
+
+	// annAllocatedFloatingIP is written onto a Service by the provider to
+	// record the floating IP it allocated for the Service. Only the floating
+	// IP recorded in it is released together with the Service.
+	annAllocatedFloatingIP = "kubernetes.digitalocean.com/allocated-floating-ip"
+
+	lbModeLoadBalancer = "loadbalancer"
+	lbModeFloatingIP   = "floating-ip"
+)
+
+// getLoadBalancerMode returns the mode in which service is exposed.
+func getLoadBalancerMode(service *v1.Service) (string, error) {
+	mode, ok := service.Annotations[annDOLoadBalancerMode]
+	if !ok {
+		return lbModeLoadBalancer, nil
+	}
+
+	if mode != lbModeLoadBalancer && mode != lbModeFloatingIP {
+		return "", fmt.Errorf("invalid mode: %q specified in annotation: %q", mode, annDOLoadBalancerMode)
+	}
+
+	return mode, nil
+}
+
+// isFloatingIPMode returns true if service is exposed through a floating IP.
+// An invalid mode is reported once the regular load balancer is built.
+func isFloatingIPMode(service *v1.Service) bool {
+	mode, err := getLoadBalancerMode(service)
+	return err == nil && mode == lbModeFloatingIP
+}
+
+// serviceFloatingIP returns the floating IP of service and whether it was
+// specified by the user. The IP is taken from annDOFloatingIP if set, then
+// from annAllocatedFloatingIP and from the load balancer status of service
+// otherwise. An empty string is returned if service has no floating IP yet.
+func serviceFloatingIP(service *v1.Service) (ip string, userSpecified bool) {
+	if ip := service.Annotations[annDOFloatingIP]; ip != "" {
+		return ip, true
+	}
+
+	if ip := service.Annotations[annAllocatedFloatingIP]; ip != "" {
+		return ip, false
+	}
+
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP, false
+		}
+	}
+
+	return "", false
+}
+
+// floatingIPTarget returns the droplet among the droplets of nodes that ip
+// should be assigned to. The droplet ip is currently assigned to is kept if
+// it still backs one of nodes and is active; otherwise the first active
+// droplet by name in the region of ip is chosen. nil is returned if there is
+// no eligible droplet.
+func floatingIPTarget(fip *godo.FloatingIP, nodes []*v1.Node, droplets []godo.Droplet) *godo.Droplet {
+	var candidates []*godo.Droplet
+	for _, node := range nodes {
+		droplet := dropletForNode(node, droplets)
+		if droplet == nil || droplet.Status != dropletActiveStatus {
+			continue
+		}
+
+		if fip.Region != nil && droplet.Region != nil && fip.Region.Slug != droplet.Region.Slug {
+			continue
+		}
+
+		if fip.Droplet != nil && fip.Droplet.ID == droplet.ID {
+			return droplet
+		}
+
+		candidates = append(candidates, droplet)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	return candidates[0]
+}
+
+// getFloatingIP returns the *v1.LoadBalancerStatus of service in
+// floating-ip mode.
+func (l *loadbalancers) getFloatingIP(ctx context.Context, service *v1.Service) (*v1.LoadBalancerStatus, bool, error) {
+	ip, _ := serviceFloatingIP(service)
+	if ip == "" {
+		return nil, false, nil
+	}
+
+	fip, _, err := l.client.FloatingIPs.Get(ctx, ip)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return floatingIPStatus(fip.IP), true, nil
+}
+
+// ensureFloatingIP allocates or reuses the floating IP of service and
+// assigns it to a healthy droplet among nodes, failing over to another
+// droplet if the current one is no longer eligible. Nodes are selected like
+// the backends of load balancers.
+func (l *loadbalancers) ensureFloatingIP(ctx context.Context, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	nodes, err := selectBackendNodes(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	droplets, err := dropletList(ctx, l.client, l.dropletTag)
+	if err != nil {
+		return nil, err
+	}
+
+	var fip *godo.FloatingIP
+	ip, userSpecified := serviceFloatingIP(service)
+	if ip != "" {
+		fip, _, err = l.client.FloatingIPs.Get(ctx, ip)
+		if err != nil && (userSpecified || !isNotFound(err)) {
+			return nil, fmt.Errorf("failed to get floating IP %s: %s", ip, err)
+		}
+	}
+
+	allocated := false
+	if fip == nil {
+		fip, _, err = l.client.FloatingIPs.Create(ctx, &godo.FloatingIPCreateRequest{Region: l.region})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create floating IP: %s", err)
+		}
+		allocated = true
+		glog.Infof("allocated floating IP %s for service %s/%s", fip.IP, service.Namespace, service.Name)
+
+		if err := l.recordAllocatedFloatingIP(service, fip.IP); err != nil {
+			err = fmt.Errorf("failed to record allocated floating IP %s: %s", fip.IP, err)
+			l.releaseFloatingIP(ctx, service, fip.IP)
+			return nil, err
+		}
+	}
+
+	target := floatingIPTarget(fip, nodes, droplets)
+	if target == nil {
+		err := fmt.Errorf("no healthy node selected in region of floating IP %s", fip.IP)
+		if allocated {
+			l.releaseFloatingIP(ctx, service, fip.IP)
+		}
+		return nil, err
+	}
+
+	if fip.Droplet == nil || fip.Droplet.ID != target.ID {
+		if _, _, err := l.client.FloatingIPActions.Assign(ctx, fip.IP, target.ID); err != nil {
+			err = fmt.Errorf("failed to assign floating IP %s to droplet %d: %s", fip.IP, target.ID, err)
+			if allocated {
+				l.releaseFloatingIP(ctx, service, fip.IP)
+			}
+			return nil, err
+		}
+		glog.Infof("assigned floating IP %s of service %s/%s to droplet %s", fip.IP, service.Namespace, service.Name, target.Name)
+	}
+
+	return floatingIPStatus(fip.IP), nil
+}
+
+// releaseFloatingIP releases the floating IP ip just allocated for service
+// which could not be assigned. It is not reported in the status of service
+// yet, so every retry would allocate another one otherwise.
+func (l *loadbalancers) releaseFloatingIP(ctx context.Context, service *v1.Service, ip string) {
+	if _, err := l.client.FloatingIPs.Delete(ctx, ip); err != nil {
+		glog.Errorf("failed to release unassigned floating IP %s of service %s/%s: %s", ip, service.Namespace, service.Name, err)
+		return
+	}
+	l.recordAllocatedFloatingIP(service, "")
+	glog.Infof("released unassigned floating IP %s of service %s/%s", ip, service.Namespace, service.Name)
+}
+
+// recordAllocatedFloatingIP sets annAllocatedFloatingIP of service to ip, or
+// removes it if ip is empty.
+func (l *loadbalancers) recordAllocatedFloatingIP(service *v1.Service, ip string) error {
+	if l.kclient == nil {
+		return nil
+	}
+
+	var value interface{}
+	if ip != "" {
+		value = ip
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annAllocatedFloatingIP: value},
+		},
+	})
+	return patchServiceAnnotations(l.kclient, service, patch)
+}
+
+// deleteFloatingIP unassigns the floating IP of service, and releases it if
+// it was allocated by the provider as recorded in annAllocatedFloatingIP.
+func (l *loadbalancers) deleteFloatingIP(ctx context.Context, service *v1.Service) error {
+	ip, userSpecified := serviceFloatingIP(service)
+	if ip == "" {
+		return nil
+	}
+
+	fip, _, err := l.client.FloatingIPs.Get(ctx, ip)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if userSpecified || service.Annotations[annAllocatedFloatingIP] != ip {
+		if !userSpecified {
+			glog.Infof("keeping floating IP %s of service %s/%s, it was not allocated for the service", ip, service.Namespace, service.Name)
+		}
+		if fip.Droplet == nil {
+			return nil
+		}
+		_, _, err := l.client.FloatingIPActions.Unassign(ctx, ip)
+		return err
+	}
+
+	// deleting a floating IP unassigns it.
+	if _, err = l.client.FloatingIPs.Delete(ctx, ip); err != nil {
+		return err
+	}
+
+	if err := l.recordAllocatedFloatingIP(service, ""); err != nil {
+		glog.Errorf("failed to remove allocated floating IP annotation of service %s/%s: %s", service.Namespace, service.Name, err)
+	}
+
+	return nil
+}
+
+// floatingIPStatus returns a *v1.LoadBalancerStatus reporting ip.
+func floatingIPStatus(ip string) *v1.LoadBalancerStatus {
+	return &v1.LoadBalancerStatus{
+		Ingress: []v1.LoadBalancerIngress{
+			{
+				IP: ip,
+			},
+		},
+	}
+}
@@ -0,0 +1,436 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+)
+
+// fakeFloatingIPs is a stateful fake of the floating IPs and floating IP
+// actions services.
+type fakeFloatingIPs struct {
+	fips     map[string]*godo.FloatingIP
+	droplets map[int]*godo.Droplet
+	nextIP   string
+	// assignErr is returned by Assign if set.
+	assignErr error
+}
+
+func (f *fakeFloatingIPs) List(context.Context, *godo.ListOptions) ([]godo.FloatingIP, *godo.Response, error) {
+	var list []godo.FloatingIP
+	for _, fip := range f.fips {
+		list = append(list, *fip)
+	}
+	return list, newFakeOKResponse(), nil
+}
+
+func (f *fakeFloatingIPs) Get(_ context.Context, ip string) (*godo.FloatingIP, *godo.Response, error) {
+	fip, ok := f.fips[ip]
+	if !ok {
+		return nil, nil, newFakeNotFoundErrorResponse()
+	}
+	return fip, newFakeOKResponse(), nil
+}
+
+func (f *fakeFloatingIPs) Create(_ context.Context, req *godo.FloatingIPCreateRequest) (*godo.FloatingIP, *godo.Response, error) {
+	fip := &godo.FloatingIP{IP: f.nextIP, Region: &godo.Region{Slug: req.Region}}
+	f.fips[fip.IP] = fip
+	return fip, newFakeOKResponse(), nil
+}
+
+func (f *fakeFloatingIPs) Delete(_ context.Context, ip string) (*godo.Response, error) {
+	delete(f.fips, ip)
+	return newFakeOKResponse(), nil
+}
+
+type fakeFloatingIPActions struct {
+	*fakeFloatingIPs
+}
+
+func (f fakeFloatingIPActions) Assign(_ context.Context, ip string, dropletID int) (*godo.Action, *godo.Response, error) {
+	if f.assignErr != nil {
+		return nil, nil, f.assignErr
+	}
+	f.fips[ip].Droplet = f.droplets[dropletID]
+	return &godo.Action{}, newFakeOKResponse(), nil
+}
+
+func (f fakeFloatingIPActions) Unassign(_ context.Context, ip string) (*godo.Action, *godo.Response, error) {
+	f.fips[ip].Droplet = nil
+	return &godo.Action{}, newFakeOKResponse(), nil
+}
+
+func (f fakeFloatingIPActions) Get(context.Context, string, int) (*godo.Action, *godo.Response, error) {
+	return &godo.Action{}, newFakeOKResponse(), nil
+}
+
+func (f fakeFloatingIPActions) List(context.Context, string, *godo.ListOptions) ([]godo.Action, *godo.Response, error) {
+	return nil, newFakeOKResponse(), nil
+}
+
+func newFakeFloatingIPClient(droplets []godo.Droplet) (*godo.Client, *fakeFloatingIPs) {
+	fake := &fakeFloatingIPs{
+		fips:     map[string]*godo.FloatingIP{},
+		droplets: map[int]*godo.Droplet{},
+		nextIP:   "192.0.2.1",
+	}
+	for i := range droplets {
+		fake.droplets[droplets[i].ID] = &droplets[i]
+	}
+
+	fakeDroplet := &fakeDropletService{}
+	fakeDroplet.listFunc = func(context.Context, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+		return droplets, newFakeOKResponse(), nil
+	}
+
+	client := newFakeClient(fakeDroplet)
+	client.FloatingIPs = fake
+	client.FloatingIPActions = fakeFloatingIPActions{fake}
+
+	return client, fake
+}
+
+func newFloatingIPService(annotations map[string]string, ingressIP string) *v1.Service {
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[annDOLoadBalancerMode] = lbModeFloatingIP
+
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Namespace:   "default",
+			UID:         "foobar123",
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{{Name: "dns", Protocol: "UDP", Port: 53, NodePort: 30053}},
+		},
+	}
+	if ingressIP != "" {
+		service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: ingressIP}}
+	}
+
+	return service
+}
+
+func Test_getLoadBalancerMode(t *testing.T) {
+	testcases := []struct {
+		name        string
+		annotations map[string]string
+		mode        string
+		err         bool
+	}{
+		{"default", nil, lbModeLoadBalancer, false},
+		{"floating ip", map[string]string{annDOLoadBalancerMode: "floating-ip"}, lbModeFloatingIP, false},
+		{"invalid", map[string]string{annDOLoadBalancerMode: "magic"}, "", true},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+			mode, err := getLoadBalancerMode(service)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if mode != test.mode {
+				t.Errorf("expected mode %q, got %q", test.mode, mode)
+			}
+		})
+	}
+}
+
+func Test_ensureFloatingIP(t *testing.T) {
+	region := &godo.Region{Slug: "nyc1"}
+	droplets := []godo.Droplet{
+		{ID: 1, Name: "node-a", Status: "active", Region: region},
+		{ID: 2, Name: "node-b", Status: "active", Region: region},
+		{ID: 3, Name: "node-c", Status: "off", Region: region},
+	}
+	nodeA := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}}
+	nodeB := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}}
+	nodeC := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-c"}}
+
+	client, fake := newFakeFloatingIPClient(droplets)
+	lb := newLoadbalancers(client, "nyc1")
+
+	// a new floating IP is allocated and assigned to the first node by name.
+	service := newFloatingIPService(nil, "")
+	status, err := lb.EnsureLoadBalancer(context.TODO(), "test", service, []*v1.Node{nodeB, nodeA})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(status, floatingIPStatus("192.0.2.1")) {
+		t.Errorf("unexpected status: %v", status)
+	}
+	if fake.fips["192.0.2.1"].Droplet.ID != 1 {
+		t.Errorf("expected floating IP to be assigned to droplet 1, got %d", fake.fips["192.0.2.1"].Droplet.ID)
+	}
+
+	// the floating IP is reused and stays on its droplet.
+	service = newFloatingIPService(nil, "192.0.2.1")
+	fake.nextIP = "192.0.2.2"
+	if err := lb.UpdateLoadBalancer(context.TODO(), "test", service, []*v1.Node{nodeB, nodeA}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(fake.fips) != 1 || fake.fips["192.0.2.1"].Droplet.ID != 1 {
+		t.Errorf("expected floating IP to be reused on droplet 1, got %v", fake.fips)
+	}
+
+	// the floating IP fails over once its node is gone, skipping
+	// droplets which are not active.
+	if err := lb.UpdateLoadBalancer(context.TODO(), "test", service, []*v1.Node{nodeC, nodeB}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fake.fips["192.0.2.1"].Droplet.ID != 2 {
+		t.Errorf("expected floating IP to fail over to droplet 2, got %d", fake.fips["192.0.2.1"].Droplet.ID)
+	}
+
+	// no eligible node.
+	if err := lb.UpdateLoadBalancer(context.TODO(), "test", service, []*v1.Node{nodeC}); err == nil {
+		t.Error("expected error without healthy nodes")
+	}
+
+	_, exists, err := lb.GetLoadBalancer(context.TODO(), "test", service)
+	if err != nil || !exists {
+		t.Errorf("expected floating IP to exist, got exists %t and error %v", exists, err)
+	}
+
+	// an allocated floating IP is released with the service.
+	service = newFloatingIPService(map[string]string{annAllocatedFloatingIP: "192.0.2.1"}, "192.0.2.1")
+	if err := lb.EnsureLoadBalancerDeleted(context.TODO(), "test", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(fake.fips) != 0 {
+		t.Errorf("expected floating IP to be released, got %v", fake.fips)
+	}
+}
+
+func Test_ensureFloatingIP_selectsNodes(t *testing.T) {
+	region := &godo.Region{Slug: "nyc1"}
+	droplets := []godo.Droplet{
+		{ID: 1, Name: "node-a", Status: "active", Region: region},
+		{ID: 2, Name: "node-b", Status: "active", Region: region},
+		{ID: 3, Name: "node-c", Status: "active", Region: region},
+		{ID: 4, Name: "node-d", Status: "active", Region: region},
+	}
+	// node-a to node-c come first by name but are excluded, draining or not
+	// selected by the Service.
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{labelExcludeFromLoadBalancers: "true", "role": "ingress"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-b", Labels: map[string]string{"role": "ingress"}, Annotations: map[string]string{annDrainFromLoadBalancers: "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-c"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-d", Labels: map[string]string{"role": "ingress"}}},
+	}
+
+	client, fake := newFakeFloatingIPClient(droplets)
+	lb := newLoadbalancers(client, "nyc1")
+
+	service := newFloatingIPService(map[string]string{annDOLoadBalancerNodeSelector: "role=ingress"}, "")
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "test", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if id := fake.fips["192.0.2.1"].Droplet.ID; id != 4 {
+		t.Errorf("expected floating IP to be assigned to droplet 4, got %d", id)
+	}
+
+	// an invalid selector fails before a floating IP is allocated.
+	fake.fips = map[string]*godo.FloatingIP{}
+	service = newFloatingIPService(map[string]string{annDOLoadBalancerNodeSelector: "role in"}, "")
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "test", service, nodes); err == nil {
+		t.Error("expected error with an invalid node selector")
+	}
+	if len(fake.fips) != 0 {
+		t.Errorf("expected no floating IP to be allocated, got %v", fake.fips)
+	}
+}
+
+func Test_ensureFloatingIP_releasesUnassigned(t *testing.T) {
+	region := &godo.Region{Slug: "nyc1"}
+	droplets := []godo.Droplet{
+		{ID: 1, Name: "node-a", Status: "active", Region: region},
+		{ID: 2, Name: "node-b", Status: "off", Region: region},
+	}
+	nodeA := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}}
+	nodeB := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}}
+
+	testcases := []struct {
+		name      string
+		nodes     []*v1.Node
+		assignErr error
+	}{
+		{"no healthy node", []*v1.Node{nodeB}, nil},
+		{"assign fails", []*v1.Node{nodeA}, errors.New("droplet is locked")},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			client, fake := newFakeFloatingIPClient(droplets)
+			fake.assignErr = test.assignErr
+			lb := newLoadbalancers(client, "nyc1")
+
+			// every retry would allocate another floating IP if the
+			// unassigned one was kept.
+			service := newFloatingIPService(nil, "")
+			for i := 0; i < 2; i++ {
+				if _, err := lb.EnsureLoadBalancer(context.TODO(), "test", service, test.nodes); err == nil {
+					t.Fatal("expected error")
+				}
+				if len(fake.fips) != 0 {
+					t.Fatalf("expected floating IP to be released, got %v", fake.fips)
+				}
+			}
+		})
+	}
+}
+
+func Test_ensureFloatingIP_keepsExisting(t *testing.T) {
+	client, fake := newFakeFloatingIPClient(nil)
+	fake.fips["192.0.2.9"] = &godo.FloatingIP{IP: "192.0.2.9"}
+	lb := newLoadbalancers(client, "nyc1")
+
+	// a floating IP the service already has is kept when it cannot be
+	// assigned.
+	service := newFloatingIPService(nil, "192.0.2.9")
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "test", service, nil); err == nil {
+		t.Fatal("expected error without healthy nodes")
+	}
+	if _, ok := fake.fips["192.0.2.9"]; !ok {
+		t.Error("expected floating IP of the service to be kept")
+	}
+}
+
+func Test_deleteFloatingIP_userSpecified(t *testing.T) {
+	client, fake := newFakeFloatingIPClient(nil)
+	fake.fips["192.0.2.9"] = &godo.FloatingIP{IP: "192.0.2.9", Droplet: &godo.Droplet{ID: 1}}
+	lb := newLoadbalancers(client, "nyc1")
+
+	service := newFloatingIPService(map[string]string{annDOFloatingIP: "192.0.2.9"}, "192.0.2.9")
+	if err := lb.EnsureLoadBalancerDeleted(context.TODO(), "test", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fip, ok := fake.fips["192.0.2.9"]
+	if !ok {
+		t.Fatal("expected user specified floating IP to be kept")
+	}
+	if fip.Droplet != nil {
+		t.Error("expected user specified floating IP to be unassigned")
+	}
+}
+
+func Test_deleteFloatingIP_notAllocated(t *testing.T) {
+	client, fake := newFakeFloatingIPClient(nil)
+	fake.fips["192.0.2.9"] = &godo.FloatingIP{IP: "192.0.2.9", Droplet: &godo.Droplet{ID: 1}}
+	lb := newLoadbalancers(client, "nyc1")
+
+	// the floating IP reported in the status was not recorded as allocated
+	// for the service, e.g. because it was specified by the user before.
+	service := newFloatingIPService(nil, "192.0.2.9")
+	if err := lb.EnsureLoadBalancerDeleted(context.TODO(), "test", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fip, ok := fake.fips["192.0.2.9"]
+	if !ok {
+		t.Fatal("expected floating IP which was not allocated for the service to be kept")
+	}
+	if fip.Droplet != nil {
+		t.Error("expected floating IP to be unassigned")
+	}
+}
+
+func Test_ensureFloatingIP_recordsAllocation(t *testing.T) {
+	region := &godo.Region{Slug: "nyc1"}
+	client, fake := newFakeFloatingIPClient([]godo.Droplet{{ID: 1, Name: "node-a", Status: "active", Region: region}})
+	lb := newLoadbalancers(client, "nyc1")
+
+	var patches []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		patches = append(patches, r.Method+" "+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind": "Service", "apiVersion": "v1"}`))
+	}))
+	defer server.Close()
+
+	kclient, err := kubernetes.NewForConfig(&restclient.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.kclient = kclient
+
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}}}
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "test", newFloatingIPService(nil, ""), nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{`PATCH {"metadata":{"annotations":{"kubernetes.digitalocean.com/allocated-floating-ip":"192.0.2.1"}}}`}
+	if !reflect.DeepEqual(patches, expected) {
+		t.Fatalf("expected allocation to be recorded, got %v", patches)
+	}
+
+	// a retry before the status was persisted reuses the recorded floating
+	// IP.
+	fake.nextIP = "192.0.2.2"
+	service := newFloatingIPService(map[string]string{annAllocatedFloatingIP: "192.0.2.1"}, "")
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "test", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(fake.fips) != 1 {
+		t.Errorf("expected recorded floating IP to be reused, got %v", fake.fips)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(context.TODO(), "test", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(fake.fips) != 0 {
+		t.Errorf("expected floating IP to be released, got %v", fake.fips)
+	}
+	expected = append(expected, `PATCH {"metadata":{"annotations":{"kubernetes.digitalocean.com/allocated-floating-ip":null}}}`)
+	if !reflect.DeepEqual(patches, expected) {
+		t.Errorf("expected allocation record to be removed, got %v", patches)
+	}
+
+	// the record of a floating IP released as it could not be assigned is
+	// removed as well.
+	fake.nextIP = "192.0.2.3"
+	fake.assignErr = errors.New("droplet is locked")
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "test", newFloatingIPService(nil, ""), nodes); err == nil {
+		t.Fatal("expected error")
+	}
+	expected = append(expected,
+		`PATCH {"metadata":{"annotations":{"kubernetes.digitalocean.com/allocated-floating-ip":"192.0.2.3"}}}`,
+		`PATCH {"metadata":{"annotations":{"kubernetes.digitalocean.com/allocated-floating-ip":null}}}`,
+	)
+	if !reflect.DeepEqual(patches, expected) {
+		t.Errorf("expected allocation record to be removed after release, got %v", patches)
+	}
+}
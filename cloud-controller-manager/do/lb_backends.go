@@ -0,0 +1,159 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// annDOLoadBalancerNodeSelector is the annotation used to restrict the
+	// backends of the load balancer of a Service to the nodes matching a
+	// label selector, e.g. role=ingress,tier!=batch.
+	annDOLoadBalancerNodeSelector = "service.beta.kubernetes.io/do-loadbalancer-node-selector"
+
+	// annDOLoadBalancerDropletTag is the annotation used to restrict the
+	// backends of the load balancer of a Service to the nodes whose droplets
+	// carry a tag.
+	annDOLoadBalancerDropletTag = "service.beta.kubernetes.io/do-loadbalancer-droplet-tag"
+
+	// labelExcludeFromLoadBalancers excludes a node from all load balancers
+	// when set to true.
+	labelExcludeFromLoadBalancers = "node.digitalocean.com/exclude-from-load-balancers"
+)
+
+// getNodeSelector returns the node selector of service, or labels.Everything
+// if it has none.
+func getNodeSelector(service *v1.Service) (labels.Selector, error) {
+	s, ok := service.Annotations[annDOLoadBalancerNodeSelector]
+	if !ok {
+		return labels.Everything(), nil
+	}
+
+	selector, err := labels.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node selector %q specified in annotation %q: %s", s, annDOLoadBalancerNodeSelector, err)
+	}
+
+	return selector, nil
+}
+
+// selectBackendNodes returns the nodes the load balancer of service may
+// balance across: nodes carrying labelExcludeFromLoadBalancers or draining
+// are left out, as are nodes not matching the node selector of service.
+func selectBackendNodes(service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	selector, err := getNodeSelector(service)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []*v1.Node
+	for _, node := range nodes {
+		if excluded, _ := strconv.ParseBool(node.Labels[labelExcludeFromLoadBalancers]); excluded || isDraining(node) {
+			continue
+		}
+		if !selector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		selected = append(selected, node)
+	}
+
+	return selected, nil
+}
+
+// dropletsWithTag returns the droplets carrying the tag annotation of
+// service, or all droplets if it has none.
+func dropletsWithTag(service *v1.Service, droplets []nodeDroplet) []nodeDroplet {
+	tag := service.Annotations[annDOLoadBalancerDropletTag]
+	if tag == "" {
+		return droplets
+	}
+
+	var tagged []nodeDroplet
+	for _, nd := range droplets {
+		for _, t := range nd.droplet.Tags {
+			if t == tag {
+				tagged = append(tagged, nd)
+				break
+			}
+		}
+	}
+
+	return tagged
+}
+
+// lbBackends are the nodes of a load balancer, as sorted, comma separated
+// node names.
+type lbBackends struct {
+	// selected are the nodes balanced across.
+	selected string
+	// excluded are the nodes left out, e.g. by the backend selection, for
+	// being in another region or draining.
+	excluded string
+}
+
+// reportBackends records the nodes the load balancer of service balances
+// across, droplets, and the others among nodes, so that they are written to
+// the status annotations of service. Whenever the nodes balanced across
+// change, they are logged and an event is recorded on service.
+func (l *loadbalancers) reportBackends(service *v1.Service, droplets []nodeDroplet, nodes []*v1.Node) {
+	selected := map[string]bool{}
+	names := make([]string, len(droplets))
+	for i, nd := range droplets {
+		names[i] = nd.node.Name
+		selected[nd.node.Name] = true
+	}
+	sort.Strings(names)
+	backends := strings.Join(names, ", ")
+
+	var excluded []string
+	for _, node := range nodes {
+		if !selected[node.Name] {
+			excluded = append(excluded, node.Name)
+		}
+	}
+	sort.Strings(excluded)
+
+	l.backendsMu.Lock()
+	previous, ok := l.backends[service.UID]
+	l.backends[service.UID] = lbBackends{
+		selected: strings.Join(names, ","),
+		excluded: strings.Join(excluded, ","),
+	}
+	l.backendsMu.Unlock()
+
+	if ok && previous.selected == strings.Join(names, ",") {
+		return
+	}
+
+	if len(names) == 0 {
+		glog.Warningf("load balancer of service %s has no nodes to balance across", serviceKey(service))
+		l.eventf(service, v1.EventTypeWarning, "LoadBalancerNoBackends", "No nodes match the backend selection of the load balancer")
+		return
+	}
+
+	glog.V(2).Infof("load balancer of service %s balances across %d nodes: %s", serviceKey(service), len(names), backends)
+	l.eventf(service, v1.EventTypeNormal, "LoadBalancerBackends", "Balancing across %d nodes: %s", len(names), backends)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// newLabeledNode returns a node named name carrying labels.
+func newLabeledNode(name string, labels map[string]string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func Test_selectBackendNodes(t *testing.T) {
+	nodes := []*v1.Node{
+		newLabeledNode("master", map[string]string{"role": "master", labelExcludeFromLoadBalancers: "true"}),
+		newLabeledNode("ingress", map[string]string{"role": "ingress"}),
+		newLabeledNode("worker", map[string]string{"role": "worker", labelExcludeFromLoadBalancers: "false"}),
+	}
+
+	testcases := []struct {
+		name     string
+		selector string
+		selected []string
+		err      bool
+	}{
+		{
+			name:     "no selector",
+			selected: []string{"ingress", "worker"},
+		},
+		{
+			name:     "selector",
+			selector: "role in (ingress, master)",
+			selected: []string{"ingress"},
+		},
+		{
+			name:     "no match",
+			selector: "role=batch",
+			selected: nil,
+		},
+		{
+			name:     "invalid selector",
+			selector: "role in ingress",
+			err:      true,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			service := &v1.Service{}
+			if test.selector != "" {
+				service.Annotations = map[string]string{annDOLoadBalancerNodeSelector: test.selector}
+			}
+
+			selected, err := selectBackendNodes(service, nodes)
+			if test.err != (err != nil) {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+
+			var names []string
+			for _, node := range selected {
+				names = append(names, node.Name)
+			}
+			if !reflect.DeepEqual(names, test.selected) {
+				t.Errorf("expected nodes %v, got %v", test.selected, names)
+			}
+		})
+	}
+}
+
+func Test_loadbalancers_backendSelection(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t)
+	defer closeFn()
+
+	for i, tags := range [][]string{nil, {"edge"}, {"edge", "gpu"}} {
+		fake.AddDroplet(godo.Droplet{ID: i + 1, Name: fmt.Sprintf("node-%d", i+1), Tags: tags})
+	}
+	nodes := []*v1.Node{
+		newLabeledNode("node-1", map[string]string{"role": "ingress"}),
+		newLabeledNode("node-2", map[string]string{"role": "ingress"}),
+		newLabeledNode("node-3", map[string]string{"role": "worker"}),
+	}
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	recorder := record.NewFakeRecorder(10)
+	lb.recorder = recorder
+
+	service := newScenarioService()
+	service.Annotations = map[string]string{
+		annDOLoadBalancerNodeSelector: "role=ingress",
+		annDOLoadBalancerDropletTag:   "edge",
+	}
+	ctx := context.TODO()
+
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || !reflect.DeepEqual(lbs[0].DropletIDs, []int{2}) {
+		t.Fatalf("expected a load balancer for node-2 only, got %v", lbs)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); !strings.Contains(events, "LoadBalancerBackends Balancing across 1 nodes: node-2") {
+		t.Errorf("expected the backends to be reported, got %s", events)
+	}
+	if backends := lb.backends[service.UID]; backends != (lbBackends{selected: "node-2", excluded: "node-1,node-3"}) {
+		t.Errorf("expected node-2 selected and node-1, node-3 excluded, got %+v", backends)
+	}
+
+	// unchanged backends are not reported again.
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events for unchanged backends, got %v", events)
+	}
+
+	// excluded nodes are left out of every load balancer.
+	nodes[1].Labels[labelExcludeFromLoadBalancers] = "true"
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs[0].DropletIDs) != 0 {
+		t.Errorf("expected excluded node to be removed, got %v", lbs[0].DropletIDs)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); !strings.Contains(events, "LoadBalancerNoBackends") {
+		t.Errorf("expected missing backends to be reported, got %s", events)
+	}
+
+	service.Annotations[annDOLoadBalancerNodeSelector] = "role in ingress"
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err == nil {
+		t.Error("expected invalid node selector to fail")
+	}
+}
@@ -0,0 +1,406 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// annDrainFromLoadBalancers marks a node as draining when set to true.
+	// The droplet of a draining node is removed from the load balancers
+	// balancing across it right away, so that it gets no new connections,
+	// and reported drained once the drain window, the grace period of the
+	// connections it still serves, expired.
+	annDrainFromLoadBalancers = "node.digitalocean.com/drain-from-load-balancers"
+
+	// defaultLBDrainWindow is the default grace period of the connections
+	// draining nodes still serve.
+	defaultLBDrainWindow = 2 * time.Minute
+
+	// lbDrainSyncPeriod is the interval between two checks for draining
+	// nodes and expired drain windows.
+	lbDrainSyncPeriod = 10 * time.Second
+)
+
+// isDraining returns whether node is marked as draining.
+func isDraining(node *v1.Node) bool {
+	draining, _ := strconv.ParseBool(node.Annotations[annDrainFromLoadBalancers])
+	return draining
+}
+
+// lbDrainKey identifies the droplet of a load balancer.
+type lbDrainKey struct {
+	lbID      string
+	dropletID int
+}
+
+// lbDrain is the drain of a droplet from a load balancer, which starts once
+// the droplet was removed from it.
+type lbDrain struct {
+	node    *v1.Node
+	service *v1.Service
+	since   time.Time
+	// done is set once the drain window expired.
+	done bool
+}
+
+// lbDrainTarget is a load balancer checked for droplets of draining nodes.
+type lbDrainTarget struct {
+	name    string
+	service *v1.Service
+}
+
+// lbDrains tracks the droplets drained from load balancers, whose
+// connections are given window to complete, and the load balancers to drain
+// them from by ID.
+type lbDrains struct {
+	window  time.Duration
+	account string
+	now     func() time.Time
+
+	mu      sync.Mutex
+	drains  map[lbDrainKey]*lbDrain
+	targets map[string]lbDrainTarget
+}
+
+// newLBDrains returns an lbDrains keeping droplets for window, reporting
+// metrics for account.
+func newLBDrains(window time.Duration, account string) *lbDrains {
+	return &lbDrains{
+		window:  window,
+		account: account,
+		now:     time.Now,
+		drains:  map[lbDrainKey]*lbDrain{},
+		targets: map[string]lbDrainTarget{},
+	}
+}
+
+// lbDrainsFromEnv returns the lbDrains configured through the process
+// environment for account.
+func lbDrainsFromEnv(account string) (*lbDrains, error) {
+	window, err := durationFromEnv(doLBDrainWindowEnv, defaultLBDrainWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLBDrains(window, account), nil
+}
+
+// start records that the droplet key of node was removed from the load
+// balancer of service as it is draining. It returns whether the drain just
+// started.
+func (d *lbDrains) start(key lbDrainKey, node *v1.Node, service *v1.Service) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.drains[key]; ok {
+		return false
+	}
+
+	d.drains[key] = &lbDrain{node: node, service: service, since: d.now()}
+	d.updateMetrics()
+	return true
+}
+
+// finish records that the drain window of the droplet key expired. It
+// returns the drain if it was not finished before.
+func (d *lbDrains) finish(key lbDrainKey) *lbDrain {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	drain, ok := d.drains[key]
+	if !ok || drain.done {
+		return nil
+	}
+
+	drain.done = true
+	d.updateMetrics()
+	lbDrainedBackends.WithLabelValues(d.account).Inc()
+
+	copied := *drain
+	return &copied
+}
+
+// cancel forgets the drain of the droplet key, e.g. because its node is no
+// longer draining.
+func (d *lbDrains) cancel(key lbDrainKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.drains[key]; ok {
+		delete(d.drains, key)
+		d.updateMetrics()
+	}
+}
+
+// watch records that the load balancer lb of service is checked for droplets
+// of draining nodes.
+func (d *lbDrains) watch(lb *godo.LoadBalancer, service *v1.Service) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.targets[lb.ID] = lbDrainTarget{name: lb.Name, service: service}
+}
+
+// forget stops checking the load balancer id, e.g. once it was deleted.
+func (d *lbDrains) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.targets, id)
+}
+
+// listTargets returns a copy of the load balancers checked for droplets of
+// draining nodes by ID.
+func (d *lbDrains) listTargets() map[string]lbDrainTarget {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	targets := make(map[string]lbDrainTarget, len(d.targets))
+	for id, target := range d.targets {
+		targets[id] = target
+	}
+	return targets
+}
+
+// list returns a copy of the drains by droplet.
+func (d *lbDrains) list() map[lbDrainKey]lbDrain {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	drains := make(map[lbDrainKey]lbDrain, len(d.drains))
+	for key, drain := range d.drains {
+		drains[key] = *drain
+	}
+	return drains
+}
+
+// updateMetrics sets lbDrainingBackends to the number of unfinished drains.
+// d.mu must be held.
+func (d *lbDrains) updateMetrics() {
+	draining := 0
+	for _, drain := range d.drains {
+		if !drain.done {
+			draining++
+		}
+	}
+	lbDrainingBackends.WithLabelValues(d.account).Set(float64(draining))
+}
+
+// drainingDroplets returns the draining nodes, among nodes and those of
+// l.nodeLister, by the ID of their droplet.
+func (l *loadbalancers) drainingDroplets(ctx context.Context, nodes []*v1.Node) (map[int]*v1.Node, error) {
+	var draining []*v1.Node
+	seen := map[string]bool{}
+	for _, node := range nodes {
+		seen[node.Name] = true
+		if isDraining(node) {
+			draining = append(draining, node)
+		}
+	}
+
+	if l.nodeLister != nil {
+		all, err := l.nodeLister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range all {
+			if !seen[node.Name] && isDraining(node) {
+				draining = append(draining, node)
+			}
+		}
+	}
+
+	if len(draining) == 0 {
+		return nil, nil
+	}
+
+	droplets, _, err := l.nodesToDroplets(ctx, draining)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]*v1.Node, len(droplets))
+	for _, nd := range droplets {
+		byID[nd.droplet.ID] = nd.node
+	}
+	return byID, nil
+}
+
+// drainBackends adjusts lbRequest, updating the load balancer lb of service
+// to balance across nodes, for draining nodes: their droplets are never
+// added, and those lb balances across are removed, starting their drain.
+func (l *loadbalancers) drainBackends(ctx context.Context, service *v1.Service, lb *godo.LoadBalancer, lbRequest *godo.LoadBalancerRequest, nodes []*v1.Node) error {
+	if nodes == nil {
+		return nil
+	}
+	l.drains.watch(lb, service)
+
+	draining, err := l.drainingDroplets(ctx, nodes)
+	if err != nil {
+		return err
+	}
+
+	var dropletIDs []int
+	for _, id := range lbRequest.DropletIDs {
+		if _, ok := draining[id]; ok {
+			continue
+		}
+		l.drains.cancel(lbDrainKey{lbID: lb.ID, dropletID: id})
+		dropletIDs = append(dropletIDs, id)
+	}
+	lbRequest.DropletIDs = dropletIDs
+
+	for _, id := range lb.DropletIDs {
+		if node, ok := draining[id]; ok {
+			l.startDrain(service, lbDrainKey{lbID: lb.ID, dropletID: id}, node)
+		}
+	}
+	return nil
+}
+
+// startDrain records the start of the drain of the droplet key of node,
+// removed from the load balancer of service.
+func (l *loadbalancers) startDrain(service *v1.Service, key lbDrainKey, node *v1.Node) {
+	if !l.drains.start(key, node, service) {
+		return
+	}
+
+	glog.Infof("removed draining node %s from load balancer %s of service %s, giving its connections %s to complete", node.Name, key.lbID, serviceKey(service), l.drains.window)
+	l.eventf(service, v1.EventTypeNormal, "LoadBalancerBackendDraining", "Removed draining node %s from load balancer %s, giving its connections %s to complete", node.Name, key.lbID, l.drains.window)
+	l.nodeEventf(node, v1.EventTypeNormal, "DrainingFromLoadBalancer", "Removed from load balancer %s of service %s, giving its connections %s to complete", key.lbID, serviceKey(service), l.drains.window)
+}
+
+// reportDrained logs and records events for the droplet key whose drain
+// window expired.
+func (l *loadbalancers) reportDrained(key lbDrainKey, drain *lbDrain) {
+	glog.Infof("node %s drained from load balancer %s of service %s", drain.node.Name, key.lbID, serviceKey(drain.service))
+	l.eventf(drain.service, v1.EventTypeNormal, "LoadBalancerBackendDrained", "Node %s drained from load balancer %s after %s", drain.node.Name, key.lbID, l.drains.window)
+	l.nodeEventf(drain.node, v1.EventTypeNormal, "DrainedFromLoadBalancer", "Drained from load balancer %s of service %s after %s", key.lbID, serviceKey(drain.service), l.drains.window)
+}
+
+// nodeEventf records an event on node if l has a recorder.
+func (l *loadbalancers) nodeEventf(node *v1.Node, eventType, reason, messageFmt string, args ...interface{}) {
+	if l.recorder == nil {
+		return
+	}
+	l.recorder.Eventf(node, eventType, reason, messageFmt, args...)
+}
+
+// runDrains drains the droplets of draining nodes from load balancers and
+// reports the drains whose window expired every lbDrainSyncPeriod until
+// stopCh is closed. UpdateLoadBalancer is not called when a node is annotated
+// as draining, so the drain cannot wait for it.
+func (l *loadbalancers) runDrains(nodeListerSynced cache.InformerSynced, stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, nodeListerSynced) {
+		glog.Error("failed to sync node cache for load balancer drains")
+		return
+	}
+
+	wait.Until(func() {
+		l.syncDrains(context.Background())
+	}, lbDrainSyncPeriod, stopCh)
+}
+
+// syncDrains removes the droplets of draining nodes from the load balancers
+// updated before, reports the drains whose window expired, and forgets the
+// drains of nodes which were deleted or are no longer draining.
+func (l *loadbalancers) syncDrains(ctx context.Context) {
+	l.removeDrainingDroplets(ctx)
+
+	for key, drain := range l.drains.list() {
+		if l.nodeLister != nil {
+			node, err := l.nodeLister.Get(drain.node.Name)
+			if apierrors.IsNotFound(err) || (err == nil && !isDraining(node)) {
+				l.drains.cancel(key)
+				continue
+			}
+		}
+
+		if drain.done || drain.since.Add(l.drains.window).After(l.drains.now()) {
+			continue
+		}
+		if finished := l.drains.finish(key); finished != nil {
+			l.reportDrained(key, finished)
+		}
+	}
+}
+
+// removeDrainingDroplets removes the droplets of the draining nodes of
+// l.nodeLister from the indexed load balancers updated before, starting
+// their drain.
+func (l *loadbalancers) removeDrainingDroplets(ctx context.Context) {
+	if l.nodeLister == nil {
+		return
+	}
+
+	draining, err := l.drainingDroplets(ctx, nil)
+	if err != nil {
+		glog.Errorf("failed to look up the droplets of draining nodes: %s", err)
+		return
+	}
+	if len(draining) == 0 {
+		return
+	}
+
+	for id, target := range l.drains.listTargets() {
+		lb, ok := l.index.lookup(target.name)
+		if !ok || lb.ID != id {
+			l.drains.forget(id)
+			continue
+		}
+
+		for _, dropletID := range lb.DropletIDs {
+			node, ok := draining[dropletID]
+			if !ok {
+				continue
+			}
+
+			if _, err := l.client.LoadBalancers.RemoveDroplets(ctx, lb.ID, dropletID); err != nil && !isNotFound(err) {
+				glog.Errorf("failed to remove droplet %d of draining node %s from load balancer %s: %s", dropletID, node.Name, lb.ID, err)
+				continue
+			}
+			l.index.put(withoutDroplet(lb, dropletID))
+			l.startDrain(target.service, lbDrainKey{lbID: lb.ID, dropletID: dropletID}, node)
+		}
+	}
+}
+
+// withoutDroplet returns a copy of lb without the droplet id.
+func withoutDroplet(lb *godo.LoadBalancer, id int) *godo.LoadBalancer {
+	copied := *lb
+	copied.DropletIDs = nil
+	for _, dropletID := range lb.DropletIDs {
+		if dropletID != id {
+			copied.DropletIDs = append(copied.DropletIDs, dropletID)
+		}
+	}
+	return &copied
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_loadbalancers_drain(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1", "node-2")
+	defer closeFn()
+
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		indexer.Add(node)
+	}
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.nodeLister = corelisters.NewNodeLister(indexer)
+	lb.drains = newLBDrains(time.Minute, "drain-test")
+	now := time.Now()
+	lb.drains.now = func() time.Time { return now }
+	recorder := record.NewFakeRecorder(20)
+	lb.recorder = recorder
+
+	service := newScenarioService()
+	ctx := context.TODO()
+
+	expectDroplets := func(expected []int) {
+		t.Helper()
+		if lbs := fake.LoadBalancers(); len(lbs) != 1 || !reflect.DeepEqual(lbs[0].DropletIDs, expected) {
+			t.Fatalf("expected load balancer for droplets %v, got %v", expected, lbs)
+		}
+	}
+
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectDroplets([]int{1, 2})
+	drainEvents(recorder)
+
+	// the draining node is removed right away, while still schedulable and
+	// without an update of the load balancer.
+	draining := nodes[1].DeepCopy()
+	draining.Annotations = map[string]string{annDrainFromLoadBalancers: "true"}
+	indexer.Update(draining)
+	lb.syncDrains(ctx)
+	expectDroplets([]int{1})
+	events := strings.Join(drainEvents(recorder), "\n")
+	for _, reason := range []string{"LoadBalancerBackendDraining Removed draining node node-2", "DrainingFromLoadBalancer"} {
+		if !strings.Contains(events, reason) {
+			t.Errorf("expected event %q, got %s", reason, events)
+		}
+	}
+
+	var m dto.Metric
+	if err := lbDrainingBackends.WithLabelValues("drain-test").Write(&m); err != nil || m.GetGauge().GetValue() != 1 {
+		t.Errorf("expected 1 draining backend, got %v and %v", m.GetGauge().GetValue(), err)
+	}
+
+	// the node is not reported drained before the window expired.
+	lb.syncDrains(ctx)
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events within the drain window, got %v", events)
+	}
+
+	now = now.Add(time.Minute)
+	lb.syncDrains(ctx)
+	events = strings.Join(drainEvents(recorder), "\n")
+	for _, reason := range []string{"LoadBalancerBackendDrained Node node-2 drained", "DrainedFromLoadBalancer"} {
+		if !strings.Contains(events, reason) {
+			t.Errorf("expected event %q, got %s", reason, events)
+		}
+	}
+	if err := lbDrainedBackends.WithLabelValues("drain-test").Write(&m); err != nil || m.GetCounter().GetValue() != 1 {
+		t.Errorf("expected 1 drained backend, got %v and %v", m.GetCounter().GetValue(), err)
+	}
+	if err := lbDrainingBackends.WithLabelValues("drain-test").Write(&m); err != nil || m.GetGauge().GetValue() != 0 {
+		t.Errorf("expected no draining backend, got %v and %v", m.GetGauge().GetValue(), err)
+	}
+
+	// draining nodes are not added back while still passed.
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, []*v1.Node{nodes[0], draining}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectDroplets([]int{1})
+
+	// the node is balanced across again once it no longer drains.
+	indexer.Update(nodes[1])
+	lb.syncDrains(ctx)
+	if drains := lb.drains.list(); len(drains) != 0 {
+		t.Errorf("expected drains to be forgotten, got %v", drains)
+	}
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectDroplets([]int{1, 2})
+}
+
+func Test_loadbalancers_drainOnUpdate(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1", "node-2")
+	defer closeFn()
+
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	}
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.drains = newLBDrains(time.Minute, "drain-test-update")
+	recorder := record.NewFakeRecorder(20)
+	lb.recorder = recorder
+
+	service := newScenarioService()
+	ctx := context.TODO()
+
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	drainEvents(recorder)
+
+	// a draining node passed to the update is removed, and its drain starts.
+	nodes[1].Annotations = map[string]string{annDrainFromLoadBalancers: "true"}
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lbs := fake.LoadBalancers(); !reflect.DeepEqual(lbs[0].DropletIDs, []int{1}) {
+		t.Errorf("expected draining node to be removed, got %v", lbs[0].DropletIDs)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); !strings.Contains(events, "LoadBalancerBackendDraining Removed draining node node-2") {
+		t.Errorf("expected the drain to be reported, got %s", events)
+	}
+	if drains := lb.drains.list(); len(drains) != 1 {
+		t.Errorf("expected 1 drain, got %v", drains)
+	}
+}
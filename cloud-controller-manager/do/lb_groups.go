@@ -0,0 +1,290 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+// annDOLoadBalancerGroup is the annotation used to place a Service into a
+// named group of Services sharing one DO load balancer. The forwarding rules
+// of all members are merged; the other settings of the load balancer, such
+// as its health check and algorithm, are taken from the oldest member.
+const annDOLoadBalancerGroup = "service.beta.kubernetes.io/do-loadbalancer-group"
+
+// lbGroupPattern matches valid load balancer group names.
+var lbGroupPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+var errNoServiceLister = errors.New("load balancer groups require the cloud provider to be initialized with a Service lister")
+
+// getLoadBalancerGroup returns the load balancer group of service, or an
+// empty string if it has none.
+func getLoadBalancerGroup(service *v1.Service) (string, error) {
+	group, ok := service.Annotations[annDOLoadBalancerGroup]
+	if !ok {
+		return "", nil
+	}
+
+	if !lbGroupPattern.MatchString(group) {
+		return "", fmt.Errorf("invalid load balancer group %q specified in annotation %q: must consist of at most 63 lower case alphanumeric characters or '-'", group, annDOLoadBalancerGroup)
+	}
+	if isFloatingIPMode(service) {
+		return "", fmt.Errorf("annotation %q cannot be used with %q set to %q", annDOLoadBalancerGroup, annDOLoadBalancerMode, lbModeFloatingIP)
+	}
+
+	return group, nil
+}
+
+// lbGroupName returns the name of the load balancer shared by the group in
+// the cluster clusterName.
+func lbGroupName(clusterName, group string) string {
+	return fmt.Sprintf("%s-group-%s", clusterName, group)
+}
+
+// lbName returns the name of the load balancer of service, which is shared
+// with the other Services of its group if it has one.
+func lbName(clusterName string, service *v1.Service) (string, error) {
+	group, err := getLoadBalancerGroup(service)
+	if err != nil {
+		return "", err
+	}
+
+	if group == "" {
+		return cloudprovider.GetLoadBalancerName(service), nil
+	}
+
+	return lbGroupName(clusterName, group), nil
+}
+
+// groupMembers returns the LoadBalancer Services of group in the account of
+// service, oldest first. The copy of service in the lister is replaced with
+// service itself, or left out if withService is false, e.g. because service
+// is being deleted.
+func (l *loadbalancers) groupMembers(group string, service *v1.Service, withService bool) ([]*v1.Service, error) {
+	if l.serviceLister == nil {
+		return nil, errNoServiceLister
+	}
+
+	services, err := l.serviceLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var members []*v1.Service
+	for _, s := range services {
+		if s.UID == service.UID || s.Spec.Type != v1.ServiceTypeLoadBalancer || s.DeletionTimestamp != nil {
+			continue
+		}
+		if s.Annotations[annDOLoadBalancerGroup] == group && s.Annotations[annDOAccount] == service.Annotations[annDOAccount] {
+			members = append(members, s)
+		}
+	}
+	if withService {
+		members = append(members, service)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		ti, tj := members[i].CreationTimestamp, members[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return serviceKey(members[i]) < serviceKey(members[j])
+	})
+
+	return members, nil
+}
+
+// serviceKey returns the namespace/name of service.
+func serviceKey(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
+
+// buildGroupLoadBalancerRequest returns a *godo.LoadBalancerRequest to
+// balance requests for members, the Services of group, across nodes. The
+// forwarding rules of members are merged; members are expected oldest first,
+// and rules of younger members whose entry port is taken are left out. The
+// entry ports left out are returned by member. The nodes are reported on
+// service, the Service being reconciled.
+func (l *loadbalancers) buildGroupLoadBalancerRequest(clusterName, group string, service *v1.Service, members []*v1.Service, nodes []*v1.Node) (*godo.LoadBalancerRequest, map[*v1.Service][]int, error) {
+	lbRequest, err := l.buildLoadBalancerRequestFor(clusterName, members[0], service, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	lbRequest.ForwardingRules = nil
+
+	conflicts := map[*v1.Service][]int{}
+	owners := map[int]*v1.Service{}
+	for _, member := range members {
+		rules, err := buildForwardingRules(member)
+		if err != nil {
+			glog.Warningf("leaving out the forwarding rules of service %s from load balancer group %q: %s", serviceKey(member), group, err)
+			continue
+		}
+
+		for _, rule := range rules {
+			if owner, ok := owners[rule.EntryPort]; ok && owner != member {
+				conflicts[member] = append(conflicts[member], rule.EntryPort)
+				continue
+			}
+			owners[rule.EntryPort] = member
+			lbRequest.ForwardingRules = append(lbRequest.ForwardingRules, rule)
+		}
+	}
+
+	return lbRequest, conflicts, nil
+}
+
+// loadBalancerRequest returns a *godo.LoadBalancerRequest for the load
+// balancer of service, merged with the other Services of its group if it has
+// one. The entry ports of service conflicting with older members of its group
+// are returned as well.
+func (l *loadbalancers) loadBalancerRequest(clusterName string, service *v1.Service, nodes []*v1.Node) (*godo.LoadBalancerRequest, []int, error) {
+	group, err := getLoadBalancerGroup(service)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if group == "" {
+		lbRequest, err := l.buildLoadBalancerRequest(clusterName, service, nodes)
+		return lbRequest, nil, err
+	}
+
+	members, err := l.groupMembers(group, service, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lbRequest, conflicts, err := l.buildGroupLoadBalancerRequest(clusterName, group, service, members, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return lbRequest, conflicts[service], nil
+}
+
+// removeFromGroup updates the load balancer of group to only hold the
+// forwarding rules of members, the Services left in the group after service
+// left it. It keeps balancing across the same droplets.
+func (l *loadbalancers) removeFromGroup(ctx context.Context, clusterName, group string, service *v1.Service, members []*v1.Service) error {
+	lb, err := l.lbByName(ctx, lbGroupName(clusterName, group))
+	if err != nil {
+		if err == errLBNotFound {
+			return nil
+		}
+		return err
+	}
+
+	lbRequest, _, err := l.buildGroupLoadBalancerRequest(clusterName, group, service, members, nil)
+	if err != nil {
+		return err
+	}
+	lbRequest.DropletIDs = lb.DropletIDs
+	if lb.Region != nil {
+		lbRequest.Region = lb.Region.Slug
+	}
+
+	return l.updateLoadBalancerByID(ctx, lb.ID, lbRequest)
+}
+
+// leaveOtherGroups removes the forwarding rules of service from the load
+// balancers of the groups it left. Those are the load balancers of other
+// groups forwarding to a node port of service, since node ports are unique
+// within the cluster. The load balancer of a group left without members is
+// deleted.
+func (l *loadbalancers) leaveOtherGroups(ctx context.Context, clusterName string, service *v1.Service) error {
+	group, err := getLoadBalancerGroup(service)
+	if err != nil {
+		return err
+	}
+
+	nodePorts := map[int]bool{}
+	for _, port := range service.Spec.Ports {
+		if port.NodePort != 0 {
+			nodePorts[int(port.NodePort)] = true
+		}
+	}
+	if len(nodePorts) == 0 {
+		return nil
+	}
+
+	prefix := lbGroupName(clusterName, "")
+	for _, lb := range l.index.withPrefix(prefix) {
+		left := strings.TrimPrefix(lb.Name, prefix)
+		if left == group || !forwardsToNodePorts(lb, nodePorts) {
+			continue
+		}
+
+		members, err := l.groupMembers(left, service, false)
+		if err != nil {
+			return err
+		}
+
+		glog.Infof("removing service %s from load balancer group %q it left", serviceKey(service), left)
+		if len(members) > 0 {
+			if err := l.removeFromGroup(ctx, clusterName, left, service, members); err != nil {
+				return err
+			}
+			continue
+		}
+
+		glog.Infof("deleting load balancer %s of group %q without members", lb.ID, left)
+		if _, err := l.client.LoadBalancers.Delete(ctx, lb.ID); err != nil && !isNotFound(err) {
+			return err
+		}
+		l.index.remove(lb.ID)
+	}
+
+	return nil
+}
+
+// forwardsToNodePorts returns true if a forwarding rule of lb targets one of
+// nodePorts.
+func forwardsToNodePorts(lb godo.LoadBalancer, nodePorts map[int]bool) bool {
+	for _, rule := range lb.ForwardingRules {
+		if nodePorts[rule.TargetPort] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// portConflictError returns the error reported for service whose entry ports
+// conflict with older members of its group, after recording an event.
+func (l *loadbalancers) portConflictError(service *v1.Service, ports []int) error {
+	strs := make([]string, len(ports))
+	for i, port := range ports {
+		strs[i] = fmt.Sprint(port)
+	}
+
+	message := fmt.Sprintf("entry ports %s are already used by other services of load balancer group %q", strings.Join(strs, ", "), service.Annotations[annDOLoadBalancerGroup])
+	l.eventf(service, v1.EventTypeWarning, "LoadBalancerPortConflict", "Forwarding rules for %s", message)
+
+	return fmt.Errorf("forwarding rules of service %s were left out: %s", serviceKey(service), message)
+}
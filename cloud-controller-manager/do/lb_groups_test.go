@@ -0,0 +1,280 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// newGroupService returns a LoadBalancer Service in group created at minute
+// of the test, with a port per entry port to node port mapping in ports.
+func newGroupService(name, group string, minute int, ports map[int32]int32) *v1.Service {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			UID:               types.UID("uid-" + name),
+			CreationTimestamp: metav1.NewTime(time.Date(2018, 8, 1, 10, minute, 0, 0, time.UTC)),
+			Annotations:       map[string]string{annDOLoadBalancerGroup: group},
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	for port, nodePort := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Protocol: "TCP", Port: port, NodePort: nodePort})
+	}
+	return service
+}
+
+// entryPorts returns the sorted entry ports of lb.
+func entryPorts(lb godo.LoadBalancer) []int {
+	var ports []int
+	for _, rule := range lb.ForwardingRules {
+		ports = append(ports, rule.EntryPort)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+func Test_getLoadBalancerGroup(t *testing.T) {
+	testcases := []struct {
+		name        string
+		annotations map[string]string
+		group       string
+		err         bool
+	}{
+		{
+			name:        "no group",
+			annotations: nil,
+			group:       "",
+		},
+		{
+			name:        "group",
+			annotations: map[string]string{annDOLoadBalancerGroup: "team-a"},
+			group:       "team-a",
+		},
+		{
+			name:        "invalid group",
+			annotations: map[string]string{annDOLoadBalancerGroup: "Team_A"},
+			err:         true,
+		},
+		{
+			name:        "empty group",
+			annotations: map[string]string{annDOLoadBalancerGroup: ""},
+			err:         true,
+		},
+		{
+			name:        "floating IP mode",
+			annotations: map[string]string{annDOLoadBalancerGroup: "team-a", annDOLoadBalancerMode: lbModeFloatingIP},
+			err:         true,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+			group, err := getLoadBalancerGroup(service)
+			if test.err != (err != nil) {
+				t.Fatalf("expected error %t, got %v", test.err, err)
+			}
+			if group != test.group {
+				t.Errorf("expected group %q, got %q", test.group, group)
+			}
+		})
+	}
+}
+
+func Test_loadbalancers_groupWithoutLister(t *testing.T) {
+	_, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	service := newGroupService("web", "shared", 0, map[int32]int32{80: 30080})
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+
+	if _, err := lb.EnsureLoadBalancer(context.TODO(), "cluster", service, nodes); err != errNoServiceLister {
+		t.Errorf("expected %v, got %v", errNoServiceLister, err)
+	}
+}
+
+func Test_loadbalancers_group(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	web := newGroupService("web", "shared", 0, map[int32]int32{80: 30080})
+	api := newGroupService("api", "shared", 1, map[int32]int32{8080: 30081})
+	// admin is the youngest member, so its port 80 conflicts with web's.
+	admin := newGroupService("admin", "shared", 2, map[int32]int32{80: 30082, 9090: 30083})
+	other := newGroupService("other", "other", 0, map[int32]int32{80: 30084})
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, s := range []*v1.Service{web, api, admin, other} {
+		indexer.Add(s)
+	}
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.serviceLister = corelisters.NewServiceLister(indexer)
+	recorder := record.NewFakeRecorder(10)
+	lb.recorder = recorder
+
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	ctx := context.TODO()
+
+	status, err := lb.EnsureLoadBalancer(ctx, "cluster", api, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || lbs[0].Name != "cluster-group-shared" {
+		t.Fatalf("expected a single load balancer for the group, got %v", lbs)
+	}
+	if ports := entryPorts(lbs[0]); !reflect.DeepEqual(ports, []int{80, 8080, 9090}) {
+		t.Errorf("expected merged entry ports, got %v", ports)
+	}
+	if lbs[0].HealthCheck.Port != 30080 {
+		t.Errorf("expected health check of the oldest member, got %+v", lbs[0].HealthCheck)
+	}
+	if _, ok := lb.backends[api.UID]; !ok {
+		t.Error("expected backends to be reported on the reconciled service")
+	}
+	if _, ok := lb.backends[web.UID]; ok {
+		t.Error("expected no backends to be reported on the oldest member")
+	}
+
+	if webStatus, err := lb.EnsureLoadBalancer(ctx, "cluster", web, nodes); err != nil || !reflect.DeepEqual(webStatus, status) {
+		t.Errorf("expected members to share %v, got %v and %v", status, webStatus, err)
+	}
+
+	_, err = lb.EnsureLoadBalancer(ctx, "cluster", admin, nodes)
+	if err == nil || !strings.Contains(err.Error(), "entry ports 80 are already used") {
+		t.Errorf("expected port conflict, got %v", err)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); !strings.Contains(events, "LoadBalancerPortConflict") {
+		t.Errorf("expected a LoadBalancerPortConflict event, got %s", events)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs) != 1 {
+		t.Errorf("expected the group to keep a single load balancer, got %v", lbs)
+	}
+
+	// once web is gone, admin gets port 80.
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", web); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	indexer.Delete(web)
+	lbs = fake.LoadBalancers()
+	if len(lbs) != 1 {
+		t.Fatalf("expected load balancer to be kept for the other members, got %v", lbs)
+	}
+	if ports := entryPorts(lbs[0]); !reflect.DeepEqual(ports, []int{80, 8080, 9090}) {
+		t.Errorf("expected admin to take over port 80, got %v", ports)
+	}
+	targets := map[int]int{}
+	for _, rule := range lbs[0].ForwardingRules {
+		targets[rule.EntryPort] = rule.TargetPort
+	}
+	if expected := map[int]int{80: 30082, 8080: 30081, 9090: 30083}; !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected target ports %v, got %v", expected, targets)
+	}
+	if len(lbs[0].DropletIDs) != 1 {
+		t.Errorf("expected droplets to be kept, got %v", lbs[0].DropletIDs)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", api); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	indexer.Delete(api)
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", admin); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	indexer.Delete(admin)
+	if lbs := fake.LoadBalancers(); len(lbs) != 0 {
+		t.Errorf("expected load balancer to be deleted with its last member, got %v", lbs)
+	}
+}
+
+func Test_loadbalancers_groupLeft(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	web := newGroupService("web", "shared", 0, map[int32]int32{80: 30080})
+	api := newGroupService("api", "shared", 1, map[int32]int32{8080: 30081})
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(web)
+	indexer.Add(api)
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.serviceLister = corelisters.NewServiceLister(indexer)
+
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	ctx := context.TODO()
+
+	for _, s := range []*v1.Service{web, api} {
+		if _, err := lb.EnsureLoadBalancer(ctx, "cluster", s, nodes); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	byName := func() map[string]godo.LoadBalancer {
+		lbs := map[string]godo.LoadBalancer{}
+		for _, lb := range fake.LoadBalancers() {
+			lbs[lb.Name] = lb
+		}
+		return lbs
+	}
+
+	// api moves to another group, its rules leave the shared load balancer.
+	api = api.DeepCopy()
+	api.Annotations[annDOLoadBalancerGroup] = "other"
+	indexer.Update(api)
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", api, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := byName()
+	if ports := entryPorts(lbs["cluster-group-shared"]); !reflect.DeepEqual(ports, []int{80}) {
+		t.Errorf("expected only the rules of web on the shared load balancer, got %v", ports)
+	}
+	if ports := entryPorts(lbs["cluster-group-other"]); !reflect.DeepEqual(ports, []int{8080}) {
+		t.Errorf("expected the rules of api on the load balancer of its new group, got %v", ports)
+	}
+
+	// web leaves the group it is the last member of, its load balancer is
+	// deleted.
+	web = web.DeepCopy()
+	delete(web.Annotations, annDOLoadBalancerGroup)
+	indexer.Update(web)
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", web, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs = byName()
+	if _, ok := lbs["cluster-group-shared"]; ok || len(lbs) != 2 {
+		t.Errorf("expected the load balancer of the group without members to be deleted, got %v", lbs)
+	}
+}
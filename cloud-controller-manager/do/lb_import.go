@@ -0,0 +1,367 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// annDOLoadBalancerID is the annotation used to adopt an existing load
+	// balancer, e.g. one built by hand, for a Service. It is used while no
+	// load balancer has the name of the Service's, renamed on its first
+	// update and deleted along with the Service. Adoption must be enabled
+	// through doLBAdoptionEnv, and is refused for load balancers named like
+	// those of other Services or groups.
+	annDOLoadBalancerID = "service.beta.kubernetes.io/do-loadbalancer-id"
+
+	// the range node ports are allocated from by default.
+	defaultNodePortMin = 30000
+	defaultNodePortMax = 32767
+)
+
+// lbForService returns the load balancer name of service, or the load
+// balancer to adopt if none is named name. The returned error is
+// errLBNotFound if neither exists.
+func (l *loadbalancers) lbForService(ctx context.Context, name string, service *v1.Service) (*godo.LoadBalancer, error) {
+	lb, err := l.lbByName(ctx, name)
+	if err != errLBNotFound {
+		return lb, err
+	}
+
+	lb, err = l.adoptedLoadBalancer(ctx, service)
+	if err != nil || lb == nil {
+		return nil, err
+	}
+
+	l.adoptedMu.Lock()
+	reported := l.adopted[service.UID] == lb.ID
+	l.adopted[service.UID] = lb.ID
+	l.adoptedMu.Unlock()
+
+	if !reported {
+		glog.Infof("adopting load balancer %s (%s) for service %s", lb.ID, lb.Name, serviceKey(service))
+		l.eventf(service, v1.EventTypeNormal, "AdoptingLoadBalancer", "Adopting load balancer %s named %s specified in annotation %q", lb.ID, lb.Name, annDOLoadBalancerID)
+	}
+	return lb, nil
+}
+
+// adoptionRefusedError reports that a Service may not adopt the load
+// balancer specified in annDOLoadBalancerID.
+type adoptionRefusedError struct {
+	msg string
+}
+
+func (e *adoptionRefusedError) Error() string {
+	return e.msg
+}
+
+// adoptedLoadBalancer returns the load balancer specified in
+// annDOLoadBalancerID of service, or errLBNotFound if it does not exist. nil
+// is returned if service has no such annotation. The returned error is an
+// *adoptionRefusedError if service may not adopt the load balancer, see
+// checkAdoptable.
+func (l *loadbalancers) adoptedLoadBalancer(ctx context.Context, service *v1.Service) (*godo.LoadBalancer, error) {
+	id := service.Annotations[annDOLoadBalancerID]
+	if id == "" {
+		return nil, errLBNotFound
+	}
+	if !l.adoption {
+		return nil, &adoptionRefusedError{fmt.Sprintf("annotation %q requires adopting load balancers to be enabled with %s", annDOLoadBalancerID, doLBAdoptionEnv)}
+	}
+
+	lb, _, err := l.client.LoadBalancers.Get(ctx, id)
+	if err != nil {
+		if isNotFound(err) {
+			glog.Warningf("load balancer %s specified in annotation %q of service %s does not exist", id, annDOLoadBalancerID, serviceKey(service))
+			return nil, errLBNotFound
+		}
+		return nil, err
+	}
+
+	if err := l.checkAdoptable(lb, service); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+// lbGroupNamePattern matches the names of the load balancers of groups in
+// any cluster.
+var lbGroupNamePattern = regexp.MustCompile(`-group-[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// lbServiceNamePattern matches the names of the load balancers of Services,
+// see cloudprovider.GetLoadBalancerName.
+var lbServiceNamePattern = regexp.MustCompile(`^a[0-9a-f]{31}$`)
+
+// checkAdoptable returns an error if service may not adopt lb: load
+// balancers named like those created for Services or groups, in this
+// cluster or another, belong to them, and a load balancer is adopted by a
+// single Service.
+func (l *loadbalancers) checkAdoptable(lb *godo.LoadBalancer, service *v1.Service) error {
+	if lbServiceNamePattern.MatchString(lb.Name) || lbGroupNamePattern.MatchString(lb.Name) {
+		return &adoptionRefusedError{fmt.Sprintf("load balancer %s specified in annotation %q is named %s like those created for Services, only load balancers created otherwise can be adopted", lb.ID, annDOLoadBalancerID, lb.Name)}
+	}
+
+	if l.serviceLister == nil {
+		return nil
+	}
+	services, err := l.serviceLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, s := range services {
+		if s.UID != service.UID && s.Annotations[annDOLoadBalancerID] == lb.ID {
+			return &adoptionRefusedError{fmt.Sprintf("load balancer %s specified in annotation %q is adopted by service %s already", lb.ID, annDOLoadBalancerID, serviceKey(s))}
+		}
+	}
+	return nil
+}
+
+// ServiceFromLoadBalancer returns a Service of type LoadBalancer whose
+// annotations and ports make the provider adopt lb and keep its settings,
+// along with the settings of lb which cannot be represented and are changed
+// once the Service is created. The selector of the Service is left for the
+// caller to fill in.
+func ServiceFromLoadBalancer(lb *godo.LoadBalancer) (*v1.Service, []string) {
+	service := &v1.Service{
+		TypeMeta: metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        serviceNameForLoadBalancer(lb),
+			Annotations: map[string]string{annDOLoadBalancerID: lb.ID},
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	annotations := service.Annotations
+	var unrepresentable []string
+
+	if lb.Region != nil && lb.Region.Slug != "" {
+		annotations[annDOLoadBalancerRegion] = lb.Region.Slug
+	}
+	if lb.Algorithm == "least_connections" {
+		annotations[annDOAlgorithm] = lb.Algorithm
+	}
+	if lb.RedirectHttpToHttps {
+		annotations[annDORedirectHttpToHttps] = "true"
+	}
+
+	if lb.Tag != "" {
+		annotations[annDOLoadBalancerDropletTag] = lb.Tag
+		unrepresentable = append(unrepresentable, fmt.Sprintf("the load balancer balances across the droplets tagged %s; only the droplets of nodes carrying the tag are balanced across", lb.Tag))
+	} else if len(lb.DropletIDs) > 0 {
+		unrepresentable = append(unrepresentable, fmt.Sprintf("droplets %s are replaced with the droplets of the nodes of the cluster", joinInts(lb.DropletIDs)))
+	}
+
+	if s := lb.StickySessions; s != nil && s.Type == "cookies" {
+		annotations[annDOStickySessionsType] = s.Type
+		annotations[annDOStickySessionsCookieName] = s.CookieName
+		annotations[annDOStickySessionsCookieTTL] = strconv.Itoa(s.CookieTtlSeconds)
+	}
+
+	protocol := forwardingProtocol(lb)
+	if protocol != "tcp" {
+		annotations[annDOProtocol] = protocol
+	}
+	unrepresentable = append(unrepresentable, importForwardingRules(service, protocol, lb.ForwardingRules)...)
+	unrepresentable = append(unrepresentable, importHealthCheck(service, protocol, lb.HealthCheck)...)
+
+	return service, unrepresentable
+}
+
+// serviceNameForLoadBalancer returns a valid Service name made from the name
+// of lb.
+func serviceNameForLoadBalancer(lb *godo.LoadBalancer) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(lb.Name))
+
+	name = strings.Trim(name, "-")
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "lb-" + name
+	}
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// forwardingProtocol returns the protocol annotation matching the forwarding
+// rules of lb best: the protocol of its plain rules, else the target
+// protocol of its rules terminating TLS, else that of its health check.
+func forwardingProtocol(lb *godo.LoadBalancer) string {
+	for _, rule := range lb.ForwardingRules {
+		if rule.CertificateID == "" && !rule.TlsPassthrough && rule.EntryProtocol == rule.TargetProtocol {
+			return rule.EntryProtocol
+		}
+	}
+	for _, rule := range lb.ForwardingRules {
+		if rule.CertificateID != "" {
+			return rule.TargetProtocol
+		}
+	}
+	if lb.HealthCheck != nil && (lb.HealthCheck.Protocol == "http" || lb.HealthCheck.Protocol == "https") {
+		return lb.HealthCheck.Protocol
+	}
+	if len(lb.ForwardingRules) > 0 {
+		return "https"
+	}
+	return "tcp"
+}
+
+// importForwardingRules adds a port to service for each of rules which
+// buildForwardingRules produces with protocol, along with the TLS
+// annotations. The rules which cannot be produced are returned.
+func importForwardingRules(service *v1.Service, protocol string, rules []godo.ForwardingRule) []string {
+	var unrepresentable []string
+	var tlsPorts []string
+	certificateID := ""
+	passthrough := false
+	nodePorts := map[int]bool{}
+
+	for _, rule := range rules {
+		tls := false
+		switch {
+		case rule.EntryProtocol == protocol && rule.TargetProtocol == protocol && rule.CertificateID == "" && !rule.TlsPassthrough:
+		case protocol != "tcp" && rule.EntryProtocol == "https" && rule.CertificateID != "" && !rule.TlsPassthrough && rule.TargetProtocol == protocol &&
+			!passthrough && (certificateID == "" || certificateID == rule.CertificateID):
+			tls = true
+			certificateID = rule.CertificateID
+		case protocol != "tcp" && rule.EntryProtocol == "https" && rule.TlsPassthrough && rule.TargetProtocol == "https" && certificateID == "":
+			tls = true
+			passthrough = true
+		default:
+			unrepresentable = append(unrepresentable, fmt.Sprintf("forwarding rule %s is left out, it cannot be combined with protocol %s and the other rules", formatForwardingRule(rule), protocol))
+			continue
+		}
+
+		port := v1.ServicePort{
+			Name:       fmt.Sprintf("%s-%d", rule.EntryProtocol, rule.EntryPort),
+			Protocol:   v1.ProtocolTCP,
+			Port:       int32(rule.EntryPort),
+			TargetPort: intstr.FromInt(rule.EntryPort),
+		}
+		switch {
+		case rule.TargetPort < defaultNodePortMin || rule.TargetPort > defaultNodePortMax:
+			unrepresentable = append(unrepresentable, fmt.Sprintf("target port %d of forwarding rule %s is not a node port, another one is allocated", rule.TargetPort, formatForwardingRule(rule)))
+		case nodePorts[rule.TargetPort]:
+			unrepresentable = append(unrepresentable, fmt.Sprintf("target port %d of forwarding rule %s is the node port of another port, another one is allocated", rule.TargetPort, formatForwardingRule(rule)))
+		default:
+			port.NodePort = int32(rule.TargetPort)
+			nodePorts[rule.TargetPort] = true
+		}
+		service.Spec.Ports = append(service.Spec.Ports, port)
+
+		if tls {
+			tlsPorts = append(tlsPorts, strconv.Itoa(rule.EntryPort))
+		}
+	}
+
+	if len(tlsPorts) > 0 {
+		service.Annotations[annDOTLSPorts] = strings.Join(tlsPorts, ",")
+	}
+	if certificateID != "" {
+		service.Annotations[annDOCertificateID] = certificateID
+	}
+	if passthrough {
+		service.Annotations[annDOTLSPassThrough] = "true"
+	}
+
+	return unrepresentable
+}
+
+// importHealthCheck adds the annotations of healthCheck to service, whose
+// ports were imported with protocol. The settings buildHealthCheck does not
+// produce are returned.
+func importHealthCheck(service *v1.Service, protocol string, healthCheck *godo.HealthCheck) []string {
+	if healthCheck == nil {
+		return nil
+	}
+
+	// the health check uses the node port of the first port.
+	ports := service.Spec.Ports
+	for i := range ports {
+		if ports[i].NodePort != 0 && ports[i].NodePort == int32(healthCheck.Port) {
+			ports[0], ports[i] = ports[i], ports[0]
+			break
+		}
+	}
+
+	var unrepresentable []string
+	if healthCheck.Protocol != protocol {
+		unrepresentable = append(unrepresentable, fmt.Sprintf("health check protocol %s is changed to %s", healthCheck.Protocol, protocol))
+	}
+	if healthCheck.Path != "" && protocol != "tcp" {
+		service.Annotations[annDOHealthCheckPath] = healthCheck.Path
+	}
+	if len(service.Spec.Ports) > 0 && service.Spec.Ports[0].NodePort != int32(healthCheck.Port) {
+		unrepresentable = append(unrepresentable, fmt.Sprintf("health check port %d is changed to the node port of the first port", healthCheck.Port))
+	}
+
+	settings := []struct {
+		name         string
+		value, fixed int
+	}{
+		{"check interval", healthCheck.CheckIntervalSeconds, 3},
+		{"response timeout", healthCheck.ResponseTimeoutSeconds, 5},
+		{"healthy threshold", healthCheck.HealthyThreshold, 5},
+		{"unhealthy threshold", healthCheck.UnhealthyThreshold, 3},
+	}
+	for _, setting := range settings {
+		if setting.value != setting.fixed {
+			unrepresentable = append(unrepresentable, fmt.Sprintf("health check %s %d is changed to %d", setting.name, setting.value, setting.fixed))
+		}
+	}
+
+	return unrepresentable
+}
+
+// formatForwardingRule returns rule as entry -> target, e.g.
+// https:443 -> http:30080.
+func formatForwardingRule(rule godo.ForwardingRule) string {
+	s := fmt.Sprintf("%s:%d -> %s:%d", rule.EntryProtocol, rule.EntryPort, rule.TargetProtocol, rule.TargetPort)
+	if rule.CertificateID != "" {
+		s += " with certificate " + rule.CertificateID
+	}
+	if rule.TlsPassthrough {
+		s += " with TLS passthrough"
+	}
+	return s
+}
+
+// joinInts returns ints sorted and separated by commas.
+func joinInts(ints []int) string {
+	sorted := sortedInts(ints)
+	s := make([]string, len(sorted))
+	for i, n := range sorted {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ", ")
+}
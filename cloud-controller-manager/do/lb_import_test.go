@@ -0,0 +1,268 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_ServiceFromLoadBalancer(t *testing.T) {
+	testcases := []struct {
+		name            string
+		lb              *godo.LoadBalancer
+		unrepresentable []string
+		diff            []string
+	}{
+		{
+			name: "representable",
+			lb: &godo.LoadBalancer{
+				ID:        "lb-1",
+				Name:      "Web_LB",
+				Region:    &godo.Region{Slug: "ams3"},
+				Algorithm: "least_connections",
+				ForwardingRules: []godo.ForwardingRule{
+					{EntryProtocol: "http", EntryPort: 80, TargetProtocol: "http", TargetPort: 30080},
+					{EntryProtocol: "https", EntryPort: 443, TargetProtocol: "http", TargetPort: 30443, CertificateID: "cert-1"},
+				},
+				HealthCheck: &godo.HealthCheck{
+					Protocol: "http", Port: 30443, Path: "/healthz",
+					CheckIntervalSeconds: 3, ResponseTimeoutSeconds: 5, HealthyThreshold: 5, UnhealthyThreshold: 3,
+				},
+				StickySessions:      &godo.StickySessions{Type: "cookies", CookieName: "DO", CookieTtlSeconds: 300},
+				RedirectHttpToHttps: true,
+			},
+			diff: []string{`name: live "Web_LB", rendered "ascenario"`},
+		},
+		{
+			name: "unrepresentable",
+			lb: &godo.LoadBalancer{
+				ID:         "lb-2",
+				Name:       "2nd",
+				Region:     &godo.Region{Slug: "nyc1"},
+				Algorithm:  "round_robin",
+				DropletIDs: []int{3, 4},
+				ForwardingRules: []godo.ForwardingRule{
+					{EntryProtocol: "http", EntryPort: 80, TargetProtocol: "http", TargetPort: 30080},
+					{EntryProtocol: "http", EntryPort: 8080, TargetProtocol: "http", TargetPort: 30080},
+					{EntryProtocol: "tcp", EntryPort: 22, TargetProtocol: "tcp", TargetPort: 22},
+				},
+				HealthCheck: &godo.HealthCheck{
+					Protocol: "tcp", Port: 30080,
+					CheckIntervalSeconds: 10, ResponseTimeoutSeconds: 5, HealthyThreshold: 5, UnhealthyThreshold: 3,
+				},
+				StickySessions: &godo.StickySessions{Type: "none"},
+			},
+			unrepresentable: []string{
+				"droplets 3, 4 are replaced with the droplets of the nodes of the cluster",
+				"target port 30080 of forwarding rule http:8080 -> http:30080 is the node port of another port, another one is allocated",
+				"forwarding rule tcp:22 -> tcp:22 is left out, it cannot be combined with protocol http and the other rules",
+				"health check protocol tcp is changed to http",
+				"health check check interval 10 is changed to 3",
+			},
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			service, unrepresentable := ServiceFromLoadBalancer(test.lb)
+			if !reflect.DeepEqual(unrepresentable, test.unrepresentable) {
+				t.Errorf("expected unrepresentable settings %q, got %q", test.unrepresentable, unrepresentable)
+			}
+			if service.Annotations[annDOLoadBalancerID] != test.lb.ID {
+				t.Errorf("expected service to adopt %s, got %v", test.lb.ID, service.Annotations)
+			}
+			if test.diff == nil {
+				return
+			}
+
+			// the settings of representable load balancers are kept.
+			service.UID = "scenario"
+			rendered := RenderLoadBalancer("cluster", "nyc1", service, nil, nil)
+			if len(rendered.Errors) != 0 {
+				t.Fatalf("unexpected errors: %v", rendered.Errors)
+			}
+			if diff := DiffLoadBalancer(rendered.Request, test.lb); !reflect.DeepEqual(diff, test.diff) {
+				t.Errorf("expected diff %q, got %q", test.diff, diff)
+			}
+		})
+	}
+}
+
+func Test_serviceNameForLoadBalancer(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Web_LB":                 "web-lb",
+		"2nd":                    "lb-2nd",
+		"--":                     "lb",
+		strings.Repeat("a", 70):  strings.Repeat("a", 63),
+		"prod.example.com (old)": "prod-example-com--old",
+	} {
+		if actual := serviceNameForLoadBalancer(&godo.LoadBalancer{Name: name}); actual != expected {
+			t.Errorf("expected name %q for %q, got %q", expected, name, actual)
+		}
+	}
+}
+
+func Test_loadbalancers_adopt(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	handBuilt := fake.AddLoadBalancer(godo.LoadBalancer{
+		Name:   "hand-built",
+		Region: &godo.Region{Slug: "nyc1"},
+		ForwardingRules: []godo.ForwardingRule{
+			{EntryProtocol: "tcp", EntryPort: 80, TargetProtocol: "tcp", TargetPort: 30080},
+		},
+	})
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.adoption = true
+	recorder := record.NewFakeRecorder(10)
+	lb.recorder = recorder
+
+	service := newScenarioService()
+	service.Annotations = map[string]string{annDOLoadBalancerID: handBuilt.ID}
+	nodes := []*v1.Node{newLabeledNode("node-1", nil)}
+	ctx := context.TODO()
+
+	status, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status.Ingress[0].IP != handBuilt.IP {
+		t.Errorf("expected IP %s of the adopted load balancer, got %s", handBuilt.IP, status.Ingress[0].IP)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || lbs[0].ID != handBuilt.ID || lbs[0].Name != "ascenario" || !reflect.DeepEqual(lbs[0].DropletIDs, []int{1}) {
+		t.Fatalf("expected the hand built load balancer to be renamed and updated, got %v", lbs)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); strings.Count(events, "AdoptingLoadBalancer Adopting load balancer "+handBuilt.ID) != 1 {
+		t.Errorf("expected adoption to be reported once, got %s", events)
+	}
+
+	// once renamed, the load balancer is found by name.
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if events := drainEvents(recorder); strings.Contains(strings.Join(events, "\n"), "AdoptingLoadBalancer") {
+		t.Errorf("expected no further adoption, got %v", events)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs) != 1 {
+		t.Errorf("expected no other load balancer, got %v", lbs)
+	}
+}
+
+func Test_loadbalancers_deleteAdopted(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	handBuilt := fake.AddLoadBalancer(godo.LoadBalancer{Name: "hand-built", Region: &godo.Region{Slug: "nyc1"}})
+	other := fake.AddLoadBalancer(godo.LoadBalancer{Name: "other", Region: &godo.Region{Slug: "nyc1"}})
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.adoption = true
+	ctx := context.TODO()
+
+	// the Service is deleted before the adopted load balancer was renamed.
+	service := newScenarioService()
+	service.Annotations = map[string]string{annDOLoadBalancerID: handBuilt.ID}
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs) != 1 || lbs[0].ID != other.ID {
+		t.Fatalf("expected the adopted load balancer to be deleted, got %v", lbs)
+	}
+
+	// a load balancer named after the Service takes precedence over the
+	// annotation, which is left alone.
+	fake.AddLoadBalancer(godo.LoadBalancer{Name: "ascenario", Region: &godo.Region{Slug: "nyc1"}})
+	service.Annotations = map[string]string{annDOLoadBalancerID: other.ID}
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lbs := fake.LoadBalancers(); len(lbs) != 1 || lbs[0].ID != other.ID {
+		t.Errorf("expected only the load balancer named after the service to be deleted, got %v", lbs)
+	}
+}
+
+func Test_loadbalancers_adoptRefused(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	handBuilt := fake.AddLoadBalancer(godo.LoadBalancer{Name: "hand-built", Region: &godo.Region{Slug: "nyc1"}})
+	ofService := fake.AddLoadBalancer(godo.LoadBalancer{Name: "a0123456789abcdef0123456789abcde", Region: &godo.Region{Slug: "nyc1"}})
+	ofGroup := fake.AddLoadBalancer(godo.LoadBalancer{Name: "other-cluster-group-web", Region: &godo.Region{Slug: "nyc1"}})
+
+	claimed := newScenarioService()
+	claimed.Name = "claimed"
+	claimed.UID = "claimed"
+	claimed.Annotations = map[string]string{annDOLoadBalancerID: handBuilt.ID}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(claimed)
+
+	nodes := []*v1.Node{newLabeledNode("node-1", nil)}
+	ctx := context.TODO()
+
+	testcases := []struct {
+		name     string
+		adoption bool
+		id       string
+		err      string
+	}{
+		{"adoption disabled", false, handBuilt.ID, "requires adopting load balancers to be enabled with DO_LB_ADOPTION"},
+		{"load balancer of a service", true, ofService.ID, "named a0123456789abcdef0123456789abcde like those created for Services"},
+		{"load balancer of a group", true, ofGroup.ID, "named other-cluster-group-web like those created for Services"},
+		{"adopted by another service", true, handBuilt.ID, "adopted by service default/claimed already"},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+			lb.adoption = test.adoption
+			lb.serviceLister = corelisters.NewServiceLister(indexer)
+
+			service := newScenarioService()
+			service.Annotations = map[string]string{annDOLoadBalancerID: test.id}
+
+			_, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+
+			// the load balancer is left alone when the Service is deleted.
+			if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			for _, found := range fake.LoadBalancers() {
+				if found.ID == test.id && found.Name == "ascenario" {
+					t.Errorf("expected load balancer %s not to be renamed", test.id)
+				}
+			}
+			if lbs := fake.LoadBalancers(); len(lbs) != 3 {
+				t.Errorf("expected no load balancer to be created or deleted, got %v", lbs)
+			}
+		})
+	}
+}
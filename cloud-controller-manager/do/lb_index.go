@@ -0,0 +1,205 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+// defaultLBIndexTTL is the duration after which load balancers found in the
+// index are listed again before being used.
+const defaultLBIndexTTL = 1 * time.Minute
+
+// lbIndex indexes the load balancers of the account by name and ID.
+//
+// Load balancers found in a fresh index are used as is, while names missing
+// from it are always listed again, so that a stale index never leads to
+// creating a duplicate load balancer. Mutations made through the cloud
+// provider update the index in place.
+type lbIndex struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	byID map[string]godo.LoadBalancer
+	// byName holds the IDs of the load balancers with a name, the one in
+	// use first.
+	byName  map[string][]string
+	fetched time.Time
+	// warned holds the IDs of the load balancers sharing a name which were
+	// last logged, by name, so that each set is logged once.
+	warned map[string]string
+}
+
+// newLBIndex returns an empty lbIndex whose entries are fresh for ttl.
+func newLBIndex(ttl time.Duration) *lbIndex {
+	return &lbIndex{
+		ttl:    ttl,
+		byID:   map[string]godo.LoadBalancer{},
+		byName: map[string][]string{},
+		warned: map[string]string{},
+	}
+}
+
+// lookup returns the load balancer in use named name, or nil if the index
+// has none, and whether the index is fresh.
+func (i *lbIndex) lookup(name string) (*godo.LoadBalancer, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	fresh := time.Since(i.fetched) < i.ttl
+
+	ids := i.byName[name]
+	if len(ids) == 0 {
+		return nil, fresh
+	}
+
+	lb := i.byID[ids[0]]
+	return &lb, fresh
+}
+
+// all returns the load balancers named name, the one in use first.
+func (i *lbIndex) all(name string) []godo.LoadBalancer {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var lbs []godo.LoadBalancer
+	for _, id := range i.byName[name] {
+		lbs = append(lbs, i.byID[id])
+	}
+	return lbs
+}
+
+// withPrefix returns the load balancers in use whose name starts with prefix,
+// ordered by name.
+func (i *lbIndex) withPrefix(prefix string) []godo.LoadBalancer {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var names []string
+	for name := range i.byName {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lbs := make([]godo.LoadBalancer, 0, len(names))
+	for _, name := range names {
+		lbs = append(lbs, i.byID[i.byName[name][0]])
+	}
+	return lbs
+}
+
+// replace replaces the indexed load balancers with lbs, as listed from the
+// API. Load balancers sharing a name are logged once per set of load
+// balancers.
+func (i *lbIndex) replace(lbs []godo.LoadBalancer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.byID = map[string]godo.LoadBalancer{}
+	i.byName = map[string][]string{}
+	for _, lb := range lbs {
+		i.byID[lb.ID] = lb
+		i.byName[lb.Name] = append(i.byName[lb.Name], lb.ID)
+	}
+	warned := map[string]string{}
+	for name := range i.byName {
+		i.sortName(name)
+		ids := i.byName[name]
+		if len(ids) < 2 {
+			continue
+		}
+
+		set := strings.Join(ids, ",")
+		if i.warned[name] != set {
+			glog.Warningf("found %d load balancers named %q, using the oldest %s and ignoring %s", len(ids), name, ids[0], strings.Join(ids[1:], ", "))
+		}
+		warned[name] = set
+	}
+	i.warned = warned
+	i.fetched = time.Now()
+}
+
+// put adds or updates lb, e.g. once it was created or updated. Load
+// balancers without an IP, such as new ones, are removed instead so that they
+// are listed again once looked up.
+func (i *lbIndex) put(lb *godo.LoadBalancer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if old, ok := i.byID[lb.ID]; ok {
+		delete(i.byID, lb.ID)
+		i.removeID(old.Name, lb.ID)
+	}
+	if lb.IP == "" {
+		return
+	}
+
+	i.byID[lb.ID] = *lb
+	i.byName[lb.Name] = append(i.byName[lb.Name], lb.ID)
+	i.sortName(lb.Name)
+}
+
+// remove removes the load balancer id, e.g. once it was deleted.
+func (i *lbIndex) remove(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	lb, ok := i.byID[id]
+	if !ok {
+		return
+	}
+	delete(i.byID, id)
+	i.removeID(lb.Name, id)
+}
+
+// removeID removes id from the IDs named name. i.mu must be held.
+func (i *lbIndex) removeID(name, id string) {
+	ids := i.byName[name]
+	for n := range ids {
+		if ids[n] == id {
+			ids = append(ids[:n], ids[n+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(i.byName, name)
+		return
+	}
+	i.byName[name] = ids
+}
+
+// sortName orders the IDs named name so that the oldest load balancer is
+// used, and the one with the lowest ID among those created at once. i.mu must
+// be held.
+func (i *lbIndex) sortName(name string) {
+	ids := i.byName[name]
+	sort.Slice(ids, func(a, b int) bool {
+		ca, cb := i.byID[ids[a]].Created, i.byID[ids[b]].Created
+		if ca != cb {
+			return ca < cb
+		}
+		return ids[a] < ids[b]
+	})
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+// countRequests returns the number of requests made to fake for
+// method and path.
+func countRequests(fake *fakedo.Server, request string) int {
+	n := 0
+	for _, r := range fake.Requests() {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func Test_lbByName_pages(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t)
+	defer closeFn()
+
+	for i := 0; i < apiPerPage+20; i++ {
+		fake.AddLoadBalancer(godo.LoadBalancer{Name: fmt.Sprintf("lb-%d", i)})
+	}
+
+	lb := newTestLoadbalancers(client, "nyc1", 2, 1)
+	ctx := context.TODO()
+
+	found, err := lb.lbByName(ctx, fmt.Sprintf("lb-%d", apiPerPage+10))
+	if err != nil {
+		t.Fatalf("expected load balancer on the second page to be found, got %s", err)
+	}
+	if found.Name != fmt.Sprintf("lb-%d", apiPerPage+10) {
+		t.Errorf("unexpected load balancer %q", found.Name)
+	}
+	if n := countRequests(fake, "GET /v2/load_balancers"); n != 2 {
+		t.Errorf("expected both pages to be listed, got %d requests", n)
+	}
+
+	// found load balancers are served from the index.
+	if _, err := lb.lbByName(ctx, "lb-3"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := countRequests(fake, "GET /v2/load_balancers"); n != 2 {
+		t.Errorf("expected indexed load balancer not to be listed again, got %d requests", n)
+	}
+
+	// missing ones are always listed again, so that load balancers created
+	// elsewhere are found.
+	fake.AddLoadBalancer(godo.LoadBalancer{Name: "lb-new"})
+	if _, err := lb.lbByName(ctx, "lb-new"); err != nil {
+		t.Fatalf("expected load balancer created since the last listing to be found, got %s", err)
+	}
+	if _, err := lb.lbByName(ctx, "lb-missing"); err != errLBNotFound {
+		t.Errorf("expected %v, got %v", errLBNotFound, err)
+	}
+	if n := countRequests(fake, "GET /v2/load_balancers"); n != 6 {
+		t.Errorf("expected missing load balancers to be listed again, got %d requests", n)
+	}
+}
+
+func Test_lbByName_staleIndex(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t)
+	defer closeFn()
+
+	fake.AddLoadBalancer(godo.LoadBalancer{Name: "lb"})
+
+	lb := newTestLoadbalancers(client, "nyc1", 2, 1)
+	lb.index = newLBIndex(0)
+	ctx := context.TODO()
+
+	for i := 0; i < 2; i++ {
+		if _, err := lb.lbByName(ctx, "lb"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := countRequests(fake, "GET /v2/load_balancers"); n != 2 {
+		t.Errorf("expected stale index to be listed again, got %d requests", n)
+	}
+}
+
+func Test_loadbalancers_duplicates(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	service := newScenarioService()
+	name := cloudprovider.GetLoadBalancerName(service)
+	newer := fake.AddLoadBalancer(godo.LoadBalancer{Name: name, Created: "2018-08-02T10:00:00Z"})
+	oldest := fake.AddLoadBalancer(godo.LoadBalancer{Name: name, Created: "2018-08-01T10:00:00Z"})
+	other := fake.AddLoadBalancer(godo.LoadBalancer{Name: "other"})
+
+	lb := newTestLoadbalancers(client, "nyc1", 2, 1)
+	ctx := context.TODO()
+
+	found, err := lb.lbByName(ctx, name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if found.ID != oldest.ID {
+		t.Errorf("expected the oldest load balancer %s to be used, got %s", oldest.ID, found.ID)
+	}
+
+	status, exists, err := lb.GetLoadBalancer(ctx, "cluster", service)
+	if err != nil || !exists {
+		t.Fatalf("expected load balancer to exist, got %t and %v", exists, err)
+	}
+	if status.Ingress[0].IP != oldest.IP {
+		t.Errorf("expected IP %s of the oldest load balancer, got %s", oldest.IP, status.Ingress[0].IP)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 2 || lbs[0].ID == oldest.ID || lbs[1].ID == oldest.ID {
+		t.Errorf("expected only %s in use to be deleted, keeping %s and %s, got %v", oldest.ID, newer.ID, other.ID, lbs)
+	}
+}
+
+func Test_loadbalancers_deletedElsewhere(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	service := newScenarioService()
+	lb := newTestLoadbalancers(client, "nyc1", 2, 1)
+	lb.index = newLBIndex(time.Hour)
+	ctx := context.TODO()
+
+	existing := fake.AddLoadBalancer(godo.LoadBalancer{Name: cloudprovider.GetLoadBalancerName(service)})
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the indexed load balancer is deleted outside of the cloud provider.
+	if _, err := client.LoadBalancers.Delete(ctx, existing.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); !isNotFound(err) {
+		t.Fatalf("expected update of the deleted load balancer to fail, got %v", err)
+	}
+
+	// the next attempt recreates it instead of updating the deleted one.
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || lbs[0].ID == existing.ID {
+		t.Errorf("expected the load balancer to be recreated, got %v", lbs)
+	}
+}
+
+func Test_lbIndex(t *testing.T) {
+	index := newLBIndex(time.Hour)
+
+	if lb, fresh := index.lookup("lb"); lb != nil || fresh {
+		t.Errorf("expected empty index to be stale and have nothing, got %v", lb)
+	}
+
+	index.replace([]godo.LoadBalancer{
+		{ID: "b", Name: "lb", IP: "192.0.2.2", Created: "2018-08-01T10:00:00Z"},
+		{ID: "a", Name: "lb", IP: "192.0.2.1", Created: "2018-08-01T10:00:00Z"},
+		{ID: "c", Name: "other", IP: "192.0.2.3"},
+	})
+	if lb, fresh := index.lookup("lb"); lb == nil || lb.ID != "a" || !fresh {
+		t.Errorf("expected load balancers created at once to be ordered by ID, got %v", lb)
+	}
+
+	// renamed load balancers move.
+	index.put(&godo.LoadBalancer{ID: "c", Name: "renamed", IP: "192.0.2.3"})
+	if lb, _ := index.lookup("other"); lb != nil {
+		t.Errorf("expected renamed load balancer to be gone, got %v", lb)
+	}
+	if lb, _ := index.lookup("renamed"); lb == nil || lb.ID != "c" {
+		t.Errorf("expected renamed load balancer, got %v", lb)
+	}
+
+	// load balancers without an IP are dropped so that they are listed again.
+	index.put(&godo.LoadBalancer{ID: "a", Name: "lb", Status: lbStatusNew})
+	if lb, _ := index.lookup("lb"); lb == nil || lb.ID != "b" {
+		t.Errorf("expected the remaining duplicate, got %v", lb)
+	}
+
+	index.remove("b")
+	if lbs := index.all("lb"); len(lbs) != 0 {
+		t.Errorf("expected removed load balancers to be gone, got %v", lbs)
+	}
+}
+
+func Test_lbIndex_warnsOnce(t *testing.T) {
+	index := newLBIndex(time.Hour)
+	duplicates := []godo.LoadBalancer{
+		{ID: "a", Name: "lb", IP: "192.0.2.1"},
+		{ID: "b", Name: "lb", IP: "192.0.2.2"},
+	}
+
+	index.replace(duplicates)
+	if index.warned["lb"] != "a,b" {
+		t.Fatalf("expected duplicates to be recorded as logged, got %v", index.warned)
+	}
+
+	// the same set is not logged again, a changed one is.
+	index.replace(duplicates)
+	if len(index.warned) != 1 {
+		t.Errorf("expected one logged set, got %v", index.warned)
+	}
+	index.replace(append(duplicates, godo.LoadBalancer{ID: "c", Name: "lb", IP: "192.0.2.3"}))
+	if index.warned["lb"] != "a,b,c" {
+		t.Errorf("expected changed set to be logged, got %v", index.warned)
+	}
+
+	index.replace(duplicates[:1])
+	if len(index.warned) != 0 {
+		t.Errorf("expected resolved duplicates to be forgotten, got %v", index.warned)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// defaultLBRecoveryThreshold is the default number of times a load
+	// balancer must error or time out becoming active before it is replaced.
+	defaultLBRecoveryThreshold = 3
+
+	// defaultLBRecoveryBackoff is the default minimum duration between the
+	// first and the second replacement of the load balancer of a Service. It
+	// doubles with every further replacement up to
+	// defaultLBRecoveryMaxBackoff.
+	defaultLBRecoveryBackoff    = 1 * time.Minute
+	defaultLBRecoveryMaxBackoff = 30 * time.Minute
+)
+
+// lbRecoveryAttempts tracks the replacements of the load balancers with one
+// name.
+type lbRecoveryAttempts struct {
+	count int
+	last  time.Time
+	// backoffReported is whether backing off from the last replacement was
+	// reported on the Service.
+	backoffReported bool
+}
+
+// lbRecovery decides when load balancers which errored or did not become
+// active in time are replaced. A load balancer is replaced once it failed
+// threshold times. Further replacements of load balancers with the same name
+// are delayed by an exponential backoff, so that a Service whose load
+// balancers keep failing does not exhaust the account's quota.
+//
+// A nil lbRecovery never replaces load balancers.
+type lbRecovery struct {
+	threshold  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	now        func() time.Time
+
+	mu sync.Mutex
+	// failures holds the failures of load balancers by ID.
+	failures map[string]int
+	// attempts holds the replacements of load balancers by name.
+	attempts map[string]*lbRecoveryAttempts
+}
+
+// newLBRecovery returns an lbRecovery replacing load balancers after
+// threshold failures, backing off from backoff up to maxBackoff.
+func newLBRecovery(threshold int, backoff, maxBackoff time.Duration) *lbRecovery {
+	return &lbRecovery{
+		threshold:  threshold,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		now:        time.Now,
+		failures:   map[string]int{},
+		attempts:   map[string]*lbRecoveryAttempts{},
+	}
+}
+
+// lbRecoveryFromEnv returns the lbRecovery configured through the process
+// environment. nil is returned if recovery is disabled.
+func lbRecoveryFromEnv() (*lbRecovery, error) {
+	threshold := defaultLBRecoveryThreshold
+	if s := os.Getenv(doLBRecoveryThresholdEnv); s != "" {
+		var err error
+		threshold, err = strconv.Atoi(s)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("%q must be a non-negative integer, got: %q", doLBRecoveryThresholdEnv, s)
+		}
+	}
+	if threshold == 0 {
+		return nil, nil
+	}
+
+	backoff, err := durationFromEnv(doLBRecoveryBackoffEnv, defaultLBRecoveryBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBackoff, err := durationFromEnv(doLBRecoveryMaxBackoffEnv, defaultLBRecoveryMaxBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLBRecovery(threshold, backoff, maxBackoff), nil
+}
+
+// fail records that the load balancer id errored or timed out becoming
+// active.
+func (r *lbRecovery) fail(id string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures[id]++
+}
+
+// failed returns the number of failures of the load balancer id.
+func (r *lbRecovery) failed(id string) int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.failures[id]
+}
+
+// succeed forgets the failures of the load balancer id, which is active, and
+// the replacements of load balancers named name.
+func (r *lbRecovery) succeed(name, id string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.failures, id)
+	delete(r.attempts, name)
+}
+
+// due returns whether the load balancer id named name is to be replaced. If
+// it failed often enough but was replaced too recently, the time it can be
+// replaced at is returned instead.
+func (r *lbRecovery) due(name, id string) (bool, time.Time) {
+	if r == nil {
+		return false, time.Time{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failures[id] < r.threshold {
+		return false, time.Time{}
+	}
+
+	a, ok := r.attempts[name]
+	if !ok {
+		return true, time.Time{}
+	}
+
+	backoff := r.backoff
+	for i := 1; i < a.count && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.maxBackoff {
+		backoff = r.maxBackoff
+	}
+
+	if next := a.last.Add(backoff); next.After(r.now()) {
+		return false, next
+	}
+
+	return true, time.Time{}
+}
+
+// reportBackoff returns true the first time it is called since the last
+// replacement of load balancers named name, so that backing off is reported
+// once per replacement rather than on every sync.
+func (r *lbRecovery) reportBackoff(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.attempts[name]
+	if !ok || a.backoffReported {
+		return false
+	}
+	a.backoffReported = true
+	return true
+}
+
+// replace records that the load balancer id named name is being replaced and
+// returns the number of replacements of load balancers with that name so
+// far.
+func (r *lbRecovery) replace(name, id string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.failures, id)
+
+	a, ok := r.attempts[name]
+	if !ok {
+		a = &lbRecoveryAttempts{}
+		r.attempts[name] = a
+	}
+	a.count++
+	a.last = r.now()
+	a.backoffReported = false
+
+	return a.count
+}
+
+// eventf records an event on service if the cloud provider was initialized
+// with a recorder.
+func (l *loadbalancers) eventf(service *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if l.recorder == nil {
+		return
+	}
+	l.recorder.Eventf(service, eventType, reason, messageFmt, args...)
+}
+
+// waitActiveFor waits for the load balancer lbID of service to become active
+// like waitActive, recording an event on service if it errored or timed out.
+func (l *loadbalancers) waitActiveFor(service *v1.Service, lbID string) (*godo.LoadBalancer, error) {
+	before := l.recovery.failed(lbID)
+
+	lb, err := l.waitActive(lbID)
+	if err != nil {
+		if after := l.recovery.failed(lbID); after > before {
+			l.eventf(service, v1.EventTypeWarning, "LoadBalancerNotActive", "Load balancer %s failed to become active (%d of %d failures before it is replaced): %s", lbID, after, l.recovery.threshold, err)
+		}
+		return nil, err
+	}
+
+	l.recovery.succeed(lb.Name, lb.ID)
+	return lb, nil
+}
+
+// recoverLoadBalancer replaces the load balancer of service if it failed to
+// become active often enough. It is deleted in favour of another active load
+// balancer with the same name if there is one, which is adopted, and so that
+// it is recreated otherwise. An error is returned while further replacements
+// are backing off.
+func (l *loadbalancers) recoverLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) error {
+	if l.recovery == nil {
+		return nil
+	}
+
+	name, err := lbName(clusterName, service)
+	if err != nil {
+		return err
+	}
+
+	lb, err := l.lbByName(ctx, name)
+	if err != nil {
+		if err == errLBNotFound {
+			return nil
+		}
+		return err
+	}
+
+	due, next := l.recovery.due(name, lb.ID)
+	if !due {
+		if next.IsZero() {
+			return nil
+		}
+		// the error stays the same while backing off, so that it does not
+		// change the status annotations of service on every sync.
+		at := next.UTC().Format(time.RFC3339)
+		if l.recovery.reportBackoff(name) {
+			l.eventf(service, v1.EventTypeWarning, "LoadBalancerRecoveryBackoff", "Load balancer %s failed to become active, replacing it again at %s", lb.ID, at)
+		}
+		return fmt.Errorf("load balancer %s failed to become active, replacing it again at %s", lb.ID, at)
+	}
+
+	// replacements are listed along with the failed load balancer.
+	if err := l.refreshIndex(ctx); err != nil {
+		return err
+	}
+	var replacement *godo.LoadBalancer
+	for _, other := range l.index.all(name) {
+		if other.ID != lb.ID && other.Status == lbStatusActive {
+			replacement = &other
+			break
+		}
+	}
+
+	attempt := l.recovery.replace(name, lb.ID)
+	if replacement != nil {
+		glog.Warningf("load balancer %s of service %s/%s failed to become active, adopting active load balancer %s", lb.ID, service.Namespace, service.Name, replacement.ID)
+		l.eventf(service, v1.EventTypeNormal, "AdoptingLoadBalancer", "Load balancer %s failed to become active, deleting it and adopting active load balancer %s", lb.ID, replacement.ID)
+	} else {
+		glog.Warningf("load balancer %s of service %s/%s failed to become active, deleting it to recreate it (attempt %d)", lb.ID, service.Namespace, service.Name, attempt)
+		l.eventf(service, v1.EventTypeWarning, "RecreatingLoadBalancer", "Load balancer %s failed to become active, deleting it to recreate it (attempt %d)", lb.ID, attempt)
+	}
+
+	if _, err := l.client.LoadBalancers.Delete(ctx, lb.ID); err != nil && !isNotFound(err) {
+		l.eventf(service, v1.EventTypeWarning, "LoadBalancerRecoveryFailed", "Failed to delete load balancer %s: %s", lb.ID, err)
+		return err
+	}
+	l.index.remove(lb.ID)
+
+	return nil
+}
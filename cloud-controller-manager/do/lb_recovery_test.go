@@ -0,0 +1,243 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+// drainEvents returns the events recorded so far.
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func Test_lbRecovery_due(t *testing.T) {
+	now := time.Date(2018, 8, 1, 10, 0, 0, 0, time.UTC)
+	r := newLBRecovery(2, time.Minute, 3*time.Minute)
+	r.now = func() time.Time { return now }
+
+	r.fail("lb-1")
+	if due, _ := r.due("lb", "lb-1"); due {
+		t.Error("expected a single failure not to be due")
+	}
+	r.fail("lb-1")
+	if due, _ := r.due("lb", "lb-1"); !due {
+		t.Fatal("expected the first replacement to be due right away")
+	}
+
+	// the replacement, and then its replacement, fail in turn.
+	backoffs := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	id := "lb-1"
+	for i, backoff := range backoffs {
+		if attempt := r.replace("lb", id); attempt != i+1 {
+			t.Errorf("expected attempt %d, got %d", i+1, attempt)
+		}
+		id = fmt.Sprintf("lb-%d", i+2)
+		r.fail(id)
+		r.fail(id)
+
+		now = now.Add(backoff - time.Second)
+		if due, next := r.due("lb", id); due || !next.Equal(now.Add(time.Second)) {
+			t.Errorf("attempt %d: expected to back off for another second, got %t and %s", i+2, due, next)
+		}
+		if !r.reportBackoff("lb") || r.reportBackoff("lb") {
+			t.Errorf("attempt %d: expected backing off to be reported once", i+2)
+		}
+		now = now.Add(time.Second)
+		if due, _ := r.due("lb", id); !due {
+			t.Errorf("attempt %d: expected replacement to be due after %s", i+2, backoff)
+		}
+	}
+
+	// an active load balancer resets the backoff.
+	r.succeed("lb", id)
+	r.fail("lb-new")
+	r.fail("lb-new")
+	if due, _ := r.due("lb", "lb-new"); !due {
+		t.Error("expected replacement to be due right away once a load balancer was active")
+	}
+
+	var disabled *lbRecovery
+	disabled.fail("lb-1")
+	if due, _ := disabled.due("lb", "lb-1"); due {
+		t.Error("expected disabled recovery never to be due")
+	}
+}
+
+func Test_lbRecoveryFromEnv(t *testing.T) {
+	defer os.Unsetenv(doLBRecoveryThresholdEnv)
+
+	r, err := lbRecoveryFromEnv()
+	if err != nil || r == nil || r.threshold != defaultLBRecoveryThreshold {
+		t.Errorf("expected default recovery, got %v and %v", r, err)
+	}
+
+	os.Setenv(doLBRecoveryThresholdEnv, "0")
+	if r, err := lbRecoveryFromEnv(); err != nil || r != nil {
+		t.Errorf("expected recovery to be disabled, got %v and %v", r, err)
+	}
+
+	os.Setenv(doLBRecoveryThresholdEnv, "-1")
+	if _, err := lbRecoveryFromEnv(); err == nil {
+		t.Error("expected negative threshold to fail")
+	}
+}
+
+// newRecoveringLoadbalancers returns loadbalancers for fake replacing load
+// balancers after threshold failures, along with the recorder of its events.
+func newRecoveringLoadbalancers(client *godo.Client, threshold int, backoff time.Duration) (*loadbalancers, *record.FakeRecorder) {
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.recovery = newLBRecovery(threshold, backoff, backoff)
+	recorder := record.NewFakeRecorder(100)
+	lb.recorder = recorder
+	return lb, recorder
+}
+
+func Test_loadbalancers_recoverErrored(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	fake.SetLoadBalancerTransition(1, fakedo.StatusErrored)
+	lb, recorder := newRecoveringLoadbalancers(client, 2, time.Hour)
+	service := newScenarioService()
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	ctx := context.TODO()
+
+	for i := 0; i < 2; i++ {
+		if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err == nil {
+			t.Fatal("expected errored load balancer to fail")
+		}
+	}
+	errored := fake.LoadBalancers()
+	if len(errored) != 1 || errored[0].Status != fakedo.StatusErrored {
+		t.Fatalf("expected a single errored load balancer, got %v", errored)
+	}
+
+	// the errored load balancer is replaced by one which becomes active.
+	fake.SetLoadBalancerTransition(1, fakedo.StatusActive)
+	status, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || lbs[0].ID == errored[0].ID || status.Ingress[0].IP != lbs[0].IP {
+		t.Errorf("expected errored load balancer to be recreated, got %v and %v", lbs, status)
+	}
+
+	events := strings.Join(drainEvents(recorder), "\n")
+	for _, reason := range []string{"LoadBalancerNotActive", "RecreatingLoadBalancer"} {
+		if !strings.Contains(events, reason) {
+			t.Errorf("expected a %s event, got %s", reason, events)
+		}
+	}
+}
+
+func Test_loadbalancers_recoverBackoff(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	fake.SetLoadBalancerTransition(1, fakedo.StatusErrored)
+	lb, recorder := newRecoveringLoadbalancers(client, 1, time.Hour)
+	service := newScenarioService()
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	ctx := context.TODO()
+
+	// created, replaced once, and its replacement errors as well.
+	for i := 0; i < 2; i++ {
+		if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err == nil {
+			t.Fatal("expected errored load balancer to fail")
+		}
+	}
+	replaced := fake.LoadBalancers()
+
+	drainEvents(recorder)
+
+	// every sync while backing off fails with the same error, and the backoff
+	// is reported once.
+	var errs []string
+	for i := 0; i < 2; i++ {
+		_, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+		if err == nil || !strings.Contains(err.Error(), "replacing it again at") {
+			t.Fatalf("expected replacement to back off, got %v", err)
+		}
+		errs = append(errs, err.Error())
+	}
+	if errs[0] != errs[1] {
+		t.Errorf("expected the same error while backing off, got %q and %q", errs[0], errs[1])
+	}
+	if lbs := fake.LoadBalancers(); len(lbs) != 1 || lbs[0].ID != replaced[0].ID {
+		t.Errorf("expected load balancer not to be replaced while backing off, got %v", lbs)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); strings.Count(events, "LoadBalancerRecoveryBackoff") != 1 {
+		t.Errorf("expected a single LoadBalancerRecoveryBackoff event, got %s", events)
+	}
+}
+
+func Test_loadbalancers_recoverAdopt(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	service := newScenarioService()
+	name := cloudprovider.GetLoadBalancerName(service)
+	errored := fake.AddLoadBalancer(godo.LoadBalancer{Name: name, Status: fakedo.StatusErrored, Created: "2018-08-01T10:00:00Z"})
+	active := fake.AddLoadBalancer(godo.LoadBalancer{Name: name, Created: "2018-08-02T10:00:00Z"})
+
+	lb, recorder := newRecoveringLoadbalancers(client, 1, time.Hour)
+	nodes := []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}
+	ctx := context.TODO()
+
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err == nil {
+		t.Fatal("expected the oldest, errored, load balancer to fail")
+	}
+
+	status, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || lbs[0].ID != active.ID || status.Ingress[0].IP != active.IP {
+		t.Errorf("expected %s to be deleted and %s adopted, got %v and %v", errored.ID, active.ID, lbs, status)
+	}
+	if len(lbs[0].DropletIDs) != 1 {
+		t.Errorf("expected adopted load balancer to be updated, got %v", lbs[0].DropletIDs)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); !strings.Contains(events, "AdoptingLoadBalancer") {
+		t.Errorf("expected an AdoptingLoadBalancer event, got %s", events)
+	}
+}
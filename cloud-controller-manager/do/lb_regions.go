@@ -0,0 +1,150 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+// annDOLoadBalancerRegion is the annotation used to specify the region of
+// the load balancer of a Service. If not set, the region holding most of the
+// nodes is used, or that of the existing load balancer.
+const annDOLoadBalancerRegion = "service.beta.kubernetes.io/do-loadbalancer-region"
+
+// nodeDroplet is a node along with its droplet.
+type nodeDroplet struct {
+	node    *v1.Node
+	droplet *godo.Droplet
+}
+
+// nodesToDroplets returns the droplets of nodes, in the order of nodes, along
+// with the names of the nodes no droplet was found for.
+func (l *loadbalancers) nodesToDroplets(ctx context.Context, nodes []*v1.Node) ([]nodeDroplet, []string, error) {
+	droplets, err := dropletList(ctx, l.client, l.dropletTag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var found []nodeDroplet
+	var missing []string
+	for _, node := range nodes {
+		droplet := dropletForNode(node, droplets)
+		if droplet == nil {
+			glog.V(2).Infof("no droplet found for node %s, leaving it out of load balancers", node.Name)
+			missing = append(missing, node.Name)
+			continue
+		}
+		found = append(found, nodeDroplet{node: node, droplet: droplet})
+	}
+
+	return found, missing, nil
+}
+
+// dropletRegionSlug returns the region of droplet, or an empty string if it
+// is unknown.
+func dropletRegionSlug(droplet *godo.Droplet) string {
+	if droplet.Region == nil {
+		return ""
+	}
+	return droplet.Region.Slug
+}
+
+// chooseLoadBalancerRegion returns the region holding most of droplets.
+// Ties are broken in favour of preferred, the region of the cluster, and
+// then alphabetically. preferred is returned if no droplet region is known.
+func chooseLoadBalancerRegion(droplets []nodeDroplet, preferred string) string {
+	counts := map[string]int{}
+	for _, nd := range droplets {
+		if region := dropletRegionSlug(nd.droplet); region != "" {
+			counts[region]++
+		}
+	}
+
+	chosen, most := preferred, counts[preferred]
+	for region, count := range counts {
+		if count > most || (count == most && chosen != preferred && region < chosen) {
+			chosen, most = region, count
+		}
+	}
+
+	return chosen
+}
+
+// loadBalancerRegion returns the region of the load balancer name of
+// service, balancing across droplets. The region is taken from the
+// annotation of service if set, from the existing load balancer otherwise,
+// since load balancers cannot be moved, and chosen from droplets for new load
+// balancers.
+func (l *loadbalancers) loadBalancerRegion(name string, service *v1.Service, droplets []nodeDroplet) string {
+	if region := service.Annotations[annDOLoadBalancerRegion]; region != "" {
+		return region
+	}
+
+	if lb, _ := l.index.lookup(name); lb != nil && lb.Region != nil && lb.Region.Slug != "" {
+		return lb.Region.Slug
+	}
+
+	return chooseLoadBalancerRegion(droplets, l.region)
+}
+
+// dropletsInRegion returns the droplets in region, along with the names of
+// the nodes left out because their droplet is in another region. Droplets
+// whose region is unknown are kept.
+func dropletsInRegion(droplets []nodeDroplet, region string) ([]nodeDroplet, []string) {
+	var kept []nodeDroplet
+	var excluded []string
+	for _, nd := range droplets {
+		if r := dropletRegionSlug(nd.droplet); r != "" && r != region {
+			excluded = append(excluded, nd.node.Name)
+			continue
+		}
+		kept = append(kept, nd)
+	}
+
+	sort.Strings(excluded)
+	return kept, excluded
+}
+
+// reportExcludedNodes logs and records an event on service for the nodes
+// left out of its load balancer in region.
+func (l *loadbalancers) reportExcludedNodes(service *v1.Service, region string, excluded []string) {
+	if len(excluded) == 0 {
+		return
+	}
+
+	glog.Warningf("nodes %s are not in region %s of the load balancer of service %s, leaving them out", strings.Join(excluded, ", "), region, serviceKey(service))
+	l.eventf(service, v1.EventTypeWarning, "LoadBalancerNodesExcluded", "Nodes %s are not in region %s of the load balancer and were left out", strings.Join(excluded, ", "), region)
+}
+
+// checkLoadBalancerRegion returns an error if the annotation of service asks
+// for a region other than the one of its existing load balancer lb.
+func checkLoadBalancerRegion(service *v1.Service, lb *godo.LoadBalancer) error {
+	region := service.Annotations[annDOLoadBalancerRegion]
+	if region == "" || lb.Region == nil || lb.Region.Slug == "" || lb.Region.Slug == region {
+		return nil
+	}
+
+	return fmt.Errorf("load balancer %s is in region %s and cannot be moved to region %q specified in annotation %q, delete and recreate the service instead", lb.ID, lb.Region.Slug, region, annDOLoadBalancerRegion)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// regionDroplets returns a nodeDroplet per region in regions. Empty regions
+// are left unknown.
+func regionDroplets(regions ...string) []nodeDroplet {
+	var droplets []nodeDroplet
+	for i, region := range regions {
+		droplet := &godo.Droplet{ID: i + 1}
+		if region != "" {
+			droplet.Region = &godo.Region{Slug: region}
+		}
+		droplets = append(droplets, nodeDroplet{node: &v1.Node{}, droplet: droplet})
+	}
+	return droplets
+}
+
+func Test_chooseLoadBalancerRegion(t *testing.T) {
+	testcases := []struct {
+		name     string
+		droplets []nodeDroplet
+		region   string
+	}{
+		{
+			name:     "no droplets",
+			droplets: nil,
+			region:   "nyc1",
+		},
+		{
+			name:     "unknown regions",
+			droplets: regionDroplets("", ""),
+			region:   "nyc1",
+		},
+		{
+			name:     "most droplets",
+			droplets: regionDroplets("nyc1", "sfo2", "sfo2"),
+			region:   "sfo2",
+		},
+		{
+			name:     "tie with the cluster region",
+			droplets: regionDroplets("sfo2", "nyc1", "ams3", "ams3", "nyc1", "sfo2"),
+			region:   "nyc1",
+		},
+		{
+			name:     "tie between other regions",
+			droplets: regionDroplets("sfo2", "ams3", "lon1"),
+			region:   "ams3",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			if region := chooseLoadBalancerRegion(test.droplets, "nyc1"); region != test.region {
+				t.Errorf("expected region %q, got %q", test.region, region)
+			}
+		})
+	}
+}
+
+func Test_loadbalancers_regions(t *testing.T) {
+	fake, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	sfo := []godo.Droplet{
+		fake.AddDroplet(godo.Droplet{Name: "node-2", Region: &godo.Region{Slug: "sfo2"}}),
+		fake.AddDroplet(godo.Droplet{Name: "node-3", Region: &godo.Region{Slug: "sfo2"}}),
+	}
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	recorder := record.NewFakeRecorder(10)
+	lb.recorder = recorder
+
+	var nodes []*v1.Node
+	for _, name := range []string{"node-1", "node-2", "node-3"} {
+		nodes = append(nodes, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	service := newScenarioService()
+	ctx := context.TODO()
+
+	// most nodes are in sfo2.
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs := fake.LoadBalancers()
+	if len(lbs) != 1 || lbs[0].Region.Slug != "sfo2" {
+		t.Fatalf("expected a load balancer in sfo2, got %v", lbs)
+	}
+	if expected := []int{sfo[0].ID, sfo[1].ID}; !reflect.DeepEqual(lbs[0].DropletIDs, expected) {
+		t.Errorf("expected droplets %v, got %v", expected, lbs[0].DropletIDs)
+	}
+	if events := strings.Join(drainEvents(recorder), "\n"); !strings.Contains(events, "LoadBalancerNodesExcluded Nodes node-1 are not in region sfo2") {
+		t.Errorf("expected node-1 to be reported as excluded, got %s", events)
+	}
+
+	// the existing load balancer keeps its region once most nodes move.
+	for _, name := range []string{"node-4", "node-5"} {
+		fake.AddDroplet(godo.Droplet{Name: name, Region: &godo.Region{Slug: "nyc1"}})
+		nodes = append(nodes, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lbs = fake.LoadBalancers()
+	if len(lbs) != 1 || lbs[0].Region.Slug != "sfo2" || len(lbs[0].DropletIDs) != 2 {
+		t.Errorf("expected load balancer to stay in sfo2, got %v", lbs)
+	}
+
+	// it cannot be moved through the annotation either.
+	service.Annotations = map[string]string{annDOLoadBalancerRegion: "nyc1"}
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes); err == nil || !strings.Contains(err.Error(), "cannot be moved") {
+		t.Errorf("expected moving the load balancer to fail, got %v", err)
+	}
+
+	// new load balancers are created in the annotated region.
+	pinned := newScenarioService()
+	pinned.UID = "pinned"
+	pinned.Annotations = map[string]string{annDOLoadBalancerRegion: "nyc1"}
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", pinned, nodes[:3]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	found, err := lb.lbByName(ctx, "apinned")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if found.Region.Slug != "nyc1" || !reflect.DeepEqual(found.DropletIDs, []int{1}) {
+		t.Errorf("expected a load balancer in nyc1 for node-1, got %v in %v", found.DropletIDs, found.Region)
+	}
+}
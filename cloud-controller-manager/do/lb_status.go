@@ -0,0 +1,427 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// the status annotations are written onto Services by the provider to
+	// report the state of their load balancer. They are owned by the
+	// provider; all other annotations are left alone.
+	annStatusLoadBalancerID         = "kubernetes.digitalocean.com/load-balancer-id"
+	annStatusLoadBalancerStatus     = "kubernetes.digitalocean.com/load-balancer-status"
+	annStatusLoadBalancerDroplets   = "kubernetes.digitalocean.com/load-balancer-droplets"
+	annStatusLoadBalancerConfigHash = "kubernetes.digitalocean.com/load-balancer-config-hash"
+	annStatusLoadBalancerBackends   = "kubernetes.digitalocean.com/load-balancer-backends"
+	annStatusLoadBalancerExcluded   = "kubernetes.digitalocean.com/load-balancer-excluded-nodes"
+	annStatusLastReconcileTime      = "kubernetes.digitalocean.com/last-reconcile-time"
+	annStatusLastReconcileError     = "kubernetes.digitalocean.com/last-reconcile-error"
+
+	// statusTimeRefreshPeriod is how old the last reconcile time may get
+	// before it is rewritten although nothing else changed. Every write
+	// changes the annotations of the Service, which makes the service
+	// controller reconcile it again, so the time is not written every
+	// time.
+	statusTimeRefreshPeriod = 10 * time.Minute
+
+	// maxStatusErrorLength is the length reconcile errors are truncated to.
+	maxStatusErrorLength = 1024
+
+	// maxStatusNodesLength is the length the lists of backends and excluded
+	// nodes are truncated to.
+	maxStatusNodesLength = 4096
+
+	// statusSyncPeriod is the interval between two writes of the pending
+	// status annotations.
+	statusSyncPeriod = time.Second
+
+	// maxStatusPendingAge is how long status annotations are kept pending
+	// for a Service which does not report the load balancer status returned
+	// along with them, e.g. because the service controller failed to
+	// persist it and reconciles the Service again.
+	maxStatusPendingAge = 5 * time.Minute
+)
+
+var (
+	// statusErrorRequestID matches the request IDs godo adds to API errors.
+	statusErrorRequestID = regexp.MustCompile(` \(request "[^"]*"\)`)
+	// statusErrorDuration matches durations, e.g. 1m30s or 250ms.
+	statusErrorDuration = regexp.MustCompile(`\b[0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h)([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))*\b`)
+)
+
+// statusAnnotations are the annotations owned by the provider.
+var statusAnnotations = []string{
+	annStatusLoadBalancerID,
+	annStatusLoadBalancerStatus,
+	annStatusLoadBalancerDroplets,
+	annStatusLoadBalancerConfigHash,
+	annStatusLoadBalancerBackends,
+	annStatusLoadBalancerExcluded,
+	annStatusLastReconcileTime,
+	annStatusLastReconcileError,
+}
+
+// loadBalancerConfigHash returns a hash of the configuration of lb as applied
+// by DigitalOcean, leaving out its droplets.
+func loadBalancerConfigHash(lb *godo.LoadBalancer) string {
+	config := struct {
+		Name                string                `json:"name"`
+		Region              string                `json:"region"`
+		Algorithm           string                `json:"algorithm"`
+		ForwardingRules     []godo.ForwardingRule `json:"forwarding_rules"`
+		HealthCheck         *godo.HealthCheck     `json:"health_check"`
+		StickySessions      *godo.StickySessions  `json:"sticky_sessions"`
+		RedirectHttpToHttps bool                  `json:"redirect_http_to_https"`
+	}{
+		Name:                lb.Name,
+		Algorithm:           lb.Algorithm,
+		ForwardingRules:     lb.ForwardingRules,
+		HealthCheck:         lb.HealthCheck,
+		StickySessions:      lb.StickySessions,
+		RedirectHttpToHttps: lb.RedirectHttpToHttps,
+	}
+	if lb.Region != nil {
+		config.Region = lb.Region.Slug
+	}
+
+	// marshaling cannot fail for these types.
+	data, _ := json.Marshal(config)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// desiredStatusAnnotations returns the status annotations reporting lb, which
+// is nil if the Service has no load balancer, its backends and reconcileErr.
+// Annotations to remove have an empty value. The annotations listing the
+// nodes are left out, and so kept as they are, if backends is nil.
+func desiredStatusAnnotations(lb *godo.LoadBalancer, backends *lbBackends, reconcileErr error) map[string]string {
+	desired := map[string]string{
+		annStatusLoadBalancerID:         "",
+		annStatusLoadBalancerStatus:     "",
+		annStatusLoadBalancerDroplets:   "",
+		annStatusLoadBalancerConfigHash: "",
+		annStatusLastReconcileError:     "",
+	}
+
+	if lb != nil {
+		desired[annStatusLoadBalancerID] = lb.ID
+		desired[annStatusLoadBalancerStatus] = lb.Status
+		desired[annStatusLoadBalancerDroplets] = strconv.Itoa(len(lb.DropletIDs))
+		desired[annStatusLoadBalancerConfigHash] = loadBalancerConfigHash(lb)
+		if backends != nil {
+			desired[annStatusLoadBalancerBackends] = truncateNodeList(backends.selected)
+			desired[annStatusLoadBalancerExcluded] = truncateNodeList(backends.excluded)
+		}
+	} else {
+		desired[annStatusLoadBalancerBackends] = ""
+		desired[annStatusLoadBalancerExcluded] = ""
+	}
+
+	if reconcileErr != nil {
+		desired[annStatusLastReconcileError] = statusErrorMessage(reconcileErr)
+	}
+
+	return desired
+}
+
+// truncateNodeList truncates the comma separated node names in nodes to
+// maxStatusNodesLength, leaving out whole names and ending with "...".
+func truncateNodeList(nodes string) string {
+	if len(nodes) <= maxStatusNodesLength {
+		return nodes
+	}
+
+	cut := strings.LastIndex(nodes[:maxStatusNodesLength-len(",...")], ",")
+	if cut < 0 {
+		return "..."
+	}
+	return nodes[:cut] + ",..."
+}
+
+// statusErrorMessage returns the message of the reconcile error err without
+// the parts which differ between two failures for the same reason, request
+// IDs and durations. Every change of the annotation makes the service
+// controller reconcile the Service again right away rather than backing off.
+func statusErrorMessage(err error) string {
+	msg := statusErrorRequestID.ReplaceAllString(err.Error(), "")
+	msg = statusErrorDuration.ReplaceAllString(msg, "<duration>")
+	if len(msg) > maxStatusErrorLength {
+		msg = msg[:maxStatusErrorLength]
+	}
+	return msg
+}
+
+// statusAnnotationsPatch returns a JSON merge patch updating the status
+// annotations among current to desired at now, or nil if they are up to
+// date. Only the annotations which changed are in the patch, so that edits of
+// other annotations made in the meantime are kept.
+func statusAnnotationsPatch(current, desired map[string]string, now time.Time) []byte {
+	changes := map[string]interface{}{}
+	for key, value := range desired {
+		old, ok := current[key]
+		switch {
+		case value == "" && ok:
+			changes[key] = nil
+		case value != "" && value != old:
+			changes[key] = value
+		}
+	}
+
+	last, err := time.Parse(time.RFC3339, current[annStatusLastReconcileTime])
+	if len(changes) > 0 || err != nil || now.Sub(last) >= statusTimeRefreshPeriod {
+		changes[annStatusLastReconcileTime] = now.UTC().Format(time.RFC3339)
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": changes,
+		},
+	})
+	return patch
+}
+
+// writeStatus updates the status annotations of service after reconciling
+// its load balancer failed with reconcileErr, or succeeded if it is nil. They
+// are written once the service controller persisted status as the load
+// balancer status of service.
+func (l *loadbalancers) writeStatus(clusterName string, service *v1.Service, status *v1.LoadBalancerStatus, reconcileErr error) {
+	if l.status == nil || isFloatingIPMode(service) {
+		return
+	}
+
+	var lb *godo.LoadBalancer
+	if name, err := lbName(clusterName, service); err == nil {
+		lb, _ = l.index.lookup(name)
+	}
+
+	var backends *lbBackends
+	l.backendsMu.Lock()
+	if b, ok := l.backends[service.UID]; ok {
+		backends = &b
+	}
+	l.backendsMu.Unlock()
+
+	l.status.set(service, status, desiredStatusAnnotations(lb, backends, reconcileErr))
+}
+
+// clearStatus removes the status annotations of service once its load
+// balancer was deleted and its load balancer status cleared.
+func (l *loadbalancers) clearStatus(service *v1.Service) {
+	if l.status == nil {
+		return
+	}
+
+	l.status.set(service, &v1.LoadBalancerStatus{}, nil)
+}
+
+// clearStatusPatch returns a JSON merge patch removing the status annotations
+// among current, or nil if there are none.
+func clearStatusPatch(current map[string]string) []byte {
+	changes := map[string]interface{}{}
+	for _, key := range statusAnnotations {
+		if _, ok := current[key]; ok {
+			changes[key] = nil
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": changes,
+		},
+	})
+	return patch
+}
+
+// pendingStatus are the status annotations of a Service awaiting the load
+// balancer status reported along with them.
+type pendingStatus struct {
+	uid types.UID
+	// status is the load balancer status the service controller persists
+	// once the reconcile returned.
+	status v1.LoadBalancerStatus
+	// desired are the status annotations to write, or nil to remove them
+	// all.
+	desired map[string]string
+	since   time.Time
+}
+
+// patch returns the JSON merge patch applying p onto the annotations current
+// at now, or nil if they are up to date.
+func (p *pendingStatus) patch(current map[string]string, now time.Time) []byte {
+	if p.desired == nil {
+		return clearStatusPatch(current)
+	}
+	return statusAnnotationsPatch(current, p.desired, now)
+}
+
+// statusWriter writes the status annotations of Services. Patching a Service
+// bumps its resourceVersion, so patching it while the service controller
+// reconciles it fails the update of its load balancer status with a
+// conflict. The annotations are kept pending instead, and written once the
+// Service reports the load balancer status returned along with them, either
+// because it was persisted or because it did not change.
+type statusWriter struct {
+	kclient             kubernetes.Interface
+	serviceLister       corelisters.ServiceLister
+	serviceListerSynced cache.InformerSynced
+	now                 func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]*pendingStatus
+}
+
+// newStatusWriter returns a new statusWriter.
+func newStatusWriter(kclient kubernetes.Interface, serviceLister corelisters.ServiceLister, serviceListerSynced cache.InformerSynced) *statusWriter {
+	return &statusWriter{
+		kclient:             kclient,
+		serviceLister:       serviceLister,
+		serviceListerSynced: serviceListerSynced,
+		now:                 time.Now,
+		pending:             map[string]*pendingStatus{},
+	}
+}
+
+// set replaces the pending status annotations of service with desired, to
+// be written once service reports status, or removes them if desired is nil.
+func (w *statusWriter) set(service *v1.Service, status *v1.LoadBalancerStatus, desired map[string]string) {
+	pending := &pendingStatus{uid: service.UID, desired: desired, since: w.now()}
+	if status != nil {
+		pending.status = *status
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[serviceKey(service)] = pending
+}
+
+// Run writes the pending status annotations every statusSyncPeriod until
+// stopCh is closed.
+func (w *statusWriter) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, w.serviceListerSynced) {
+		glog.Error("failed to sync service cache for load balancer status annotations")
+		return
+	}
+
+	wait.Until(w.sync, statusSyncPeriod, stopCh)
+}
+
+// sync writes the pending status annotations of the Services reporting the
+// load balancer status returned along with them. Those of Services which
+// were deleted, or never report it, are dropped.
+func (w *statusWriter) sync() {
+	w.mu.Lock()
+	pending := make(map[string]*pendingStatus, len(w.pending))
+	for key, p := range w.pending {
+		pending[key] = p
+	}
+	w.mu.Unlock()
+
+	for key, p := range pending {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		service, err := w.serviceLister.Services(namespace).Get(name)
+		if apierrors.IsNotFound(err) || (err == nil && service.UID != p.uid) {
+			w.done(key, p)
+			continue
+		}
+		if err != nil {
+			glog.Errorf("failed to get service %s: %s", key, err)
+			continue
+		}
+
+		if !loadBalancerStatusEqual(&service.Status.LoadBalancer, &p.status) {
+			if w.now().Sub(p.since) >= maxStatusPendingAge {
+				glog.Warningf("dropping load balancer status annotations of service %s, its load balancer status was not updated within %s", key, maxStatusPendingAge)
+				w.done(key, p)
+			}
+			continue
+		}
+
+		if err := patchServiceAnnotations(w.kclient, service, p.patch(service.Annotations, w.now())); err != nil {
+			glog.Errorf("failed to write load balancer status annotations of service %s: %s", key, err)
+			continue
+		}
+		w.done(key, p)
+	}
+}
+
+// done forgets the pending status annotations p of the Service key, unless
+// they were replaced in the meantime.
+func (w *statusWriter) done(key string, p *pendingStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pending[key] == p {
+		delete(w.pending, key)
+	}
+}
+
+// loadBalancerStatusEqual returns whether a and b report the same ingress
+// points.
+func loadBalancerStatusEqual(a, b *v1.LoadBalancerStatus) bool {
+	if len(a.Ingress) != len(b.Ingress) {
+		return false
+	}
+	for i := range a.Ingress {
+		if a.Ingress[i] != b.Ingress[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// patchServiceAnnotations applies the JSON merge patch to service if it is
+// not nil. A Service which no longer exists is not an error.
+func patchServiceAnnotations(kclient kubernetes.Interface, service *v1.Service, patch []byte) error {
+	if patch == nil {
+		return nil
+	}
+
+	_, err := kclient.CoreV1().Services(service.Namespace).Patch(service.Name, types.MergePatchType, patch)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+func Test_statusAnnotationsPatch(t *testing.T) {
+	now := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	lb := &godo.LoadBalancer{
+		ID:         "lb-1",
+		Name:       "ascenario",
+		Status:     "active",
+		Region:     &godo.Region{Slug: "nyc1"},
+		DropletIDs: []int{1, 2},
+	}
+	desired := desiredStatusAnnotations(lb, nil, nil)
+	hash := loadBalancerConfigHash(lb)
+
+	upToDate := map[string]string{
+		"user":                          "edit",
+		annStatusLoadBalancerID:         "lb-1",
+		annStatusLoadBalancerStatus:     "active",
+		annStatusLoadBalancerDroplets:   "2",
+		annStatusLoadBalancerConfigHash: hash,
+		annStatusLastReconcileTime:      now.Add(-time.Minute).Format(time.RFC3339),
+	}
+	withChange := func(key, value string) map[string]string {
+		current := map[string]string{}
+		for k, v := range upToDate {
+			current[k] = v
+		}
+		current[key] = value
+		return current
+	}
+
+	testcases := []struct {
+		name    string
+		current map[string]string
+		desired map[string]string
+		changes map[string]interface{}
+	}{
+		{
+			name:    "up to date",
+			current: upToDate,
+			desired: desired,
+		},
+		{
+			name:    "droplets changed",
+			current: withChange(annStatusLoadBalancerDroplets, "3"),
+			desired: desired,
+			changes: map[string]interface{}{
+				annStatusLoadBalancerDroplets: "2",
+				annStatusLastReconcileTime:    "2018-08-01T12:00:00Z",
+			},
+		},
+		{
+			name:    "stale time",
+			current: withChange(annStatusLastReconcileTime, now.Add(-statusTimeRefreshPeriod).Format(time.RFC3339)),
+			desired: desired,
+			changes: map[string]interface{}{
+				annStatusLastReconcileTime: "2018-08-01T12:00:00Z",
+			},
+		},
+		{
+			name:    "error without load balancer",
+			current: upToDate,
+			desired: desiredStatusAnnotations(nil, nil, errors.New("boom")),
+			changes: map[string]interface{}{
+				annStatusLoadBalancerID:         nil,
+				annStatusLoadBalancerStatus:     nil,
+				annStatusLoadBalancerDroplets:   nil,
+				annStatusLoadBalancerConfigHash: nil,
+				annStatusLastReconcileError:     "boom",
+				annStatusLastReconcileTime:      "2018-08-01T12:00:00Z",
+			},
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			patch := statusAnnotationsPatch(test.current, test.desired, now)
+			if test.changes == nil {
+				if patch != nil {
+					t.Fatalf("expected no patch, got %s", patch)
+				}
+				return
+			}
+
+			var decoded struct {
+				Metadata struct {
+					Annotations map[string]interface{} `json:"annotations"`
+				} `json:"metadata"`
+			}
+			if err := json.Unmarshal(patch, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded.Metadata.Annotations, test.changes) {
+				t.Errorf("expected changes %v, got %v", test.changes, decoded.Metadata.Annotations)
+			}
+		})
+	}
+}
+
+func Test_statusErrorMessage(t *testing.T) {
+	testcases := []struct {
+		name string
+		err  error
+		msg  string
+	}{
+		{
+			"plain",
+			errors.New("invalid forwarding rule"),
+			"invalid forwarding rule",
+		},
+		{
+			"request ID",
+			errors.New(`POST https://api.digitalocean.com/v2/load_balancers: 422 (request "a1b2c3") invalid region`),
+			"POST https://api.digitalocean.com/v2/load_balancers: 422 invalid region",
+		},
+		{
+			"durations",
+			errors.New("load balancer 1 still pending after 1m30s, retrying in 250ms"),
+			"load balancer 1 still pending after <duration>, retrying in <duration>",
+		},
+		{
+			"names with digits",
+			errors.New("no droplet in nyc1 for node pool-s1-2vcpu"),
+			"no droplet in nyc1 for node pool-s1-2vcpu",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			if msg := statusErrorMessage(test.err); msg != test.msg {
+				t.Errorf("expected %q, got %q", test.msg, msg)
+			}
+		})
+	}
+}
+
+func Test_truncateNodeList(t *testing.T) {
+	short := "node-1,node-2"
+	if got := truncateNodeList(short); got != short {
+		t.Errorf("expected %q to be kept, got %q", short, got)
+	}
+
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("node-%d", i)
+	}
+	got := truncateNodeList(strings.Join(names, ","))
+	if len(got) > maxStatusNodesLength || !strings.HasSuffix(got, ",...") {
+		t.Fatalf("expected list truncated to %d with a trailing ..., got %d: %q", maxStatusNodesLength, len(got), got[len(got)-20:])
+	}
+	if !strings.HasSuffix(strings.TrimSuffix(got, ",..."), names[strings.Count(got, ",")-1]) {
+		t.Errorf("expected whole node names only, got %q", got[len(got)-20:])
+	}
+}
+
+func Test_loadbalancers_writeStatus(t *testing.T) {
+	_, client, closeFn := newFakeAPI(t, "node-1")
+	defer closeFn()
+
+	var mu sync.Mutex
+	var patches []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		patches = append(patches, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type")+" "+string(body))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind": "Service", "apiVersion": "v1"}`))
+	}))
+	defer server.Close()
+
+	kclient, err := kubernetes.NewForConfig(&restclient.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := newScenarioService()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(service)
+
+	lb := newTestLoadbalancers(client, "nyc1", 5, 1)
+	lb.status = newStatusWriter(kclient, corelisters.NewServiceLister(indexer), nil)
+
+	nodes := []*v1.Node{newLabeledNode("node-1", nil)}
+	ctx := context.TODO()
+
+	status, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the annotations wait for the service controller to persist the status.
+	lb.status.sync()
+	if len(patches) != 0 {
+		t.Fatalf("expected no patch before the status was persisted, got %v", patches)
+	}
+
+	persisted := service.DeepCopy()
+	persisted.Status.LoadBalancer = *status
+	indexer.Update(persisted)
+	lb.status.sync()
+	if len(patches) != 1 {
+		t.Fatalf("expected 1 patch, got %v", patches)
+	}
+
+	created, _ := lb.index.lookup("ascenario")
+	var decoded struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	prefix := "PATCH /api/v1/namespaces/" + service.Namespace + "/services/" + service.Name + " application/merge-patch+json "
+	if len(patches[0]) < len(prefix) || patches[0][:len(prefix)] != prefix {
+		t.Fatalf("expected a merge patch of the service, got %s", patches[0])
+	}
+	if err := json.Unmarshal([]byte(patches[0][len(prefix):]), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	annotations := decoded.Metadata.Annotations
+	if annotations[annStatusLoadBalancerID] != created.ID || annotations[annStatusLoadBalancerStatus] != "active" || annotations[annStatusLoadBalancerDroplets] != "1" || annotations[annStatusLastReconcileTime] == "" {
+		t.Errorf("expected status of load balancer %s, got %v", created.ID, annotations)
+	}
+	if annotations[annStatusLoadBalancerBackends] != "node-1" {
+		t.Errorf("expected node-1 to be reported as backend, got %v", annotations)
+	}
+	if _, ok := annotations[annStatusLoadBalancerExcluded]; ok {
+		t.Errorf("expected no excluded nodes, got %v", annotations)
+	}
+	if len(lb.status.pending) != 0 {
+		t.Errorf("expected written annotations to be forgotten, got %v", lb.status.pending)
+	}
+
+	// a service reporting the state already is not patched again.
+	persisted.Annotations = annotations
+	indexer.Update(persisted)
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", persisted, nodes); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lb.status.sync()
+	if len(patches) != 1 {
+		t.Errorf("expected no further patch, got %v", patches[1:])
+	}
+
+	// the annotations are removed once the load balancer status was cleared.
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", persisted); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lb.status.sync()
+	if len(patches) != 1 {
+		t.Fatalf("expected no patch before the status was cleared, got %v", patches[1:])
+	}
+	cleared := persisted.DeepCopy()
+	cleared.Status.LoadBalancer = v1.LoadBalancerStatus{}
+	indexer.Update(cleared)
+	lb.status.sync()
+	if len(patches) != 2 {
+		t.Fatalf("expected status to be cleared, got %v", patches)
+	}
+}
+
+func Test_statusWriter_drop(t *testing.T) {
+	service := newScenarioService()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	w := newStatusWriter(nil, corelisters.NewServiceLister(indexer), nil)
+	now := time.Now()
+	w.now = func() time.Time { return now }
+	status := &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "10.0.0.1"}}}
+
+	// the annotations of deleted services are dropped.
+	w.set(service, status, map[string]string{})
+	w.sync()
+	if len(w.pending) != 0 {
+		t.Errorf("expected annotations of deleted service to be dropped, got %v", w.pending)
+	}
+
+	// so are those of a service recreated under the same name.
+	recreated := service.DeepCopy()
+	recreated.UID = "recreated"
+	indexer.Add(recreated)
+	w.set(service, status, map[string]string{})
+	w.sync()
+	if len(w.pending) != 0 {
+		t.Errorf("expected annotations of replaced service to be dropped, got %v", w.pending)
+	}
+
+	// and those of a service whose status is never persisted, eventually.
+	w.set(recreated, status, map[string]string{})
+	w.sync()
+	if len(w.pending) != 1 {
+		t.Errorf("expected annotations to be kept pending, got %v", w.pending)
+	}
+	now = now.Add(maxStatusPendingAge)
+	w.sync()
+	if len(w.pending) != 0 {
+		t.Errorf("expected annotations to be dropped after %s, got %v", maxStatusPendingAge, w.pending)
+	}
+}
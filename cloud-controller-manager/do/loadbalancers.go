@@ -22,10 +22,14 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/api/core/v1"
-	"k8s.io/kubernetes/pkg/cloudprovider"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/digitalocean/godo"
 	"github.com/golang/glog"
@@ -101,19 +105,74 @@ type loadbalancers struct {
 	region            string
 	lbActiveTimeout   int
 	lbActiveCheckTick int
+	index             *lbIndex
+
+	// recovery replaces load balancers which fail to become active, if
+	// set. recorder is used to record events on their services.
+	recovery *lbRecovery
+	recorder record.EventRecorder
+	// serviceLister finds the Services sharing a load balancer group.
+	serviceLister corelisters.ServiceLister
+
+	// account is the name of the account of the load balancers when several
+	// are configured. Nodes without a droplet in it are reported on
+	// Services. dropletTag restricts its droplets balanced across or
+	// assigned floating IPs to those carrying the tag, if set.
+	account    string
+	dropletTag string
+
+	// backends holds the nodes last reported as backends, and excluded, by
+	// Service.
+	backendsMu sync.Mutex
+	backends   map[types.UID]lbBackends
+
+	// drains removes the droplets of draining nodes from load balancers
+	// and reports them drained after a grace period. nodeLister finds the
+	// draining nodes, which need not be passed to UpdateLoadBalancer.
+	drains     *lbDrains
+	nodeLister corelisters.NodeLister
+
+	// adoption allows Services to adopt existing load balancers through
+	// annDOLoadBalancerID. adopted holds the load balancer last reported
+	// adopted by Service.
+	adoption  bool
+	adoptedMu sync.Mutex
+	adopted   map[types.UID]string
+
+	// kclient records the floating IPs allocated for Services, if set.
+	// status writes the status annotations onto Services, if set.
+	kclient kubernetes.Interface
+	status  *statusWriter
 }
 
-// newLoadbalancers returns a cloudprovider.LoadBalancer whose concrete type is a *loadbalancer.
-func newLoadbalancers(client *godo.Client, region string) cloudprovider.LoadBalancer {
-	return &loadbalancers{client, region, defaultActiveTimeout, defaultActiveCheckTick}
+// newLoadbalancers returns a *loadbalancers, which implements cloudprovider.LoadBalancer.
+func newLoadbalancers(client *godo.Client, region string) *loadbalancers {
+	return &loadbalancers{
+		client:            client,
+		region:            region,
+		lbActiveTimeout:   defaultActiveTimeout,
+		lbActiveCheckTick: defaultActiveCheckTick,
+		index:             newLBIndex(defaultLBIndexTTL),
+		backends:          map[types.UID]lbBackends{},
+		adopted:           map[types.UID]string{},
+		drains:            newLBDrains(defaultLBDrainWindow, defaultAccountName),
+	}
 }
 
 // GetLoadBalancer returns the *v1.LoadBalancerStatus of service.
 //
 // GetLoadBalancer will not modify service.
 func (l *loadbalancers) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (*v1.LoadBalancerStatus, bool, error) {
-	lbName := cloudprovider.GetLoadBalancerName(service)
-	lb, err := l.lbByName(ctx, lbName)
+	if isFloatingIPMode(service) {
+		return l.getFloatingIP(ctx, service)
+	}
+
+	lbName, err := lbName(clusterName, service)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lb, err := l.lbForService(ctx, lbName, service)
 	if err != nil {
 		if err == errLBNotFound {
 			return nil, false, nil
@@ -123,10 +182,13 @@ func (l *loadbalancers) GetLoadBalancer(ctx context.Context, clusterName string,
 	}
 
 	if lb.Status != lbStatusActive {
-		lb, err = l.waitActive(lb.ID)
+		lb, err = l.waitActiveFor(service, lb.ID)
 		if err != nil {
 			return nil, true, fmt.Errorf("error waiting for load balancer to be active %v", err)
 		}
+		l.index.put(lb)
+	} else {
+		l.recovery.succeed(lb.Name, lb.ID)
 	}
 
 	return &v1.LoadBalancerStatus{
@@ -143,13 +205,37 @@ func (l *loadbalancers) GetLoadBalancer(ctx context.Context, clusterName string,
 //
 // EnsureLoadBalancer will not modify service or nodes.
 func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	lbStatus, err := l.ensureLoadBalancer(ctx, clusterName, service, nodes)
+	// the service controller persists the status returned on success only.
+	status := &service.Status.LoadBalancer
+	if err == nil {
+		status = lbStatus
+	}
+	l.writeStatus(clusterName, service, status, err)
+	return lbStatus, err
+}
+
+// ensureLoadBalancer implements EnsureLoadBalancer.
+func (l *loadbalancers) ensureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	if isFloatingIPMode(service) {
+		return l.ensureFloatingIP(ctx, service, nodes)
+	}
+
+	if err := l.recoverLoadBalancer(ctx, clusterName, service); err != nil {
+		return nil, err
+	}
+
+	if err := l.leaveOtherGroups(ctx, clusterName, service); err != nil {
+		return nil, fmt.Errorf("failed to remove service %s from the load balancer groups it left: %s", serviceKey(service), err)
+	}
+
 	lbStatus, exists, err := l.GetLoadBalancer(ctx, clusterName, service)
 	if err != nil {
 		return nil, err
 	}
 
 	if !exists {
-		lbRequest, err := l.buildLoadBalancerRequest(service, nodes)
+		lbRequest, conflicts, err := l.loadBalancerRequest(clusterName, service, nodes)
 		if err != nil {
 			return nil, err
 		}
@@ -159,10 +245,16 @@ func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 			return nil, err
 		}
 
-		lb, err = l.waitActive(lb.ID)
+		lb, err = l.waitActiveFor(service, lb.ID)
 		if err != nil {
 			return nil, err
 		}
+		l.index.put(lb)
+		l.drains.watch(lb, service)
+
+		if len(conflicts) > 0 {
+			return nil, l.portConflictError(service, conflicts)
+		}
 
 		return &v1.LoadBalancerStatus{
 			Ingress: []v1.LoadBalancerIngress{
@@ -173,10 +265,13 @@ func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 		}, nil
 	}
 
-	err = l.UpdateLoadBalancer(ctx, clusterName, service, nodes)
+	conflicts, err := l.updateLoadBalancer(ctx, clusterName, service, nodes)
 	if err != nil {
 		return nil, err
 	}
+	if len(conflicts) > 0 {
+		return nil, l.portConflictError(service, conflicts)
+	}
 
 	lbStatus, exists, err = l.GetLoadBalancer(ctx, clusterName, service)
 	if err != nil {
@@ -192,19 +287,62 @@ func (l *loadbalancers) EnsureLoadBalancer(ctx context.Context, clusterName stri
 //
 // UpdateLoadBalancer will not modify service or nodes.
 func (l *loadbalancers) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
-	lbRequest, err := l.buildLoadBalancerRequest(service, nodes)
-	if err != nil {
+	if isFloatingIPMode(service) {
+		_, err := l.ensureFloatingIP(ctx, service, nodes)
 		return err
 	}
 
-	lbName := cloudprovider.GetLoadBalancerName(service)
-	lb, err := l.lbByName(ctx, lbName)
+	conflicts, err := l.updateLoadBalancer(ctx, clusterName, service, nodes)
+	if len(conflicts) > 0 {
+		glog.Warningf("forwarding rules of service %s for entry ports %v conflict with other services of its load balancer group", serviceKey(service), conflicts)
+	}
+	l.writeStatus(clusterName, service, &service.Status.LoadBalancer, err)
+	return err
+}
+
+// updateLoadBalancer updates the load balancer for service to balance across
+// the droplets in nodes. The entry ports of service conflicting with other
+// Services of its group, which were left out, are returned.
+func (l *loadbalancers) updateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) ([]int, error) {
+	name, err := lbName(clusterName, service)
 	if err != nil {
+		return nil, err
+	}
+
+	// the load balancer is looked up first, so that its region is kept.
+	lb, err := l.lbForService(ctx, name, service)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLoadBalancerRegion(service, lb); err != nil {
+		return nil, err
+	}
+
+	lbRequest, conflicts, err := l.loadBalancerRequest(clusterName, service, nodes)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.drainBackends(ctx, service, lb, lbRequest, nodes); err != nil {
+		return nil, err
+	}
+
+	return conflicts, l.updateLoadBalancerByID(ctx, lb.ID, lbRequest)
+}
+
+// updateLoadBalancerByID updates the load balancer id with lbRequest.
+func (l *loadbalancers) updateLoadBalancerByID(ctx context.Context, id string, lbRequest *godo.LoadBalancerRequest) error {
+	updated, _, err := l.client.LoadBalancers.Update(ctx, id, lbRequest)
+	if err != nil {
+		if isNotFound(err) {
+			// the load balancer was deleted behind our back, it is listed
+			// again on the next attempt.
+			l.index.remove(id)
+		}
 		return err
 	}
 
-	_, _, err = l.client.LoadBalancers.Update(ctx, lb.ID, lbRequest)
-	return err
+	l.index.put(updated)
+	return nil
 }
 
 // EnsureLoadBalancerDeleted deletes the specified loadbalancer if it exists.
@@ -213,7 +351,32 @@ func (l *loadbalancers) UpdateLoadBalancer(ctx context.Context, clusterName stri
 //
 // EnsureLoadBalancerDeleted will not modify service.
 func (l *loadbalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	if isFloatingIPMode(service) {
+		return l.deleteFloatingIP(ctx, service)
+	}
+
+	if err := l.ensureLoadBalancerDeleted(ctx, clusterName, service); err != nil {
+		l.writeStatus(clusterName, service, &service.Status.LoadBalancer, err)
+		return err
+	}
+
+	l.clearStatus(service)
+	return nil
+}
+
+// ensureLoadBalancerDeleted implements EnsureLoadBalancerDeleted for load
+// balancers which are not in floating IP mode.
+func (l *loadbalancers) ensureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+
+	l.backendsMu.Lock()
+	delete(l.backends, service.UID)
+	l.backendsMu.Unlock()
+
 	_, exists, err := l.GetLoadBalancer(ctx, clusterName, service)
+	if _, refused := err.(*adoptionRefusedError); refused {
+		glog.Warningf("keeping load balancer specified in annotation %q of service %s: %s", annDOLoadBalancerID, serviceKey(service), err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -222,79 +385,153 @@ func (l *loadbalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterNa
 		return nil
 	}
 
-	lbName := cloudprovider.GetLoadBalancerName(service)
-
-	lb, err := l.lbByName(ctx, lbName)
+	group, err := getLoadBalancerGroup(service)
 	if err != nil {
 		return err
 	}
+	if group != "" {
+		members, err := l.groupMembers(group, service, false)
+		if err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			// the load balancer is kept for the other members, without
+			// the forwarding rules of service.
+			return l.removeFromGroup(ctx, clusterName, group, service, members)
+		}
+	}
 
-	_, err = l.client.LoadBalancers.Delete(ctx, lb.ID)
-	return err
-}
+	// all load balancers are listed so that the one deleted is the one in
+	// use.
+	if err := l.refreshIndex(ctx); err != nil {
+		return err
+	}
 
-// lbByName gets a DigitalOcean Load Balancer by name. The returned error will
-// be lbNotFound if the load balancer does not exist.
-func (l *loadbalancers) lbByName(ctx context.Context, name string) (*godo.LoadBalancer, error) {
-	lbs, _, err := l.client.LoadBalancers.List(ctx, &godo.ListOptions{})
+	lbName, err := lbName(clusterName, service)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, lb := range lbs {
-		if lb.Name == name {
-			return &lb, nil
+	// only the load balancer in use is deleted; others sharing its name may
+	// have been created by someone else.
+	named := l.index.all(lbName)
+	if len(named) > 0 {
+		_, err := l.client.LoadBalancers.Delete(ctx, named[0].ID)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		l.index.remove(named[0].ID)
+
+		for _, lb := range named[1:] {
+			glog.Warningf("keeping load balancer %s named %q after deleting %s of service %s, delete it manually if unused", lb.ID, lbName, named[0].ID, serviceKey(service))
 		}
 	}
 
-	return nil, errLBNotFound
+	// an adopted load balancer keeps its own name until its first update.
+	if id := service.Annotations[annDOLoadBalancerID]; id != "" && len(named) == 0 {
+		glog.Infof("deleting adopted load balancer %s of service %s", id, serviceKey(service))
+		_, err := l.client.LoadBalancers.Delete(ctx, id)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		l.index.remove(id)
+	}
+
+	l.adoptedMu.Lock()
+	delete(l.adopted, service.UID)
+	l.adoptedMu.Unlock()
+
+	return nil
 }
 
-// nodesToDropletID returns a []int containing ids of all droplets identified by name in nodes.
+// lbByName gets a DigitalOcean Load Balancer by name. The returned error will
+// be lbNotFound if the load balancer does not exist. If several load
+// balancers have the name, the oldest one is returned.
 //
-// Node names are assumed to match droplet names.
-func (l *loadbalancers) nodesToDropletIDs(nodes []*v1.Node) ([]int, error) {
-	droplets, err := allDropletList(context.TODO(), l.client)
+// Load balancers are looked up in l.index, which is refreshed by listing all
+// load balancers if it is stale or does not have the name.
+func (l *loadbalancers) lbByName(ctx context.Context, name string) (*godo.LoadBalancer, error) {
+	if lb, fresh := l.index.lookup(name); lb != nil && fresh {
+		return lb, nil
+	}
 
-	if err != nil {
+	if err := l.refreshIndex(ctx); err != nil {
 		return nil, err
 	}
 
-	var dropletIDs []int
-	for _, node := range nodes {
-	Loop:
-		for _, droplet := range droplets {
-			if node.Name == droplet.Name {
-				dropletIDs = append(dropletIDs, droplet.ID)
-				break
-			}
-			addresses, err := nodeAddresses(&droplet)
-			if err != nil {
-				glog.Errorf("error getting node addresses for %s: %v", droplet.Name, err)
-				continue
-			}
-			for _, address := range addresses {
-				if address.Address == string(node.Name) {
-					dropletIDs = append(dropletIDs, droplet.ID)
-					break Loop
-				}
-			}
-		}
+	if lb, _ := l.index.lookup(name); lb != nil {
+		return lb, nil
+	}
+
+	return nil, errLBNotFound
+}
+
+// refreshIndex replaces the load balancers in l.index with those of all
+// pages.
+func (l *loadbalancers) refreshIndex(ctx context.Context) error {
+	lbs, err := allLoadBalancerList(ctx, l.client)
+	if err != nil {
+		return err
 	}
 
-	return dropletIDs, nil
+	l.index.replace(lbs)
+	return nil
 }
 
 // buildLoadBalancerRequest returns a *godo.LoadBalancerRequest to balance
-// requests for service across nodes.
-func (l *loadbalancers) buildLoadBalancerRequest(service *v1.Service, nodes []*v1.Node) (*godo.LoadBalancerRequest, error) {
-	lbName := cloudprovider.GetLoadBalancerName(service)
+// requests for service across the nodes in the region of its load balancer
+// which match its backend selection. Nodes in other regions are left out and
+// reported on service, as are the nodes balanced across. If nodes is nil, no
+// droplets are resolved or reported.
+func (l *loadbalancers) buildLoadBalancerRequest(clusterName string, service *v1.Service, nodes []*v1.Node) (*godo.LoadBalancerRequest, error) {
+	return l.buildLoadBalancerRequestFor(clusterName, service, service, nodes)
+}
 
-	dropletIDs, err := l.nodesToDropletIDs(nodes)
+// buildLoadBalancerRequestFor is buildLoadBalancerRequest reporting the nodes
+// on subject, the Service being reconciled, rather than on service, e.g. the
+// member of a group whose settings the load balancer of the group takes.
+func (l *loadbalancers) buildLoadBalancerRequestFor(clusterName string, service, subject *v1.Service, nodes []*v1.Node) (*godo.LoadBalancerRequest, error) {
+	if _, err := getLoadBalancerMode(service); err != nil {
+		return nil, err
+	}
+
+	name, err := lbName(clusterName, service)
 	if err != nil {
 		return nil, err
 	}
 
+	var droplets []nodeDroplet
+	if nodes != nil {
+		selected, err := selectBackendNodes(service, nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		var missing []string
+		droplets, missing, err = l.nodesToDroplets(context.TODO(), selected)
+		if err != nil {
+			return nil, err
+		}
+		if l.account != "" && len(missing) > 0 {
+			l.eventf(subject, v1.EventTypeWarning, "LoadBalancerNodesExcluded", "Nodes %s have no droplet in account %s and were left out", strings.Join(missing, ", "), l.account)
+		}
+		droplets = dropletsWithTag(service, droplets)
+	}
+
+	region := l.loadBalancerRegion(name, service, droplets)
+
+	var dropletIDs []int
+	if nodes != nil {
+		var excluded []string
+		droplets, excluded = dropletsInRegion(droplets, region)
+		l.reportExcludedNodes(subject, region, excluded)
+		l.reportBackends(subject, droplets, nodes)
+
+		for _, nd := range droplets {
+			dropletIDs = append(dropletIDs, nd.droplet.ID)
+		}
+	}
+
 	forwardingRules, err := buildForwardingRules(service)
 	if err != nil {
 		return nil, err
@@ -315,9 +552,9 @@ func (l *loadbalancers) buildLoadBalancerRequest(service *v1.Service, nodes []*v
 	redirectHttpToHttps := getRedirectHttpToHttps(service)
 
 	return &godo.LoadBalancerRequest{
-		Name:                lbName,
+		Name:                name,
 		DropletIDs:          dropletIDs,
-		Region:              l.region,
+		Region:              region,
 		ForwardingRules:     forwardingRules,
 		HealthCheck:         healthCheck,
 		StickySessions:      stickySessions,
@@ -344,9 +581,11 @@ func (l *loadbalancers) waitActive(lbID string) (*godo.LoadBalancer, error) {
 				return lb, nil
 			}
 			if lb.Status == lbStatusErrored {
+				l.recovery.fail(lbID)
 				return nil, fmt.Errorf("error creating DigitalOcean balancer: %q", lbID)
 			}
 		case <-ctx.Done():
+			l.recovery.fail(lbID)
 			return nil, fmt.Errorf("load balancer creation for %q timed out", lbID)
 		}
 	}
@@ -28,6 +28,8 @@ import (
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/kubernetes/pkg/cloudprovider"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
 )
 
 var _ cloudprovider.LoadBalancer = new(loadbalancers)
@@ -87,6 +89,15 @@ func newFakeLBClient(fakeLB *fakeLBService, fakeDroplet *fakeDropletService) *go
 	return client
 }
 
+// newTestLoadbalancers returns loadbalancers waiting timeout seconds for load
+// balancers to become active, checking every tick seconds.
+func newTestLoadbalancers(client *godo.Client, region string, timeout, tick int) *loadbalancers {
+	lb := newLoadbalancers(client, region)
+	lb.lbActiveTimeout = timeout
+	lb.lbActiveCheckTick = tick
+	return lb
+}
+
 func Test_getAlgorithm(t *testing.T) {
 	testcases := []struct {
 		name      string
@@ -569,8 +580,8 @@ func Test_getStickySessionsCookieTTL(t *testing.T) {
 			ttl, err := getStickySessionsCookieTTL(test.service)
 			if ttl != test.ttl {
 				t.Error("unexpected sticky sessions cookie ttl")
-				t.Logf("expected: %q", test.ttl)
-				t.Logf("actual: %q", ttl)
+				t.Logf("expected: %d", test.ttl)
+				t.Logf("actual: %d", ttl)
 			}
 
 			if !reflect.DeepEqual(err, test.err) {
@@ -1562,9 +1573,9 @@ func Test_buildLoadBalancerRequest(t *testing.T) {
 			fakeDroplet.listFunc = test.dropletListFn
 			fakeClient := newFakeLBClient(&fakeLBService{}, fakeDroplet)
 
-			lb := &loadbalancers{fakeClient, "nyc3", 2, 1}
+			lb := newTestLoadbalancers(fakeClient, "nyc3", 2, 1)
 
-			lbr, err := lb.buildLoadBalancerRequest(test.service, test.nodes)
+			lbr, err := lb.buildLoadBalancerRequest("cluster", test.service, test.nodes)
 
 			if !reflect.DeepEqual(lbr, test.lbr) {
 				t.Error("unexpected load balancer request")
@@ -1582,7 +1593,7 @@ func Test_buildLoadBalancerRequest(t *testing.T) {
 	}
 }
 
-func Test_nodeToDropletIDs(t *testing.T) {
+func Test_nodesToDroplets(t *testing.T) {
 	testcases := []struct {
 		name          string
 		nodes         []*v1.Node
@@ -1707,8 +1718,12 @@ func Test_nodeToDropletIDs(t *testing.T) {
 			fakeDroplet.listFunc = test.dropletListFn
 			fakeClient := newFakeLBClient(&fakeLBService{}, fakeDroplet)
 
-			lb := &loadbalancers{fakeClient, "nyc1", 2, 1}
-			dropletIDs, err := lb.nodesToDropletIDs(test.nodes)
+			lb := newTestLoadbalancers(fakeClient, "nyc1", 2, 1)
+			droplets, _, err := lb.nodesToDroplets(context.TODO(), test.nodes)
+			var dropletIDs []int
+			for _, nd := range droplets {
+				dropletIDs = append(dropletIDs, nd.droplet.ID)
+			}
 			if !reflect.DeepEqual(dropletIDs, test.dropletIDs) {
 				t.Error("unexpected droplet IDs")
 				t.Logf("expected: %v", test.dropletIDs)
@@ -1779,7 +1794,7 @@ func Test_lbByName(t *testing.T) {
 			fakeLB.listFn = test.listFn
 			fakeClient := newFakeLBClient(fakeLB, &fakeDropletService{})
 
-			lb := &loadbalancers{fakeClient, "nyc1", 2, 1}
+			lb := newTestLoadbalancers(fakeClient, "nyc1", 2, 1)
 			loadbalancer, err := lb.lbByName(context.TODO(), test.lbName)
 
 			if !reflect.DeepEqual(loadbalancer, test.loadbalancer) {
@@ -1930,7 +1945,7 @@ func Test_GetLoadBalancer(t *testing.T) {
 			fakeLB.listFn = test.listFn
 			fakeClient := newFakeLBClient(fakeLB, &fakeDropletService{})
 
-			lb := &loadbalancers{fakeClient, "nyc1", 2, 1}
+			lb := newTestLoadbalancers(fakeClient, "nyc1", 2, 1)
 
 			// we don't actually use clusterName param in GetLoadBalancer
 			lbStatus, exists, err := lb.GetLoadBalancer(context.TODO(), "test", test.service)
@@ -2164,7 +2179,7 @@ func Test_EnsureLoadBalancer(t *testing.T) {
 			}
 			fakeClient := newFakeLBClient(fakeLB, fakeDroplet)
 
-			lb := &loadbalancers{fakeClient, "nyc1", 2, 1}
+			lb := newTestLoadbalancers(fakeClient, "nyc1", 2, 1)
 
 			// clusterName param in EnsureLoadBalancer currently not used
 			lbStatus, err := lb.EnsureLoadBalancer(context.TODO(), "test", test.service, test.nodes)
@@ -2242,7 +2257,7 @@ func Test_waitActive(t *testing.T) {
 
 			fakeClient := newFakeLBClient(fakeLB, nil)
 
-			lb := &loadbalancers{fakeClient, "nyc1", 2, 1}
+			lb := newTestLoadbalancers(fakeClient, "nyc1", 2, 1)
 
 			lbStatus, err := lb.waitActive("lb1")
 			if !reflect.DeepEqual(lbStatus, test.lbStatus) {
@@ -2259,3 +2274,53 @@ func Test_waitActive(t *testing.T) {
 		})
 	}
 }
+
+// Test_loadbalancers_cassette replays a recording of the lifecycle of a load
+// balancer, including its transition from new to active and a rate limited
+// update. It is recorded with droplets node-1 and node-2.
+func Test_loadbalancers_cassette(t *testing.T) {
+	client, done := cassetteClient(t, "loadbalancers", func(fake *fakedo.Server) {
+		fake.SetLoadBalancerTransition(2, fakedo.StatusActive)
+		for n := 1; n <= 2; n++ {
+			fake.AddDroplet(godo.Droplet{Name: fmt.Sprintf("node-%d", n), Region: &godo.Region{Slug: "nyc1"}})
+		}
+	}, "PUT /v2/load_balancers/* status=429 times=1")
+	defer done()
+
+	ctx := context.TODO()
+	lb := newTestLoadbalancers(client, "nyc1", 60, 1)
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "cassette"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080}},
+		},
+	}
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	}
+
+	status, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(status.Ingress) != 1 || status.Ingress[0].IP == "" {
+		t.Errorf("expected the IP of the active load balancer, got %v", status)
+	}
+
+	err = lb.UpdateLoadBalancer(ctx, "cluster", service, nodes[:1])
+	if godoErr, ok := err.(*godo.ErrorResponse); !ok || godoErr.Response.StatusCode != 429 {
+		t.Fatalf("expected rate limited update, got %v", err)
+	}
+	if err := lb.UpdateLoadBalancer(ctx, "cluster", service, nodes[:1]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, exists, err := lb.GetLoadBalancer(ctx, "cluster", service); err != nil || exists {
+		t.Errorf("expected load balancer to be gone, got %t and %v", exists, err)
+	}
+}
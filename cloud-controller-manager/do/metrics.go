@@ -0,0 +1,104 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiRequests counts the requests made to the DigitalOcean API by account,
+// method and status code. The code is "error" for requests which got no
+// response.
+var apiRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "digitalocean",
+		Subsystem: "api",
+		Name:      "requests_total",
+		Help:      "Number of requests made to the DigitalOcean API by account, method and status code.",
+	},
+	[]string{"account", "method", "code"},
+)
+
+// lbDrainingBackends is the number of droplets removed from load balancers
+// whose drain window did not expire yet by account.
+var lbDrainingBackends = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "digitalocean",
+		Subsystem: "loadbalancer",
+		Name:      "draining_backends",
+		Help:      "Number of droplets draining from load balancers by account.",
+	},
+	[]string{"account"},
+)
+
+// lbDrainedBackends counts the droplets whose drain from load balancers
+// completed by account.
+var lbDrainedBackends = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "digitalocean",
+		Subsystem: "loadbalancer",
+		Name:      "drained_backends_total",
+		Help:      "Number of droplets drained from load balancers by account.",
+	},
+	[]string{"account"},
+)
+
+// dryRunMode is 1 for accounts whose mutating API calls are only logged,
+// either because dry-run was turned on or entered automatically, and 0
+// otherwise.
+var dryRunMode = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "digitalocean",
+		Subsystem: "api",
+		Name:      "dry_run",
+		Help:      "Whether mutating calls to the DigitalOcean API are only logged, by account.",
+	},
+	[]string{"account"},
+)
+
+func init() {
+	prometheus.MustRegister(apiRequests, lbDrainingBackends, lbDrainedBackends, dryRunMode)
+}
+
+// metricsTransport is an http.RoundTripper counting the requests made for
+// account in apiRequests.
+type metricsTransport struct {
+	base    http.RoundTripper
+	account string
+}
+
+// newMetricsTransport returns a metricsTransport counting the requests made
+// through base for account.
+func newMetricsTransport(base http.RoundTripper, account string) http.RoundTripper {
+	return &metricsTransport{base: base, account: account}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequests.WithLabelValues(t.account, req.Method, code).Inc()
+
+	return resp, err
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDeletionConfirmations is the default number of consecutive
+	// not-found observations required before a droplet is reported as gone.
+	defaultDeletionConfirmations = 3
+
+	// defaultDeletionWindow is the default minimum duration between the first
+	// and the confirming not-found observation of a droplet.
+	defaultDeletionWindow = 2 * time.Minute
+)
+
+// notFoundObservation tracks the not-found observations of one droplet.
+type notFoundObservation struct {
+	count int
+	first time.Time
+}
+
+// notFoundTracker confirms that droplets are gone before their nodes get
+// deleted. A droplet is confirmed to be gone once it was observed missing
+// threshold times in a row and at least window has passed since the first of
+// those observations.
+type notFoundTracker struct {
+	threshold int
+	window    time.Duration
+	now       func() time.Time
+
+	mu           sync.Mutex
+	observations map[string]*notFoundObservation
+}
+
+// newNotFoundTracker returns a notFoundTracker with the given threshold and
+// window.
+func newNotFoundTracker(threshold int, window time.Duration) *notFoundTracker {
+	return &notFoundTracker{
+		threshold:    threshold,
+		window:       window,
+		now:          time.Now,
+		observations: map[string]*notFoundObservation{},
+	}
+}
+
+// notFoundTrackerFromEnv returns a notFoundTracker configured through the
+// process environment.
+func notFoundTrackerFromEnv() (*notFoundTracker, error) {
+	threshold := defaultDeletionConfirmations
+	if s := os.Getenv(doNodeDeletionConfirmationsEnv); s != "" {
+		var err error
+		threshold, err = strconv.Atoi(s)
+		if err != nil || threshold < 1 {
+			return nil, fmt.Errorf("%q must be a positive integer, got: %q", doNodeDeletionConfirmationsEnv, s)
+		}
+	}
+
+	window, err := durationFromEnv(doNodeDeletionWindowEnv, defaultDeletionWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	return newNotFoundTracker(threshold, window), nil
+}
+
+// observe records that the droplet identified by id was not found. It
+// returns whether the droplet is now confirmed to be gone along with the
+// number of consecutive observations so far.
+func (t *notFoundTracker) observe(id string) (confirmed bool, count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	o, ok := t.observations[id]
+	if !ok {
+		o = &notFoundObservation{first: now}
+		t.observations[id] = o
+	}
+	o.count++
+
+	if o.count >= t.threshold && now.Sub(o.first) >= t.window {
+		delete(t.observations, id)
+		return true, o.count
+	}
+
+	return false, o.count
+}
+
+// reset forgets all not-found observations of the droplet identified by id.
+func (t *notFoundTracker) reset(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.observations, id)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_notFoundTracker(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := newNotFoundTracker(3, time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		confirmed, count := tracker.observe("123")
+		if confirmed {
+			t.Fatalf("expected observation %d not to confirm before window passed", i)
+		}
+		if count != i {
+			t.Errorf("expected count %d, got %d", i, count)
+		}
+		now = now.Add(10 * time.Second)
+	}
+
+	now = now.Add(time.Minute)
+	if confirmed, _ := tracker.observe("123"); !confirmed {
+		t.Error("expected droplet to be confirmed gone after threshold and window")
+	}
+
+	tracker.observe("456")
+	tracker.observe("456")
+	tracker.reset("456")
+	now = now.Add(time.Hour)
+	if confirmed, count := tracker.observe("456"); confirmed || count != 1 {
+		t.Errorf("expected reset to restart observations, got confirmed %t and count %d", confirmed, count)
+	}
+}
+
+func newFakeNotFoundErrorResponse() *godo.ErrorResponse {
+	return &godo.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusNotFound},
+		Message:  "not found",
+	}
+}
+
+func Test_InstanceExistsByProviderID(t *testing.T) {
+	testcases := []struct {
+		name      string
+		getErr    error
+		listed    []godo.Droplet
+		threshold int
+		exists    []bool
+		events    int
+	}{
+		{
+			"droplet found",
+			nil,
+			nil,
+			1,
+			[]bool{true},
+			0,
+		},
+		{
+			"droplet missing but listed",
+			newFakeNotFoundErrorResponse(),
+			[]godo.Droplet{*newFakeDroplet()},
+			1,
+			[]bool{true},
+			0,
+		},
+		{
+			"droplet missing until confirmed",
+			newFakeNotFoundErrorResponse(),
+			nil,
+			3,
+			[]bool{true, true, false},
+			2,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeDropletService{}
+			fake.getFunc = func(context.Context, int) (*godo.Droplet, *godo.Response, error) {
+				if test.getErr != nil {
+					return nil, nil, test.getErr
+				}
+				return newFakeDroplet(), newFakeOKResponse(), nil
+			}
+			fake.listFunc = func(context.Context, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+				return test.listed, newFakeOKResponse(), nil
+			}
+
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			indexer.Add(&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-droplet"},
+				Spec:       v1.NodeSpec{ProviderID: "digitalocean://123"},
+			})
+			recorder := record.NewFakeRecorder(10)
+
+			instances := newInstances(singleAccount(newFakeClient(fake)), "nyc1")
+			instances.notFound = newNotFoundTracker(test.threshold, 0)
+			instances.recorder = recorder
+			instances.nodeLister = corelisters.NewNodeLister(indexer)
+
+			for i, want := range test.exists {
+				exists, err := instances.InstanceExistsByProviderID(context.TODO(), "digitalocean://123")
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if exists != want {
+					t.Errorf("call %d: expected exists to be %t, got %t", i+1, want, exists)
+				}
+			}
+
+			if len(recorder.Events) != test.events {
+				t.Errorf("expected %d events, got %d", test.events, len(recorder.Events))
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// nodeFloatingIPKey is the label or annotation naming the floating IP a
+	// node should be pinned to. The annotation takes precedence over the
+	// label.
+	nodeFloatingIPKey = "node.digitalocean.com/floating-ip"
+
+	// nodeFloatingIPPoolKey is the label or annotation naming the floating
+	// IP pool, as configured through doFloatingIPPoolsEnv, a node should get
+	// a floating IP from.
+	nodeFloatingIPPoolKey = "node.digitalocean.com/floating-ip-pool"
+
+	// annAssignedFloatingIP is the annotation recording the floating IP
+	// assigned to a node by the cloud controller manager, so that it can be
+	// unassigned once the node no longer asks for it.
+	annAssignedFloatingIP = "node.digitalocean.com/assigned-floating-ip"
+
+	// defaultNodeFloatingIPsSyncPeriod is the default interval between two
+	// synchronizations of node floating IPs.
+	defaultNodeFloatingIPsSyncPeriod = 1 * time.Minute
+)
+
+// nodeFloatingIPsConfig configures pinning floating IPs to nodes.
+type nodeFloatingIPsConfig struct {
+	// pools holds the floating IPs of each pool by pool name.
+	pools      map[string][]string
+	syncPeriod time.Duration
+}
+
+// nodeFloatingIPsConfigFromEnv returns the nodeFloatingIPsConfig described
+// by the process environment. nil is returned if node floating IPs are not
+// enabled.
+func nodeFloatingIPsConfigFromEnv() (*nodeFloatingIPsConfig, error) {
+	enabled, err := boolFromEnv(doNodeFloatingIPsEnv, false)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	pools, err := parseFloatingIPPools(os.Getenv(doFloatingIPPoolsEnv))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %s", doFloatingIPPoolsEnv, err)
+	}
+
+	syncPeriod, err := durationFromEnv(doNodeFloatingIPsSyncPeriodEnv, defaultNodeFloatingIPsSyncPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeFloatingIPsConfig{pools: pools, syncPeriod: syncPeriod}, nil
+}
+
+// parseFloatingIPPools parses a comma separated list of pools of the format
+// name=ip1|ip2.
+func parseFloatingIPPools(s string) (map[string][]string, error) {
+	pools := map[string][]string{}
+	if s == "" {
+		return pools, nil
+	}
+
+	for _, p := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid pool %q, format should be: name=ip1|ip2", p)
+		}
+
+		for _, ip := range strings.Split(parts[1], "|") {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("invalid IP %q in pool %q", ip, parts[0])
+			}
+			pools[parts[0]] = append(pools[parts[0]], ip)
+		}
+	}
+
+	return pools, nil
+}
+
+// nodeValue returns the value of the annotation or, if not set, the label
+// key of node.
+func nodeValue(node *v1.Node, key string) string {
+	if value := node.Annotations[key]; value != "" {
+		return value
+	}
+
+	return node.Labels[key]
+}
+
+// floatingIPClaim is a node asking for a floating IP along with its droplet.
+type floatingIPClaim struct {
+	node    *v1.Node
+	droplet *godo.Droplet
+}
+
+// floatingIPPlan is the desired assignment of floating IPs to nodes.
+type floatingIPPlan struct {
+	// assign holds the node each floating IP should be assigned to.
+	assign map[string]floatingIPClaim
+	// unsatisfied holds the nodes whose floating IP could not be granted,
+	// along with the reason.
+	unsatisfied map[*v1.Node]string
+}
+
+// planFloatingIPs returns the desired assignment of fips to nodes.
+//
+// Nodes naming a floating IP are served first. If several nodes name the
+// same floating IP, the node whose droplet holds it wins, otherwise the
+// first node by name. Nodes naming a pool are then served with the floating
+// IP of the pool their droplet already holds, or with a free floating IP of
+// the pool.
+func planFloatingIPs(pools map[string][]string, nodes []*v1.Node, droplets []godo.Droplet, fips []godo.FloatingIP) floatingIPPlan {
+	plan := floatingIPPlan{
+		assign:      map[string]floatingIPClaim{},
+		unsatisfied: map[*v1.Node]string{},
+	}
+
+	holder := map[string]int{}
+	for _, fip := range fips {
+		if fip.Droplet != nil {
+			holder[fip.IP] = fip.Droplet.ID
+		}
+	}
+
+	sorted := make([]*v1.Node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	// claims holds the nodes naming each floating IP, and poolClaims the
+	// nodes naming each pool.
+	claims := map[string][]floatingIPClaim{}
+	poolClaims := map[string][]floatingIPClaim{}
+	for _, node := range sorted {
+		ip := nodeValue(node, nodeFloatingIPKey)
+		pool := nodeValue(node, nodeFloatingIPPoolKey)
+		if ip == "" && pool == "" {
+			continue
+		}
+
+		droplet := dropletForNode(node, droplets)
+		if droplet == nil {
+			plan.unsatisfied[node] = "no droplet found for node"
+			continue
+		}
+
+		claim := floatingIPClaim{node: node, droplet: droplet}
+		if ip != "" {
+			claims[ip] = append(claims[ip], claim)
+		} else {
+			poolClaims[pool] = append(poolClaims[pool], claim)
+		}
+	}
+
+	for ip, cs := range claims {
+		winner := cs[0]
+		for _, c := range cs {
+			if holder[ip] == c.droplet.ID {
+				winner = c
+				break
+			}
+		}
+
+		plan.assign[ip] = winner
+		for _, c := range cs {
+			if c.node != winner.node {
+				plan.unsatisfied[c.node] = fmt.Sprintf("floating IP %s is claimed by node %s", ip, winner.node.Name)
+			}
+		}
+	}
+
+	for pool, cs := range poolClaims {
+		ips, ok := pools[pool]
+		if !ok {
+			for _, c := range cs {
+				plan.unsatisfied[c.node] = fmt.Sprintf("unknown floating IP pool %q", pool)
+			}
+			continue
+		}
+
+		var waiting []floatingIPClaim
+		for _, c := range cs {
+			kept := false
+			for _, ip := range ips {
+				if _, taken := plan.assign[ip]; !taken && holder[ip] == c.droplet.ID {
+					plan.assign[ip] = c
+					kept = true
+					break
+				}
+			}
+			if !kept {
+				waiting = append(waiting, c)
+			}
+		}
+
+		for _, c := range waiting {
+			granted := false
+			for _, ip := range ips {
+				if _, taken := plan.assign[ip]; !taken {
+					plan.assign[ip] = c
+					granted = true
+					break
+				}
+			}
+			if !granted {
+				plan.unsatisfied[c.node] = fmt.Sprintf("floating IP pool %q is exhausted", pool)
+			}
+		}
+	}
+
+	return plan
+}
+
+// nodeFloatingIPsController pins floating IPs to the nodes naming them.
+type nodeFloatingIPsController struct {
+	client           *godo.Client
+	kclient          kubernetes.Interface
+	nodeLister       corelisters.NodeLister
+	nodeListerSynced cache.InformerSynced
+	recorder         record.EventRecorder
+	cfg              *nodeFloatingIPsConfig
+
+	// account is the account managed by the controller when several are
+	// configured. Nodes without a droplet in it are left to the controllers
+	// of the other accounts.
+	account string
+	// dropletTag restricts the droplets of account floating IPs are
+	// assigned to, if set.
+	dropletTag string
+}
+
+// newNodeFloatingIPsController returns a new nodeFloatingIPsController.
+func newNodeFloatingIPsController(client *godo.Client, kclient kubernetes.Interface, nodeLister corelisters.NodeLister, nodeListerSynced cache.InformerSynced, recorder record.EventRecorder, cfg *nodeFloatingIPsConfig) *nodeFloatingIPsController {
+	return &nodeFloatingIPsController{
+		client:           client,
+		kclient:          kclient,
+		nodeLister:       nodeLister,
+		nodeListerSynced: nodeListerSynced,
+		recorder:         recorder,
+		cfg:              cfg,
+	}
+}
+
+// Run synchronizes node floating IPs every sync period until stopCh is
+// closed.
+func (c *nodeFloatingIPsController) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.nodeListerSynced) {
+		glog.Error("failed to sync node cache for node floating IPs controller")
+		return
+	}
+
+	wait.Until(func() {
+		if err := c.sync(context.Background()); err != nil {
+			glog.Errorf("failed to sync node floating IPs: %s", err)
+		}
+	}, c.cfg.syncPeriod, stopCh)
+}
+
+// sync assigns and unassigns floating IPs according to the nodes naming
+// them.
+func (c *nodeFloatingIPsController) sync(ctx context.Context) error {
+	droplets, err := dropletList(ctx, c.client, c.dropletTag)
+	if err != nil {
+		return fmt.Errorf("failed to list droplets: %s", err)
+	}
+
+	fips, err := allFloatingIPList(ctx, c.client)
+	if err != nil {
+		return fmt.Errorf("failed to list floating IPs: %s", err)
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %s", err)
+	}
+	if c.account != "" {
+		var own []*v1.Node
+		for _, node := range nodes {
+			if dropletForNode(node, droplets) != nil {
+				own = append(own, node)
+			}
+		}
+		nodes = own
+	}
+
+	byIP := map[string]godo.FloatingIP{}
+	for _, fip := range fips {
+		byIP[fip.IP] = fip
+	}
+
+	plan := planFloatingIPs(c.cfg.pools, nodes, droplets, fips)
+
+	assigned := map[string]string{}
+	for ip, claim := range plan.assign {
+		fip, ok := byIP[ip]
+		if !ok {
+			c.recorder.Eventf(claim.node, v1.EventTypeWarning, "FloatingIPNotFound", "Floating IP %s does not exist", ip)
+			continue
+		}
+
+		if fip.Droplet == nil || fip.Droplet.ID != claim.droplet.ID {
+			if _, _, err := c.client.FloatingIPActions.Assign(ctx, ip, claim.droplet.ID); err != nil {
+				glog.Errorf("failed to assign floating IP %s to node %s: %s", ip, claim.node.Name, err)
+				c.recorder.Eventf(claim.node, v1.EventTypeWarning, "FloatingIPAssignFailed", "Failed to assign floating IP %s: %s", ip, err)
+				continue
+			}
+			c.recorder.Eventf(claim.node, v1.EventTypeNormal, "FloatingIPAssigned", "Assigned floating IP %s to droplet %d", ip, claim.droplet.ID)
+		}
+
+		assigned[claim.node.Name] = ip
+	}
+
+	for node, reason := range plan.unsatisfied {
+		glog.Warningf("not assigning floating IP to node %s: %s", node.Name, reason)
+		c.recorder.Event(node, v1.EventTypeWarning, "FloatingIPUnavailable", reason)
+	}
+
+	for _, node := range nodes {
+		previous := node.Annotations[annAssignedFloatingIP]
+		current := assigned[node.Name]
+		if previous == current {
+			continue
+		}
+
+		if previous != "" {
+			c.release(ctx, node, previous, droplets, plan)
+		}
+
+		updated := node.DeepCopy()
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		if current == "" {
+			delete(updated.Annotations, annAssignedFloatingIP)
+		} else {
+			updated.Annotations[annAssignedFloatingIP] = current
+		}
+
+		if _, err := c.kclient.CoreV1().Nodes().Update(updated); err != nil {
+			glog.Errorf("failed to record floating IP of node %s: %s", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// release unassigns ip from the droplet of node unless ip is planned for
+// another node.
+func (c *nodeFloatingIPsController) release(ctx context.Context, node *v1.Node, ip string, droplets []godo.Droplet, plan floatingIPPlan) {
+	if _, ok := plan.assign[ip]; ok {
+		return
+	}
+
+	fip, _, err := c.client.FloatingIPs.Get(ctx, ip)
+	if err != nil {
+		if !isNotFound(err) {
+			glog.Errorf("failed to get floating IP %s of node %s: %s", ip, node.Name, err)
+		}
+		return
+	}
+
+	droplet := dropletForNode(node, droplets)
+	if fip.Droplet == nil || droplet == nil || fip.Droplet.ID != droplet.ID {
+		return
+	}
+
+	if _, _, err := c.client.FloatingIPActions.Unassign(ctx, ip); err != nil {
+		glog.Errorf("failed to unassign floating IP %s from node %s: %s", ip, node.Name, err)
+		return
+	}
+
+	c.recorder.Eventf(node, v1.EventTypeNormal, "FloatingIPUnassigned", "Unassigned floating IP %s from droplet %d", ip, droplet.ID)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseFloatingIPPools(t *testing.T) {
+	testcases := []struct {
+		name  string
+		pools string
+		want  map[string][]string
+		err   bool
+	}{
+		{"empty", "", map[string][]string{}, false},
+		{
+			"two pools",
+			"edge=192.0.2.1|192.0.2.2, egress=192.0.2.3",
+			map[string][]string{"edge": {"192.0.2.1", "192.0.2.2"}, "egress": {"192.0.2.3"}},
+			false,
+		},
+		{"missing IPs", "edge=", nil, true},
+		{"invalid IP", "edge=192.0.2", nil, true},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseFloatingIPPools(test.pools)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !test.err && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected pools %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func newFloatingIPNode(name, key, value string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if key != "" {
+		node.Labels = map[string]string{key: value}
+	}
+	return node
+}
+
+func Test_planFloatingIPs(t *testing.T) {
+	droplets := []godo.Droplet{
+		{ID: 1, Name: "node-a"},
+		{ID: 2, Name: "node-b"},
+		{ID: 3, Name: "node-c"},
+		{ID: 4, Name: "node-d"},
+	}
+	pools := map[string][]string{"edge": {"192.0.2.10", "192.0.2.11"}}
+
+	nodeA := newFloatingIPNode("node-a", nodeFloatingIPKey, "192.0.2.1")
+	nodeB := newFloatingIPNode("node-b", nodeFloatingIPKey, "192.0.2.1")
+	nodeC := newFloatingIPNode("node-c", nodeFloatingIPPoolKey, "edge")
+	nodeD := newFloatingIPNode("node-d", nodeFloatingIPPoolKey, "edge")
+	nodeE := newFloatingIPNode("node-e", nodeFloatingIPKey, "192.0.2.2")
+
+	fips := []godo.FloatingIP{
+		{IP: "192.0.2.1", Droplet: &godo.Droplet{ID: 2}},
+		{IP: "192.0.2.10"},
+		{IP: "192.0.2.11", Droplet: &godo.Droplet{ID: 4}},
+	}
+
+	plan := planFloatingIPs(pools, []*v1.Node{nodeE, nodeD, nodeC, nodeB, nodeA}, droplets, fips)
+
+	want := map[string]string{
+		// the current holder keeps a contended floating IP.
+		"192.0.2.1": "node-b",
+		// node-d keeps the pool floating IP it holds, node-c gets the other.
+		"192.0.2.11": "node-d",
+		"192.0.2.10": "node-c",
+	}
+	got := map[string]string{}
+	for ip, claim := range plan.assign {
+		got[ip] = claim.node.Name
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected assignments %v, got %v", want, got)
+	}
+
+	if _, ok := plan.unsatisfied[nodeA]; !ok {
+		t.Error("expected node-a to lose the contended floating IP")
+	}
+	if _, ok := plan.unsatisfied[nodeE]; !ok {
+		t.Error("expected node-e without droplet to be unsatisfied")
+	}
+
+	// a pool with more members than floating IPs is exhausted.
+	nodeF := newFloatingIPNode("node-f", nodeFloatingIPPoolKey, "edge")
+	droplets = append(droplets, godo.Droplet{ID: 6, Name: "node-f"})
+	plan = planFloatingIPs(pools, []*v1.Node{nodeC, nodeD, nodeF}, droplets, fips)
+	if len(plan.assign) != 2 {
+		t.Errorf("expected two pool assignments, got %v", plan.assign)
+	}
+	if _, ok := plan.unsatisfied[nodeF]; !ok {
+		t.Error("expected node-f to be unsatisfied by the exhausted pool")
+	}
+}
+
+func Test_nodeValue(t *testing.T) {
+	node := newFloatingIPNode("node", nodeFloatingIPKey, "192.0.2.1")
+	if got := nodeValue(node, nodeFloatingIPKey); got != "192.0.2.1" {
+		t.Errorf("expected label value, got %q", got)
+	}
+
+	node.Annotations = map[string]string{nodeFloatingIPKey: "192.0.2.2"}
+	if got := nodeValue(node, nodeFloatingIPKey); got != "192.0.2.2" {
+		t.Errorf("expected annotation to take precedence, got %q", got)
+	}
+}
+
+func Test_instancesNodeAddressesWithFloatingIPs(t *testing.T) {
+	droplet := godo.Droplet{
+		ID:   1,
+		Name: "node-a",
+		Networks: &godo.Networks{
+			V4: []godo.NetworkV4{
+				{IPAddress: "10.0.0.1", Type: "private"},
+				{IPAddress: "99.99.99.99", Type: "public"},
+			},
+		},
+	}
+
+	client, fake := newFakeFloatingIPClient([]godo.Droplet{droplet})
+	fake.fips["192.0.2.1"] = &godo.FloatingIP{IP: "192.0.2.1", Droplet: &godo.Droplet{ID: 1}}
+	fake.fips["192.0.2.2"] = &godo.FloatingIP{IP: "192.0.2.2", Droplet: &godo.Droplet{ID: 2}}
+
+	i := newInstances(singleAccount(client), "nyc1")
+	addresses, err := i.nodeAddresses(context.TODO(), i.accounts.defaultAccount(), &droplet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(addresses) != 3 {
+		t.Errorf("expected floating IPs to be ignored when disabled, got %v", addresses)
+	}
+
+	i.floatingIPs = true
+	addresses, err = i.nodeAddresses(context.TODO(), i.accounts.defaultAccount(), &droplet)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := v1.NodeAddress{Type: v1.NodeExternalIP, Address: "192.0.2.1"}
+	if len(addresses) != 4 || addresses[3] != want {
+		t.Errorf("expected floating IP as additional external address, got %v", addresses)
+	}
+}
@@ -0,0 +1,585 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// defaultNodeTagsSyncPeriod is the default interval between two
+	// synchronizations of droplet tags onto nodes.
+	defaultNodeTagsSyncPeriod = 1 * time.Minute
+
+	// tagKeyValueSeparator separates the key from the value in a droplet tag,
+	// e.g. pool:gpu-burst.
+	tagKeyValueSeparator = ":"
+
+	// annTagSyncedLabels and annTagSyncedTaints list the label keys and the
+	// taints, as key:effect, last written onto a node from droplet tags. Only
+	// those are removed once no tag supplies them.
+	annTagSyncedLabels = "node.digitalocean.com/tag-synced-labels"
+	annTagSyncedTaints = "node.digitalocean.com/tag-synced-taints"
+)
+
+// tagRule maps droplet tags whose key starts with tagPrefix onto Kubernetes
+// keys starting with keyPrefix. The remainder of the tag key is appended to
+// keyPrefix, so the rule pool=example.com/pool maps the tag pool:gpu onto
+// example.com/pool=gpu, and the rule k8s-=example.com/ maps the tag
+// k8s-tier:edge onto example.com/tier=edge.
+//
+// The labels and taints written by a rule are removed from a node once the
+// droplet no longer carries a matching tag. Other keys starting with
+// keyPrefix, e.g. set by users, are left alone.
+type tagRule struct {
+	tagPrefix string
+	keyPrefix string
+}
+
+// writebackRule pushes the value of the node label labelKey onto the droplet
+// as the tag tagKey:value.
+type writebackRule struct {
+	labelKey string
+	tagKey   string
+}
+
+// nodeTagsConfig configures the synchronization between droplet tags and node
+// labels and taints.
+type nodeTagsConfig struct {
+	labelRules     []tagRule
+	taintRules     []tagRule
+	writebackRules []writebackRule
+	syncPeriod     time.Duration
+}
+
+// nodeTagsConfigFromEnv returns the nodeTagsConfig described by the process
+// environment. nil is returned if no rules are configured.
+func nodeTagsConfigFromEnv() (*nodeTagsConfig, error) {
+	labelRules, err := parseTagRules(os.Getenv(doNodeTagLabelRulesEnv))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %s", doNodeTagLabelRulesEnv, err)
+	}
+
+	taintRules, err := parseTagRules(os.Getenv(doNodeTagTaintRulesEnv))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %s", doNodeTagTaintRulesEnv, err)
+	}
+
+	writebackRules, err := parseWritebackRules(os.Getenv(doNodeLabelTagWritebackEnv))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %s", doNodeLabelTagWritebackEnv, err)
+	}
+
+	if len(labelRules) == 0 && len(taintRules) == 0 && len(writebackRules) == 0 {
+		return nil, nil
+	}
+
+	allRules := append(append([]tagRule{}, labelRules...), taintRules...)
+	for _, wr := range writebackRules {
+		for _, r := range allRules {
+			if strings.HasPrefix(wr.tagKey, r.tagPrefix) {
+				return nil, fmt.Errorf("write-back tag key %q overlaps with tag rule prefix %q", wr.tagKey, r.tagPrefix)
+			}
+		}
+	}
+
+	syncPeriod, err := durationFromEnv(doNodeTagSyncPeriodEnv, defaultNodeTagsSyncPeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeTagsConfig{
+		labelRules:     labelRules,
+		taintRules:     taintRules,
+		writebackRules: writebackRules,
+		syncPeriod:     syncPeriod,
+	}, nil
+}
+
+// parseTagRules parses a comma separated list of tagPrefix=keyPrefix rules.
+func parseTagRules(s string) ([]tagRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var rules []tagRule
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(r), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid rule %q, format should be: tag-prefix=key-prefix", r)
+		}
+
+		rules = append(rules, tagRule{tagPrefix: parts[0], keyPrefix: parts[1]})
+	}
+
+	return rules, nil
+}
+
+// parseWritebackRules parses a comma separated list of labelKey=tagKey rules.
+func parseWritebackRules(s string) ([]writebackRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var rules []writebackRule
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(r), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid rule %q, format should be: label-key=tag-key", r)
+		}
+
+		if errs := validation.IsQualifiedName(parts[0]); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label key %q: %s", parts[0], strings.Join(errs, ", "))
+		}
+
+		if !isValidTag(parts[1]) || strings.Contains(parts[1], tagKeyValueSeparator) {
+			return nil, fmt.Errorf("invalid tag key %q", parts[1])
+		}
+
+		rules = append(rules, writebackRule{labelKey: parts[0], tagKey: parts[1]})
+	}
+
+	return rules, nil
+}
+
+// matchTagRules returns the Kubernetes key and the remaining value of tag if
+// tag is matched by one of rules.
+func matchTagRules(rules []tagRule, tag string) (key, value string, ok bool) {
+	parts := strings.SplitN(tag, tagKeyValueSeparator, 2)
+	tagKey := parts[0]
+	if len(parts) == 2 {
+		value = parts[1]
+	}
+
+	for _, r := range rules {
+		if strings.HasPrefix(tagKey, r.tagPrefix) {
+			return r.keyPrefix + strings.TrimPrefix(tagKey, r.tagPrefix), value, true
+		}
+	}
+
+	return "", "", false
+}
+
+// syncedKeys returns the keys listed in the annotation ann of node.
+func syncedKeys(node *v1.Node, ann string) map[string]bool {
+	keys := map[string]bool{}
+	for _, key := range strings.Split(node.Annotations[ann], ",") {
+		if key != "" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// setSyncedKeys lists keys in the annotation ann of node, removing it if
+// there are none, and returns whether it changed.
+func setSyncedKeys(node *v1.Node, ann string, keys []string) bool {
+	sort.Strings(keys)
+	value := strings.Join(keys, ",")
+
+	current, ok := node.Annotations[ann]
+	if value == "" {
+		if !ok {
+			return false
+		}
+		delete(node.Annotations, ann)
+		return true
+	}
+	if current == value {
+		return false
+	}
+
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	node.Annotations[ann] = value
+	return true
+}
+
+// taintID identifies taint among the taints of a node.
+func taintID(taint v1.Taint) string {
+	return taint.Key + tagKeyValueSeparator + string(taint.Effect)
+}
+
+// labelsFromTags returns the node labels described by tags according to
+// rules. Tags which do not translate into valid labels are skipped.
+func labelsFromTags(rules []tagRule, tags []string) map[string]string {
+	result := map[string]string{}
+	for _, tag := range tags {
+		key, value, ok := matchTagRules(rules, tag)
+		if !ok {
+			continue
+		}
+
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			glog.Warningf("skipping tag %q: invalid label key %q: %s", tag, key, strings.Join(errs, ", "))
+			continue
+		}
+
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			glog.Warningf("skipping tag %q: invalid label value %q: %s", tag, value, strings.Join(errs, ", "))
+			continue
+		}
+
+		result[key] = value
+	}
+
+	return result
+}
+
+// taintsFromTags returns the node taints described by tags according to
+// rules. The value of a matching tag has the format value[:effect]; the
+// effect defaults to NoSchedule. Tags which do not translate into valid taints
+// are skipped.
+func taintsFromTags(rules []tagRule, tags []string) []v1.Taint {
+	var taints []v1.Taint
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		key, rest, ok := matchTagRules(rules, tag)
+		if !ok {
+			continue
+		}
+
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			glog.Warningf("skipping tag %q: invalid taint key %q: %s", tag, key, strings.Join(errs, ", "))
+			continue
+		}
+
+		taint := v1.Taint{Key: key, Effect: v1.TaintEffectNoSchedule}
+		parts := strings.SplitN(rest, tagKeyValueSeparator, 2)
+		taint.Value = parts[0]
+		if len(parts) == 2 {
+			taint.Effect = v1.TaintEffect(parts[1])
+		}
+
+		switch taint.Effect {
+		case v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+		default:
+			glog.Warningf("skipping tag %q: invalid taint effect %q", tag, taint.Effect)
+			continue
+		}
+
+		if errs := validation.IsValidLabelValue(taint.Value); len(errs) > 0 {
+			glog.Warningf("skipping tag %q: invalid taint value %q: %s", tag, taint.Value, strings.Join(errs, ", "))
+			continue
+		}
+
+		id := taintID(taint)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		taints = append(taints, taint)
+	}
+
+	return taints
+}
+
+// applyTagsToNode returns a copy of node with labels and taints reconciled
+// against the droplet tags according to cfg, and whether anything changed.
+// Only the labels and taints written from tags before, as listed in the
+// annotations of node, are removed; all others are left untouched.
+func applyTagsToNode(cfg *nodeTagsConfig, node *v1.Node, tags []string) (*v1.Node, bool) {
+	updated := node.DeepCopy()
+	changed := false
+
+	if len(cfg.labelRules) > 0 {
+		desired := labelsFromTags(cfg.labelRules, tags)
+		if updated.Labels == nil {
+			updated.Labels = map[string]string{}
+		}
+
+		for key := range syncedKeys(updated, annTagSyncedLabels) {
+			if _, ok := desired[key]; ok {
+				continue
+			}
+			if _, ok := updated.Labels[key]; ok {
+				delete(updated.Labels, key)
+				changed = true
+			}
+		}
+
+		keys := make([]string, 0, len(desired))
+		for key, value := range desired {
+			if current, ok := updated.Labels[key]; !ok || current != value {
+				updated.Labels[key] = value
+				changed = true
+			}
+			keys = append(keys, key)
+		}
+		if setSyncedKeys(updated, annTagSyncedLabels, keys) {
+			changed = true
+		}
+	}
+
+	if len(cfg.taintRules) > 0 {
+		desired := taintsFromTags(cfg.taintRules, tags)
+		synced := syncedKeys(updated, annTagSyncedTaints)
+		ids := make([]string, 0, len(desired))
+		replaced := map[string]bool{}
+		for _, taint := range desired {
+			ids = append(ids, taintID(taint))
+			replaced[taintID(taint)] = true
+		}
+
+		var taints []v1.Taint
+		for _, taint := range updated.Spec.Taints {
+			if !synced[taintID(taint)] && !replaced[taintID(taint)] {
+				taints = append(taints, taint)
+			}
+		}
+		taints = append(taints, desired...)
+
+		if !taintsEqual(updated.Spec.Taints, taints) {
+			updated.Spec.Taints = taints
+			changed = true
+		}
+		if setSyncedKeys(updated, annTagSyncedTaints, ids) {
+			changed = true
+		}
+	}
+
+	return updated, changed
+}
+
+// taintsEqual returns true if a and b contain the same taints, ignoring order
+// and timestamps.
+func taintsEqual(a, b []v1.Taint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	key := func(t v1.Taint) string {
+		return t.Key + "=" + t.Value + ":" + string(t.Effect)
+	}
+
+	keys := make([]string, 0, len(a))
+	for _, t := range a {
+		keys = append(keys, key(t))
+	}
+	sort.Strings(keys)
+
+	other := make([]string, 0, len(b))
+	for _, t := range b {
+		other = append(other, key(t))
+	}
+	sort.Strings(other)
+
+	for i := range keys {
+		if keys[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writebackTagDiff returns the droplet tags to add and to remove so that the
+// droplet carries the node labels selected by rules.
+func writebackTagDiff(rules []writebackRule, node *v1.Node, tags []string) (add, remove []string) {
+	for _, r := range rules {
+		var desired string
+		if value, ok := node.Labels[r.labelKey]; ok {
+			desired = r.tagKey + tagKeyValueSeparator + value
+			if !isValidTag(desired) {
+				glog.Warningf("not writing label %s=%s of node %s back: %q is not a valid tag", r.labelKey, value, node.Name, desired)
+				desired = ""
+			}
+		}
+
+		found := false
+		for _, tag := range tags {
+			if tag == desired {
+				found = true
+				continue
+			}
+			if strings.HasPrefix(tag, r.tagKey+tagKeyValueSeparator) {
+				remove = append(remove, tag)
+			}
+		}
+
+		if desired != "" && !found {
+			add = append(add, desired)
+		}
+	}
+
+	return add, remove
+}
+
+// isValidTag returns true if tag only consists of characters accepted by the
+// DigitalOcean tags API.
+func isValidTag(tag string) bool {
+	if tag == "" || len(tag) > 255 {
+		return false
+	}
+
+	for _, r := range tag {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// nodeTagsController keeps node labels and taints in sync with the tags of
+// the droplets backing the nodes, and optionally writes selected node labels
+// back onto the droplets as tags.
+type nodeTagsController struct {
+	client           *godo.Client
+	kclient          kubernetes.Interface
+	nodeLister       corelisters.NodeLister
+	nodeListerSynced cache.InformerSynced
+	cfg              *nodeTagsConfig
+
+	// dropletTag restricts the droplets whose tags are synced to those
+	// carrying it, if set.
+	dropletTag string
+}
+
+// newNodeTagsController returns a new nodeTagsController.
+func newNodeTagsController(client *godo.Client, kclient kubernetes.Interface, nodeLister corelisters.NodeLister, nodeListerSynced cache.InformerSynced, cfg *nodeTagsConfig) *nodeTagsController {
+	return &nodeTagsController{
+		client:           client,
+		kclient:          kclient,
+		nodeLister:       nodeLister,
+		nodeListerSynced: nodeListerSynced,
+		cfg:              cfg,
+	}
+}
+
+// Run synchronizes droplet tags onto nodes every sync period until stopCh is
+// closed.
+func (c *nodeTagsController) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.nodeListerSynced) {
+		glog.Error("failed to sync node cache for node tags controller")
+		return
+	}
+
+	wait.Until(func() {
+		if err := c.sync(context.Background()); err != nil {
+			glog.Errorf("failed to sync droplet tags onto nodes: %s", err)
+		}
+	}, c.cfg.syncPeriod, stopCh)
+}
+
+// sync reconciles all nodes against the tags of their droplets.
+func (c *nodeTagsController) sync(ctx context.Context) error {
+	droplets, err := dropletList(ctx, c.client, c.dropletTag)
+	if err != nil {
+		return fmt.Errorf("failed to list droplets: %s", err)
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %s", err)
+	}
+
+	for _, node := range nodes {
+		droplet := dropletForNode(node, droplets)
+		if droplet == nil {
+			glog.V(2).Infof("no droplet found for node %s, skipping tag sync", node.Name)
+			continue
+		}
+
+		tags, err := c.writeback(ctx, node, droplet)
+		if err != nil {
+			glog.Errorf("failed to write labels of node %s back to droplet %d: %s", node.Name, droplet.ID, err)
+			tags = droplet.Tags
+		}
+
+		updated, changed := applyTagsToNode(c.cfg, node, tags)
+		if !changed {
+			continue
+		}
+
+		if _, err := c.kclient.CoreV1().Nodes().Update(updated); err != nil {
+			glog.Errorf("failed to update labels and taints of node %s: %s", node.Name, err)
+			continue
+		}
+
+		glog.V(2).Infof("synchronized labels and taints of node %s from droplet %d tags", node.Name, droplet.ID)
+	}
+
+	return nil
+}
+
+// writeback tags droplet with the node labels selected by the write-back
+// rules and returns the resulting tags of the droplet.
+func (c *nodeTagsController) writeback(ctx context.Context, node *v1.Node, droplet *godo.Droplet) ([]string, error) {
+	if len(c.cfg.writebackRules) == 0 {
+		return droplet.Tags, nil
+	}
+
+	add, remove := writebackTagDiff(c.cfg.writebackRules, node, droplet.Tags)
+	resources := []godo.Resource{
+		{ID: strconv.Itoa(droplet.ID), Type: godo.DropletResourceType},
+	}
+
+	tags := map[string]bool{}
+	for _, tag := range droplet.Tags {
+		tags[tag] = true
+	}
+
+	for _, tag := range add {
+		// creating an existing tag is a no-op.
+		if _, _, err := c.client.Tags.Create(ctx, &godo.TagCreateRequest{Name: tag}); err != nil {
+			return nil, fmt.Errorf("failed to create tag %q: %s", tag, err)
+		}
+
+		if _, err := c.client.Tags.TagResources(ctx, tag, &godo.TagResourcesRequest{Resources: resources}); err != nil {
+			return nil, fmt.Errorf("failed to tag droplet with %q: %s", tag, err)
+		}
+		tags[tag] = true
+	}
+
+	for _, tag := range remove {
+		if _, err := c.client.Tags.UntagResources(ctx, tag, &godo.UntagResourcesRequest{Resources: resources}); err != nil {
+			return nil, fmt.Errorf("failed to untag droplet from %q: %s", tag, err)
+		}
+		delete(tags, tag)
+	}
+
+	result := make([]string, 0, len(tags))
+	for tag := range tags {
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
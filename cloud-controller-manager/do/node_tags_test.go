@@ -0,0 +1,337 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseTagRules(t *testing.T) {
+	testcases := []struct {
+		name  string
+		rules string
+		want  []tagRule
+		err   bool
+	}{
+		{
+			"empty",
+			"",
+			nil,
+			false,
+		},
+		{
+			"multiple rules",
+			"pool=example.com/pool, k8s-=example.com/",
+			[]tagRule{
+				{tagPrefix: "pool", keyPrefix: "example.com/pool"},
+				{tagPrefix: "k8s-", keyPrefix: "example.com/"},
+			},
+			false,
+		},
+		{
+			"missing key prefix",
+			"pool=",
+			nil,
+			true,
+		},
+		{
+			"missing separator",
+			"pool",
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseTagRules(test.rules)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(rules, test.want) {
+				t.Error("unexpected rules")
+				t.Logf("expected: %v", test.want)
+				t.Logf("actual: %v", rules)
+			}
+		})
+	}
+}
+
+func Test_parseWritebackRules(t *testing.T) {
+	testcases := []struct {
+		name  string
+		rules string
+		want  []writebackRule
+		err   bool
+	}{
+		{
+			"valid rule",
+			"example.com/rack=rack",
+			[]writebackRule{{labelKey: "example.com/rack", tagKey: "rack"}},
+			false,
+		},
+		{
+			"invalid label key",
+			"example.com/ra ck=rack",
+			nil,
+			true,
+		},
+		{
+			"tag key with separator",
+			"example.com/rack=ra:ck",
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseWritebackRules(test.rules)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(rules, test.want) {
+				t.Error("unexpected rules")
+				t.Logf("expected: %v", test.want)
+				t.Logf("actual: %v", rules)
+			}
+		})
+	}
+}
+
+func Test_labelsFromTags(t *testing.T) {
+	rules := []tagRule{
+		{tagPrefix: "pool", keyPrefix: "example.com/pool"},
+		{tagPrefix: "k8s-", keyPrefix: "example.com/"},
+	}
+	tags := []string{"pool:gpu-burst", "k8s-tier:edge", "k8s-empty", "other:value", "k8s-bad:-value-"}
+
+	want := map[string]string{
+		"example.com/pool":  "gpu-burst",
+		"example.com/tier":  "edge",
+		"example.com/empty": "",
+	}
+
+	got := labelsFromTags(rules, tags)
+	if !reflect.DeepEqual(got, want) {
+		t.Error("unexpected labels")
+		t.Logf("expected: %v", want)
+		t.Logf("actual: %v", got)
+	}
+}
+
+func Test_taintsFromTags(t *testing.T) {
+	rules := []tagRule{{tagPrefix: "taint-", keyPrefix: "example.com/"}}
+	tags := []string{"taint-dedicated:gpu", "taint-edge:true:NoExecute", "taint-bad:x:Sometimes", "pool:gpu"}
+
+	want := []v1.Taint{
+		{Key: "example.com/dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule},
+		{Key: "example.com/edge", Value: "true", Effect: v1.TaintEffectNoExecute},
+	}
+
+	got := taintsFromTags(rules, tags)
+	if !reflect.DeepEqual(got, want) {
+		t.Error("unexpected taints")
+		t.Logf("expected: %v", want)
+		t.Logf("actual: %v", got)
+	}
+}
+
+func Test_applyTagsToNode(t *testing.T) {
+	cfg := &nodeTagsConfig{
+		labelRules: []tagRule{{tagPrefix: "k8s-", keyPrefix: "example.com/"}},
+		taintRules: []tagRule{{tagPrefix: "taint-", keyPrefix: "taints.example.com/"}},
+	}
+
+	testcases := []struct {
+		name    string
+		node    *v1.Node
+		tags    []string
+		labels  map[string]string
+		taints  []v1.Taint
+		changed bool
+		// synced are the expected annotations listing the synced keys.
+		synced map[string]string
+	}{
+		{
+			"labels and taints added",
+			&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "node-1",
+					Labels: map[string]string{"user": "label"},
+				},
+			},
+			[]string{"k8s-tier:edge", "taint-dedicated:gpu"},
+			map[string]string{"user": "label", "example.com/tier": "edge"},
+			[]v1.Taint{{Key: "taints.example.com/dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule}},
+			true,
+			map[string]string{annTagSyncedLabels: "example.com/tier", annTagSyncedTaints: "taints.example.com/dedicated:NoSchedule"},
+		},
+		{
+			"stale labels and taints removed",
+			&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "node-1",
+					Labels:      map[string]string{"user": "label", "example.com/tier": "edge"},
+					Annotations: map[string]string{annTagSyncedLabels: "example.com/tier", annTagSyncedTaints: "taints.example.com/dedicated:NoSchedule"},
+				},
+				Spec: v1.NodeSpec{
+					Taints: []v1.Taint{
+						{Key: "user", Effect: v1.TaintEffectNoSchedule},
+						{Key: "taints.example.com/dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule},
+					},
+				},
+			},
+			nil,
+			map[string]string{"user": "label"},
+			[]v1.Taint{{Key: "user", Effect: v1.TaintEffectNoSchedule}},
+			true,
+			map[string]string{},
+		},
+		{
+			"keys under the prefix not written from tags kept",
+			&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "node-1",
+					Labels: map[string]string{"example.com/owner": "team-a"},
+				},
+				Spec: v1.NodeSpec{
+					Taints: []v1.Taint{
+						{Key: "taints.example.com/maintenance", Effect: v1.TaintEffectNoExecute},
+					},
+				},
+			},
+			nil,
+			map[string]string{"example.com/owner": "team-a"},
+			[]v1.Taint{{Key: "taints.example.com/maintenance", Effect: v1.TaintEffectNoExecute}},
+			false,
+			nil,
+		},
+		{
+			"node in sync",
+			&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "node-1",
+					Labels:      map[string]string{"example.com/tier": "edge"},
+					Annotations: map[string]string{annTagSyncedLabels: "example.com/tier", annTagSyncedTaints: "taints.example.com/dedicated:NoSchedule"},
+				},
+				Spec: v1.NodeSpec{
+					Taints: []v1.Taint{
+						{Key: "taints.example.com/dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule},
+					},
+				},
+			},
+			[]string{"taint-dedicated:gpu", "k8s-tier:edge"},
+			map[string]string{"example.com/tier": "edge"},
+			[]v1.Taint{{Key: "taints.example.com/dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule}},
+			false,
+			map[string]string{annTagSyncedLabels: "example.com/tier", annTagSyncedTaints: "taints.example.com/dedicated:NoSchedule"},
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			node, changed := applyTagsToNode(cfg, test.node, test.tags)
+			if changed != test.changed {
+				t.Errorf("expected changed to be %t, got %t", test.changed, changed)
+			}
+
+			if !reflect.DeepEqual(node.Labels, test.labels) {
+				t.Error("unexpected labels")
+				t.Logf("expected: %v", test.labels)
+				t.Logf("actual: %v", node.Labels)
+			}
+
+			if !reflect.DeepEqual(node.Spec.Taints, test.taints) {
+				t.Error("unexpected taints")
+				t.Logf("expected: %v", test.taints)
+				t.Logf("actual: %v", node.Spec.Taints)
+			}
+
+			if !reflect.DeepEqual(node.Annotations, test.synced) {
+				t.Error("unexpected synced keys")
+				t.Logf("expected: %v", test.synced)
+				t.Logf("actual: %v", node.Annotations)
+			}
+		})
+	}
+}
+
+func Test_writebackTagDiff(t *testing.T) {
+	rules := []writebackRule{{labelKey: "example.com/rack", tagKey: "rack"}}
+
+	testcases := []struct {
+		name   string
+		labels map[string]string
+		tags   []string
+		add    []string
+		remove []string
+	}{
+		{
+			"tag added",
+			map[string]string{"example.com/rack": "r1"},
+			[]string{"other"},
+			[]string{"rack:r1"},
+			nil,
+		},
+		{
+			"tag replaced",
+			map[string]string{"example.com/rack": "r2"},
+			[]string{"rack:r1"},
+			[]string{"rack:r2"},
+			[]string{"rack:r1"},
+		},
+		{
+			"tag removed with label",
+			nil,
+			[]string{"rack:r1", "other"},
+			nil,
+			[]string{"rack:r1"},
+		},
+		{
+			"label value not representable as tag",
+			map[string]string{"example.com/rack": "r.1"},
+			nil,
+			nil,
+			nil,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: test.labels}}
+			add, remove := writebackTagDiff(rules, node, test.tags)
+			if !reflect.DeepEqual(add, test.add) {
+				t.Error("unexpected tags to add")
+				t.Logf("expected: %v", test.add)
+				t.Logf("actual: %v", add)
+			}
+
+			if !reflect.DeepEqual(remove, test.remove) {
+				t.Error("unexpected tags to remove")
+				t.Logf("expected: %v", test.remove)
+				t.Logf("actual: %v", remove)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/server/healthz"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	accountActiveStatus = "active"
+
+	// defaultPreflightRecheckPeriod is the interval between two runs of the
+	// preflight checks backing the health endpoint.
+	defaultPreflightRecheckPeriod = 5 * time.Minute
+)
+
+// preflightBackoff is the backoff between the runs of the preflight checks
+// on startup while checks fail transiently.
+var preflightBackoff = wait.Backoff{
+	Duration: 2 * time.Second,
+	Factor:   2,
+	Steps:    5,
+}
+
+// preflightResult is the outcome of a single preflight check.
+type preflightResult struct {
+	name string
+	err  error
+	// transient is set if the check failed for a reason which may go away by
+	// itself, such as a network or server error, rather than because of the
+	// account, region or token.
+	transient bool
+}
+
+// transientError is a preflight failure which may go away by itself.
+type transientError struct {
+	error
+}
+
+// apiFailure returns err, which an API call failed with, prefixed with msg.
+// The failure is transient unless the API rejected the request with a client
+// error other than rate limiting.
+func apiFailure(msg string, err error) error {
+	wrapped := fmt.Errorf("%s: %s", msg, err)
+
+	if godoErr, ok := err.(*godo.ErrorResponse); ok && godoErr.Response != nil {
+		code := godoErr.Response.StatusCode
+		if code >= 400 && code < 500 && code != http.StatusTooManyRequests {
+			return wrapped
+		}
+	}
+
+	return transientError{wrapped}
+}
+
+// preflightSources names where the settings verified by the preflight checks
+// come from, so that failures point at the setting to fix.
+type preflightSources struct {
+	// token is where the token is read from, e.g. DO_ACCESS_TOKEN.
+	token string
+	// region is where the region is read from, e.g. droplet metadata.
+	region string
+}
+
+// runPreflightChecks verifies that the account behind client is usable, that
+// region is available and that the token may read the resources the cloud
+// controller manager works with. The regions API does not advertise load
+// balancer support, so it is verified by listing load balancers.
+func runPreflightChecks(ctx context.Context, client *godo.Client, region string, sources preflightSources) []preflightResult {
+	results := []preflightResult{
+		{name: "account", err: checkAccount(ctx, client, sources.token)},
+		{name: "region", err: checkRegion(ctx, client, region, sources.region)},
+		{name: "permissions", err: checkPermissions(ctx, client)},
+	}
+
+	for i := range results {
+		_, results[i].transient = results[i].err.(transientError)
+	}
+
+	return results
+}
+
+// retryPreflightChecks runs the preflight checks until none fails
+// transiently, backing off according to preflightBackoff. The results of the
+// last run are returned.
+func retryPreflightChecks(ctx context.Context, client *godo.Client, region string, sources preflightSources) []preflightResult {
+	var results []preflightResult
+	wait.ExponentialBackoff(preflightBackoff, func() (bool, error) {
+		results = runPreflightChecks(ctx, client, region, sources)
+		failed := transientFailures(results)
+		if len(failed) > 0 {
+			glog.Warningf("retrying transiently failed %s", preflightError(failed))
+		}
+		return len(failed) == 0, nil
+	})
+
+	return results
+}
+
+// transientFailures returns the results which failed transiently.
+func transientFailures(results []preflightResult) []preflightResult {
+	var failed []preflightResult
+	for _, r := range results {
+		if r.err != nil && r.transient {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+// permanentFailures returns the results which failed for a reason which does
+// not go away by itself.
+func permanentFailures(results []preflightResult) []preflightResult {
+	var failed []preflightResult
+	for _, r := range results {
+		if r.err != nil && !r.transient {
+			failed = append(failed, r)
+		}
+	}
+
+	return failed
+}
+
+func checkAccount(ctx context.Context, client *godo.Client, tokenSource string) error {
+	account, _, err := client.Account.Get(ctx)
+	if err != nil {
+		return apiFailure(fmt.Sprintf("failed to get account, verify that %s holds a valid token", tokenSource), err)
+	}
+
+	if account.Status != accountActiveStatus {
+		return fmt.Errorf("account status is %q (%s), the account must be active", account.Status, account.StatusMessage)
+	}
+
+	if !account.EmailVerified {
+		// some features need a verified email, but none used here.
+		glog.Warningf("account email %s is not verified, verify it from the control panel", account.Email)
+	}
+
+	return nil
+}
+
+func checkRegion(ctx context.Context, client *godo.Client, region, regionSource string) error {
+	regions, _, err := client.Regions.List(ctx, &godo.ListOptions{PerPage: apiPerPage})
+	if err != nil {
+		return apiFailure("failed to list regions", err)
+	}
+
+	for _, r := range regions {
+		if r.Slug != region {
+			continue
+		}
+		if !r.Available {
+			return fmt.Errorf("region %q from %s is not available", region, regionSource)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("region %q from %s is unknown", region, regionSource)
+}
+
+func checkPermissions(ctx context.Context, client *godo.Client) error {
+	opt := &godo.ListOptions{PerPage: 1}
+	if _, _, err := client.Droplets.List(ctx, opt); err != nil {
+		return apiFailure("token cannot list droplets, verify its scope", err)
+	}
+
+	if _, _, err := client.LoadBalancers.List(ctx, opt); err != nil {
+		return apiFailure("token cannot list load balancers, verify its scope", err)
+	}
+
+	return nil
+}
+
+// preflightError returns a single error describing all failed results, or nil
+// if all checks passed.
+func preflightError(results []preflightResult) error {
+	var failures []string
+	for _, r := range results {
+		if r.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", r.name, r.err))
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("preflight checks failed:\n  - %s", strings.Join(failures, "\n  - "))
+}
+
+// preflightHealth periodically reruns the preflight checks of all accounts
+// and reports the last results as a health check.
+type preflightHealth struct {
+	region string
+
+	mu       sync.Mutex
+	accounts []*preflightAccount
+}
+
+// preflightAccount is an account checked by preflightHealth.
+type preflightAccount struct {
+	name    string
+	client  *godo.Client
+	sources preflightSources
+	results []preflightResult
+}
+
+var _ healthz.HealthzChecker = &preflightHealth{}
+
+// newPreflightHealth returns a preflightHealth checking region, without
+// accounts.
+func newPreflightHealth(region string) *preflightHealth {
+	return &preflightHealth{region: region}
+}
+
+// add adds the account name to check through client, initialized with
+// results.
+func (p *preflightHealth) add(name string, client *godo.Client, sources preflightSources, results []preflightResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.accounts = append(p.accounts, &preflightAccount{
+		name:    name,
+		client:  client,
+		sources: sources,
+		results: results,
+	})
+}
+
+// Name implements healthz.HealthzChecker.
+func (p *preflightHealth) Name() string {
+	return "digitalocean"
+}
+
+// Check implements healthz.HealthzChecker.
+func (p *preflightHealth) Check(_ *http.Request) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.accounts) == 1 {
+		return preflightError(p.accounts[0].results)
+	}
+
+	var failures []string
+	for _, acc := range p.accounts {
+		if err := preflightError(acc.results); err != nil {
+			failures = append(failures, fmt.Sprintf("account %q: %s", acc.name, err))
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return errors.New(strings.Join(failures, "\n"))
+}
+
+// refresh reruns the preflight checks of all accounts.
+func (p *preflightHealth) refresh(ctx context.Context) {
+	p.mu.Lock()
+	accounts := append([]*preflightAccount(nil), p.accounts...)
+	p.mu.Unlock()
+
+	for _, acc := range accounts {
+		results := runPreflightChecks(ctx, acc.client, p.region, acc.sources)
+		if err := preflightError(results); err != nil {
+			glog.Errorf("health check of account %q failed: %s", acc.name, err)
+		}
+
+		p.mu.Lock()
+		acc.results = results
+		p.mu.Unlock()
+	}
+}
+
+// serve serves the health endpoint on addr.
+func (p *preflightHealth) serve(addr string) {
+	mux := http.NewServeMux()
+	healthz.InstallHandler(mux, p)
+
+	glog.Infof("serving DigitalOcean health checks on %s/healthz", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.Errorf("failed to serve health checks: %s", err)
+	}
+}
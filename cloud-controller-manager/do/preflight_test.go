@@ -0,0 +1,249 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+type fakeAccountService struct {
+	account *godo.Account
+	err     error
+}
+
+func (f *fakeAccountService) Get(context.Context) (*godo.Account, *godo.Response, error) {
+	return f.account, newFakeOKResponse(), f.err
+}
+
+type fakeRegionsService struct {
+	regions []godo.Region
+}
+
+func (f *fakeRegionsService) List(context.Context, *godo.ListOptions) ([]godo.Region, *godo.Response, error) {
+	return f.regions, newFakeOKResponse(), nil
+}
+
+func newFakePreflightClient(account *godo.Account, lbErr error) *godo.Client {
+	fakeDroplet := &fakeDropletService{}
+	fakeDroplet.listFunc = func(context.Context, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+		return nil, newFakeOKResponse(), nil
+	}
+	fakeLB := &fakeLBService{
+		listFn: func(context.Context, *godo.ListOptions) ([]godo.LoadBalancer, *godo.Response, error) {
+			return nil, newFakeOKResponse(), lbErr
+		},
+	}
+
+	client := newFakeLBClient(fakeLB, fakeDroplet)
+	client.Account = &fakeAccountService{account: account}
+	client.Regions = &fakeRegionsService{regions: []godo.Region{
+		{Slug: "nyc1", Available: true},
+		{Slug: "ams1", Available: false},
+	}}
+
+	return client
+}
+
+func Test_runPreflightChecks(t *testing.T) {
+	activeAccount := &godo.Account{Status: "active", EmailVerified: true}
+	forbidden := &godo.ErrorResponse{Response: &http.Response{StatusCode: http.StatusForbidden}, Message: "forbidden"}
+
+	testcases := []struct {
+		name     string
+		account  *godo.Account
+		region   string
+		lbErr    error
+		failures []string
+	}{
+		{"all checks pass", activeAccount, "nyc1", nil, nil},
+		{
+			"locked account",
+			&godo.Account{Status: "locked", StatusMessage: "billing", EmailVerified: true},
+			"nyc1", nil,
+			[]string{"account: account status is \"locked\""},
+		},
+		{"unverified email", &godo.Account{Status: "active"}, "nyc1", nil, nil},
+		{"unavailable region", activeAccount, "ams1", nil, []string{"region: region \"ams1\" from DO_REGION is not available"}},
+		{"unknown region", activeAccount, "xyz1", nil, []string{"region: region \"xyz1\" from DO_REGION is unknown"}},
+		{
+			"several failures",
+			&godo.Account{Status: "active"},
+			"xyz1", forbidden,
+			[]string{"region:", "permissions: token cannot list load balancers"},
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakePreflightClient(test.account, test.lbErr)
+			err := preflightError(runPreflightChecks(context.TODO(), client, test.region, preflightSources{token: doAccessTokenEnv, region: doRegionEnv}))
+			if len(test.failures) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			for _, failure := range test.failures {
+				if !strings.Contains(err.Error(), failure) {
+					t.Errorf("expected error to contain %q, got %q", failure, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_runPreflightChecks_sources(t *testing.T) {
+	client := newFakePreflightClient(nil, nil)
+	client.Account = &fakeAccountService{err: errors.New("unauthorized")}
+
+	testcases := []struct {
+		name     string
+		sources  preflightSources
+		failures []string
+	}{
+		{
+			"environment",
+			preflightSources{token: doAccessTokenEnv, region: doRegionEnv},
+			[]string{"verify that DO_ACCESS_TOKEN holds a valid token", "region \"xyz1\" from DO_REGION"},
+		},
+		{
+			"token file and metadata",
+			preflightSources{token: `DO_ACCESS_TOKEN_PATH file "/etc/do/token"`, region: "droplet metadata"},
+			[]string{`verify that DO_ACCESS_TOKEN_PATH file "/etc/do/token" holds a valid token`, "region \"xyz1\" from droplet metadata"},
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			err := preflightError(runPreflightChecks(context.TODO(), client, "xyz1", test.sources))
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			for _, failure := range test.failures {
+				if !strings.Contains(err.Error(), failure) {
+					t.Errorf("expected error to contain %q, got %q", failure, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_retryPreflightChecks(t *testing.T) {
+	defer func(backoff wait.Backoff) { preflightBackoff = backoff }(preflightBackoff)
+	preflightBackoff = wait.Backoff{Duration: time.Millisecond, Steps: 3}
+
+	unavailable := &godo.ErrorResponse{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}, Message: "unavailable"}
+	unauthorized := &godo.ErrorResponse{Response: &http.Response{StatusCode: http.StatusUnauthorized}, Message: "unauthorized"}
+	active := &godo.Account{Status: "active", EmailVerified: true}
+
+	testcases := []struct {
+		name      string
+		errs      []error
+		calls     int
+		failed    bool
+		transient bool
+	}{
+		{"recovers from server errors", []error{unavailable, errors.New("connection reset"), nil}, 3, false, false},
+		{"keeps failing transiently", []error{unavailable, unavailable, unavailable}, 3, true, true},
+		{"invalid token is not retried", []error{unauthorized}, 1, true, false},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakePreflightClient(active, nil)
+			accounts := &sequenceAccountService{account: active, errs: test.errs}
+			client.Account = accounts
+
+			results := retryPreflightChecks(context.TODO(), client, "nyc1", preflightSources{token: doAccessTokenEnv, region: doRegionEnv})
+			if accounts.calls != test.calls {
+				t.Errorf("expected %d runs, got %d", test.calls, accounts.calls)
+			}
+
+			account := results[0]
+			if failed := account.err != nil; failed != test.failed {
+				t.Fatalf("expected failed to be %t, got error %v", test.failed, account.err)
+			}
+			if account.transient != test.transient {
+				t.Errorf("expected transient to be %t, got %t", test.transient, account.transient)
+			}
+			if permanent := len(permanentFailures(results)) > 0; permanent != (test.failed && !test.transient) {
+				t.Errorf("unexpected permanent failures %v", permanentFailures(results))
+			}
+		})
+	}
+}
+
+// sequenceAccountService fails the calls to Get with errs in turn.
+type sequenceAccountService struct {
+	account *godo.Account
+	errs    []error
+	calls   int
+}
+
+func (f *sequenceAccountService) Get(context.Context) (*godo.Account, *godo.Response, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return f.account, newFakeOKResponse(), nil
+}
+
+func Test_preflightHealth(t *testing.T) {
+	account := &godo.Account{Status: "active", EmailVerified: true}
+	client := newFakePreflightClient(account, nil)
+
+	health := newPreflightHealth("nyc1")
+	health.add(defaultAccountName, client, preflightSources{token: doAccessTokenEnv, region: doRegionEnv}, []preflightResult{{name: "account", err: errors.New("failed")}})
+	if err := health.Check(nil); err == nil {
+		t.Error("expected health check to report initial failure")
+	}
+
+	health.refresh(context.TODO())
+	if err := health.Check(nil); err != nil {
+		t.Errorf("expected health check to pass after refresh, got %s", err)
+	}
+
+	// every account is checked.
+	locked := newFakePreflightClient(&godo.Account{Status: "locked", EmailVerified: true}, nil)
+	health.add("team-b", locked, preflightSources{token: `tokenPath "/etc/do/team-b"`, region: doRegionEnv}, nil)
+	health.refresh(context.TODO())
+
+	err := health.Check(nil)
+	if err == nil {
+		t.Fatal("expected health check to report the failing account")
+	}
+	if !strings.Contains(err.Error(), `account "team-b"`) || strings.Contains(err.Error(), `account "default"`) {
+		t.Errorf("expected only account team-b to fail, got %s", err)
+	}
+}
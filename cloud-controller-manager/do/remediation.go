@@ -0,0 +1,391 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// labelDisableRemediation opts a node out of remediation when set to
+	// true.
+	labelDisableRemediation = "node.digitalocean.com/disable-remediation"
+
+	defaultRemediationPowerOnAfter    = 10 * time.Minute
+	defaultRemediationPowerCycleAfter = 15 * time.Minute
+	defaultRemediationNodeCooldown    = 30 * time.Minute
+	defaultRemediationMinInterval     = 5 * time.Minute
+	defaultRemediationMaxConcurrent   = 1
+	defaultRemediationSyncPeriod      = 1 * time.Minute
+
+	dropletActiveStatus = "active"
+)
+
+// remediation is an action taken on a droplet to bring its node back.
+type remediation string
+
+const (
+	remediationNone       remediation = ""
+	remediationPowerOn    remediation = "PowerOn"
+	remediationPowerCycle remediation = "PowerCycle"
+)
+
+// remediationConfig configures the remediation of stuck droplets.
+type remediationConfig struct {
+	// powerOnAfter is how long a droplet must be off before it is powered
+	// on.
+	powerOnAfter time.Duration
+	// powerCycleAfter is how long a node must be NotReady while its droplet
+	// is active before the droplet is power cycled.
+	powerCycleAfter time.Duration
+	// nodeCooldown is the minimum duration between two remediations of the
+	// same node.
+	nodeCooldown time.Duration
+	// minInterval is the minimum duration between any two remediations.
+	minInterval time.Duration
+	// maxConcurrent is the maximum number of remediations in progress.
+	maxConcurrent int
+	syncPeriod    time.Duration
+}
+
+// remediationConfigFromEnv returns the remediationConfig described by the
+// process environment. nil is returned if remediation is not enabled.
+func remediationConfigFromEnv() (*remediationConfig, error) {
+	enabled, err := boolFromEnv(doNodeRemediationEnv, false)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	cfg := &remediationConfig{maxConcurrent: defaultRemediationMaxConcurrent}
+
+	durations := []struct {
+		env string
+		def time.Duration
+		dst *time.Duration
+	}{
+		{doNodeRemediationPowerOnAfterEnv, defaultRemediationPowerOnAfter, &cfg.powerOnAfter},
+		{doNodeRemediationPowerCycleAfterEnv, defaultRemediationPowerCycleAfter, &cfg.powerCycleAfter},
+		{doNodeRemediationNodeCooldownEnv, defaultRemediationNodeCooldown, &cfg.nodeCooldown},
+		{doNodeRemediationMinIntervalEnv, defaultRemediationMinInterval, &cfg.minInterval},
+		{doNodeRemediationSyncPeriodEnv, defaultRemediationSyncPeriod, &cfg.syncPeriod},
+	}
+	for _, d := range durations {
+		if *d.dst, err = durationFromEnv(d.env, d.def); err != nil {
+			return nil, err
+		}
+	}
+
+	if s := os.Getenv(doNodeRemediationMaxConcurrentEnv); s != "" {
+		cfg.maxConcurrent, err = strconv.Atoi(s)
+		if err != nil || cfg.maxConcurrent < 1 {
+			return nil, fmt.Errorf("%q must be a positive integer, got: %q", doNodeRemediationMaxConcurrentEnv, s)
+		}
+	}
+
+	return cfg, nil
+}
+
+// nodeNotReadySince returns the time since which node is not ready, or the
+// zero time if node is ready or has no Ready condition.
+func nodeNotReadySince(node *v1.Node) time.Time {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady && cond.Status != v1.ConditionTrue {
+			return cond.LastTransitionTime.Time
+		}
+	}
+
+	return time.Time{}
+}
+
+// decideRemediation returns the remediation due for node backed by droplet,
+// given that the droplet was first observed off at offSince.
+func decideRemediation(cfg *remediationConfig, node *v1.Node, droplet *godo.Droplet, offSince, now time.Time) remediation {
+	if droplet.Locked {
+		// an action is already in progress.
+		return remediationNone
+	}
+
+	switch droplet.Status {
+	case dropletShutdownStatus:
+		if !offSince.IsZero() && now.Sub(offSince) >= cfg.powerOnAfter {
+			return remediationPowerOn
+		}
+	case dropletActiveStatus:
+		notReadySince := nodeNotReadySince(node)
+		if !notReadySince.IsZero() && now.Sub(notReadySince) >= cfg.powerCycleAfter {
+			return remediationPowerCycle
+		}
+	}
+
+	return remediationNone
+}
+
+// remediationLimiter enforces the maximum number of concurrent remediations
+// and the minimum interval between two remediations. A single limiter is
+// shared by the remediation controllers of all accounts.
+type remediationLimiter struct {
+	maxConcurrent int
+	minInterval   time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	last     time.Time
+}
+
+// newRemediationLimiter returns a remediationLimiter with the limits of cfg.
+func newRemediationLimiter(cfg *remediationConfig) *remediationLimiter {
+	return &remediationLimiter{
+		maxConcurrent: cfg.maxConcurrent,
+		minInterval:   cfg.minInterval,
+	}
+}
+
+// acquire reserves a remediation at now. It returns why no remediation may
+// start, or an empty string if one was reserved.
+func (l *remediationLimiter) acquire(now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= l.maxConcurrent {
+		return fmt.Sprintf("%d remediations already in progress", l.inFlight)
+	}
+
+	if !l.last.IsZero() && now.Sub(l.last) < l.minInterval {
+		return fmt.Sprintf("last remediation was less than %s ago", l.minInterval)
+	}
+
+	l.inFlight++
+	l.last = now
+
+	return ""
+}
+
+// release ends a remediation reserved by acquire.
+func (l *remediationLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight > 0 {
+		l.inFlight--
+	}
+}
+
+// inFlightRemediation is a remediation whose droplet action has not finished
+// yet.
+type inFlightRemediation struct {
+	dropletID int
+	actionID  int
+}
+
+// remediationController powers on droplets which stay off and power cycles
+// droplets whose nodes stay NotReady.
+type remediationController struct {
+	client           *godo.Client
+	nodeLister       corelisters.NodeLister
+	nodeListerSynced cache.InformerSynced
+	recorder         record.EventRecorder
+	cfg              *remediationConfig
+	now              func() time.Time
+
+	// offSince holds the time each droplet was first observed off.
+	offSince map[int]time.Time
+	// lastRemediated holds the time of the last remediation of each node.
+	lastRemediated map[string]time.Time
+	// inFlight holds the remediations in progress by node name.
+	inFlight map[string]inFlightRemediation
+	// limiter bounds the remediations across accounts. Controllers of
+	// different accounts must share the same limiter.
+	limiter *remediationLimiter
+
+	// dropletTag restricts the droplets which are remediated to those
+	// carrying it, if set.
+	dropletTag string
+}
+
+// newRemediationController returns a new remediationController.
+func newRemediationController(client *godo.Client, nodeLister corelisters.NodeLister, nodeListerSynced cache.InformerSynced, recorder record.EventRecorder, cfg *remediationConfig) *remediationController {
+	return &remediationController{
+		client:           client,
+		nodeLister:       nodeLister,
+		nodeListerSynced: nodeListerSynced,
+		recorder:         recorder,
+		cfg:              cfg,
+		now:              time.Now,
+		offSince:         map[int]time.Time{},
+		lastRemediated:   map[string]time.Time{},
+		inFlight:         map[string]inFlightRemediation{},
+		limiter:          newRemediationLimiter(cfg),
+	}
+}
+
+// Run checks for nodes to remediate every sync period until stopCh is closed.
+func (c *remediationController) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.nodeListerSynced) {
+		glog.Error("failed to sync node cache for remediation controller")
+		return
+	}
+
+	wait.Until(func() {
+		if err := c.sync(context.Background()); err != nil {
+			glog.Errorf("failed to remediate nodes: %s", err)
+		}
+	}, c.cfg.syncPeriod, stopCh)
+}
+
+// sync remediates the nodes due for remediation, within the configured
+// limits.
+func (c *remediationController) sync(ctx context.Context) error {
+	c.pruneInFlight(ctx)
+
+	droplets, err := dropletList(ctx, c.client, c.dropletTag)
+	if err != nil {
+		return fmt.Errorf("failed to list droplets: %s", err)
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %s", err)
+	}
+
+	now := c.now()
+	seen := map[int]bool{}
+	for _, node := range nodes {
+		droplet := dropletForNode(node, droplets)
+		if droplet == nil {
+			continue
+		}
+		seen[droplet.ID] = true
+
+		if droplet.Status == dropletShutdownStatus {
+			if _, ok := c.offSince[droplet.ID]; !ok {
+				c.offSince[droplet.ID] = now
+			}
+		} else {
+			delete(c.offSince, droplet.ID)
+		}
+
+		action := decideRemediation(c.cfg, node, droplet, c.offSince[droplet.ID], now)
+		if action == remediationNone {
+			continue
+		}
+
+		reason := c.blocked(node, now)
+		if reason == "" {
+			reason = c.limiter.acquire(now)
+		}
+		if reason != "" {
+			glog.V(2).Infof("not remediating node %s with %s: %s", node.Name, action, reason)
+			continue
+		}
+
+		c.remediate(ctx, node, droplet, action, now)
+	}
+
+	for id := range c.offSince {
+		if !seen[id] {
+			delete(c.offSince, id)
+		}
+	}
+
+	return nil
+}
+
+// blocked returns why node may not be remediated now, or an empty string if
+// it may. The limits shared across accounts are checked by the limiter.
+func (c *remediationController) blocked(node *v1.Node, now time.Time) string {
+	if disabled, _ := strconv.ParseBool(node.Labels[labelDisableRemediation]); disabled {
+		return "remediation disabled by label " + labelDisableRemediation
+	}
+
+	if _, ok := c.inFlight[node.Name]; ok {
+		return "remediation already in progress"
+	}
+
+	if last, ok := c.lastRemediated[node.Name]; ok && now.Sub(last) < c.cfg.nodeCooldown {
+		return fmt.Sprintf("node was remediated less than %s ago", c.cfg.nodeCooldown)
+	}
+
+	return ""
+}
+
+// remediate performs action on droplet and records an event on node. The
+// caller must have acquired the limiter.
+func (c *remediationController) remediate(ctx context.Context, node *v1.Node, droplet *godo.Droplet, action remediation, now time.Time) {
+	var (
+		result *godo.Action
+		err    error
+	)
+	switch action {
+	case remediationPowerOn:
+		result, _, err = c.client.DropletActions.PowerOn(ctx, droplet.ID)
+	case remediationPowerCycle:
+		result, _, err = c.client.DropletActions.PowerCycle(ctx, droplet.ID)
+	}
+
+	c.lastRemediated[node.Name] = now
+
+	if err != nil {
+		c.limiter.release()
+		glog.Errorf("failed to remediate node %s with %s of droplet %d: %s", node.Name, action, droplet.ID, err)
+		c.recorder.Eventf(node, v1.EventTypeWarning, "DropletRemediationFailed", "Failed to %s droplet %d: %s", action, droplet.ID, err)
+		return
+	}
+
+	glog.Infof("remediating node %s with %s of droplet %d", node.Name, action, droplet.ID)
+	c.recorder.Eventf(node, v1.EventTypeNormal, "Droplet"+string(action), "Triggered %s of droplet %d (action %d) with droplet status %q", action, droplet.ID, result.ID, droplet.Status)
+
+	c.inFlight[node.Name] = inFlightRemediation{dropletID: droplet.ID, actionID: result.ID}
+	delete(c.offSince, droplet.ID)
+}
+
+// pruneInFlight forgets in-flight remediations whose droplet actions have
+// finished.
+func (c *remediationController) pruneInFlight(ctx context.Context) {
+	for name, r := range c.inFlight {
+		action, _, err := c.client.DropletActions.Get(ctx, r.dropletID, r.actionID)
+		if isNotFound(err) {
+			delete(c.inFlight, name)
+			c.limiter.release()
+			continue
+		}
+		if err != nil {
+			glog.Errorf("failed to get action %d of droplet %d: %s", r.actionID, r.dropletID, err)
+			continue
+		}
+
+		if action.Status != godo.ActionInProgress {
+			glog.V(2).Infof("remediation of node %s finished with status %q", name, action.Status)
+			delete(c.inFlight, name)
+			c.limiter.release()
+		}
+	}
+}
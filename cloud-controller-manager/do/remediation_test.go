@@ -0,0 +1,278 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+type fakeDropletActionsService struct {
+	godo.DropletActionsService
+	powerOnFn    func(context.Context, int) (*godo.Action, *godo.Response, error)
+	powerCycleFn func(context.Context, int) (*godo.Action, *godo.Response, error)
+	getFn        func(context.Context, int, int) (*godo.Action, *godo.Response, error)
+}
+
+func (f *fakeDropletActionsService) PowerOn(ctx context.Context, id int) (*godo.Action, *godo.Response, error) {
+	return f.powerOnFn(ctx, id)
+}
+
+func (f *fakeDropletActionsService) PowerCycle(ctx context.Context, id int) (*godo.Action, *godo.Response, error) {
+	return f.powerCycleFn(ctx, id)
+}
+
+func (f *fakeDropletActionsService) Get(ctx context.Context, dropletID, actionID int) (*godo.Action, *godo.Response, error) {
+	return f.getFn(ctx, dropletID, actionID)
+}
+
+func newNotReadyNode(name string, since time.Time) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{
+				Type:               v1.NodeReady,
+				Status:             v1.ConditionUnknown,
+				LastTransitionTime: metav1.NewTime(since),
+			}},
+		},
+	}
+}
+
+func Test_decideRemediation(t *testing.T) {
+	cfg := &remediationConfig{powerOnAfter: 10 * time.Minute, powerCycleAfter: 15 * time.Minute}
+	now := time.Unix(10000, 0)
+	readyNode := &v1.Node{
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+
+	testcases := []struct {
+		name     string
+		node     *v1.Node
+		droplet  *godo.Droplet
+		offSince time.Time
+		want     remediation
+	}{
+		{
+			"droplet off long enough",
+			readyNode,
+			&godo.Droplet{Status: "off"},
+			now.Add(-11 * time.Minute),
+			remediationPowerOn,
+		},
+		{
+			"droplet off recently",
+			readyNode,
+			&godo.Droplet{Status: "off"},
+			now.Add(-time.Minute),
+			remediationNone,
+		},
+		{
+			"node not ready long enough",
+			newNotReadyNode("node", now.Add(-20*time.Minute)),
+			&godo.Droplet{Status: "active"},
+			time.Time{},
+			remediationPowerCycle,
+		},
+		{
+			"node not ready recently",
+			newNotReadyNode("node", now.Add(-5*time.Minute)),
+			&godo.Droplet{Status: "active"},
+			time.Time{},
+			remediationNone,
+		},
+		{
+			"droplet locked",
+			newNotReadyNode("node", now.Add(-20*time.Minute)),
+			&godo.Droplet{Status: "active", Locked: true},
+			time.Time{},
+			remediationNone,
+		},
+		{
+			"ready node",
+			readyNode,
+			&godo.Droplet{Status: "active"},
+			time.Time{},
+			remediationNone,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			got := decideRemediation(cfg, test.node, test.droplet, test.offSince, now)
+			if got != test.want {
+				t.Errorf("expected remediation %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_remediationController(t *testing.T) {
+	now := time.Unix(10000, 0)
+
+	optedOut := newNotReadyNode("node-3", now.Add(-time.Hour))
+	optedOut.Labels = map[string]string{labelDisableRemediation: "true"}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(newNotReadyNode("node-1", now.Add(-time.Hour)))
+	indexer.Add(newNotReadyNode("node-2", now.Add(-time.Hour)))
+	indexer.Add(optedOut)
+
+	fakeDroplets := &fakeDropletService{}
+	fakeDroplets.listFunc = func(context.Context, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+		return []godo.Droplet{
+			{ID: 1, Name: "node-1", Status: "active"},
+			{ID: 2, Name: "node-2", Status: "active"},
+			{ID: 3, Name: "node-3", Status: "active"},
+		}, newFakeOKResponse(), nil
+	}
+
+	var cycled []int
+	actionStatus := godo.ActionInProgress
+	fakeActions := &fakeDropletActionsService{
+		powerCycleFn: func(_ context.Context, id int) (*godo.Action, *godo.Response, error) {
+			cycled = append(cycled, id)
+			return &godo.Action{ID: 100 + id, Status: godo.ActionInProgress}, newFakeOKResponse(), nil
+		},
+		getFn: func(_ context.Context, _, actionID int) (*godo.Action, *godo.Response, error) {
+			return &godo.Action{ID: actionID, Status: actionStatus}, newFakeOKResponse(), nil
+		},
+	}
+
+	client := newFakeClient(fakeDroplets)
+	client.DropletActions = fakeActions
+	recorder := record.NewFakeRecorder(10)
+	cfg := &remediationConfig{
+		powerOnAfter:    10 * time.Minute,
+		powerCycleAfter: 15 * time.Minute,
+		nodeCooldown:    30 * time.Minute,
+		minInterval:     time.Minute,
+		maxConcurrent:   1,
+	}
+
+	c := newRemediationController(client, corelisters.NewNodeLister(indexer), nil, recorder, cfg)
+	c.now = func() time.Time { return now }
+
+	if err := c.sync(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(cycled) != 1 {
+		t.Fatalf("expected exactly one remediation due to concurrency limit, got %v", cycled)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected one event, got %d", len(recorder.Events))
+	}
+
+	// the first remediation is still in flight.
+	now = now.Add(2 * time.Minute)
+	c.sync(context.TODO())
+	if len(cycled) != 1 {
+		t.Fatalf("expected no remediation while another one is in flight, got %v", cycled)
+	}
+
+	// the second node is remediated once the first action completed, the
+	// opted out node never is.
+	actionStatus = godo.ActionCompleted
+	now = now.Add(2 * time.Minute)
+	c.sync(context.TODO())
+	if len(cycled) != 2 || cycled[0] == cycled[1] {
+		t.Fatalf("expected both nodes to be remediated once, got %v", cycled)
+	}
+
+	for i := 0; i < 3; i++ {
+		now = now.Add(2 * time.Minute)
+		c.sync(context.TODO())
+	}
+	if len(cycled) != 2 {
+		t.Errorf("expected node cooldown and opt-out label to prevent further remediations, got %v", cycled)
+	}
+}
+
+func Test_remediationController_sharedLimiter(t *testing.T) {
+	now := time.Unix(10000, 0)
+
+	cfg := &remediationConfig{
+		powerOnAfter:    10 * time.Minute,
+		powerCycleAfter: 15 * time.Minute,
+		nodeCooldown:    30 * time.Minute,
+		minInterval:     time.Minute,
+		maxConcurrent:   1,
+	}
+	limiter := newRemediationLimiter(cfg)
+
+	var cycled []int
+	actionStatus := godo.ActionInProgress
+	newAccountController := func(nodeName string, dropletID int) *remediationController {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		indexer.Add(newNotReadyNode(nodeName, now.Add(-time.Hour)))
+
+		fakeDroplets := &fakeDropletService{}
+		fakeDroplets.listFunc = func(context.Context, *godo.ListOptions) ([]godo.Droplet, *godo.Response, error) {
+			return []godo.Droplet{{ID: dropletID, Name: nodeName, Status: "active"}}, newFakeOKResponse(), nil
+		}
+
+		client := newFakeClient(fakeDroplets)
+		client.DropletActions = &fakeDropletActionsService{
+			powerCycleFn: func(_ context.Context, id int) (*godo.Action, *godo.Response, error) {
+				cycled = append(cycled, id)
+				return &godo.Action{ID: 100 + id, Status: godo.ActionInProgress}, newFakeOKResponse(), nil
+			},
+			getFn: func(_ context.Context, _, actionID int) (*godo.Action, *godo.Response, error) {
+				return &godo.Action{ID: actionID, Status: actionStatus}, newFakeOKResponse(), nil
+			},
+		}
+
+		c := newRemediationController(client, corelisters.NewNodeLister(indexer), nil, record.NewFakeRecorder(10), cfg)
+		c.now = func() time.Time { return now }
+		c.limiter = limiter
+		return c
+	}
+
+	first := newAccountController("node-1", 1)
+	second := newAccountController("node-2", 2)
+
+	first.sync(context.TODO())
+	second.sync(context.TODO())
+	if len(cycled) != 1 {
+		t.Fatalf("expected the concurrency limit to span accounts, got %v", cycled)
+	}
+
+	// the first action completed, but the minimum interval has not passed.
+	actionStatus = godo.ActionCompleted
+	first.sync(context.TODO())
+	second.sync(context.TODO())
+	if len(cycled) != 1 {
+		t.Fatalf("expected the minimum interval to span accounts, got %v", cycled)
+	}
+
+	now = now.Add(2 * time.Minute)
+	second.sync(context.TODO())
+	if len(cycled) != 2 {
+		t.Fatalf("expected the second account to remediate after the interval, got %v", cycled)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+
+	"github.com/digitalocean/godo"
+)
+
+// RenderedLoadBalancer is the load balancer request the provider would send
+// for a Service, without talking to the DigitalOcean API.
+type RenderedLoadBalancer struct {
+	// Request is the request creating or updating the load balancer. It is
+	// nil if the Service is invalid.
+	Request *godo.LoadBalancerRequest `json:"request,omitempty"`
+	// Errors holds every problem with the annotations of the Service.
+	Errors []string `json:"errors,omitempty"`
+	// Notes holds the events the provider would record along with other
+	// remarks, e.g. about nodes without droplets.
+	Notes []string `json:"notes,omitempty"`
+}
+
+// RenderLoadBalancer returns the load balancer request the provider would
+// send for service in a cluster clusterName running in region, balancing
+// across nodes whose droplets are droplets. If droplets is nil, it is made up
+// from the provider IDs and region labels of nodes. Services of a load
+// balancer group are rendered as if they were its only member.
+func RenderLoadBalancer(clusterName, region string, service *v1.Service, nodes []*v1.Node, droplets []godo.Droplet) *RenderedLoadBalancer {
+	// ports read from files lack the protocol the API server defaults.
+	service = service.DeepCopy()
+	for i := range service.Spec.Ports {
+		if service.Spec.Ports[i].Protocol == "" {
+			service.Spec.Ports[i].Protocol = v1.ProtocolTCP
+		}
+	}
+
+	rendered := &RenderedLoadBalancer{}
+	for _, err := range validateLoadBalancerService(service) {
+		rendered.Errors = append(rendered.Errors, err.Error())
+	}
+	if len(rendered.Errors) > 0 {
+		return rendered
+	}
+
+	if service.UID == "" {
+		rendered.Notes = append(rendered.Notes, "service has no UID, the name of its load balancer is derived from the UID it gets once created")
+	}
+
+	if droplets == nil {
+		droplets = dropletsFromNodes(nodes)
+	}
+	for _, node := range nodes {
+		if dropletForNode(node, droplets) == nil {
+			rendered.Notes = append(rendered.Notes, fmt.Sprintf("no droplet found for node %s, it is left out", node.Name))
+		}
+	}
+
+	client, err := godo.New(&http.Client{Transport: &dropletsTransport{droplets: droplets}})
+	if err != nil {
+		rendered.Errors = append(rendered.Errors, err.Error())
+		return rendered
+	}
+	recorder := record.NewFakeRecorder(100)
+	l := newLoadbalancers(client, region)
+	l.recorder = recorder
+
+	group, _ := getLoadBalancerGroup(service)
+	if group == "" {
+		rendered.Request, err = l.buildLoadBalancerRequest(clusterName, service, nodes)
+	} else {
+		rendered.Request, _, err = l.buildGroupLoadBalancerRequest(clusterName, group, service, []*v1.Service{service}, nodes)
+	}
+	if err != nil {
+		rendered.Errors = append(rendered.Errors, err.Error())
+	}
+
+	close(recorder.Events)
+	for event := range recorder.Events {
+		rendered.Notes = append(rendered.Notes, event)
+	}
+
+	return rendered
+}
+
+// validateLoadBalancerService returns the problems with the load balancer
+// annotations of service. Unlike building the request, which stops at the
+// first one, every annotation is checked.
+func validateLoadBalancerService(service *v1.Service) []error {
+	var errs []error
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		errs = append(errs, fmt.Errorf("service has type %q, load balancers are only created for type %q", service.Spec.Type, v1.ServiceTypeLoadBalancer))
+	}
+
+	if _, err := getLoadBalancerMode(service); err != nil {
+		errs = append(errs, err)
+	} else if isFloatingIPMode(service) {
+		errs = append(errs, fmt.Errorf("service is exposed through a floating IP, it has no load balancer"))
+	}
+
+	if _, err := getLoadBalancerGroup(service); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := buildForwardingRules(service); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := buildHealthCheck(service); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := buildStickySessions(service); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := getNodeSelector(service); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// dropletsFromNodes returns a droplet for each node with a provider ID, in
+// the region of its region label.
+func dropletsFromNodes(nodes []*v1.Node) []godo.Droplet {
+	var droplets []godo.Droplet
+	for _, node := range nodes {
+		id, err := dropletIDFromProviderID(node.Spec.ProviderID)
+		if err != nil {
+			continue
+		}
+		dropletID, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+
+		droplet := godo.Droplet{ID: dropletID, Name: node.Name}
+		if region := node.Labels[kubeletapis.LabelZoneRegion]; region != "" {
+			droplet.Region = &godo.Region{Slug: region}
+		}
+		droplets = append(droplets, droplet)
+	}
+	return droplets
+}
+
+// dropletsTransport is an http.RoundTripper answering droplet list requests
+// with droplets, and failing all other requests.
+type dropletsTransport struct {
+	droplets []godo.Droplet
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *dropletsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.URL.Path != "/v2/droplets" {
+		return nil, fmt.Errorf("%s %s is not available when rendering offline", req.Method, req.URL.Path)
+	}
+
+	droplets := t.droplets
+	if droplets == nil {
+		droplets = []godo.Droplet{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"droplets": droplets})
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// DiffLoadBalancer returns the differences between the load balancer lb and
+// lbRequest, one per setting. Droplets and forwarding rules are compared
+// regardless of their order.
+func DiffLoadBalancer(lbRequest *godo.LoadBalancerRequest, lb *godo.LoadBalancer) []string {
+	var diffs []string
+	diff := func(setting string, live, rendered interface{}) {
+		l, _ := json.Marshal(live)
+		r, _ := json.Marshal(rendered)
+		if !bytes.Equal(l, r) {
+			diffs = append(diffs, fmt.Sprintf("%s: live %s, rendered %s", setting, l, r))
+		}
+	}
+
+	region := ""
+	if lb.Region != nil {
+		region = lb.Region.Slug
+	}
+
+	diff("name", lb.Name, lbRequest.Name)
+	diff("region", region, lbRequest.Region)
+	diff("algorithm", lb.Algorithm, lbRequest.Algorithm)
+	diff("redirect_http_to_https", lb.RedirectHttpToHttps, lbRequest.RedirectHttpToHttps)
+	diff("droplet_ids", sortedInts(lb.DropletIDs), sortedInts(lbRequest.DropletIDs))
+	diff("forwarding_rules", sortedForwardingRules(lb.ForwardingRules), sortedForwardingRules(lbRequest.ForwardingRules))
+	diff("health_check", lb.HealthCheck, lbRequest.HealthCheck)
+	diff("sticky_sessions", lb.StickySessions, lbRequest.StickySessions)
+
+	return diffs
+}
+
+// sortedInts returns a sorted copy of ints, which is empty rather than nil.
+func sortedInts(ints []int) []int {
+	sorted := append([]int{}, ints...)
+	sort.Ints(sorted)
+	return sorted
+}
+
+// sortedForwardingRules returns a copy of rules sorted by entry port, which
+// is empty rather than nil.
+func sortedForwardingRules(rules []godo.ForwardingRule) []godo.ForwardingRule {
+	sorted := append([]godo.ForwardingRule{}, rules...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].EntryPort < sorted[j].EntryPort
+	})
+	return sorted
+}
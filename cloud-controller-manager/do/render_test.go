@@ -0,0 +1,99 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+)
+
+func Test_RenderLoadBalancer(t *testing.T) {
+	nodes := []*v1.Node{
+		newLabeledNode("node-1", map[string]string{kubeletapis.LabelZoneRegion: "sfo2"}),
+		newLabeledNode("node-2", map[string]string{kubeletapis.LabelZoneRegion: "sfo2"}),
+		newLabeledNode("node-3", nil),
+	}
+	nodes[0].Spec.ProviderID = "digitalocean://11"
+	nodes[1].Spec.ProviderID = "digitalocean://12"
+
+	service := newScenarioService()
+	service.Spec.Ports[0].Protocol = ""
+	service.Annotations = map[string]string{annDOProtocol: "http"}
+
+	rendered := RenderLoadBalancer("cluster", "nyc1", service, nodes, nil)
+	if len(rendered.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", rendered.Errors)
+	}
+	if rendered.Request.Name != "ascenario" || rendered.Request.Region != "sfo2" || !reflect.DeepEqual(rendered.Request.DropletIDs, []int{11, 12}) {
+		t.Errorf("expected load balancer ascenario in sfo2 for droplets 11 and 12, got %+v", rendered.Request)
+	}
+	if rules := rendered.Request.ForwardingRules; len(rules) != 1 || rules[0].EntryProtocol != "http" || rules[0].TargetPort != 30080 {
+		t.Errorf("expected an http forwarding rule to port 30080, got %v", rules)
+	}
+	notes := strings.Join(rendered.Notes, "\n")
+	for _, note := range []string{"no droplet found for node node-3", "LoadBalancerBackends Balancing across 2 nodes: node-1, node-2"} {
+		if !strings.Contains(notes, note) {
+			t.Errorf("expected note %q, got %s", note, notes)
+		}
+	}
+
+	// all invalid annotations are reported at once.
+	service.Annotations = map[string]string{
+		annDOProtocol:                 "udp",
+		annDOStickySessionsType:       "cookies",
+		annDOLoadBalancerNodeSelector: "role in ingress",
+	}
+	rendered = RenderLoadBalancer("cluster", "nyc1", service, nodes, nil)
+	if rendered.Request != nil || len(rendered.Errors) != 4 {
+		t.Errorf("expected 4 errors and no request, got %v and %+v", rendered.Errors, rendered.Request)
+	}
+}
+
+func Test_DiffLoadBalancer(t *testing.T) {
+	lbRequest := &godo.LoadBalancerRequest{
+		Name:       "ascenario",
+		Region:     "nyc1",
+		Algorithm:  "round_robin",
+		DropletIDs: []int{2, 1},
+		ForwardingRules: []godo.ForwardingRule{
+			{EntryProtocol: "http", EntryPort: 80, TargetProtocol: "http", TargetPort: 30080},
+			{EntryProtocol: "tcp", EntryPort: 443, TargetProtocol: "tcp", TargetPort: 30443},
+		},
+	}
+	lb := &godo.LoadBalancer{
+		Name:       "ascenario",
+		Region:     &godo.Region{Slug: "nyc1"},
+		Algorithm:  "least_connections",
+		DropletIDs: []int{1, 2},
+		ForwardingRules: []godo.ForwardingRule{
+			lbRequest.ForwardingRules[1],
+			lbRequest.ForwardingRules[0],
+		},
+	}
+
+	diffs := DiffLoadBalancer(lbRequest, lb)
+	expected := []string{`algorithm: live "least_connections", rendered "round_robin"`}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected diff %v, got %v", expected, diffs)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/digitalocean/godo"
+	"github.com/golang/glog"
+)
+
+const (
+	// labelVCPUs, labelMemory, labelDisk and labelTransfer describe the
+	// resources of the droplet size of a node. Memory is given in MB, disk in
+	// GB and transfer in TB.
+	labelVCPUs    = "node.digitalocean.com/vcpus"
+	labelMemory   = "node.digitalocean.com/memory-mb"
+	labelDisk     = "node.digitalocean.com/disk-gb"
+	labelTransfer = "node.digitalocean.com/transfer-tb"
+
+	// labelPriceClass buckets the monthly price of the droplet size of a node,
+	// see priceClass.
+	labelPriceClass = "node.digitalocean.com/price-class"
+
+	// annPriceHourly and annPriceMonthly hold the price of the droplet size of
+	// a node in USD.
+	annPriceHourly  = "node.digitalocean.com/price-hourly"
+	annPriceMonthly = "node.digitalocean.com/price-monthly"
+
+	// defaultSizeCacheTTL is the duration after which the size catalog is
+	// refreshed.
+	defaultSizeCacheTTL = 1 * time.Hour
+
+	// defaultSizeMissTTL is the duration for which a slug missing from the
+	// size catalog is reported as not found without refreshing the catalog.
+	defaultSizeMissTTL = 10 * time.Minute
+
+	// defaultNodeSizesSyncPeriod is the default interval between two
+	// synchronizations of size labels onto nodes.
+	defaultNodeSizesSyncPeriod = 5 * time.Minute
+)
+
+// priceClasses are the upper monthly price bounds in USD of the price
+// classes, in ascending order. Sizes above the last bound are premium.
+var priceClasses = []struct {
+	name     string
+	maxPrice float64
+}{
+	{"low", 20},
+	{"medium", 80},
+	{"high", 320},
+}
+
+// priceClass returns the price class of size.
+func priceClass(size *godo.Size) string {
+	for _, pc := range priceClasses {
+		if size.PriceMonthly <= pc.maxPrice {
+			return pc.name
+		}
+	}
+
+	return "premium"
+}
+
+// sizeCache caches the DigitalOcean size catalog.
+type sizeCache struct {
+	client  *godo.Client
+	ttl     time.Duration
+	missTTL time.Duration
+
+	mu      sync.Mutex
+	sizes   map[string]godo.Size
+	fetched time.Time
+	// missing holds the slugs not found in the catalog along with the time
+	// they were looked up.
+	missing map[string]time.Time
+}
+
+// newSizeCache returns a sizeCache refreshing the catalog after ttl.
+func newSizeCache(client *godo.Client, ttl time.Duration) *sizeCache {
+	return &sizeCache{client: client, ttl: ttl, missTTL: defaultSizeMissTTL}
+}
+
+// get returns the size identified by slug. The catalog is refreshed if it is
+// stale or does not contain slug, unless slug was already missing from a
+// refresh within the miss TTL. If the refresh fails, a stale cached size is
+// returned.
+func (c *sizeCache) get(ctx context.Context, slug string) (*godo.Size, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size, ok := c.sizes[slug]
+	if ok && time.Since(c.fetched) < c.ttl {
+		return &size, nil
+	}
+
+	if missed, ok := c.missing[slug]; ok && time.Since(missed) < c.missTTL {
+		return nil, fmt.Errorf("size %q not found", slug)
+	}
+
+	if err := c.refresh(ctx); err != nil {
+		if ok {
+			glog.Warningf("using stale size %s: %s", slug, err)
+			return &size, nil
+		}
+		return nil, err
+	}
+
+	size, ok = c.sizes[slug]
+	if !ok {
+		c.missing[slug] = time.Now()
+		return nil, fmt.Errorf("size %q not found", slug)
+	}
+
+	return &size, nil
+}
+
+// refresh replaces the cached catalog with the sizes listed by the API. The
+// caller must hold c.mu.
+func (c *sizeCache) refresh(ctx context.Context) error {
+	sizes := map[string]godo.Size{}
+
+	opt := &godo.ListOptions{PerPage: apiPerPage}
+	for {
+		list, resp, err := c.client.Sizes.List(ctx, opt)
+		if err != nil {
+			return fmt.Errorf("failed to list sizes: %s", err)
+		}
+
+		for _, size := range list {
+			sizes[size.Slug] = size
+		}
+
+		if resp == nil || resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return err
+		}
+
+		opt.Page = page + 1
+	}
+
+	c.sizes = sizes
+	c.fetched = time.Now()
+	c.missing = map[string]time.Time{}
+
+	return nil
+}
+
+// sizeLabels returns the node labels describing size.
+func sizeLabels(size *godo.Size) map[string]string {
+	return map[string]string{
+		labelVCPUs:      strconv.Itoa(size.Vcpus),
+		labelMemory:     strconv.Itoa(size.Memory),
+		labelDisk:       strconv.Itoa(size.Disk),
+		labelTransfer:   strconv.FormatFloat(size.Transfer, 'f', -1, 64),
+		labelPriceClass: priceClass(size),
+	}
+}
+
+// sizeAnnotations returns the node annotations describing the price of size.
+func sizeAnnotations(size *godo.Size) map[string]string {
+	return map[string]string{
+		annPriceHourly:  strconv.FormatFloat(size.PriceHourly, 'f', -1, 64),
+		annPriceMonthly: strconv.FormatFloat(size.PriceMonthly, 'f', -1, 64),
+	}
+}
+
+// applySizeToNode returns a copy of node carrying the labels and annotations
+// of size, and whether anything changed.
+func applySizeToNode(node *v1.Node, size *godo.Size) (*v1.Node, bool) {
+	updated := node.DeepCopy()
+	changed := false
+
+	if updated.Labels == nil {
+		updated.Labels = map[string]string{}
+	}
+	for key, value := range sizeLabels(size) {
+		if current, ok := updated.Labels[key]; !ok || current != value {
+			updated.Labels[key] = value
+			changed = true
+		}
+	}
+
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	for key, value := range sizeAnnotations(size) {
+		if current, ok := updated.Annotations[key]; !ok || current != value {
+			updated.Annotations[key] = value
+			changed = true
+		}
+	}
+
+	return updated, changed
+}
+
+// nodeSizesController labels nodes with the resources and price of the size
+// of their droplets.
+type nodeSizesController struct {
+	client           *godo.Client
+	kclient          kubernetes.Interface
+	nodeLister       corelisters.NodeLister
+	nodeListerSynced cache.InformerSynced
+	sizes            *sizeCache
+	syncPeriod       time.Duration
+
+	// dropletTag restricts the droplets whose sizes are labelled to those
+	// carrying it, if set.
+	dropletTag string
+}
+
+// newNodeSizesController returns a new nodeSizesController.
+func newNodeSizesController(client *godo.Client, kclient kubernetes.Interface, nodeLister corelisters.NodeLister, nodeListerSynced cache.InformerSynced, sizes *sizeCache) *nodeSizesController {
+	return &nodeSizesController{
+		client:           client,
+		kclient:          kclient,
+		nodeLister:       nodeLister,
+		nodeListerSynced: nodeListerSynced,
+		sizes:            sizes,
+		syncPeriod:       defaultNodeSizesSyncPeriod,
+	}
+}
+
+// Run synchronizes size labels onto nodes every sync period until stopCh is
+// closed.
+func (c *nodeSizesController) Run(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.nodeListerSynced) {
+		glog.Error("failed to sync node cache for node sizes controller")
+		return
+	}
+
+	wait.Until(func() {
+		if err := c.sync(context.Background()); err != nil {
+			glog.Errorf("failed to sync size labels onto nodes: %s", err)
+		}
+	}, c.syncPeriod, stopCh)
+}
+
+// sync reconciles the size labels and annotations of all nodes.
+func (c *nodeSizesController) sync(ctx context.Context) error {
+	droplets, err := dropletList(ctx, c.client, c.dropletTag)
+	if err != nil {
+		return fmt.Errorf("failed to list droplets: %s", err)
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %s", err)
+	}
+
+	for _, node := range nodes {
+		droplet := dropletForNode(node, droplets)
+		if droplet == nil {
+			glog.V(2).Infof("no droplet found for node %s, skipping size labels", node.Name)
+			continue
+		}
+
+		size, err := c.sizes.get(ctx, droplet.SizeSlug)
+		if err != nil {
+			glog.Errorf("failed to get size of node %s: %s", node.Name, err)
+			continue
+		}
+
+		updated, changed := applySizeToNode(node, size)
+		if !changed {
+			continue
+		}
+
+		if _, err := c.kclient.CoreV1().Nodes().Update(updated); err != nil {
+			glog.Errorf("failed to update size labels of node %s: %s", node.Name, err)
+			continue
+		}
+
+		glog.V(2).Infof("updated size labels of node %s to size %s", node.Name, size.Slug)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeSizesService struct {
+	listFn func(context.Context, *godo.ListOptions) ([]godo.Size, *godo.Response, error)
+}
+
+func (f *fakeSizesService) List(ctx context.Context, opt *godo.ListOptions) ([]godo.Size, *godo.Response, error) {
+	return f.listFn(ctx, opt)
+}
+
+func Test_priceClass(t *testing.T) {
+	testcases := []struct {
+		price float64
+		class string
+	}{
+		{5, "low"},
+		{20, "low"},
+		{40, "medium"},
+		{160, "high"},
+		{640, "premium"},
+	}
+
+	for _, test := range testcases {
+		class := priceClass(&godo.Size{PriceMonthly: test.price})
+		if class != test.class {
+			t.Errorf("expected price class %q for price %v, got %q", test.class, test.price, class)
+		}
+	}
+}
+
+func Test_sizeCache(t *testing.T) {
+	calls := 0
+	var listErr error
+	fake := &fakeSizesService{
+		listFn: func(_ context.Context, opt *godo.ListOptions) ([]godo.Size, *godo.Response, error) {
+			calls++
+			if listErr != nil {
+				return nil, nil, listErr
+			}
+			if opt.Page < 2 {
+				return []godo.Size{{Slug: "s-1vcpu-1gb"}}, &godo.Response{
+					Links: &godo.Links{Pages: &godo.Pages{Next: "http://example.com/v2/sizes?page=2", Last: "http://example.com/v2/sizes?page=2"}},
+				}, nil
+			}
+			return []godo.Size{{Slug: "s-2vcpu-4gb", Vcpus: 2}}, &godo.Response{}, nil
+		},
+	}
+	client := godo.NewClient(nil)
+	client.Sizes = fake
+
+	c := newSizeCache(client, time.Hour)
+
+	size, err := c.get(context.TODO(), "s-2vcpu-4gb")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if size.Vcpus != 2 {
+		t.Errorf("expected 2 vcpus, got %d", size.Vcpus)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 list calls, got %d", calls)
+	}
+
+	if _, err := c.get(context.TODO(), "s-1vcpu-1gb"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected cached catalog to be used, got %d list calls", calls)
+	}
+
+	if _, err := c.get(context.TODO(), "unknown"); err == nil {
+		t.Error("expected error for unknown size")
+	}
+	if calls != 4 {
+		t.Errorf("expected catalog to be refreshed on miss, got %d list calls", calls)
+	}
+
+	if _, err := c.get(context.TODO(), "unknown"); err == nil {
+		t.Error("expected error for unknown size")
+	}
+	if calls != 4 {
+		t.Errorf("expected cached miss to be used, got %d list calls", calls)
+	}
+
+	c.missTTL = 0
+	listErr = errors.New("unavailable")
+	if _, err := c.get(context.TODO(), "unknown"); err == nil {
+		t.Error("expected error for unknown size")
+	}
+	if calls != 5 {
+		t.Errorf("expected catalog to be refreshed after the miss expired, got %d list calls", calls)
+	}
+
+	c.ttl = 0
+	size, err = c.get(context.TODO(), "s-2vcpu-4gb")
+	if err != nil {
+		t.Fatalf("expected stale size on failed refresh, got error: %s", err)
+	}
+	if size.Vcpus != 2 {
+		t.Errorf("expected 2 vcpus, got %d", size.Vcpus)
+	}
+}
+
+func Test_applySizeToNode(t *testing.T) {
+	size := &godo.Size{
+		Slug:         "s-2vcpu-4gb",
+		Vcpus:        2,
+		Memory:       4096,
+		Disk:         80,
+		Transfer:     4,
+		PriceMonthly: 20,
+		PriceHourly:  0.02976,
+	}
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"user": "label"},
+		},
+	}
+
+	updated, changed := applySizeToNode(node, size)
+	if !changed {
+		t.Error("expected node to change")
+	}
+
+	wantLabels := map[string]string{
+		"user":          "label",
+		labelVCPUs:      "2",
+		labelMemory:     "4096",
+		labelDisk:       "80",
+		labelTransfer:   "4",
+		labelPriceClass: "low",
+	}
+	if !reflect.DeepEqual(updated.Labels, wantLabels) {
+		t.Error("unexpected labels")
+		t.Logf("expected: %v", wantLabels)
+		t.Logf("actual: %v", updated.Labels)
+	}
+
+	wantAnnotations := map[string]string{
+		annPriceHourly:  "0.02976",
+		annPriceMonthly: "20",
+	}
+	if !reflect.DeepEqual(updated.Annotations, wantAnnotations) {
+		t.Error("unexpected annotations")
+		t.Logf("expected: %v", wantAnnotations)
+		t.Logf("actual: %v", updated.Annotations)
+	}
+
+	if _, changed := applySizeToNode(updated, size); changed {
+		t.Error("expected labeled node to be unchanged")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	kubeletapis "k8s.io/kubernetes/pkg/kubelet/apis"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// csiDriverName and legacyCSIDriverName are the names the DigitalOcean
+	// Block Storage CSI driver has been registered under.
+	csiDriverName       = "dobs.csi.digitalocean.com"
+	legacyCSIDriverName = "com.digitalocean.csi.dobs"
+
+	// flexDriverPrefix is the prefix of DigitalOcean flex volume drivers,
+	// which pass the volume ID through the flexVolumeIDOption.
+	flexDriverPrefix   = "digitalocean"
+	flexVolumeIDOption = "volumeID"
+)
+
+// volumeIDFromPV returns the DigitalOcean volume ID backing pv. An empty
+// string is returned if pv is not a DigitalOcean Block Storage volume.
+func volumeIDFromPV(pv *v1.PersistentVolume) string {
+	switch {
+	case pv.Spec.CSI != nil:
+		if pv.Spec.CSI.Driver == csiDriverName || pv.Spec.CSI.Driver == legacyCSIDriverName {
+			return pv.Spec.CSI.VolumeHandle
+		}
+	case pv.Spec.FlexVolume != nil:
+		if strings.HasPrefix(pv.Spec.FlexVolume.Driver, flexDriverPrefix) {
+			return pv.Spec.FlexVolume.Options[flexVolumeIDOption]
+		}
+	}
+
+	return ""
+}
+
+// GetLabelsForVolume returns the region label of the DigitalOcean Block
+// Storage volume backing pv. No labels are returned for persistent volumes
+// not backed by DigitalOcean Block Storage. The volume is looked up in every
+// account.
+//
+// The zone label is not set since DigitalOcean has no notion of zones and
+// nodes are labeled with their region only; a zone label would make volumes
+// unschedulable.
+func (c *cloud) GetLabelsForVolume(ctx context.Context, pv *v1.PersistentVolume) (map[string]string, error) {
+	volumeID := volumeIDFromPV(pv)
+	if volumeID == "" {
+		return nil, nil
+	}
+
+	var volume *godo.Volume
+	var err error
+	for _, acc := range c.accounts.list {
+		volume, _, err = acc.client.Storage.GetVolume(ctx, volumeID)
+		if !isNotFound(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume %q of persistent volume %s: %s", volumeID, pv.Name, err)
+	}
+
+	if volume.Region == nil || volume.Region.Slug == "" {
+		return nil, fmt.Errorf("volume %q of persistent volume %s has no region", volumeID, pv.Name)
+	}
+
+	return map[string]string{
+		kubeletapis.LabelZoneRegion: volume.Region.Slug,
+	}, nil
+}
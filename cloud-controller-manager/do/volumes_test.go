@@ -0,0 +1,131 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package do
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+var _ cloudprovider.PVLabeler = new(cloud)
+
+type fakeStorageService struct {
+	godo.StorageService
+	getVolumeFn func(context.Context, string) (*godo.Volume, *godo.Response, error)
+}
+
+func (f *fakeStorageService) GetVolume(ctx context.Context, id string) (*godo.Volume, *godo.Response, error) {
+	return f.getVolumeFn(ctx, id)
+}
+
+func Test_GetLabelsForVolume(t *testing.T) {
+	getVolumeFn := func(_ context.Context, id string) (*godo.Volume, *godo.Response, error) {
+		if id != "vol-123" {
+			return nil, newFakeNotOKResponse(), errors.New("not found")
+		}
+		return &godo.Volume{ID: id, Region: &godo.Region{Slug: "nyc3"}}, newFakeOKResponse(), nil
+	}
+
+	testcases := []struct {
+		name   string
+		spec   v1.PersistentVolumeSpec
+		labels map[string]string
+		err    bool
+	}{
+		{
+			"csi volume",
+			v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: csiDriverName, VolumeHandle: "vol-123"},
+				},
+			},
+			map[string]string{"failure-domain.beta.kubernetes.io/region": "nyc3"},
+			false,
+		},
+		{
+			"flex volume",
+			v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					FlexVolume: &v1.FlexPersistentVolumeSource{
+						Driver:  "digitalocean/flex-volume-driver",
+						Options: map[string]string{flexVolumeIDOption: "vol-123"},
+					},
+				},
+			},
+			map[string]string{"failure-domain.beta.kubernetes.io/region": "nyc3"},
+			false,
+		},
+		{
+			"foreign csi driver",
+			v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: "other.csi.example.com", VolumeHandle: "vol-123"},
+				},
+			},
+			nil,
+			false,
+		},
+		{
+			"host path volume",
+			v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					HostPath: &v1.HostPathVolumeSource{Path: "/data"},
+				},
+			},
+			nil,
+			false,
+		},
+		{
+			"unknown volume",
+			v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: csiDriverName, VolumeHandle: "vol-456"},
+				},
+			},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			client := godo.NewClient(nil)
+			client.Storage = &fakeStorageService{getVolumeFn: getVolumeFn}
+			c := &cloud{accounts: singleAccount(client)}
+
+			pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}, Spec: test.spec}
+			labels, err := c.GetLabelsForVolume(context.TODO(), pv)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(labels, test.labels) {
+				t.Error("unexpected labels")
+				t.Logf("expected: %v", test.labels)
+				t.Logf("actual: %v", labels)
+			}
+		})
+	}
+}
@@ -19,18 +19,17 @@ package do
 import (
 	"context"
 
-	"github.com/digitalocean/godo"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/kubernetes/pkg/cloudprovider"
 )
 
 type zones struct {
-	client *godo.Client
-	region string
+	accounts *accounts
+	region   string
 }
 
-func newZones(client *godo.Client, region string) cloudprovider.Zones {
-	return zones{client, region}
+func newZones(accounts *accounts, region string) cloudprovider.Zones {
+	return zones{accounts, region}
 }
 
 // GetZone returns a cloudprovider.Zone from the region of z. GetZone only sets
@@ -50,7 +49,7 @@ func (z zones) GetZoneByProviderID(ctx context.Context, providerID string) (clou
 		return cloudprovider.Zone{}, err
 	}
 
-	d, err := dropletByID(ctx, z.client, id)
+	d, _, err := z.accounts.dropletByID(ctx, id)
 	if err != nil {
 		return cloudprovider.Zone{}, err
 	}
@@ -62,7 +61,7 @@ func (z zones) GetZoneByProviderID(ctx context.Context, providerID string) (clou
 // by nodeName. GetZoneByNodeName only sets the Region field of the returned
 // cloudprovider.Zone.
 func (z zones) GetZoneByNodeName(ctx context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
-	d, err := dropletByName(ctx, z.client, nodeName)
+	d, _, err := z.accounts.dropletByName(ctx, nodeName)
 	if err != nil {
 		return cloudprovider.Zone{}, err
 	}
@@ -22,7 +22,7 @@ func TestZones_GetZoneByNodeName(t *testing.T) {
 	}
 
 	client := newFakeClient(fake)
-	zones := newZones(client, "nyc1")
+	zones := newZones(singleAccount(client), "nyc1")
 
 	expected := cloudprovider.Zone{Region: "test1"}
 
@@ -46,7 +46,7 @@ func TestZones_GetZoneByProviderID(t *testing.T) {
 		return droplet, resp, nil
 	}
 	client := newFakeClient(fake)
-	zones := newZones(client, "nyc1")
+	zones := newZones(singleAccount(client), "nyc1")
 
 	expected := cloudprovider.Zone{Region: "test1"}
 
@@ -0,0 +1,380 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+const (
+	timeout = 30 * time.Second
+	// retryTimeout bounds waits for the backoff retries of the service
+	// controller, whose delay doubles from 5s with every failure.
+	retryTimeout = 2 * time.Minute
+)
+
+func startHarness(t *testing.T) *Harness {
+	h, err := Start(fakedo.NewServer(), map[string]string{
+		// the size labels controller is irrelevant to the scenarios.
+		"DO_NODE_SIZE_LABELS": "false",
+	})
+	if err != nil {
+		t.Fatalf("failed to start harness: %s", err)
+	}
+	return h
+}
+
+func addNodes(t *testing.T, h *Harness, names ...string) []godo.Droplet {
+	var droplets []godo.Droplet
+	for _, name := range names {
+		d, err := h.AddNode(name)
+		if err != nil {
+			t.Fatalf("failed to add node %s: %s", name, err)
+		}
+		droplets = append(droplets, d)
+	}
+	return droplets
+}
+
+// waitInitialized waits for the cloud node controller to initialize the node
+// name with the droplet d.
+func waitInitialized(t *testing.T, h *Harness, name string, d godo.Droplet) {
+	err := h.Wait(timeout, func() (bool, error) {
+		node, err := h.Kube.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return node.Spec.ProviderID == "digitalocean://"+strconv.Itoa(d.ID) && len(node.Spec.Taints) == 0 && len(node.Status.Addresses) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("node %s was not initialized: %s", name, err)
+	}
+}
+
+// waitLoadBalancer waits for the fake API to hold a single load balancer
+// satisfying condition, and returns it.
+func waitLoadBalancer(t *testing.T, h *Harness, what string, condition func(godo.LoadBalancer) bool) godo.LoadBalancer {
+	var lb godo.LoadBalancer
+	err := h.Wait(timeout, func() (bool, error) {
+		lbs := h.API.LoadBalancers()
+		if len(lbs) != 1 {
+			return false, nil
+		}
+		lb = lbs[0]
+		return condition(lb), nil
+	})
+	if err != nil {
+		t.Fatalf("load balancer never %s: %s, got %+v", what, err, h.API.LoadBalancers())
+	}
+	return lb
+}
+
+// updateService applies mutate to the Service web, retrying on conflicts
+// with the writes of the controllers.
+func updateService(t *testing.T, h *Harness, mutate func(*v1.Service)) {
+	services := h.Kube.CoreV1().Services("default")
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		service, err := services.Get("web", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		mutate(service)
+		_, err = services.Update(service)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to update service: %s", err)
+	}
+}
+
+// expectNoStatusConflicts fails t if the service controller failed to
+// update the status of a Service because it was changed meanwhile.
+func expectNoStatusConflicts(t *testing.T, h *Harness) {
+	if n := h.Kube.StatusConflicts(); n > 0 {
+		t.Errorf("expected no conflicting Service status updates, got %d", n)
+	}
+}
+
+func sameDroplets(lb godo.LoadBalancer, droplets []godo.Droplet) bool {
+	if len(lb.DropletIDs) != len(droplets) {
+		return false
+	}
+	ids := map[int]bool{}
+	for _, id := range lb.DropletIDs {
+		ids[id] = true
+	}
+	for _, d := range droplets {
+		if !ids[d.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	h := startHarness(t)
+	defer h.Stop()
+
+	droplets := addNodes(t, h, "node-1", "node-2")
+	for i, d := range droplets {
+		waitInitialized(t, h, d.Name, droplets[i])
+	}
+
+	// create Service
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{
+				{Name: "http", Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+				{Name: "https", Protocol: v1.ProtocolTCP, Port: 443, NodePort: 30443},
+			},
+		},
+	}
+	if _, err := h.Kube.CoreV1().Services("default").Create(service); err != nil {
+		t.Fatalf("failed to create service: %s", err)
+	}
+
+	lb := waitLoadBalancer(t, h, "became active", func(lb godo.LoadBalancer) bool {
+		return lb.Status == fakedo.StatusActive && sameDroplets(lb, droplets)
+	})
+	err := h.Wait(timeout, func() (bool, error) {
+		s, err := h.Kube.CoreV1().Services("default").Get("web", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		ingress := s.Status.LoadBalancer.Ingress
+		return len(ingress) == 1 && ingress[0].IP == lb.IP, nil
+	})
+	if err != nil {
+		t.Fatalf("service status never reported load balancer IP %s: %s", lb.IP, err)
+	}
+	err = h.Wait(timeout, func() (bool, error) {
+		for _, e := range h.Kube.RecordedEvents() {
+			if e.InvolvedObject.Name == "web" && e.Reason == "EnsuredLoadBalancer" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("no EnsuredLoadBalancer event was recorded: %s", err)
+	}
+
+	// scale nodes; the service controller only syncs nodes every 100s, so
+	// the Service is nudged to pick up the new node.
+	droplets = append(droplets, addNodes(t, h, "node-3")...)
+	waitInitialized(t, h, "node-3", droplets[2])
+	updateService(t, h, func(s *v1.Service) {
+		s.Annotations = map[string]string{"e2e/generation": "2"}
+	})
+	waitLoadBalancer(t, h, "picked up node-3", func(lb godo.LoadBalancer) bool {
+		return sameDroplets(lb, droplets)
+	})
+
+	// rotate cert
+	certificateForPort := func(lb godo.LoadBalancer, port int) string {
+		for _, rule := range lb.ForwardingRules {
+			if rule.EntryPort == port {
+				return rule.CertificateID
+			}
+		}
+		return ""
+	}
+	for _, name := range []string{"cert-1", "cert-2"} {
+		cert := h.API.AddCertificate(godo.Certificate{Name: name})
+		updateService(t, h, func(s *v1.Service) {
+			s.Annotations["service.beta.kubernetes.io/do-loadbalancer-protocol"] = "http"
+			s.Annotations["service.beta.kubernetes.io/do-loadbalancer-tls-ports"] = "443"
+			s.Annotations["service.beta.kubernetes.io/do-loadbalancer-certificate-id"] = cert.ID
+		})
+		waitLoadBalancer(t, h, "used certificate "+name, func(lb godo.LoadBalancer) bool {
+			return certificateForPort(lb, 443) == cert.ID
+		})
+	}
+
+	// delete Service
+	if err := h.Kube.CoreV1().Services("default").Delete("web", nil); err != nil {
+		t.Fatalf("failed to delete service: %s", err)
+	}
+	err = h.Wait(timeout, func() (bool, error) {
+		return len(h.API.LoadBalancers()) == 0, nil
+	})
+	if err != nil {
+		t.Fatalf("load balancer was not deleted: %s, got %+v", err, h.API.LoadBalancers())
+	}
+	expectNoStatusConflicts(t, h)
+}
+
+// countRequests returns the number of requests to the fake API made with
+// method for path.
+func countRequests(h *Harness, method, path string) int {
+	n := 0
+	for _, r := range h.API.Requests() {
+		if r == method+" "+path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestServiceStatusAnnotations(t *testing.T) {
+	const (
+		annLoadBalancerID     = "kubernetes.digitalocean.com/load-balancer-id"
+		annLoadBalancerStatus = "kubernetes.digitalocean.com/load-balancer-status"
+		annLastReconcileError = "kubernetes.digitalocean.com/last-reconcile-error"
+	)
+
+	h := startHarness(t)
+	defer h.Stop()
+
+	droplets := addNodes(t, h, "node-1")
+	waitInitialized(t, h, "node-1", droplets[0])
+
+	services := h.Kube.CoreV1().Services("default")
+	annotations := func() (map[string]string, error) {
+		s, err := services.Get("web", metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return s.Annotations, nil
+	}
+
+	// creating the load balancer fails, each time with another request ID.
+	h.API.AddFault(fakedo.Fault{Method: http.MethodPost, PathPrefix: "/v2/load_balancers", Status: http.StatusInternalServerError})
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Name: "http", Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	if _, err := services.Create(service); err != nil {
+		t.Fatalf("failed to create service: %s", err)
+	}
+
+	var reconcileErr string
+	err := h.Wait(timeout, func() (bool, error) {
+		a, err := annotations()
+		reconcileErr = a[annLastReconcileError]
+		return reconcileErr != "", err
+	})
+	if err != nil {
+		t.Fatalf("reconcile error was never written: %s", err)
+	}
+	if !strings.Contains(reconcileErr, "injected fault") || strings.Contains(reconcileErr, "request") {
+		t.Errorf("expected reconcile error without request ID, got %q", reconcileErr)
+	}
+
+	// the annotation does not change between failures, so the Service is
+	// retried with backoff rather than right away.
+	time.Sleep(time.Second)
+	before := countRequests(h, http.MethodPost, "/v2/load_balancers")
+	time.Sleep(3 * time.Second)
+	if retries := countRequests(h, http.MethodPost, "/v2/load_balancers") - before; retries > 1 {
+		t.Errorf("expected failing reconciles to back off, got %d retries in 3s", retries)
+	}
+	if a, err := annotations(); err != nil || a[annLastReconcileError] != reconcileErr {
+		t.Errorf("expected reconcile error %q to be kept, got %q and error %v", reconcileErr, a[annLastReconcileError], err)
+	}
+
+	// once the load balancer is created, its state replaces the error. The
+	// Service is left to the backoff retry, since updating it while the
+	// retry creates the load balancer fails the update of its status.
+	h.API.ClearFaults()
+	var lb godo.LoadBalancer
+	err = h.Wait(retryTimeout, func() (bool, error) {
+		lbs := h.API.LoadBalancers()
+		if len(lbs) != 1 {
+			return false, nil
+		}
+		lb = lbs[0]
+		return lb.Status == fakedo.StatusActive, nil
+	})
+	if err != nil {
+		t.Fatalf("load balancer never became active: %s, got %+v", err, h.API.LoadBalancers())
+	}
+	err = h.Wait(timeout, func() (bool, error) {
+		a, err := annotations()
+		_, failed := a[annLastReconcileError]
+		return a[annLoadBalancerID] == lb.ID && a[annLoadBalancerStatus] == fakedo.StatusActive && !failed, err
+	})
+	if err != nil {
+		a, _ := annotations()
+		t.Fatalf("status annotations never reported load balancer %s: %s, got %v", lb.ID, err, a)
+	}
+	expectNoStatusConflicts(t, h)
+}
+
+func TestDropletShutdown(t *testing.T) {
+	h := startHarness(t)
+	defer h.Stop()
+
+	droplets := addNodes(t, h, "node-1")
+	waitInitialized(t, h, "node-1", droplets[0])
+
+	h.API.SetDropletStatus(droplets[0].ID, "off")
+	if err := h.SetNodeReady("node-1", false); err != nil {
+		t.Fatalf("failed to mark node not ready: %s", err)
+	}
+
+	hasShutdownTaint := func() (bool, error) {
+		node, err := h.Kube.CoreV1().Nodes().Get("node-1", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, taint := range node.Spec.Taints {
+			if taint.MatchTaint(controller.ShutdownTaint) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if err := h.Wait(timeout, hasShutdownTaint); err != nil {
+		t.Fatalf("shut down node was not tainted: %s", err)
+	}
+
+	// powering the droplet back on lifts the taint once the node is ready.
+	h.API.SetDropletStatus(droplets[0].ID, "active")
+	if err := h.SetNodeReady("node-1", true); err != nil {
+		t.Fatalf("failed to mark node ready: %s", err)
+	}
+	err := h.Wait(timeout, func() (bool, error) {
+		tainted, err := hasShutdownTaint()
+		return !tainted, err
+	})
+	if err != nil {
+		t.Fatalf("shutdown taint was not removed: %s", err)
+	}
+
+	if _, err := h.Kube.CoreV1().Nodes().Get("node-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected shut down node to be kept, got %s", err)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package e2e runs the digitalocean cloud provider inside the upstream
+// Kubernetes service and cloud node controllers, against a fake Kubernetes
+// API and the fake DigitalOcean API of package fakedo. It lets scenarios
+// such as creating a Service or shutting down a droplet be exercised end to
+// end without a cluster or a DigitalOcean account.
+package e2e
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+	nodecontroller "k8s.io/kubernetes/pkg/controller/cloud"
+	servicecontroller "k8s.io/kubernetes/pkg/controller/service"
+	"k8s.io/kubernetes/pkg/scheduler/algorithm"
+
+	// register the digitalocean cloud provider.
+	_ "github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/do"
+	"github.com/digitalocean/digitalocean-cloud-controller-manager/cloud-controller-manager/fakedo"
+)
+
+const (
+	// Region is the region the cloud provider runs in.
+	Region = "nyc1"
+	// ClusterName is the name of the cluster passed to the controllers.
+	ClusterName = "e2e"
+
+	nodeMonitorPeriod         = 500 * time.Millisecond
+	nodeStatusUpdateFrequency = 500 * time.Millisecond
+	pollInterval              = 100 * time.Millisecond
+)
+
+// Harness wires the cloud provider into the upstream controllers. Start
+// configures the cloud provider through the environment, so harnesses must
+// not run in parallel.
+type Harness struct {
+	// API is the fake DigitalOcean API the cloud provider talks to.
+	API *fakedo.Server
+	// Kube is the fake Kubernetes API the controllers talk to.
+	Kube *Kube
+	// Cloud is the cloud provider under test.
+	Cloud cloudprovider.Interface
+
+	server *httptest.Server
+	stopCh chan struct{}
+	nodes  int
+}
+
+// Start starts the cloud provider and the controllers against api. The
+// environment variables in env are set on top of the ones pointing the
+// cloud provider at api.
+func Start(api *fakedo.Server, env map[string]string) (*Harness, error) {
+	h := &Harness{
+		API:    api,
+		Kube:   NewKube(),
+		server: httptest.NewServer(api),
+		stopCh: make(chan struct{}),
+	}
+
+	vars := map[string]string{
+		"DO_ACCESS_TOKEN": "e2e",
+		"DO_OVERRIDE_URL": h.server.URL,
+		"DO_REGION":       Region,
+	}
+	for k, v := range env {
+		vars[k] = v
+	}
+	for k, v := range vars {
+		if err := os.Setenv(k, v); err != nil {
+			h.server.Close()
+			return nil, err
+		}
+	}
+
+	cloud, err := cloudprovider.GetCloudProvider("digitalocean", nil)
+	if err != nil {
+		h.server.Close()
+		return nil, fmt.Errorf("failed to start cloud provider: %s", err)
+	}
+	h.Cloud = cloud
+	cloud.Initialize(&clientBuilder{h.Kube})
+
+	factory := informers.NewSharedInformerFactory(h.Kube, 0)
+	services, err := servicecontroller.New(cloud, h.Kube, factory.Core().V1().Services(), factory.Core().V1().Nodes(), ClusterName)
+	if err != nil {
+		h.server.Close()
+		return nil, fmt.Errorf("failed to create service controller: %s", err)
+	}
+	nodes := nodecontroller.NewCloudNodeController(factory.Core().V1().Nodes(), h.Kube, cloud, nodeMonitorPeriod, nodeStatusUpdateFrequency)
+
+	factory.Start(h.stopCh)
+	go services.Run(h.stopCh, 1)
+	nodes.Run(h.stopCh)
+
+	return h, nil
+}
+
+// Stop stops the controllers and the fake DigitalOcean API.
+func (h *Harness) Stop() {
+	close(h.stopCh)
+	h.server.Close()
+}
+
+// AddNode adds a droplet named name and registers it as a ready node
+// awaiting initialization by the cloud provider, the way a kubelet run with
+// --cloud-provider=external does.
+func (h *Harness) AddNode(name string) (godo.Droplet, error) {
+	h.nodes++
+	droplet := h.API.AddDroplet(godo.Droplet{
+		Name:     name,
+		Region:   &godo.Region{Slug: Region},
+		SizeSlug: "s-1vcpu-1gb",
+		Networks: &godo.Networks{
+			V4: []godo.NetworkV4{
+				{IPAddress: fmt.Sprintf("10.0.0.%d", h.nodes), Type: "private"},
+				{IPAddress: fmt.Sprintf("192.0.2.%d", h.nodes), Type: "public"},
+			},
+		},
+	})
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{}},
+		Spec: v1.NodeSpec{
+			Taints: []v1.Taint{{
+				Key:    algorithm.TaintExternalCloudProvider,
+				Value:  "true",
+				Effect: v1.TaintEffectNoSchedule,
+			}},
+		},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+	if _, err := h.Kube.CoreV1().Nodes().Create(node); err != nil {
+		return godo.Droplet{}, err
+	}
+
+	return droplet, nil
+}
+
+// SetNodeReady sets the Ready condition of the node name, as its kubelet
+// would.
+func (h *Harness) SetNodeReady(name string, ready bool) error {
+	node, err := h.Kube.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == v1.NodeReady {
+			node.Status.Conditions[i].Status = status
+		}
+	}
+
+	_, err = h.Kube.CoreV1().Nodes().UpdateStatus(node)
+	return err
+}
+
+// Wait polls condition until it returns true, an error or timeout elapses.
+func (h *Harness) Wait(timeout time.Duration, condition func() (bool, error)) error {
+	return wait.PollImmediate(pollInterval, timeout, condition)
+}
+
+// clientBuilder hands out the fake Kubernetes API to the cloud provider.
+type clientBuilder struct {
+	kube *Kube
+}
+
+func (b *clientBuilder) Config(name string) (*rest.Config, error) {
+	return &rest.Config{}, nil
+}
+
+func (b *clientBuilder) ConfigOrDie(name string) *rest.Config {
+	return &rest.Config{}
+}
+
+func (b *clientBuilder) Client(name string) (kubernetes.Interface, error) {
+	return b.kube, nil
+}
+
+func (b *clientBuilder) ClientOrDie(name string) kubernetes.Interface {
+	return b.kube
+}
+
+func (b *clientBuilder) ClientGoClient(name string) (kubernetes.Interface, error) {
+	return b.kube, nil
+}
+
+func (b *clientBuilder) ClientGoClientOrDie(name string) kubernetes.Interface {
+	return b.kube
+}
@@ -0,0 +1,454 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// Kube is a minimal in-memory fake of the Kubernetes API. It serves the
+// nodes, services and events the cloud controller manager and the upstream
+// service and node controllers use; any other API panics. Updates carrying
+// a resourceVersion other than the stored one fail with a conflict, as they
+// do against an API server.
+type Kube struct {
+	kubernetes.Interface
+	core *fakeCoreV1
+}
+
+// NewKube returns an empty Kube.
+func NewKube() *Kube {
+	return &Kube{core: &fakeCoreV1{
+		nodes:    newStore(v1.Resource("nodes")),
+		services: newStore(v1.Resource("services")),
+	}}
+}
+
+// CoreV1 implements kubernetes.Interface.
+func (k *Kube) CoreV1() corev1.CoreV1Interface {
+	return k.core
+}
+
+// Core implements kubernetes.Interface.
+func (k *Kube) Core() corev1.CoreV1Interface {
+	return k.core
+}
+
+// StatusConflicts returns the number of status updates of Services which
+// failed with a conflict so far.
+func (k *Kube) StatusConflicts() int {
+	k.core.mu.Lock()
+	defer k.core.mu.Unlock()
+
+	return k.core.statusConflicts
+}
+
+// RecordedEvents returns the events recorded so far.
+func (k *Kube) RecordedEvents() []v1.Event {
+	k.core.mu.Lock()
+	defer k.core.mu.Unlock()
+
+	return append([]v1.Event(nil), k.core.events...)
+}
+
+type fakeCoreV1 struct {
+	corev1.CoreV1Interface
+
+	nodes    *store
+	services *store
+
+	mu              sync.Mutex
+	events          []v1.Event
+	statusConflicts int
+}
+
+func (c *fakeCoreV1) RESTClient() rest.Interface {
+	// a nil *rest.RESTClient has no rate limiter, which is all the
+	// controllers ask it for.
+	return (*rest.RESTClient)(nil)
+}
+
+func (c *fakeCoreV1) Nodes() corev1.NodeInterface {
+	return &fakeNodes{store: c.nodes}
+}
+
+func (c *fakeCoreV1) Services(namespace string) corev1.ServiceInterface {
+	return &fakeServices{core: c, store: c.services, namespace: namespace}
+}
+
+func (c *fakeCoreV1) Events(namespace string) corev1.EventInterface {
+	return &fakeEvents{core: c}
+}
+
+// store holds objects of one resource, keyed by namespace/name, and
+// broadcasts their changes to watchers.
+type store struct {
+	resource schema.GroupResource
+
+	mu      sync.Mutex
+	rv      int
+	objects map[string]runtime.Object
+	watch   *watch.Broadcaster
+}
+
+func newStore(resource schema.GroupResource) *store {
+	return &store{
+		resource: resource,
+		objects:  map[string]runtime.Object{},
+		watch:    watch.NewBroadcaster(100, watch.WaitIfChannelFull),
+	}
+}
+
+func key(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+func (s *store) selfLink(namespace, name string) string {
+	if namespace == "" {
+		return fmt.Sprintf("/api/v1/%s/%s", s.resource.Resource, name)
+	}
+	return fmt.Sprintf("/api/v1/namespaces/%s/%s/%s", namespace, s.resource.Resource, name)
+}
+
+func (s *store) notFound(name string) error {
+	return apierrors.NewNotFound(s.resource, name)
+}
+
+func (s *store) get(namespace, name string) (runtime.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[key(namespace, name)]
+	if !ok {
+		return nil, s.notFound(name)
+	}
+	return obj.DeepCopyObject(), nil
+}
+
+// list returns the objects in namespace, or in all namespaces if empty,
+// ordered by key.
+func (s *store) list(namespace string) ([]runtime.Object, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k, obj := range s.objects {
+		if namespace != "" && accessor(obj).GetNamespace() != namespace {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	objs := make([]runtime.Object, 0, len(keys))
+	for _, k := range keys {
+		objs = append(objs, s.objects[k].DeepCopyObject())
+	}
+	return objs, strconv.Itoa(s.rv)
+}
+
+// put stores obj, creating it if create is set and failing if it does not
+// exist otherwise. Updates of an object changed since obj was read, by its
+// resourceVersion, fail with a conflict; those without a resourceVersion are
+// unconditional.
+func (s *store) put(obj runtime.Object, create bool) (runtime.Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := accessor(obj)
+	k := key(m.GetNamespace(), m.GetName())
+	stored, exists := s.objects[k]
+	switch {
+	case create && exists:
+		return nil, apierrors.NewAlreadyExists(s.resource, m.GetName())
+	case !create && !exists:
+		return nil, s.notFound(m.GetName())
+	case !create && m.GetResourceVersion() != "" && m.GetResourceVersion() != accessor(stored).GetResourceVersion():
+		return nil, apierrors.NewConflict(s.resource, m.GetName(), fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+
+	obj = obj.DeepCopyObject()
+	m = accessor(obj)
+	s.rv++
+	m.SetResourceVersion(strconv.Itoa(s.rv))
+	if create {
+		m.SetUID(types.UID(fmt.Sprintf("%s-%d", s.resource.Resource, s.rv)))
+		m.SetCreationTimestamp(metav1.Now())
+		// event recorders refer to objects by their self link.
+		m.SetSelfLink(s.selfLink(m.GetNamespace(), m.GetName()))
+	}
+	s.objects[k] = obj
+
+	event := watch.Modified
+	if create {
+		event = watch.Added
+	}
+	s.watch.Action(event, obj.DeepCopyObject())
+
+	return obj.DeepCopyObject(), nil
+}
+
+func (s *store) delete(namespace, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := key(namespace, name)
+	obj, ok := s.objects[k]
+	if !ok {
+		return s.notFound(name)
+	}
+	delete(s.objects, k)
+	s.watch.Action(watch.Deleted, obj.DeepCopyObject())
+
+	return nil
+}
+
+// patch applies a strategic merge patch or a JSON merge patch to the object
+// namespace/name. Since objects are stored whole, subresources are patched
+// the same way.
+func (s *store) patch(namespace, name string, pt types.PatchType, data []byte, into runtime.Object) (runtime.Object, error) {
+	if pt != types.StrategicMergePatchType && pt != types.MergePatchType {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("unsupported patch type %q", pt))
+	}
+
+	obj, err := s.get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	original, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var patched []byte
+	if pt == types.MergePatchType {
+		patched, err = jsonpatch.MergePatch(original, data)
+	} else {
+		patched, err = strategicpatch.StrategicMergePatch(original, data, into)
+	}
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	if err := json.Unmarshal(patched, into); err != nil {
+		return nil, err
+	}
+
+	return s.put(into, false)
+}
+
+func (s *store) watchNamespace(namespace string) watch.Interface {
+	w := s.watch.Watch()
+	if namespace == "" {
+		return w
+	}
+	return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+		return e, accessor(e.Object).GetNamespace() == namespace
+	})
+}
+
+func accessor(obj runtime.Object) metav1.Object {
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+type fakeNodes struct {
+	corev1.NodeInterface
+	store *store
+}
+
+func (f *fakeNodes) Create(node *v1.Node) (*v1.Node, error) {
+	obj, err := f.store.put(node, true)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Node), nil
+}
+
+func (f *fakeNodes) Update(node *v1.Node) (*v1.Node, error) {
+	obj, err := f.store.put(node, false)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Node), nil
+}
+
+func (f *fakeNodes) UpdateStatus(node *v1.Node) (*v1.Node, error) {
+	return f.Update(node)
+}
+
+func (f *fakeNodes) Delete(name string, options *metav1.DeleteOptions) error {
+	return f.store.delete("", name)
+}
+
+func (f *fakeNodes) Get(name string, options metav1.GetOptions) (*v1.Node, error) {
+	obj, err := f.store.get("", name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Node), nil
+}
+
+func (f *fakeNodes) List(opts metav1.ListOptions) (*v1.NodeList, error) {
+	objs, rv := f.store.list("")
+	list := &v1.NodeList{ListMeta: metav1.ListMeta{ResourceVersion: rv}}
+	for _, obj := range objs {
+		list.Items = append(list.Items, *obj.(*v1.Node))
+	}
+	return list, nil
+}
+
+func (f *fakeNodes) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return f.store.watchNamespace(""), nil
+}
+
+func (f *fakeNodes) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*v1.Node, error) {
+	obj, err := f.store.patch("", name, pt, data, &v1.Node{})
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Node), nil
+}
+
+func (f *fakeNodes) PatchStatus(name string, data []byte) (*v1.Node, error) {
+	return f.Patch(name, types.StrategicMergePatchType, data, "status")
+}
+
+type fakeServices struct {
+	corev1.ServiceInterface
+	core      *fakeCoreV1
+	store     *store
+	namespace string
+}
+
+func (f *fakeServices) Create(service *v1.Service) (*v1.Service, error) {
+	service = service.DeepCopy()
+	service.Namespace = f.namespace
+	obj, err := f.store.put(service, true)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Service), nil
+}
+
+func (f *fakeServices) Update(service *v1.Service) (*v1.Service, error) {
+	obj, err := f.store.put(service, false)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Service), nil
+}
+
+func (f *fakeServices) UpdateStatus(service *v1.Service) (*v1.Service, error) {
+	updated, err := f.Update(service)
+	if apierrors.IsConflict(err) {
+		f.core.mu.Lock()
+		f.core.statusConflicts++
+		f.core.mu.Unlock()
+	}
+	return updated, err
+}
+
+func (f *fakeServices) Delete(name string, options *metav1.DeleteOptions) error {
+	return f.store.delete(f.namespace, name)
+}
+
+func (f *fakeServices) Get(name string, options metav1.GetOptions) (*v1.Service, error) {
+	obj, err := f.store.get(f.namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Service), nil
+}
+
+func (f *fakeServices) List(opts metav1.ListOptions) (*v1.ServiceList, error) {
+	objs, rv := f.store.list(f.namespace)
+	list := &v1.ServiceList{ListMeta: metav1.ListMeta{ResourceVersion: rv}}
+	for _, obj := range objs {
+		list.Items = append(list.Items, *obj.(*v1.Service))
+	}
+	return list, nil
+}
+
+func (f *fakeServices) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return f.store.watchNamespace(f.namespace), nil
+}
+
+func (f *fakeServices) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*v1.Service, error) {
+	obj, err := f.store.patch(f.namespace, name, pt, data, &v1.Service{})
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Service), nil
+}
+
+// fakeEvents records the events sent by event broadcasters.
+type fakeEvents struct {
+	corev1.EventInterface
+	core *fakeCoreV1
+}
+
+func (f *fakeEvents) CreateWithEventNamespace(event *v1.Event) (*v1.Event, error) {
+	f.core.mu.Lock()
+	defer f.core.mu.Unlock()
+
+	f.core.events = append(f.core.events, *event.DeepCopy())
+	return event, nil
+}
+
+// UpdateWithEventNamespace replaces the recorded event, which the broadcaster
+// does to bump the count of repeated events.
+func (f *fakeEvents) UpdateWithEventNamespace(event *v1.Event) (*v1.Event, error) {
+	f.core.mu.Lock()
+	defer f.core.mu.Unlock()
+
+	for i, e := range f.core.events {
+		if e.Namespace == event.Namespace && e.Name == event.Name {
+			f.core.events[i] = *event.DeepCopy()
+			return event, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(v1.Resource("events"), event.Name)
+}
+
+func (f *fakeEvents) PatchWithEventNamespace(event *v1.Event, data []byte) (*v1.Event, error) {
+	return f.UpdateWithEventNamespace(event)
+}
@@ -0,0 +1,810 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakedo
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+// The handlers below are called with s.mu held and the path segments
+// following the collection name.
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet || len(parts) != 0 {
+		notFound(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"account": s.account})
+}
+
+func (s *Server) handleRegions(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet || len(parts) != 0 {
+		notFound(w)
+		return
+	}
+
+	start, end, links := paginate(r, len(s.regions))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"regions": s.regions[start:end], "links": links})
+}
+
+func (s *Server) handleSizes(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet || len(parts) != 0 {
+		notFound(w)
+		return
+	}
+
+	start, end, links := paginate(r, len(s.sizes))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sizes": s.sizes[start:end], "links": links})
+}
+
+// sortedDroplets returns the droplets tagged with tag, or all droplets if
+// tag is empty, sorted by ID.
+func (s *Server) sortedDroplets(tag string) []godo.Droplet {
+	list := []godo.Droplet{}
+	for _, d := range s.droplets {
+		if tag == "" || hasString(d.Tags, tag) {
+			list = append(list, *d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (s *Server) handleDroplets(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w)
+			return
+		}
+		list := s.sortedDroplets(r.URL.Query().Get("tag_name"))
+		start, end, links := paginate(r, len(list))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"droplets": list[start:end], "links": links})
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	droplet, ok := s.droplets[id]
+	if err != nil || !ok {
+		notFound(w)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"droplet": droplet})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteDroplet(id)
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "actions" && r.Method == http.MethodPost:
+		var req map[string]interface{}
+		if !decode(w, r, &req) {
+			return
+		}
+		actionType, _ := req["type"].(string)
+		switch actionType {
+		case "power_on", "power_cycle", "reboot":
+			droplet.Status = "active"
+		case "power_off", "shutdown":
+			droplet.Status = "off"
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.action(actionType, id, "droplet")})
+	case len(parts) == 3 && parts[1] == "actions" && r.Method == http.MethodGet:
+		s.getAction(w, parts[2])
+	default:
+		notFound(w)
+	}
+}
+
+// action records a completed action. s.mu must be held.
+func (s *Server) action(actionType string, resourceID int, resourceType string) *godo.Action {
+	now := &godo.Timestamp{Time: time.Now()}
+	action := &godo.Action{
+		ID:           s.id(),
+		Status:       godo.ActionCompleted,
+		Type:         actionType,
+		StartedAt:    now,
+		CompletedAt:  now,
+		ResourceID:   resourceID,
+		ResourceType: resourceType,
+	}
+	s.actions[action.ID] = action
+	return action
+}
+
+func (s *Server) getAction(w http.ResponseWriter, id string) {
+	actionID, _ := strconv.Atoi(id)
+	action, ok := s.actions[actionID]
+	if !ok {
+		notFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"action": action})
+}
+
+// deleteDroplet removes the droplet id along with its references from load
+// balancers, firewalls and floating IPs. s.mu must be held.
+func (s *Server) deleteDroplet(id int) {
+	delete(s.droplets, id)
+
+	for _, lb := range s.lbs {
+		lb.DropletIDs = removeInts(lb.DropletIDs, id)
+	}
+	for _, fw := range s.fws {
+		fw.DropletIDs = removeInts(fw.DropletIDs, id)
+	}
+	for _, fip := range s.fips {
+		if fip.Droplet != nil && fip.Droplet.ID == id {
+			fip.Droplet = nil
+		}
+	}
+}
+
+// readLoadBalancer transitions lb out of status new once it was read often
+// enough. s.mu must be held.
+func (s *Server) readLoadBalancer(lb *godo.LoadBalancer) {
+	if lb.Status != StatusNew {
+		return
+	}
+
+	s.lbReads[lb.ID]++
+	if s.lbReads[lb.ID] < s.lbReadsUntilReady {
+		return
+	}
+
+	delete(s.lbReads, lb.ID)
+	lb.Status = s.lbOutcome
+	if lb.Status == StatusActive {
+		lb.IP = s.ip()
+	}
+}
+
+// applyLoadBalancerRequest sets the fields of lb from req. s.mu must be held.
+func (s *Server) applyLoadBalancerRequest(lb *godo.LoadBalancer, req *godo.LoadBalancerRequest) {
+	lb.Name = req.Name
+	lb.Algorithm = req.Algorithm
+	if lb.Algorithm == "" {
+		lb.Algorithm = "round_robin"
+	}
+	lb.Region = &godo.Region{Slug: req.Region}
+	lb.ForwardingRules = req.ForwardingRules
+	lb.HealthCheck = req.HealthCheck
+	lb.StickySessions = req.StickySessions
+	lb.DropletIDs = req.DropletIDs
+	lb.Tag = req.Tag
+	lb.RedirectHttpToHttps = req.RedirectHttpToHttps
+}
+
+func (s *Server) handleLoadBalancers(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []godo.LoadBalancer{}
+			for _, lb := range s.lbs {
+				s.readLoadBalancer(lb)
+				list = append(list, *lb)
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+			start, end, links := paginate(r, len(list))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancers": list[start:end], "links": links})
+		case http.MethodPost:
+			var req godo.LoadBalancerRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			if req.Name == "" || len(req.ForwardingRules) == 0 {
+				writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "name and forwarding_rules are required")
+				return
+			}
+			lb := &godo.LoadBalancer{
+				ID:      s.uuid(),
+				Status:  StatusNew,
+				Created: time.Now().UTC().Format(time.RFC3339Nano),
+			}
+			s.applyLoadBalancerRequest(lb, &req)
+			s.lbs[lb.ID] = lb
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"load_balancer": lb})
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	lb, ok := s.lbs[parts[0]]
+	if !ok {
+		notFound(w)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.readLoadBalancer(lb)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer": lb})
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var req godo.LoadBalancerRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		s.applyLoadBalancerRequest(lb, &req)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"load_balancer": lb})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(s.lbs, lb.ID)
+		delete(s.lbReads, lb.ID)
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "droplets":
+		var req struct {
+			IDs []int `json:"droplet_ids"`
+		}
+		if !decode(w, r, &req) {
+			return
+		}
+		for _, id := range req.IDs {
+			lb.DropletIDs = removeInts(lb.DropletIDs, id)
+			if r.Method == http.MethodPost {
+				lb.DropletIDs = append(lb.DropletIDs, id)
+			}
+		}
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "forwarding_rules":
+		var req struct {
+			Rules []godo.ForwardingRule `json:"forwarding_rules"`
+		}
+		if !decode(w, r, &req) {
+			return
+		}
+		for _, rule := range req.Rules {
+			var kept []godo.ForwardingRule
+			for _, existing := range lb.ForwardingRules {
+				if existing != rule {
+					kept = append(kept, existing)
+				}
+			}
+			lb.ForwardingRules = kept
+			if r.Method == http.MethodPost {
+				lb.ForwardingRules = append(lb.ForwardingRules, rule)
+			}
+		}
+		noContent(w)
+	default:
+		notFound(w)
+	}
+}
+
+// tag returns the API representation of the tag name. s.mu must be held.
+func (s *Server) tag(name string) godo.Tag {
+	tagged := s.sortedDroplets(name)
+	resources := &godo.TaggedDropletsResources{Count: len(tagged)}
+	if len(tagged) > 0 {
+		resources.LastTagged = &tagged[len(tagged)-1]
+	}
+	return godo.Tag{Name: name, Resources: &godo.TaggedResources{Droplets: resources}}
+}
+
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			var names []string
+			for name := range s.tags {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			list := []godo.Tag{}
+			for _, name := range names {
+				list = append(list, s.tag(name))
+			}
+			start, end, links := paginate(r, len(list))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"tags": list[start:end], "links": links})
+		case http.MethodPost:
+			var req godo.TagCreateRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			if req.Name == "" {
+				writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "name is required")
+				return
+			}
+			s.tags[req.Name] = true
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"tag": s.tag(req.Name)})
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	name := parts[0]
+	if !s.tags[name] {
+		notFound(w)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tag": s.tag(name)})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(s.tags, name)
+		for _, d := range s.droplets {
+			d.Tags = removeStrings(d.Tags, name)
+		}
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "resources":
+		var req godo.TagResourcesRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		for _, res := range req.Resources {
+			id, _ := strconv.Atoi(res.ID)
+			d, ok := s.droplets[id]
+			if res.Type != godo.DropletResourceType || !ok {
+				continue
+			}
+			d.Tags = removeStrings(d.Tags, name)
+			if r.Method == http.MethodPost {
+				d.Tags = append(d.Tags, name)
+			}
+		}
+		noContent(w)
+	default:
+		notFound(w)
+	}
+}
+
+func (s *Server) handleFirewalls(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []godo.Firewall{}
+			for _, fw := range s.fws {
+				list = append(list, *fw)
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+			start, end, links := paginate(r, len(list))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"firewalls": list[start:end], "links": links})
+		case http.MethodPost:
+			var req godo.FirewallRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			fw := &godo.Firewall{
+				ID:            s.uuid(),
+				Name:          req.Name,
+				Status:        "succeeded",
+				InboundRules:  req.InboundRules,
+				OutboundRules: req.OutboundRules,
+				DropletIDs:    req.DropletIDs,
+				Tags:          req.Tags,
+				Created:       time.Now().UTC().Format(time.RFC3339),
+			}
+			s.fws[fw.ID] = fw
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"firewall": fw})
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	fw, ok := s.fws[parts[0]]
+	if !ok {
+		notFound(w)
+		return
+	}
+
+	add := r.Method == http.MethodPost
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"firewall": fw})
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var req godo.FirewallRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		fw.Name = req.Name
+		fw.InboundRules = req.InboundRules
+		fw.OutboundRules = req.OutboundRules
+		fw.DropletIDs = req.DropletIDs
+		fw.Tags = req.Tags
+		writeJSON(w, http.StatusOK, map[string]interface{}{"firewall": fw})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(s.fws, fw.ID)
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "droplets":
+		var req struct {
+			IDs []int `json:"droplet_ids"`
+		}
+		if !decode(w, r, &req) {
+			return
+		}
+		for _, id := range req.IDs {
+			fw.DropletIDs = removeInts(fw.DropletIDs, id)
+			if add {
+				fw.DropletIDs = append(fw.DropletIDs, id)
+			}
+		}
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "tags":
+		var req struct {
+			Tags []string `json:"tags"`
+		}
+		if !decode(w, r, &req) {
+			return
+		}
+		for _, tag := range req.Tags {
+			fw.Tags = removeStrings(fw.Tags, tag)
+			if add {
+				fw.Tags = append(fw.Tags, tag)
+			}
+		}
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "rules":
+		var req godo.FirewallRulesRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		if add {
+			fw.InboundRules = append(fw.InboundRules, req.InboundRules...)
+			fw.OutboundRules = append(fw.OutboundRules, req.OutboundRules...)
+		} else {
+			fw.InboundRules = removeInboundRules(fw.InboundRules, req.InboundRules)
+			fw.OutboundRules = removeOutboundRules(fw.OutboundRules, req.OutboundRules)
+		}
+		noContent(w)
+	default:
+		notFound(w)
+	}
+}
+
+func (s *Server) handleFloatingIPs(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []godo.FloatingIP{}
+			for _, fip := range s.fips {
+				list = append(list, *fip)
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+			start, end, links := paginate(r, len(list))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"floating_ips": list[start:end], "links": links})
+		case http.MethodPost:
+			var req godo.FloatingIPCreateRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			fip := &godo.FloatingIP{IP: s.ip(), Region: &godo.Region{Slug: req.Region}}
+			if req.DropletID != 0 {
+				d, ok := s.droplets[req.DropletID]
+				if !ok {
+					writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "droplet not found")
+					return
+				}
+				fip.Droplet = d
+				fip.Region = d.Region
+			}
+			s.fips[fip.IP] = fip
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"floating_ip": fip})
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	fip, ok := s.fips[parts[0]]
+	if !ok {
+		notFound(w)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"floating_ip": fip})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(s.fips, fip.IP)
+		noContent(w)
+	case len(parts) == 2 && parts[1] == "actions" && r.Method == http.MethodPost:
+		var req struct {
+			Type      string `json:"type"`
+			DropletID int    `json:"droplet_id"`
+		}
+		if !decode(w, r, &req) {
+			return
+		}
+		switch req.Type {
+		case "assign":
+			d, ok := s.droplets[req.DropletID]
+			if !ok {
+				writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "droplet not found")
+				return
+			}
+			fip.Droplet = d
+		case "unassign":
+			fip.Droplet = nil
+		default:
+			writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "unknown action type")
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"action": s.action(req.Type, 0, "floating_ip")})
+	case len(parts) == 3 && parts[1] == "actions" && r.Method == http.MethodGet:
+		s.getAction(w, parts[2])
+	default:
+		notFound(w)
+	}
+}
+
+func (s *Server) handleDomains(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []godo.Domain{}
+			for _, d := range s.domains {
+				list = append(list, *d)
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+			start, end, links := paginate(r, len(list))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"domains": list[start:end], "links": links})
+		case http.MethodPost:
+			var req godo.DomainCreateRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			if _, exists := s.domains[req.Name]; exists || req.Name == "" {
+				writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "name is invalid or already taken")
+				return
+			}
+			d := &godo.Domain{Name: req.Name, TTL: 1800}
+			s.domains[d.Name] = d
+			if req.IPAddress != "" {
+				s.records[d.Name] = []godo.DomainRecord{{ID: s.id(), Type: "A", Name: "@", Data: req.IPAddress, TTL: 1800}}
+			}
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"domain": d})
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	d, ok := s.domains[parts[0]]
+	if !ok {
+		notFound(w)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"domain": d})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		delete(s.domains, d.Name)
+		delete(s.records, d.Name)
+		noContent(w)
+	case len(parts) >= 2 && parts[1] == "records":
+		s.handleDomainRecords(w, r, d.Name, parts[2:])
+	default:
+		notFound(w)
+	}
+}
+
+func (s *Server) handleDomainRecords(w http.ResponseWriter, r *http.Request, domain string, parts []string) {
+	records := s.records[domain]
+
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := append([]godo.DomainRecord{}, records...)
+			start, end, links := paginate(r, len(list))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"domain_records": list[start:end], "links": links})
+		case http.MethodPost:
+			var req godo.DomainRecordEditRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			record := domainRecord(s.id(), &req)
+			s.records[domain] = append(records, record)
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"domain_record": record})
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	id, _ := strconv.Atoi(parts[0])
+	for i := range records {
+		if records[i].ID != id {
+			continue
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"domain_record": records[i]})
+		case http.MethodPut:
+			var req godo.DomainRecordEditRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			records[i] = domainRecord(id, &req)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"domain_record": records[i]})
+		case http.MethodDelete:
+			s.records[domain] = append(records[:i], records[i+1:]...)
+			noContent(w)
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	notFound(w)
+}
+
+func (s *Server) handleCertificates(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []godo.Certificate{}
+			for _, c := range s.certs {
+				list = append(list, *c)
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+			start, end, links := paginate(r, len(list))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"certificates": list[start:end], "links": links})
+		case http.MethodPost:
+			var req godo.CertificateRequest
+			if !decode(w, r, &req) {
+				return
+			}
+			if req.Name == "" {
+				writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", "name is required")
+				return
+			}
+			c := &godo.Certificate{
+				ID:       s.uuid(),
+				Name:     req.Name,
+				DNSNames: req.DNSNames,
+				NotAfter: time.Now().Add(90 * 24 * time.Hour).UTC().Format(time.RFC3339),
+				Created:  time.Now().UTC().Format(time.RFC3339),
+				State:    "verified",
+				Type:     req.Type,
+			}
+			if c.Type == "" {
+				c.Type = "custom"
+			}
+			s.certs[c.ID] = c
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"certificate": c})
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	c, ok := s.certs[parts[0]]
+	if !ok || len(parts) != 1 {
+		notFound(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"certificate": c})
+	case http.MethodDelete:
+		delete(s.certs, c.ID)
+		noContent(w)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func (s *Server) handleVolumes(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	if len(parts) == 0 {
+		list := []godo.Volume{}
+		for _, v := range s.volumes {
+			list = append(list, *v)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		start, end, links := paginate(r, len(list))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"volumes": list[start:end], "links": links})
+		return
+	}
+
+	v, ok := s.volumes[parts[0]]
+	if !ok || len(parts) != 1 {
+		notFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"volume": v})
+}
+
+func domainRecord(id int, req *godo.DomainRecordEditRequest) godo.DomainRecord {
+	return godo.DomainRecord{
+		ID:       id,
+		Type:     req.Type,
+		Name:     req.Name,
+		Data:     req.Data,
+		Priority: req.Priority,
+		Port:     req.Port,
+		TTL:      req.TTL,
+		Weight:   req.Weight,
+		Flags:    req.Flags,
+		Tag:      req.Tag,
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeStrings(list []string, s string) []string {
+	var kept []string
+	for _, e := range list {
+		if e != s {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+func removeInts(list []int, i int) []int {
+	var kept []int
+	for _, e := range list {
+		if e != i {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+func removeInboundRules(rules, remove []godo.InboundRule) []godo.InboundRule {
+	var kept []godo.InboundRule
+	for _, rule := range rules {
+		removed := false
+		for _, r := range remove {
+			if rule.Protocol == r.Protocol && rule.PortRange == r.PortRange {
+				removed = true
+			}
+		}
+		if !removed {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
+
+func removeOutboundRules(rules, remove []godo.OutboundRule) []godo.OutboundRule {
+	var kept []godo.OutboundRule
+	for _, rule := range rules {
+		removed := false
+		for _, r := range remove {
+			if rule.Protocol == r.Protocol && rule.PortRange == r.PortRange {
+				removed = true
+			}
+		}
+		if !removed {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakedo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+// The methods below seed and inspect the state of the fake. Returned
+// resources are copies.
+
+// SetAccount sets the account returned by the API.
+func (s *Server) SetAccount(account godo.Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.account = account
+}
+
+// SetRegions sets the regions returned by the API.
+func (s *Server) SetRegions(regions []godo.Region) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.regions = regions
+}
+
+// SetSizes sets the droplet sizes returned by the API.
+func (s *Server) SetSizes(sizes []godo.Size) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sizes = sizes
+}
+
+// AddDroplet adds droplet, assigning it an ID if it has none, and returns
+// it. Its tags are created as needed.
+func (s *Server) AddDroplet(droplet godo.Droplet) godo.Droplet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if droplet.ID == 0 {
+		droplet.ID = s.id()
+	}
+	if droplet.Status == "" {
+		droplet.Status = "active"
+	}
+	for _, tag := range droplet.Tags {
+		s.tags[tag] = true
+	}
+
+	s.droplets[droplet.ID] = &droplet
+	return droplet
+}
+
+// SetDropletStatus sets the status of the droplet id, e.g. to off.
+func (s *Server) SetDropletStatus(id int, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.droplets[id]; ok {
+		d.Status = status
+	}
+}
+
+// DeleteDroplet deletes the droplet id as if it was destroyed by the user.
+func (s *Server) DeleteDroplet(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteDroplet(id)
+}
+
+// Droplet returns the droplet id.
+func (s *Server) Droplet(id int) (godo.Droplet, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.droplets[id]
+	if !ok {
+		return godo.Droplet{}, false
+	}
+	return *d, true
+}
+
+// LoadBalancers returns all load balancers by creation order.
+func (s *Server) LoadBalancers() []godo.LoadBalancer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []godo.LoadBalancer{}
+	for _, lb := range s.lbs {
+		list = append(list, *lb)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// AddLoadBalancer adds lb, assigning it an ID and creation time if it has
+// none, and returns it. It is active, with an IP, unless it has a status.
+func (s *Server) AddLoadBalancer(lb godo.LoadBalancer) godo.LoadBalancer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lb.ID == "" {
+		lb.ID = s.uuid()
+	}
+	if lb.Status == "" {
+		lb.Status = StatusActive
+	}
+	if lb.IP == "" && lb.Status == StatusActive {
+		lb.IP = s.ip()
+	}
+	if lb.Created == "" {
+		lb.Created = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	s.lbs[lb.ID] = &lb
+	return lb
+}
+
+// SetLoadBalancerStatus sets the status of the load balancer id, e.g. to
+// simulate it erroring.
+func (s *Server) SetLoadBalancerStatus(id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lb, ok := s.lbs[id]; ok {
+		lb.Status = status
+	}
+}
+
+// AddFloatingIP adds fip and returns it.
+func (s *Server) AddFloatingIP(fip godo.FloatingIP) godo.FloatingIP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fip.IP == "" {
+		fip.IP = s.ip()
+	}
+	if fip.Droplet != nil {
+		if d, ok := s.droplets[fip.Droplet.ID]; ok {
+			fip.Droplet = d
+		}
+	}
+
+	s.fips[fip.IP] = &fip
+	return fip
+}
+
+// FloatingIP returns the floating IP ip.
+func (s *Server) FloatingIP(ip string) (godo.FloatingIP, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fip, ok := s.fips[ip]
+	if !ok {
+		return godo.FloatingIP{}, false
+	}
+	return *fip, true
+}
+
+// Firewalls returns all firewalls.
+func (s *Server) Firewalls() []godo.Firewall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []godo.Firewall{}
+	for _, fw := range s.fws {
+		list = append(list, *fw)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Tags returns the names of all tags.
+func (s *Server) Tags() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddCertificate adds cert, assigning it an ID if it has none, and returns
+// it.
+func (s *Server) AddCertificate(cert godo.Certificate) godo.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cert.ID == "" {
+		cert.ID = s.uuid()
+	}
+	s.certs[cert.ID] = &cert
+	return cert
+}
+
+// DeleteCertificate deletes the certificate id.
+func (s *Server) DeleteCertificate(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.certs, id)
+}
+
+// Domains returns the names of all domains.
+func (s *Server) Domains() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DomainRecords returns the records of domain.
+func (s *Server) DomainRecords(domain string) []godo.DomainRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]godo.DomainRecord(nil), s.records[domain]...)
+}
+
+// AddVolume adds volume and returns it.
+func (s *Server) AddVolume(volume godo.Volume) godo.Volume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if volume.ID == "" {
+		volume.ID = s.uuid()
+	}
+	s.volumes[volume.ID] = &volume
+	return volume
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakedo implements an in-process, stateful fake of the DigitalOcean
+// API. It models droplets, load balancers, tags, firewalls, floating IPs,
+// domains, certificates and volumes closely enough for the cloud controller
+// manager to run against it, e.g. by pointing DO_OVERRIDE_URL at an
+// httptest.Server serving it. Faults can be scripted per endpoint.
+package fakedo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	defaultPerPage   = 20
+	maxPerPage       = 200
+	defaultRateLimit = 5000
+)
+
+// Statuses of load balancers.
+const (
+	StatusNew     = "new"
+	StatusActive  = "active"
+	StatusErrored = "errored"
+)
+
+// Fault makes matching requests fail or slow down.
+type Fault struct {
+	// Method matches the request method, or any method if empty.
+	Method string
+	// PathPrefix matches the request path, e.g. /v2/load_balancers.
+	PathPrefix string
+	// Status is the status code returned instead of serving the request.
+	// The request is served if zero.
+	Status int
+	// Delay is applied before the request is handled.
+	Delay time.Duration
+	// Times is the number of requests the fault applies to, or unlimited
+	// if zero.
+	Times int
+}
+
+func (f *Fault) matches(r *http.Request) bool {
+	return (f.Method == "" || f.Method == r.Method) && strings.HasPrefix(r.URL.Path, f.PathPrefix)
+}
+
+// Server is a fake of the DigitalOcean API. The zero value is not usable,
+// use NewServer.
+type Server struct {
+	mu sync.Mutex
+
+	account  godo.Account
+	regions  []godo.Region
+	sizes    []godo.Size
+	droplets map[int]*godo.Droplet
+	lbs      map[string]*godo.LoadBalancer
+	tags     map[string]bool
+	fws      map[string]*godo.Firewall
+	fips     map[string]*godo.FloatingIP
+	domains  map[string]*godo.Domain
+	records  map[string][]godo.DomainRecord
+	certs    map[string]*godo.Certificate
+	volumes  map[string]*godo.Volume
+	actions  map[int]*godo.Action
+
+	// lbReads counts the reads of load balancers in status new.
+	lbReads map[string]int
+	// lbReadsUntilReady is the number of reads after which a new load
+	// balancer transitions to lbOutcome.
+	lbReadsUntilReady int
+	lbOutcome         string
+
+	faults []*Fault
+
+	rateLimit     int
+	rateRemaining int
+	rateReset     time.Time
+
+	requests []string
+	nextID   int
+}
+
+// NewServer returns a Server with an active account, a few available regions
+// and no resources.
+func NewServer() *Server {
+	return &Server{
+		account: godo.Account{
+			Email:         "fake@example.com",
+			UUID:          "fake-account",
+			EmailVerified: true,
+			Status:        "active",
+		},
+		regions: []godo.Region{
+			{Slug: "nyc1", Name: "New York 1", Available: true},
+			{Slug: "nyc3", Name: "New York 3", Available: true},
+			{Slug: "ams3", Name: "Amsterdam 3", Available: true},
+			{Slug: "sfo2", Name: "San Francisco 2", Available: true},
+		},
+		droplets:          map[int]*godo.Droplet{},
+		lbs:               map[string]*godo.LoadBalancer{},
+		tags:              map[string]bool{},
+		fws:               map[string]*godo.Firewall{},
+		fips:              map[string]*godo.FloatingIP{},
+		domains:           map[string]*godo.Domain{},
+		records:           map[string][]godo.DomainRecord{},
+		certs:             map[string]*godo.Certificate{},
+		volumes:           map[string]*godo.Volume{},
+		actions:           map[int]*godo.Action{},
+		lbReads:           map[string]int{},
+		lbReadsUntilReady: 1,
+		lbOutcome:         StatusActive,
+		rateLimit:         defaultRateLimit,
+		rateRemaining:     defaultRateLimit,
+		rateReset:         time.Now().Add(time.Hour),
+		nextID:            1000,
+	}
+}
+
+// id returns a new numeric ID. s.mu must be held.
+func (s *Server) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+// uuid returns a new UUID-like ID. s.mu must be held.
+func (s *Server) uuid() string {
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", s.id())
+}
+
+// ip returns a new IP from the shared address space 100.64.0.0/10, which
+// is not publicly routed. s.mu must be held.
+func (s *Server) ip() string {
+	n := s.id()
+	return fmt.Sprintf("100.%d.%d.%d", 64+n/65536%64, n/256%256, n%256)
+}
+
+// AddFault scripts f.
+func (s *Server) AddFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all scripted faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// SetRateLimit sets the number of requests allowed until ResetRateLimit is
+// called. Requests over the limit fail with status 429.
+func (s *Server) SetRateLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimit = limit
+	s.rateRemaining = limit
+}
+
+// ResetRateLimit replenishes the rate limit.
+func (s *Server) ResetRateLimit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateRemaining = s.rateLimit
+	s.rateReset = time.Now().Add(time.Hour)
+}
+
+// SetLoadBalancerTransition makes new load balancers transition to status
+// after being read reads times.
+func (s *Server) SetLoadBalancerTransition(reads int, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lbReadsUntilReady = reads
+	s.lbOutcome = status
+}
+
+// Requests returns the requests served so far as "METHOD /path".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	fault := s.fault(r)
+	s.mu.Unlock()
+
+	if fault != nil {
+		time.Sleep(fault.Delay)
+		if fault.Status != 0 {
+			writeError(w, fault.Status, "fault", "injected fault")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.rate(w) {
+		writeError(w, http.StatusTooManyRequests, "too_many_requests", "API Rate limit exceeded.")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2"), "/"), "/")
+
+	var handler func(http.ResponseWriter, *http.Request, []string)
+	switch parts[0] {
+	case "account":
+		handler = s.handleAccount
+	case "regions":
+		handler = s.handleRegions
+	case "sizes":
+		handler = s.handleSizes
+	case "droplets":
+		handler = s.handleDroplets
+	case "load_balancers":
+		handler = s.handleLoadBalancers
+	case "tags":
+		handler = s.handleTags
+	case "firewalls":
+		handler = s.handleFirewalls
+	case "floating_ips":
+		handler = s.handleFloatingIPs
+	case "domains":
+		handler = s.handleDomains
+	case "certificates":
+		handler = s.handleCertificates
+	case "volumes":
+		handler = s.handleVolumes
+	default:
+		notFound(w)
+		return
+	}
+
+	handler(w, r, parts[1:])
+}
+
+// fault returns the fault applying to r, if any, and consumes it. s.mu must
+// be held.
+func (s *Server) fault(r *http.Request) *Fault {
+	for i, f := range s.faults {
+		if !f.matches(r) {
+			continue
+		}
+
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+
+		return f
+	}
+
+	return nil
+}
+
+// rate sets the rate limit headers and returns false if the rate limit is
+// exceeded. s.mu must be held.
+func (s *Server) rate(w http.ResponseWriter) bool {
+	allowed := s.rateRemaining > 0
+	if allowed {
+		s.rateRemaining--
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(s.rateLimit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(s.rateRemaining))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(s.rateReset.Unix(), 10))
+
+	return allowed
+}
+
+// paginate returns the bounds of the page of a list of n items requested by
+// r along with the links to the surrounding pages.
+func paginate(r *http.Request, n int) (start, end int, links *godo.Links) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	last := (n + perPage - 1) / perPage
+	if last < 1 {
+		last = 1
+	}
+
+	pageURL := func(p int) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("per_page", strconv.Itoa(perPage))
+		return fmt.Sprintf("http://%s%s?%s", r.Host, r.URL.Path, q.Encode())
+	}
+
+	pages := &godo.Pages{}
+	if page > 1 {
+		pages.First = pageURL(1)
+		pages.Prev = pageURL(page - 1)
+	}
+	if page < last {
+		pages.Next = pageURL(page + 1)
+		pages.Last = pageURL(last)
+	}
+
+	start = (page - 1) * perPage
+	if start > n {
+		start = n
+	}
+	end = start + perPage
+	if end > n {
+		end = n
+	}
+
+	return start, end, &godo.Links{Pages: pages}
+}
+
+// decode decodes the body of r into v, writing an error and returning false
+// if it fails.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "unprocessable_entity", err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// requestIDs numbers the failed requests, which carry a unique request ID
+// like those of the real API.
+var requestIDs uint64
+
+func writeError(w http.ResponseWriter, status int, id, message string) {
+	requestID := fmt.Sprintf("fake-%d", atomic.AddUint64(&requestIDs, 1))
+	writeJSON(w, status, map[string]string{"id": id, "message": message, "request_id": requestID})
+}
+
+func notFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed.")
+}
+
+func noContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
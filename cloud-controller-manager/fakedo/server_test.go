@@ -0,0 +1,229 @@
+/*
+Copyright 2017 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakedo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func newTestClient(t *testing.T) (*Server, *godo.Client, func()) {
+	fake := NewServer()
+	server := httptest.NewServer(fake)
+
+	client, err := godo.New(http.DefaultClient, godo.SetBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, client, server.Close
+}
+
+func TestPagination(t *testing.T) {
+	fake, client, closeFn := newTestClient(t)
+	defer closeFn()
+
+	for i := 0; i < 5; i++ {
+		fake.AddDroplet(godo.Droplet{Name: "droplet-" + strconv.Itoa(i)})
+	}
+
+	var names []string
+	opt := &godo.ListOptions{PerPage: 2}
+	for {
+		droplets, resp, err := client.Droplets.List(context.TODO(), opt)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, d := range droplets {
+			names = append(names, d.Name)
+		}
+
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		opt.Page = page + 1
+	}
+
+	if len(names) != 5 || names[0] != "droplet-0" || names[4] != "droplet-4" {
+		t.Errorf("expected all droplets across pages in order, got %v", names)
+	}
+}
+
+func TestLoadBalancerTransitions(t *testing.T) {
+	fake, client, closeFn := newTestClient(t)
+	defer closeFn()
+	ctx := context.TODO()
+
+	req := &godo.LoadBalancerRequest{
+		Name:            "lb",
+		Region:          "nyc1",
+		ForwardingRules: []godo.ForwardingRule{{EntryProtocol: "tcp", EntryPort: 80, TargetProtocol: "tcp", TargetPort: 30000}},
+	}
+
+	fake.SetLoadBalancerTransition(2, StatusActive)
+	lb, _, err := client.LoadBalancers.Create(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if lb.Status != StatusNew || lb.IP != "" {
+		t.Errorf("expected new load balancer without IP, got %+v", lb)
+	}
+
+	for _, want := range []string{StatusNew, StatusActive} {
+		lb, _, err = client.LoadBalancers.Get(ctx, lb.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if lb.Status != want {
+			t.Errorf("expected status %q, got %q", want, lb.Status)
+		}
+	}
+	if lb.IP == "" {
+		t.Error("expected active load balancer to have an IP")
+	}
+
+	fake.SetLoadBalancerTransition(1, StatusErrored)
+	errored, _, err := client.LoadBalancers.Create(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	errored, _, _ = client.LoadBalancers.Get(ctx, errored.ID)
+	if errored.Status != StatusErrored {
+		t.Errorf("expected errored load balancer, got %q", errored.Status)
+	}
+
+	if _, err := client.LoadBalancers.Delete(ctx, lb.ID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err := client.LoadBalancers.Get(ctx, lb.ID); err == nil {
+		t.Error("expected deleted load balancer to be gone")
+	}
+	if len(fake.LoadBalancers()) != 1 {
+		t.Errorf("expected one load balancer left, got %v", fake.LoadBalancers())
+	}
+}
+
+func TestTagsAndFloatingIPs(t *testing.T) {
+	fake, client, closeFn := newTestClient(t)
+	defer closeFn()
+	ctx := context.TODO()
+
+	droplet := fake.AddDroplet(godo.Droplet{Name: "node"})
+
+	if _, _, err := client.Tags.Create(ctx, &godo.TagCreateRequest{Name: "k8s"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resources := &godo.TagResourcesRequest{Resources: []godo.Resource{{ID: strconv.Itoa(droplet.ID), Type: godo.DropletResourceType}}}
+	if _, err := client.Tags.TagResources(ctx, "k8s", resources); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tagged, _, err := client.Droplets.ListByTag(ctx, "k8s", nil)
+	if err != nil || len(tagged) != 1 {
+		t.Errorf("expected tagged droplet, got %v and error %v", tagged, err)
+	}
+
+	fip, _, err := client.FloatingIPs.Create(ctx, &godo.FloatingIPCreateRequest{Region: "nyc1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err := client.FloatingIPActions.Assign(ctx, fip.IP, droplet.ID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fake.DeleteDroplet(droplet.ID)
+	got, _ := fake.FloatingIP(fip.IP)
+	if got.Droplet != nil {
+		t.Error("expected floating IP to be unassigned with its droplet")
+	}
+}
+
+func TestFaultsAndRateLimit(t *testing.T) {
+	fake, client, closeFn := newTestClient(t)
+	defer closeFn()
+	ctx := context.TODO()
+
+	fake.AddFault(Fault{Method: http.MethodGet, PathPrefix: "/v2/account", Status: http.StatusServiceUnavailable, Times: 1})
+	if _, _, err := client.Account.Get(ctx); err == nil {
+		t.Error("expected injected fault")
+	}
+	if _, _, err := client.Account.Get(ctx); err != nil {
+		t.Errorf("expected fault to apply once, got %s", err)
+	}
+
+	fake.SetRateLimit(1)
+	_, resp, err := client.Account.Get(ctx)
+	if err != nil || resp.Rate.Limit != 1 || resp.Rate.Remaining != 0 {
+		t.Errorf("expected rate limit headers, got %+v and error %v", resp.Rate, err)
+	}
+	_, resp, err = client.Account.Get(ctx)
+	if err == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected rate limit to be exceeded, got %v", err)
+	}
+
+	fake.ResetRateLimit()
+	if _, _, err := client.Account.Get(ctx); err != nil {
+		t.Errorf("expected rate limit to be replenished, got %s", err)
+	}
+
+	want := []string{"GET /v2/account", "GET /v2/account", "GET /v2/account", "GET /v2/account", "GET /v2/account"}
+	if got := fake.Requests(); len(got) != len(want) {
+		t.Errorf("expected %d requests recorded, got %v", len(want), got)
+	}
+}
+
+func TestDomainsAndCertificates(t *testing.T) {
+	fake, client, closeFn := newTestClient(t)
+	defer closeFn()
+	ctx := context.TODO()
+
+	if _, _, err := client.Domains.Create(ctx, &godo.DomainCreateRequest{Name: "example.com", IPAddress: "192.0.2.1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	record, _, err := client.Domains.CreateRecord(ctx, "example.com", &godo.DomainRecordEditRequest{Type: "A", Name: "www", Data: "192.0.2.2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := client.Domains.DeleteRecord(ctx, "example.com", record.ID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if records := fake.DomainRecords("example.com"); len(records) != 1 || records[0].Name != "@" {
+		t.Errorf("expected only the apex record to be left, got %v", records)
+	}
+
+	cert, _, err := client.Certificates.Create(ctx, &godo.CertificateRequest{Name: "cert", LeafCertificate: "leaf", PrivateKey: "key"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cert.State != "verified" {
+		t.Errorf("expected verified certificate, got %q", cert.State)
+	}
+	if _, err := client.Certificates.Delete(ctx, cert.ID); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err := client.Certificates.Get(ctx, cert.ID); err == nil {
+		t.Error("expected deleted certificate to be gone")
+	}
+}